@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	accessFileDefault = ".hfsaccess"
+	accessRuleUser    = "user"
+	accessRuleDeny    = "deny"
+	accessDenyWrites  = "writes"
+)
+
+// accessFiles are the -access-files policies, the files called name in the
+// served directories. Each applies to its directory and everything below it
+// down to the next one, which replaces it. Parsed files are remembered,
+// keyed by path and valid while their modification time and size are
+// unchanged.
+type accessFiles struct {
+	name    string
+	mu      sync.Mutex
+	entries map[string]accessEntry
+}
+
+type accessEntry struct {
+	modTime time.Time
+	size    int64
+	policy  *accessPolicy
+	err     error
+}
+
+// accessPolicy is an access file: lines of
+//
+//	user USER:PASSWORD
+//	deny
+//	deny writes
+//
+// where user lines require basic auth with one of their credentials, deny
+// refuses every request and deny writes those that change something. Blank
+// lines and those starting with # are skipped.
+type accessPolicy struct {
+	users      credentials
+	deny       bool
+	denyWrites bool
+}
+
+func newAccessFiles(name string) *accessFiles {
+	return &accessFiles{name: name, entries: make(map[string]accessEntry)}
+}
+
+func parseAccessPolicy(text string) (*accessPolicy, error) {
+	p := &accessPolicy{}
+	for i, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch {
+		case fields[0] == accessRuleUser && len(fields) == 2:
+			if err := p.users.Set(fields[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+		case fields[0] == accessRuleDeny && len(fields) == 1:
+			p.deny = true
+		case fields[0] == accessRuleDeny && len(fields) == 2 && fields[1] == accessDenyWrites:
+			p.denyWrites = true
+		default:
+			return nil, fmt.Errorf("line %d: expected %q, %q or %q", i+1, accessRuleUser+" USER:PASSWORD", accessRuleDeny, accessRuleDeny+" "+accessDenyWrites)
+		}
+	}
+	return p, nil
+}
+
+// refusal returns the status to answer r with if p keeps it out, or 0.
+func (p *accessPolicy) refusal(r *http.Request) int {
+	switch {
+	case p == nil:
+		return 0
+	case p.deny, p.denyWrites && !csrfSafeMethods[r.Method]:
+		return http.StatusForbidden
+	case len(p.users.Values) > 0:
+		if user, password, ok := r.BasicAuth(); !ok || !p.users.valid(user, password) {
+			return http.StatusUnauthorized
+		}
+	}
+	return 0
+}
+
+// restrictsReads reports whether p keeps some reads out.
+func (p *accessPolicy) restrictsReads() bool {
+	return p.deny || len(p.users.Values) > 0
+}
+
+// load returns the policy of the access file with the storage name name in
+// f, or nil if there is none.
+func (a *accessFiles) load(f *fileHandler, name string) (*accessPolicy, error) {
+	info, err := f.storage.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	osPath := filepath.Join(f.path, filepath.FromSlash(name))
+	a.mu.Lock()
+	e, ok := a.entries[osPath]
+	a.mu.Unlock()
+	if ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.policy, e.err
+	}
+	data, err := fs.ReadFile(f.storage, name)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := parseAccessPolicy(string(data))
+	if err != nil {
+		err = fmt.Errorf("%s: %v", osPath, err)
+	}
+	a.mu.Lock()
+	a.entries[osPath] = accessEntry{modTime: info.ModTime(), size: info.Size(), policy: policy, err: err}
+	a.mu.Unlock()
+	return policy, err
+}
+
+// accessPolicy returns the policy of the access file nearest to osPath: that
+// of the directory itself if info says it is one, else that of its parent or
+// the next one up to f.path, with the URL path of its directory. It is nil
+// without -access-files or such a file.
+func (f *fileHandler) accessPolicy(osPath string, info os.FileInfo) (*accessPolicy, string, error) {
+	if f.access == nil {
+		return nil, "", nil
+	}
+	dir := f.storageName(osPath)
+	if info == nil || !info.IsDir() {
+		dir = path.Dir(dir)
+	}
+	if !fs.ValidPath(dir) {
+		return nil, "", nil
+	}
+	for {
+		policy, err := f.access.load(f, path.Join(dir, f.access.name))
+		if policy != nil || err != nil {
+			return policy, path.Join(f.route, dir) + "/", err
+		}
+		if dir == "." {
+			return nil, "", nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// guarded reports whether the directory osPath has an access file keeping
+// some reads out, or one that fails to load. Listings show such directories,
+// but archives, searches, feeds and trees of the directories above leave
+// them out: only requests for them check their policy.
+func (f *fileHandler) guarded(osPath string) bool {
+	if f.access == nil {
+		return false
+	}
+	policy, err := f.access.load(f, path.Join(f.storageName(osPath), f.access.name))
+	return err != nil || policy != nil && policy.restrictsReads()
+}
+
+// refusedBelow reports whether the policy of a directory below the directory
+// osPath, or one failing to load, keeps r out, so that it may not delete or
+// replace the tree as a whole.
+func (f *fileHandler) refusedBelow(r *http.Request, osPath string) bool {
+	if f.access == nil {
+		return false
+	}
+	root := f.storageName(osPath)
+	errRefused := errors.New("refused")
+	err := fs.WalkDir(f.storage, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root || !d.IsDir() {
+			return nil
+		}
+		policy, err := f.access.load(f, path.Join(p, f.access.name))
+		if err != nil {
+			return err
+		}
+		if policy.refusal(r) != 0 {
+			return errRefused
+		}
+		return nil
+	})
+	return err != nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	logFormatPlain = "plain"
+	logFormatJSON  = "json"
+)
+
+// statusRecorder remembers the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps io.Copy on the underlying writer, which may use sendfile.
+func (s *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := io.Copy(s.ResponseWriter, r)
+	s.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Root       string  `json:"root"`
+	Vhost      string  `json:"vhost,omitempty"`
+	RemoteAddr string  `json:"remoteAddr"`
+	User       string  `json:"user,omitempty"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Query      string  `json:"query,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"durationMs"`
+	UserAgent  string  `json:"userAgent,omitempty"`
+}
+
+// logRequest writes the access log line for a completed request.
+func (f *fileHandler) logRequest(r *http.Request, rec *statusRecorder, start time.Time) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	duration := time.Since(start)
+	user := authUser(r)
+	root := f.path
+	if f.vhost != "" {
+		root = f.vhost + " " + f.path
+	}
+	if f.logFormat == logFormatJSON {
+		line, err := json.Marshal(accessLogEntry{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			Root:       f.path,
+			Vhost:      f.vhost,
+			RemoteAddr: r.RemoteAddr,
+			User:       user,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      scrubToken(r.URL.RawQuery),
+			Status:     status,
+			Bytes:      rec.bytes,
+			DurationMs: float64(duration.Microseconds()) / 1000,
+			UserAgent:  r.UserAgent(),
+		})
+		if err == nil {
+			fmt.Fprintln(log.Writer(), string(line))
+		}
+		return
+	}
+	if user != "" {
+		log.Printf("[%s] %s %s %s %s %d %d %s", root, r.RemoteAddr, user, r.Method, loggedURL(r.URL), status, rec.bytes, duration)
+	} else {
+		log.Printf("[%s] %s %s %s %d %d %s", root, r.RemoteAddr, r.Method, loggedURL(r.URL), status, rec.bytes, duration)
+	}
+}
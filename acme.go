@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	letsEncryptDirectoryURL = acme.LetsEncryptURL
+	letsEncryptAddr         = ":443"
+	httpRedirectAddr        = ":80"
+	letsEncryptPort         = "443"
+
+	// acmeRenewBefore is how long before it expires a certificate is renewed
+	acmeRenewBefore = 30 * 24 * time.Hour
+)
+
+// letsEncryptHosts returns the -hostname list, checked for names a
+// certificate can be issued for: neither IP addresses nor wildcards, which
+// the tls-alpn-01 challenge cannot validate.
+func letsEncryptHosts() ([]string, error) {
+	var hosts []string
+	for _, host := range strings.Split(hostnameFlag, ",") {
+		host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if host == "" {
+			continue
+		}
+		if net.ParseIP(host) != nil || strings.Trim(host, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" {
+			return nil, fmt.Errorf("cannot obtain a certificate for %q: give a DNS name, without wildcards", host)
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("-hostname is required: give the DNS names to obtain certificates for, comma-separated")
+	}
+	return hosts, nil
+}
+
+// validLetsEncrypt checks the -letsencrypt flags before anything is bound,
+// and fills in the default -cache-dir.
+func validLetsEncrypt() error {
+	if tlsSelfSignedFlag || sslCertificate != "" || sslKey != "" {
+		return errors.New("cannot be combined with -ssl-cert/-ssl-key or -tls-self-signed")
+	}
+	if _, err := letsEncryptHosts(); err != nil {
+		return err
+	}
+	if cacheDirFlag == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return fmt.Errorf("-cache-dir is required: %v", err)
+		}
+		cacheDirFlag = filepath.Join(dir, "http-file-server", "acme")
+	}
+	return nil
+}
+
+// letsEncryptListenError adds what to do about the usual reasons for failing
+// to bind port 443 to err.
+func letsEncryptListenError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		binaryPath, _ := os.Executable()
+		return fmt.Errorf("%v: ports below 1024 need root or the CAP_NET_BIND_SERVICE capability (setcap cap_net_bind_service=+ep %s), or listen on another port with -port and forward port 443 to it", err, binaryPath)
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Errorf("%v: another server holds the port; stop it, or listen on another port with -port and forward port 443 to it", err)
+	}
+	return err
+}
+
+// letsEncryptConfig returns the TLS configuration of -letsencrypt: an
+// autocert manager obtains the certificates of the hosts on their first
+// handshake and renews them in the background, keeping them in -cache-dir
+// along with the account key so that a restart does not ask for them again,
+// and answers the tls-alpn-01 challenges of the CA. The listeners are
+// checked for port 443, which is where validation comes in.
+func letsEncryptConfig(listeners []net.Listener) (*tls.Config, error) {
+	hosts, err := letsEncryptHosts()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cacheDirFlag, 0700); err != nil {
+		return nil, err
+	}
+	m := newCertManager(hosts, cacheDirFlag, acmeDirectoryFlag)
+	on443 := false
+	for _, l := range listeners {
+		if _, port, err := net.SplitHostPort(l.Addr().String()); err == nil && port == letsEncryptPort {
+			on443 = true
+		}
+	}
+	if !on443 {
+		log.Printf("letsencrypt: not listening on port %s, where the CA validates the hosts: forward it to this server", letsEncryptPort)
+	}
+	return m.TLSConfig(), nil
+}
+
+// newCertManager returns the manager of the certificates of hosts from the
+// ACME CA at directoryURL, cached in cacheDir. Handshakes for other names
+// fail.
+func newCertManager(hosts []string, cacheDir, directoryURL string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cacheDir),
+		HostPolicy:  autocert.HostWhitelist(hosts...),
+		RenewBefore: acmeRenewBefore,
+		Client:      &acme.Client{DirectoryURL: directoryURL},
+	}
+}
+
+// serveHTTPSRedirect sends the plain HTTP requests to addr on to HTTPS. It
+// logs rather than fails if addr cannot be bound, as HTTPS works without.
+func serveHTTPSRedirect(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("letsencrypt: not redirecting HTTP to HTTPS: listen on %q: %v", addr, err)
+		return
+	}
+	log.Printf("redirecting HTTP on %q to HTTPS", addr)
+	go newServer(http.HandlerFunc(redirectToHTTPS), nil).Serve(l)
+}
+
+// redirectToHTTPS redirects r to its URL on the HTTPS port 443, keeping the
+// method of anything but a GET or HEAD.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := requestHost(r.Host)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	status := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
+
+// isACMEChallenge reports whether hello is that of a tls-alpn-01 validation,
+// which offers no other protocol.
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
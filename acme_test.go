@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestLetsEncryptHosts(t *testing.T) {
+	defer func(v string) { hostnameFlag = v }(hostnameFlag)
+	tests := []struct {
+		flag    string
+		want    []string
+		wantErr bool
+	}{
+		{"files.example.com", []string{"files.example.com"}, false},
+		{" Files.Example.COM., www.example.com ,", []string{"files.example.com", "www.example.com"}, false},
+		{"", nil, true},
+		{" , ", nil, true},
+		{"192.0.2.1", nil, true},
+		{"::1", nil, true},
+		{"*.example.com", nil, true},
+		{"files.example.com,under_score.example.com", nil, true},
+	}
+	for _, tt := range tests {
+		hostnameFlag = tt.flag
+		got, err := letsEncryptHosts()
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("letsEncryptHosts() with -hostname %q = %q, %v", tt.flag, got, err)
+		}
+	}
+}
+
+func TestValidLetsEncrypt(t *testing.T) {
+	defer func(host, cert, key, cacheDir string, selfSigned bool) {
+		hostnameFlag, sslCertificate, sslKey, cacheDirFlag, tlsSelfSignedFlag = host, cert, key, cacheDir, selfSigned
+	}(hostnameFlag, sslCertificate, sslKey, cacheDirFlag, tlsSelfSignedFlag)
+	hostnameFlag = "files.example.com"
+
+	for _, set := range []func(){
+		func() { sslCertificate, sslKey = "cert.pem", "key.pem" },
+		func() { sslCertificate = "cert.pem" },
+		func() { tlsSelfSignedFlag = true },
+	} {
+		sslCertificate, sslKey, tlsSelfSignedFlag = "", "", false
+		set()
+		if err := validLetsEncrypt(); err == nil {
+			t.Errorf("validLetsEncrypt() with -ssl-cert %q, -ssl-key %q, -tls-self-signed %v = nil", sslCertificate, sslKey, tlsSelfSignedFlag)
+		}
+	}
+
+	sslCertificate, sslKey, tlsSelfSignedFlag = "", "", false
+	cacheDirFlag = ""
+	if err := validLetsEncrypt(); err != nil {
+		t.Fatal(err)
+	}
+	if cacheDirFlag == "" {
+		t.Error("validLetsEncrypt() left -cache-dir empty")
+	}
+}
+
+// ecdsaHello is the hello of a client that supports ECDSA certificates, for
+// the manager to answer with one.
+func ecdsaHello(host string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        host,
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+}
+
+// cacheTestCertificate puts a certificate for host valid for validity into
+// cache as the manager keeps those it obtains, and returns it.
+func cacheTestCertificate(t *testing.T, cache autocert.Cache, host string, validity time.Duration) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := cache.Put(context.Background(), host, data); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertManager(t *testing.T) {
+	// a CA that is never to be asked: the cached certificate is current, and
+	// the other hosts are refused before the CA would be
+	var asked bool
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = true
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}))
+	defer ca.Close()
+
+	dir := t.TempDir()
+	m := newCertManager([]string{"files.example.com", "www.example.com"}, dir, ca.URL)
+	cached := cacheTestCertificate(t, m.Cache, "files.example.com", 90*24*time.Hour)
+
+	cert, err := m.GetCertificate(ecdsaHello("files.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || !cert.Leaf.Equal(cached) {
+		t.Error("the handshake for a cached host did not get its certificate")
+	}
+	for _, host := range []string{"other.example.com", "example.com", "files.example.com.evil.example"} {
+		if _, err := m.GetCertificate(ecdsaHello(host)); err == nil {
+			t.Errorf("the handshake for %q got a certificate", host)
+		}
+	}
+	if asked {
+		t.Error("the CA was asked")
+	}
+	if m.RenewBefore != acmeRenewBefore || m.Client.DirectoryURL != ca.URL {
+		t.Errorf("manager renews %v before, at %q", m.RenewBefore, m.Client.DirectoryURL)
+	}
+
+	config := m.TLSConfig()
+	if !slices.Contains(config.NextProtos, acme.ALPNProto) {
+		t.Errorf("NextProtos %q leave out %q, for the tls-alpn-01 challenge", config.NextProtos, acme.ALPNProto)
+	}
+}
+
+func TestIsACMEChallenge(t *testing.T) {
+	tests := []struct {
+		protos []string
+		want   bool
+	}{
+		{[]string{acme.ALPNProto}, true},
+		{[]string{"h2", acme.ALPNProto}, false},
+		{[]string{"h2", "http/1.1"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isACMEChallenge(&tls.ClientHelloInfo{SupportedProtos: tt.protos}); got != tt.want {
+			t.Errorf("isACMEChallenge(%q) = %v, want %v", tt.protos, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		method, target, host string
+		status               int
+		location             string
+	}{
+		{http.MethodGet, "/a.txt?x=1", "files.example.com", http.StatusMovedPermanently, "https://files.example.com/a.txt?x=1"},
+		{http.MethodHead, "/", "files.example.com:80", http.StatusMovedPermanently, "https://files.example.com/"},
+		{http.MethodPut, "/dir/b.txt", "files.example.com", http.StatusPermanentRedirect, "https://files.example.com/dir/b.txt"},
+		{http.MethodGet, "/", "[2001:db8::1]:80", http.StatusMovedPermanently, "https://[2001:db8::1]/"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		redirectToHTTPS(w, r)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s on %s: status %d, Location %q, want %d, %q", tt.method, tt.target, tt.host, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
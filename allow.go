@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// addressFilter decides which client addresses are served, from -allow and
+// -deny. Without -deny, only the -allow networks are let in. With -deny, its
+// networks are shut out, except for addresses that are also in -allow: allow
+// takes precedence, so that -deny 10.0.0.0/8 -allow 10.1.2.3 admits that one
+// host of the network and everyone outside it.
+type addressFilter struct {
+	allow *networks
+	deny  *networks
+}
+
+// enabled reports whether any address could be rejected.
+func (a addressFilter) enabled() bool {
+	return len(a.allow.Values) > 0 || len(a.deny.Values) > 0
+}
+
+func (a addressFilter) allows(addr netip.Addr) bool {
+	if a.allow.contains(addr) {
+		return true
+	}
+	if len(a.deny.Values) > 0 {
+		return !a.deny.contains(addr)
+	}
+	return len(a.allow.Values) == 0
+}
+
+// addressFilterHandler refuses requests from clients the filter rejects with
+// 403. It runs after proxyHandler, so behind a trusted proxy the client's
+// address is checked rather than the proxy's. Requests over a Unix socket,
+// which have no address, are left to the socket's file permissions; other
+// requests whose address cannot be parsed are refused. pages serves the
+// refusal, styled like the routes' own status pages.
+type addressFilterHandler struct {
+	handler http.Handler
+	filter  addressFilter
+	pages   *fileHandler
+}
+
+func (h *addressFilterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil || !h.filter.allows(addr) {
+		log.Printf("refused %s %s %s: client address not allowed", clientIP(r), r.Method, loggedURL(r.URL))
+		_ = h.pages.serveStatus(w, r, http.StatusForbidden)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
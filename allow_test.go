@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func newAddressFilter(t *testing.T, allow, deny string) addressFilter {
+	t.Helper()
+	filter := addressFilter{allow: &networks{}, deny: &networks{}}
+	if err := filter.allow.Set(allow); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.deny.Set(deny); err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestAddressFilter(t *testing.T) {
+	tests := []struct {
+		allow, deny string
+		allowed     []string
+		refused     []string
+	}{
+		{"", "", []string{"192.0.2.1", "2001:db8::1"}, nil},
+		{"192.168.1.0/24", "", []string{"192.168.1.7", "::ffff:192.168.1.7"}, []string{"192.168.2.7", "::ffff:192.168.2.7", "2001:db8::1"}},
+		{"2001:db8::/32", "", []string{"2001:db8::1", "2001:db8:ffff::1", "2001:db8::2%eth0"}, []string{"2001:db9::1", "192.0.2.1"}},
+		{"", "10.0.0.0/8, fd00::/8", []string{"192.0.2.1", "2001:db8::1"}, []string{"10.1.2.3", "::ffff:10.1.2.3", "fd12::1"}},
+		{"10.1.2.3", "10.0.0.0/8", []string{"10.1.2.3", "::ffff:10.1.2.3", "192.0.2.1"}, []string{"10.1.2.4"}},
+		{"::ffff:192.0.2.1", "", []string{"192.0.2.1", "::ffff:192.0.2.1"}, []string{"192.0.2.2"}},
+		{"::1, 127.0.0.1", "", []string{"::1", "127.0.0.1"}, []string{"::2", "127.0.0.2"}},
+	}
+	for _, tt := range tests {
+		filter := newAddressFilter(t, tt.allow, tt.deny)
+		for _, s := range tt.allowed {
+			if !filter.allows(netip.MustParseAddr(s)) {
+				t.Errorf("-allow %q -deny %q refuses %s", tt.allow, tt.deny, s)
+			}
+		}
+		for _, s := range tt.refused {
+			if filter.allows(netip.MustParseAddr(s)) {
+				t.Errorf("-allow %q -deny %q allows %s", tt.allow, tt.deny, s)
+			}
+		}
+	}
+}
+
+func TestNetworksSet(t *testing.T) {
+	var n networks
+	for _, bad := range []string{"192.0.2.0/33", "example.com", "10.0.0.0/8,nonsense"} {
+		if err := n.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestAddressFilterHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := &addressFilterHandler{handler: ok, filter: newAddressFilter(t, "192.168.1.0/24, 2001:db8::/32", ""), pages: newTestHandler(t, "/", t.TempDir())}
+	tests := map[string]int{
+		"192.168.1.7:50000":        http.StatusOK,
+		"[::ffff:192.168.1.7]:443": http.StatusOK,
+		"[2001:db8::1]:443":        http.StatusOK,
+		"192.168.2.7:50000":        http.StatusForbidden,
+		"[::1]:443":                http.StatusForbidden,
+		"garbage":                  http.StatusForbidden,
+	}
+	for remoteAddr, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("client %s: %d, want %d", remoteAddr, w.Code, want)
+		}
+	}
+	// browsers get the page the routes refuse them with
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.168.2.7:50000"
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "<h1>403 Forbidden</h1>") {
+		t.Errorf("refusal to a browser: Content-Type %q, body %q", w.Header().Get("Content-Type"), w.Body)
+	}
+	// requests over a Unix socket have no address to check
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "@"
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/hfs.sock", Net: "unix"}))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("client on a Unix socket: %d", w.Code)
+	}
+}
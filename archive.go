@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	estimatedSizeHeader = "X-Estimated-Size"
+
+	// tarEntryOverhead allows for the header block of a tar entry and the
+	// padding of its content to a whole block; tarTrailer is the two zero
+	// blocks ending an archive
+	tarEntryOverhead = 1024
+	tarTrailer       = 1024
+	// zipEntryOverhead allows for the local and central directory headers
+	// of a zip entry, which grow with the name
+	zipEntryOverhead = 128
+
+	// archiveSizeTimeout bounds the walk that checks an archive against
+	// -max-archive-size; one that takes longer is refused as too large
+	archiveSizeTimeout = 30 * time.Second
+)
+
+// isArchive reports whether r asks for a zip, tar.gz or tar archive, including
+// a zip of selected entries.
+func isArchive(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Get(zipKey) != "" || q.Get(tarGzKey) != "" || q.Get(tarKey) != ""
+}
+
+// archiveMatch returns the name predicate of the search r carries over from
+// the listing, so that an archive holds just the entries listed, or nil
+// without one.
+func archiveMatch(r *http.Request) (func(name string) bool, error) {
+	if !isSearch(r) {
+		return nil, nil
+	}
+	return searchMatcher(r)
+}
+
+// archiveRootUsage totals the files the archive of the single file or
+// directory at osPath would hold, only those whose name satisfies match
+// unless it is nil.
+func (f *fileHandler) archiveRootUsage(ctx context.Context, osPath string, match func(name string) bool) dirUsage {
+	info, err := f.storage.Stat(f.storageName(osPath))
+	if err != nil {
+		// writing the archive reports it
+		return dirUsage{}
+	}
+	if !info.IsDir() {
+		return dirUsage{Size: fileSizeBytes(info.Size()), Entries: 1}
+	}
+	if match == nil {
+		return f.dirUsage(ctx, osPath, info.ModTime())
+	}
+	var usage dirUsage
+	err = f.walkArchiveRoot(ctx, osPath, match, func(path, name string, info os.FileInfo) error {
+		if name == "." {
+			return nil
+		}
+		usage.Entries++
+		if info.Mode().IsRegular() {
+			usage.Size += fileSizeBytes(info.Size())
+		}
+		return nil
+	})
+	usage.Truncated = err != nil && ctx.Err() != nil
+	return usage
+}
+
+// selectionUsage totals the files a zip of the trees rooted at paths would
+// hold. As in the archive, symlinks there are not followed.
+func (f *fileHandler) selectionUsage(ctx context.Context, paths []string) dirUsage {
+	var usage dirUsage
+	for _, p := range paths {
+		info, err := f.storage.Lstat(f.storageName(p))
+		if err != nil {
+			continue
+		}
+		usage.Entries++
+		switch {
+		case info.IsDir():
+			usage.add(f.dirUsage(ctx, p, info.ModTime()))
+		case info.Mode().IsRegular():
+			usage.Size += fileSizeBytes(info.Size())
+		}
+	}
+	return usage
+}
+
+// refuseLargeArchive answers 403 with the reason and returns true if
+// -max-archive-size is set and the archive that usage totals would exceed
+// it, or its size cannot be found within archiveSizeTimeout, rather than
+// start a download that would run for hours.
+func (f *fileHandler) refuseLargeArchive(w http.ResponseWriter, r *http.Request, usage func(ctx context.Context) dirUsage) bool {
+	if f.maxArchiveSize <= 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), archiveSizeTimeout)
+	defer cancel()
+	total := usage(ctx)
+	limit := fileSizeBytes(f.maxArchiveSize)
+	var message string
+	switch {
+	case total.Truncated:
+		message = fmt.Sprintf("This archive holds too many files to size in %v, so it may exceed the limit of %s. Download fewer files at once.", archiveSizeTimeout, limit)
+	case int64(total.Size) > f.maxArchiveSize:
+		message = fmt.Sprintf("This archive would hold %s of files, more than the limit of %s. Download fewer files at once.", total.Size, limit)
+	default:
+		return false
+	}
+	_ = f.serveStatusMessage(w, r, http.StatusForbidden, message)
+	return true
+}
+
+// serveArchiveHead answers a HEAD request for an archive of osPath with the
+// headers already set and an estimate of the size of a GET: the size of the
+// files it would contain plus perEntry bytes for each entry and trailer
+// bytes at the end. Compression is not accounted for. The estimate is left
+// out if the walk takes too long.
+func (f *fileHandler) serveArchiveHead(w http.ResponseWriter, r *http.Request, osPath string, match func(name string) bool, perEntry, trailer int64) error {
+	if _, err := f.storage.Stat(f.storageName(osPath)); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), duTimeout)
+	defer cancel()
+	usage := f.archiveRootUsage(ctx, osPath, match)
+	if !usage.Truncated {
+		estimate := int64(usage.Size) + int64(usage.Entries)*perEntry + trailer
+		w.Header().Set(estimatedSizeHeader, strconv.FormatInt(estimate, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// archiveAdder adds the file or directory at path to an archive as name,
+// which is relative and in slash form.
+type archiveAdder func(path, name string, info os.FileInfo) error
+
+// walkArchiveRoot walks the archive of the single file or directory at path
+// that a client asked for by name. A symlink there is followed, within the
+// limits the request was checked against, so that the archive holds what
+// the listing shows: a directory's entries relative to it, or one file
+// named after the link. Unless match is nil, a directory's archive holds
+// only the entries whose name satisfies it, as a search lists them: the
+// directories among them without their other contents.
+func (f *fileHandler) walkArchiveRoot(ctx context.Context, path string, match func(name string) bool, add archiveAdder) error {
+	info, err := f.storage.Stat(f.storageName(path))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return add(path, filepath.Base(path), info)
+	}
+	if match != nil {
+		addAll := add
+		add = func(path, name string, info os.FileInfo) error {
+			if name != "." && !match(filepath.Base(path)) {
+				return nil
+			}
+			return addAll(path, name, info)
+		}
+	}
+	return f.walkArchiveTree(ctx, path, path, add)
+}
+
+// walkArchive calls add for every entry of the trees rooted at paths that is
+// not hidden by path, passing the entry's name relative to basePath in slash
+// form. Symlinks, including those among paths, are not followed. It is the
+// traversal shared by the zip, tar and tar.gz writers, and stops with
+// ctx.Err() once ctx is done.
+func (f *fileHandler) walkArchive(ctx context.Context, basePath string, paths []string, add archiveAdder) error {
+	for _, root := range paths {
+		var err error
+		if info, lstatErr := f.storage.Lstat(f.storageName(root)); lstatErr == nil && info.Mode()&os.ModeSymlink != 0 {
+			var name string
+			if name, err = filepath.Rel(basePath, root); err == nil {
+				err = add(root, filepath.ToSlash(name), info)
+			}
+		} else {
+			err = f.walkArchiveTree(ctx, basePath, root, add)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkArchiveTree walks the tree of f.storage at root for walkArchive,
+// following root itself if it is a symlink.
+func (f *fileHandler) walkArchiveTree(ctx context.Context, basePath, root string, add archiveAdder) error {
+	return fs.WalkDir(f.storage, f.storageName(root), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(f.path, filepath.FromSlash(p))
+		if path != basePath && (f.hiddenFile(path) || d.IsDir() && f.guarded(path)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(basePath, path)
+		if err != nil {
+			return err
+		}
+		return add(path, filepath.ToSlash(name), info)
+	})
+}
+
+// copyContext is io.Copy that gives up with ctx.Err() once ctx is done, so
+// a single large file does not keep streaming to a client that has gone.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, contextReader{ctx: ctx, r: src})
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
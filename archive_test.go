@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func manyFilesTree(t *testing.T, n int) string {
+	t.Helper()
+	tree := map[string]string{}
+	for i := 0; i < n; i++ {
+		tree[fmt.Sprintf("d%02d/f%03d.txt", i%10, i)] = fmt.Sprintf("file %d", i)
+	}
+	return writeTestTree(t, tree)
+}
+
+func TestWalkArchiveStopsWhenCancelled(t *testing.T) {
+	dir := manyFilesTree(t, 200)
+	h := newTestHandler(t, "/", dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	added := 0
+	err := h.walkArchiveRoot(ctx, dir, nil, func(path, name string, info os.FileInfo) error {
+		added++
+		if added == 5 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("walk ended with %v, want %v", err, context.Canceled)
+	}
+	if added != 5 {
+		t.Errorf("walk added %d entries after the cancellation at 5", added)
+	}
+}
+
+func TestCopyContextStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &cancellingWriter{cancel: cancel, after: 1}
+	n, err := copyContext(ctx, w, &patternReader{size: 1 << 30})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("copy ended with %v, want %v", err, context.Canceled)
+	}
+	if n > 1<<20 {
+		t.Errorf("copied %d bytes after the cancellation", n)
+	}
+}
+
+// cancellingWriter calls cancel once it has been written to after times, as
+// a client hanging up mid-download.
+type cancellingWriter struct {
+	http.ResponseWriter
+	cancel func()
+	after  int
+	writes int
+	bytes  int
+}
+
+func (w *cancellingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	w.bytes += len(p)
+	if w.writes == w.after {
+		w.cancel()
+	}
+	return len(p), nil
+}
+
+func TestArchiveStopsWhenClientGoes(t *testing.T) {
+	dir := manyFilesTree(t, 300)
+	if err := os.WriteFile(dir+"/d00/big.bin", make([]byte, 64<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, "/", dir)
+	for _, key := range []string{zipKey, tarGzKey, tarKey} {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := httptest.NewRequest(http.MethodGet, "/?"+key+"=1", nil).WithContext(ctx)
+		w := &cancellingWriter{ResponseWriter: httptest.NewRecorder(), cancel: cancel, after: 1}
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("?%s: the archive took %v after the client went", key, elapsed)
+		}
+		if w.bytes > 1<<20 {
+			t.Errorf("?%s: %d bytes written after the client went", key, w.bytes)
+		}
+		cancel()
+	}
+}
+
+// modeTree is a tree with an executable, a read-only file, an empty
+// directory and a symlink, all with fixed modification times, or with the
+// symlink left out where there are none.
+func modeTree(t *testing.T) (dir string, mtime time.Time, symlinks bool) {
+	t.Helper()
+	dir = writeTestTree(t, map[string]string{"bin/run.sh": "#!/bin/sh\n", "ro.txt": "read only", "empty/": ""})
+	if err := os.Chmod(filepath.Join(dir, "bin", "run.sh"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "ro.txt"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	symlinks = os.Symlink("bin/run.sh", filepath.Join(dir, "link")) == nil
+	mtime = time.Date(2023, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, name := range []string{"bin/run.sh", "ro.txt", "empty", "bin"} {
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(name)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, mtime, symlinks
+}
+
+type archivedEntry struct {
+	mode     os.FileMode
+	modTime  time.Time
+	linkname string
+	content  string
+}
+
+func readTarEntries(t *testing.T, r io.Reader) map[string]archivedEntry {
+	t.Helper()
+	entries := map[string]archivedEntry{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := archivedEntry{mode: hdr.FileInfo().Mode(), modTime: hdr.ModTime, linkname: hdr.Linkname, content: string(content)}
+		if hdr.Typeflag == tar.TypeSymlink {
+			e.mode |= os.ModeSymlink
+		}
+		entries[hdr.Name] = e
+	}
+}
+
+// readArchiveEntries reads the archive body of the format that key asks for.
+func readArchiveEntries(t *testing.T, key string, body []byte) map[string]archivedEntry {
+	t.Helper()
+	switch key {
+	case tarGzKey:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readTarEntries(t, zr)
+	case tarKey:
+		return readTarEntries(t, bytes.NewReader(body))
+	}
+	return readZipEntries(t, body)
+}
+
+func readZipEntries(t *testing.T, body []byte) map[string]archivedEntry {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]archivedEntry{}
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := archivedEntry{mode: zf.Mode(), modTime: zf.Modified, content: string(content)}
+		if zf.Mode()&os.ModeSymlink != 0 {
+			e.linkname = e.content
+		}
+		entries[zf.Name] = e
+	}
+	return entries
+}
+
+func TestArchivesKeepModesTimesAndLinks(t *testing.T) {
+	dir, mtime, symlinks := modeTree(t)
+	h := newTestHandler(t, "/", dir)
+	base := filepath.Base(dir)
+	for _, key := range []string{tarGzKey, tarKey, zipKey} {
+		w := serveTest(h, http.MethodGet, "/?"+key+"=1", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("?%s: %d %s", key, w.Code, w.Body)
+		}
+		entries := readArchiveEntries(t, key, w.Body.Bytes())
+		prefix := ""
+		if _, ok := entries[base+"/ro.txt"]; ok {
+			prefix = base + "/"
+		}
+		check := func(name string, mode os.FileMode, content string) {
+			t.Helper()
+			e, ok := entries[prefix+name]
+			if !ok {
+				t.Errorf("?%s: no %s among %v", key, name, entries)
+				return
+			}
+			if runtime.GOOS != "windows" && e.mode != mode {
+				t.Errorf("?%s: %s has mode %v, want %v", key, name, e.mode, mode)
+			}
+			if e.mode&os.ModeSymlink == 0 && !e.modTime.Equal(mtime) {
+				t.Errorf("?%s: %s modified %v, want %v", key, name, e.modTime, mtime)
+			}
+			if e.content != content && e.mode&os.ModeSymlink == 0 {
+				t.Errorf("?%s: %s holds %q, want %q", key, name, e.content, content)
+			}
+		}
+		check("bin/run.sh", 0o755, "#!/bin/sh\n")
+		check("ro.txt", 0o444, "read only")
+		check("empty/", os.ModeDir|0o755, "")
+		if symlinks {
+			check("link", os.ModeSymlink|0o777, "")
+			if got := entries[prefix+"link"].linkname; got != "bin/run.sh" {
+				t.Errorf("?%s: link points to %q, want %q", key, got, "bin/run.sh")
+			}
+		}
+	}
+}
+
+func TestZipKeepsEmptyDirectories(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"empty/": "", "nested/empty/": "", "full/a.txt": "a"})
+	h := newTestHandler(t, "/", dir)
+	w := serveTest(h, http.MethodGet, "/?zip=1", nil)
+	entries := readZipEntries(t, w.Body.Bytes())
+	for _, name := range []string{"empty/", "nested/", "nested/empty/", "full/", "full/a.txt"} {
+		found := false
+		for entry := range entries {
+			found = found || entry == name || strings.HasSuffix(entry, "/"+name)
+		}
+		if !found {
+			t.Errorf("no %s among %v", name, entries)
+		}
+	}
+}
+
+// headTailWriter keeps the first and last size bytes written to it, enough
+// to read the headers of an archive of mostly zeros without storing it.
+type headTailWriter struct {
+	http.ResponseWriter
+	size       int
+	head, tail []byte
+	n          int64
+}
+
+func (w *headTailWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	if rest := w.size - len(w.head); rest > 0 {
+		w.head = append(w.head, p[:min(rest, len(p))]...)
+	}
+	w.tail = append(w.tail, p...)
+	if len(w.tail) > w.size {
+		w.tail = append(w.tail[:0], w.tail[len(w.tail)-w.size:]...)
+	}
+	return len(p), nil
+}
+
+// ReadAt reads the archive as if every byte between head and tail was 0.
+func (w *headTailWriter) ReadAt(p []byte, off int64) (int, error) {
+	tailStart := w.n - int64(len(w.tail))
+	for i := range p {
+		o := off + int64(i)
+		switch {
+		case o >= w.n:
+			return i, io.EOF
+		case o < int64(len(w.head)):
+			p[i] = w.head[o]
+		case o >= tailStart:
+			p[i] = w.tail[o-tailStart]
+		default:
+			p[i] = 0
+		}
+	}
+	return len(p), nil
+}
+
+func TestZipLargeFileUsesZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("reads a sparse file of more than 4 GB")
+	}
+	const size = 1<<32 + 1<<20
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "small.txt"), []byte("small"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "huge.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		t.Skipf("sparse file: %v", err)
+	}
+	f.Close()
+	h := newTestHandler(t, "/", dir)
+	w := &headTailWriter{ResponseWriter: httptest.NewRecorder(), size: 1 << 20}
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?zip=1", nil))
+	if w.n < size {
+		t.Fatalf("archive of %d bytes", w.n)
+	}
+	zr, err := zip.NewReader(w, w.n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var huge *zip.File
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "huge.bin") {
+			huge = zf
+		}
+	}
+	if huge == nil {
+		t.Fatalf("no huge.bin among %v", zr.File)
+	}
+	if huge.UncompressedSize64 != size || huge.CompressedSize64 != size {
+		t.Errorf("huge.bin sizes %d, %d, want %d", huge.UncompressedSize64, huge.CompressedSize64, uint64(size))
+	}
+	if huge.ReaderVersion < 45 {
+		t.Errorf("huge.bin needs version %d, want at least 45 for zip64", huge.ReaderVersion)
+	}
+	if want := zeroCRC(size); huge.CRC32 != want {
+		t.Errorf("huge.bin CRC %08x, want %08x", huge.CRC32, want)
+	}
+	// the sizes are in the local header too, not only in a data descriptor
+	i := bytes.Index(w.head, []byte(huge.Name))
+	if i < 30 || !bytes.HasPrefix(w.head[i-30:], []byte("PK\x03\x04")) {
+		t.Fatalf("no local header for %s", huge.Name)
+	}
+	local := w.head[i-30:]
+	if flags := binary.LittleEndian.Uint16(local[6:]); flags&0x8 != 0 {
+		t.Errorf("huge.bin has a data descriptor, flags %04x", flags)
+	}
+	extra := local[30+len(huge.Name):][:binary.LittleEndian.Uint16(local[28:])]
+	if len(extra) < 20 || binary.LittleEndian.Uint16(extra) != 0x0001 || binary.LittleEndian.Uint64(extra[4:]) != size {
+		t.Errorf("huge.bin local header has no zip64 sizes, extra % x", extra)
+	}
+}
+
+// zeroCRC is the CRC-32 of n zero bytes.
+func zeroCRC(n int64) uint32 {
+	crc := crc32.NewIEEE()
+	zeros := make([]byte, 1<<20)
+	for ; n > 0; n -= int64(len(zeros)) {
+		crc.Write(zeros[:min(n, int64(len(zeros)))])
+	}
+	return crc.Sum32()
+}
+
+func TestSingleFileArchives(t *testing.T) {
+	dir, mtime, symlinks := modeTree(t)
+	if symlinks {
+		if err := os.Symlink("bin", filepath.Join(dir, "bin-link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestHandler(t, "/", dir)
+	for _, key := range []string{tarGzKey, tarKey, zipKey} {
+		w := serveTest(h, http.MethodGet, "/bin/run.sh?"+key+"=1", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("?%s of a file: %d %s", key, w.Code, w.Body)
+		}
+		entries := readArchiveEntries(t, key, w.Body.Bytes())
+		e, ok := entries["run.sh"]
+		if !ok || len(entries) != 1 {
+			t.Errorf("?%s of a file holds %v, want run.sh alone", key, entries)
+		}
+		if runtime.GOOS != "windows" && e.mode != 0o755 || !e.modTime.Equal(mtime) || e.content != "#!/bin/sh\n" {
+			t.Errorf("?%s of a file: run.sh %+v", key, e)
+		}
+		if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, `filename="run.sh.`) {
+			t.Errorf("?%s of a file: Content-Disposition %q", key, got)
+		}
+
+		if w := serveTest(h, http.MethodGet, "/missing?"+key+"=1", nil); w.Code != http.StatusNotFound {
+			t.Errorf("?%s of a missing path: %d, want 404", key, w.Code)
+		}
+		if !symlinks {
+			continue
+		}
+		// a link is archived as what it points to, named after the link
+		w = serveTest(h, http.MethodGet, "/link?"+key+"=1", nil)
+		entries = readArchiveEntries(t, key, w.Body.Bytes())
+		if e, ok := entries["link"]; w.Code != http.StatusOK || !ok || len(entries) != 1 || e.content != "#!/bin/sh\n" {
+			t.Errorf("?%s of a symlink to a file: %d %v", key, w.Code, entries)
+		}
+		w = serveTest(h, http.MethodGet, "/bin-link/?"+key+"=1", nil)
+		entries = readArchiveEntries(t, key, w.Body.Bytes())
+		found := false
+		for name, e := range entries {
+			found = found || strings.HasSuffix(name, "run.sh") && e.content == "#!/bin/sh\n"
+		}
+		if w.Code != http.StatusOK || !found {
+			t.Errorf("?%s of a symlink to a directory: %d %v", key, w.Code, entries)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// auditQueueSize bounds the entries waiting to be written; requests
+	// wait for room rather than go unrecorded
+	auditQueueSize    = 1024
+	auditSyncInterval = time.Second
+	auditFileMode     = 0o600
+)
+
+// auditEntry is one line of the -audit-log: a request that changes files,
+// who sent it, how it ended and what it changed.
+type auditEntry struct {
+	Time       string        `json:"time"`
+	RemoteAddr string        `json:"remoteAddr"`
+	User       string        `json:"user,omitempty"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Status     int           `json:"status"`
+	Changes    []auditChange `json:"changes,omitempty"`
+}
+
+// auditChange is one file or directory a request changed, as reported to
+// the webhook. Size is that of a stored file.
+type auditChange struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	From   string `json:"from,omitempty"`
+	Size   *int64 `json:"size,omitempty"`
+}
+
+// auditLog appends entries to the -audit-log file from a single goroutine,
+// syncing it to disk every auditSyncInterval while there is something new.
+// Failures are logged once until a write succeeds again. With required,
+// changing requests are refused with 503 meanwhile; the request whose entry
+// could not be written has already been carried out.
+type auditLog struct {
+	file     *os.File
+	required bool
+	entries  chan []byte
+	// failed holds the error of the last write, nil once one succeeds
+	failed atomic.Pointer[error]
+}
+
+func newAuditLog(path string, required bool) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, auditFileMode)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{file: file, required: required, entries: make(chan []byte, auditQueueSize)}
+	go a.run()
+	return a, nil
+}
+
+func (a *auditLog) run() {
+	sync := time.NewTicker(auditSyncInterval)
+	defer sync.Stop()
+	dirty := false
+	for {
+		select {
+		case line := <-a.entries:
+			if _, err := a.file.Write(line); err != nil {
+				a.fail(err)
+				continue
+			}
+			if a.failed.Swap(nil) != nil {
+				log.Printf("audit log: writing again")
+			}
+			dirty = true
+		case <-sync.C:
+			if !dirty {
+				continue
+			}
+			if err := a.file.Sync(); err != nil {
+				a.fail(err)
+				continue
+			}
+			dirty = false
+		}
+	}
+}
+
+func (a *auditLog) fail(err error) {
+	if a.failed.Swap(&err) == nil {
+		log.Printf("audit log: %v", err)
+	}
+}
+
+// refuses reports whether r must be refused because its changes could not
+// be recorded.
+func (a *auditLog) refuses(r *http.Request) bool {
+	return a != nil && a.required && isMutation(r) && a.failed.Load() != nil
+}
+
+// isMutation reports whether r asks to change files. Zip downloads of a
+// selection are POSTed but change nothing, and WebDAV locks are not kept.
+func isMutation(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPut, http.MethodDelete, methodMkcol, methodMove, methodCopy:
+		return true
+	case http.MethodPost:
+		return r.URL.Query().Get(zipKey) == ""
+	}
+	return false
+}
+
+// auditKey is the context key of the changes a request made so far.
+type auditKey struct{}
+
+type auditChanges struct {
+	mu      sync.Mutex
+	changes []auditChange
+}
+
+// withAudit returns r with a record for its changes attached, if r is audited.
+func (a *auditLog) withAudit(r *http.Request) *http.Request {
+	if a == nil || !isMutation(r) {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), auditKey{}, &auditChanges{}))
+}
+
+// audit records a change r made, if r is audited.
+func audit(r *http.Request, change auditChange) {
+	if c, ok := r.Context().Value(auditKey{}).(*auditChanges); ok {
+		c.mu.Lock()
+		c.changes = append(c.changes, change)
+		c.mu.Unlock()
+	}
+}
+
+// write queues the entry of the audited request r, answered through rec.
+func (a *auditLog) write(r *http.Request, urlPath string, rec *statusRecorder) {
+	c, ok := r.Context().Value(auditKey{}).(*auditChanges)
+	if a == nil || !ok {
+		return
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	c.mu.Lock()
+	entry := auditEntry{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		RemoteAddr: clientIP(r),
+		User:       authUser(r),
+		Method:     r.Method,
+		Path:       urlPath,
+		Status:     status,
+		Changes:    c.changes,
+	}
+	line, err := json.Marshal(entry)
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+	a.entries <- append(line, '\n')
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type credentials struct {
+	Values []struct {
+		User     [sha256.Size]byte
+		Password [sha256.Size]byte
+	}
+	Texts []string
+}
+
+func (fv *credentials) help() string {
+	return "require HTTP basic auth with the credentials USER:PASSWORD (repeatable)"
+}
+
+// Set is flag.Value.Set
+func (fv *credentials) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return errors.New("expected USER:PASSWORD")
+	}
+	fv.Texts = append(fv.Texts, v[:i]+":***")
+	fv.Values = append(fv.Values, struct {
+		User     [sha256.Size]byte
+		Password [sha256.Size]byte
+	}{
+		User:     sha256.Sum256([]byte(v[:i])),
+		Password: sha256.Sum256([]byte(v[i+1:])),
+	})
+	return nil
+}
+
+func (fv *credentials) String() string {
+	return strings.Join(fv.Texts, ", ")
+}
+
+// valid compares user and password against every configured pair in constant time.
+func (fv *credentials) valid(user, password string) bool {
+	userSum := sha256.Sum256([]byte(user))
+	passwordSum := sha256.Sum256([]byte(password))
+	ok := 0
+	for _, c := range fv.Values {
+		ok |= subtle.ConstantTimeCompare(userSum[:], c.User[:]) & subtle.ConstantTimeCompare(passwordSum[:], c.Password[:])
+	}
+	return ok == 1
+}
+
+type authUserKey struct{}
+
+// authUser returns the name of the user authenticated for r, by basic auth
+// or else by the subject of its client certificate, or "" if none.
+func authUser(r *http.Request) string {
+	if user, _ := r.Context().Value(authUserKey{}).(string); user != "" {
+		return user
+	}
+	return certSubject(r)
+}
+
+type basicAuthHandler struct {
+	handler     http.Handler
+	credentials *credentials
+	realm       string
+	// shares, if set, lets valid share links through without credentials
+	shares *shareSigner
+}
+
+// ServeHTTP is http.Handler.ServeHTTP
+func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.shares != nil && isShareRequest(r) {
+		if err := h.shares.verify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		// the file handler checks again that the link names a file
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || !h.credentials.valid(user, password) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, h.realm))
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+		return
+	}
+	h.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, user)))
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	zipper "archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	browseKey   = "browse"
+	browseValue = "1"
+	zipExt      = ".zip"
+
+	// zipCacheSize is the most zip files kept open between requests
+	zipCacheSize = 32
+)
+
+// zipTarget is a name inside the zip file archive, slash-separated and ""
+// for its root.
+type zipTarget struct {
+	archive string
+	info    os.FileInfo
+	name    string
+}
+
+// zipPath returns, with -browse-zip, what a read of osPath, in the state
+// given by info and statErr, asks for inside a zip file: osPath is below it,
+// or is the file itself asked for with ?browse=1 or a trailing slash. It is
+// nil for any other request, and for a storage other than the disk.
+func (f *fileHandler) zipPath(r *http.Request, osPath string, info os.FileInfo, statErr error) *zipTarget {
+	if !f.browseZip || !isRead(r) || !f.onDisk() {
+		return nil
+	}
+	if statErr == nil {
+		if !isZipFile(osPath, info) || r.URL.Query().Get(browseKey) != browseValue && !strings.HasSuffix(r.URL.Path, "/") {
+			return nil
+		}
+		return &zipTarget{archive: osPath, info: info}
+	}
+	// the nearest parent that exists decides
+	for dir := filepath.Dir(osPath); len(dir) >= len(f.path); dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			continue
+		}
+		if !isZipFile(dir, info) || !f.contains(dir) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, osPath)
+		if err != nil {
+			return nil
+		}
+		return &zipTarget{archive: dir, info: info, name: filepath.ToSlash(rel)}
+	}
+	return nil
+}
+
+func isZipFile(osPath string, info os.FileInfo) bool {
+	return info.Mode().IsRegular() && strings.EqualFold(filepath.Ext(osPath), zipExt)
+}
+
+// zipArchive is an open zip file with its entries by name, in use by
+// readers requests.
+type zipArchive struct {
+	key    string
+	file   *os.File
+	reader *zipper.Reader
+	files  map[string]*zipper.File
+
+	// the fields below are guarded by the cache's mutex
+	lastUsed time.Time
+	readers  int
+}
+
+// zipCache keeps the zip files read recently open, keyed by their path,
+// modification time and size so that a changed file is read again. The
+// least recently used ones are closed once there are more than
+// zipCacheSize, except while they are in use.
+type zipCache struct {
+	mu      sync.Mutex
+	entries map[string]*zipArchive
+}
+
+var zips = &zipCache{entries: make(map[string]*zipArchive)}
+
+// open returns the zip file osPath, in the state info, marked as in use
+// until release.
+func (c *zipCache) open(osPath string, info os.FileInfo) (*zipArchive, error) {
+	key := fmt.Sprintf("%s\x00%d\x00%d", osPath, info.ModTime().UnixNano(), info.Size())
+	if a := c.acquire(key, nil); a != nil {
+		return a, nil
+	}
+	// the central directory is read without holding up other zip files
+	file, err := os.Open(osPath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := zipper.NewReader(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	a := &zipArchive{key: key, file: file, reader: reader, files: make(map[string]*zipper.File, len(reader.File))}
+	for _, zf := range reader.File {
+		a.files[strings.TrimSuffix(zf.Name, "/")] = zf
+	}
+	return c.acquire(key, a), nil
+}
+
+// acquire marks the archive for key as in use, adding a unless another
+// request added it first. Without a, it returns nil if there is none.
+func (c *zipCache) acquire(key string, a *zipArchive) *zipArchive {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.entries[key]; ok {
+		if a != nil {
+			a.file.Close()
+		}
+		a = cached
+	} else if a != nil {
+		c.entries[key] = a
+		c.evict()
+	} else {
+		return nil
+	}
+	a.readers++
+	a.lastUsed = time.Now()
+	return a
+}
+
+func (c *zipCache) release(a *zipArchive) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a.readers--
+	c.evict()
+}
+
+// evict closes the least recently used archives not in use until the cache
+// fits zipCacheSize. c.mu must be held.
+func (c *zipCache) evict() {
+	for len(c.entries) > zipCacheSize {
+		var oldest *zipArchive
+		for _, a := range c.entries {
+			if a.readers > 0 {
+				continue
+			}
+			if oldest == nil || a.lastUsed.Before(oldest.lastUsed) {
+				oldest = a
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		oldest.file.Close()
+		delete(c.entries, oldest.key)
+	}
+}
+
+// zipEntryReader seeks in a compressed zip entry, for ranges, by reading it
+// again from the start when going back and skipping forward to the offset.
+type zipEntryReader struct {
+	file   *zipper.File
+	rc     io.ReadCloser
+	pos    int64
+	offset int64
+}
+
+func (z *zipEntryReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += z.offset
+	case io.SeekEnd:
+		offset += int64(z.file.UncompressedSize64)
+	}
+	if offset < 0 {
+		return 0, errors.New("zip entry: negative position")
+	}
+	z.offset = offset
+	return offset, nil
+}
+
+func (z *zipEntryReader) Read(p []byte) (int, error) {
+	if z.rc != nil && z.offset < z.pos {
+		z.rc.Close()
+		z.rc = nil
+	}
+	if z.rc == nil {
+		rc, err := z.file.Open()
+		if err != nil {
+			return 0, err
+		}
+		z.rc, z.pos = rc, 0
+	}
+	if z.pos < z.offset {
+		n, err := io.CopyN(io.Discard, z.rc, z.offset-z.pos)
+		z.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := z.rc.Read(p)
+	z.pos += int64(n)
+	z.offset = z.pos
+	return n, err
+}
+
+func (z *zipEntryReader) Close() error {
+	if z.rc == nil {
+		return nil
+	}
+	return z.rc.Close()
+}
+
+// serveInZip answers a read of a name inside a zip file: an entry is served
+// like a file, with ranges, and a directory, including those only implied by
+// the names below them, is listed. Names hidden from listings stay hidden.
+func (f *fileHandler) serveInZip(w http.ResponseWriter, r *http.Request, target *zipTarget) error {
+	archive, name, info := target.archive, target.name, target.info
+	a, err := zips.open(archive, info)
+	if errors.Is(err, zipper.ErrFormat) {
+		return f.serveStatusMessage(w, r, http.StatusNotFound, "not a valid zip file")
+	}
+	if err != nil {
+		return err
+	}
+	defer zips.release(a)
+	isDir := name == ""
+	if !isDir {
+		entry, err := fs.Stat(a.reader, name)
+		if err != nil {
+			return f.serveStatus(w, r, http.StatusNotFound)
+		}
+		isDir = entry.IsDir()
+	}
+	if isDir != strings.HasSuffix(r.URL.Path, "/") {
+		f.redirectToCanonical(w, r, isDir)
+		return nil
+	}
+	if !isDir {
+		zf, ok := a.files[name]
+		if !ok {
+			return f.serveStatus(w, r, http.StatusNotFound)
+		}
+		return f.serveZipEntry(w, r, archive, a, zf, info)
+	}
+	gw, done := gzipWriter(w, r)
+	if err := f.serveZipDir(gw, r, archive, a, name, info); err != nil {
+		return err
+	}
+	return done()
+}
+
+// serveZipEntry serves the zip entry zf of archive. Stored entries are read
+// in place; compressed ones are inflated, skipping up to a range.
+func (f *fileHandler) serveZipEntry(w http.ResponseWriter, r *http.Request, archive string, a *zipArchive, zf *zipper.File, info os.FileInfo) error {
+	var content io.ReadSeeker
+	if offset, err := zf.DataOffset(); err == nil && zf.Method == zipper.Store {
+		content = io.NewSectionReader(a.file, offset, int64(zf.CompressedSize64))
+	} else {
+		entry := &zipEntryReader{file: zf}
+		defer entry.Close()
+		content = entry
+	}
+	name := path.Base(zf.Name)
+	osPath := filepath.Join(archive, filepath.FromSlash(zf.Name))
+	if f.defaultType != "" && mime.TypeByExtension(filepath.Ext(name)) == "" {
+		w.Header().Set("Content-Type", f.defaultType)
+	}
+	// the entry changes only with the zip file, and its checksum tells
+	// entries apart
+	w.Header().Set("ETag", fmt.Sprintf(`%s-%x"`, strings.TrimSuffix(fileETag(info), `"`), zf.CRC32))
+	f.setDisposition(w, r, osPath)
+	f.setUserContentHeaders(w, name)
+	http.ServeContent(w, r, name, zf.Modified, content)
+	return nil
+}
+
+// serveZipDir lists the directory name of the zip file archive as serveDir
+// lists one on disk, with nothing to change.
+func (f *fileHandler) serveZipDir(w http.ResponseWriter, r *http.Request, archive string, a *zipArchive, name string, info os.FileInfo) error {
+	dirName := name
+	if dirName == "" {
+		dirName = "."
+	}
+	entries, err := fs.ReadDir(a.reader, strings.TrimSuffix(dirName, "/"))
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if f.hidden(entry.Name()) {
+			continue
+		}
+		if entryInfo, err := entry.Info(); err == nil {
+			files = append(files, entryInfo)
+		}
+	}
+	listingSort := parseListingSort(r.URL.RawQuery)
+	listingSort.Lexical = f.lexicalSort
+	sortFiles(files, listingSort)
+	asJSON := wantsJSON(r)
+	asText := !asJSON && f.wantsText(r)
+	base := withoutToken(f.prefix.url(r, r.URL))
+	page := f.parsePage(r, base, len(files))
+	listed := page.window(files)
+	osPath := filepath.Join(archive, filepath.FromSlash(name))
+	variant := fmt.Sprintf("json=%t;text=%t;query=%s;total=%d", asJSON, asText, r.URL.RawQuery, page.Total)
+	w.Header().Add("Vary", "Accept")
+	if f.cliText {
+		w.Header().Add("Vary", "User-Agent")
+	}
+	etag, modTime := listingValidators(osPath, info, listed, variant)
+	if checkNotModified(w, r, etag, modTime) {
+		return nil
+	}
+	if asJSON || asText {
+		page.setHeaders(w)
+	}
+	switch {
+	case asJSON:
+		w.Header().Set("Content-Type", jsonContentType)
+	case asText:
+		w.Header().Set("Content-Type", textContentType+"; charset=utf-8")
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		f.setPageHeaders(w)
+	}
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	breadcrumbs := f.breadcrumbs(r, osPath)
+	data := directoryListingData{
+		Static:      f.prefix.path(r, "/static"),
+		Breadcrumbs: breadcrumbs,
+		ParentDir:   breadcrumbs[len(breadcrumbs)-2].URL,
+		Gallery:     r.URL.Query().Get(viewKey) == viewGallery,
+		Page:        page,
+		Sort:        listingSort,
+		Title: func() string {
+			relPath, _ := filepath.Rel(f.path, osPath)
+			return filepath.Join(filepath.Base(f.path), relPath)
+		}(),
+		// the forms submit to the directory itself, the archive links
+		// hidden as nothing is archived from here
+		UploadURL: &url.URL{Path: base.Path, RawPath: base.RawPath},
+		ZipURL:    withQuery(base, zipKey, zipValue),
+		TarURL:    withQuery(base, tarKey, tarValue),
+		TarGzURL:  withQuery(base, tarGzKey, tarGzValue),
+		Files:     f.listingFiles(r, base, listed),
+	}
+	if asJSON {
+		if data.Files == nil {
+			data.Files = []directoryListingFileData{}
+		}
+		return serveJSON(w, data.Files)
+	}
+	if asText {
+		return serveTextListing(w, data.Files)
+	}
+	return f.listingTemplate.Execute(w, data)
+}
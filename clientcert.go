@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// certNames is the -client-cert-cn flag: the client certificates let in, by
+// their common name or any of their subject alternative names.
+type certNames struct {
+	Values []string
+}
+
+func (fv *certNames) help() string {
+	return "let in only client certificates whose common name or a subject alternative name (DNS name, email address, URI or IP address) is NAME (repeatable)"
+}
+
+// Set is flag.Value.Set
+func (fv *certNames) Set(v string) error {
+	if v = strings.TrimSpace(v); v == "" {
+		return errors.New("empty name")
+	}
+	fv.Values = append(fv.Values, v)
+	return nil
+}
+
+func (fv *certNames) String() string {
+	return strings.Join(fv.Values, ", ")
+}
+
+// match reports whether cert has one of the names.
+func (fv *certNames) match(cert *x509.Certificate) bool {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, name := range names {
+		for _, v := range fv.Values {
+			if name != "" && strings.EqualFold(name, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exemptPaths is the -client-cert-exempt flag: URL paths served without a
+// client certificate on the -plain-addr listeners, such as /healthz. A path
+// ending in a slash takes in everything below it.
+type exemptPaths struct {
+	Values []string
+}
+
+func (fv *exemptPaths) help() string {
+	return "serve the URL path PATH, and everything below it if it ends in a slash, without a client certificate on the -plain-addr addresses (repeatable)"
+}
+
+// Set is flag.Value.Set
+func (fv *exemptPaths) Set(v string) error {
+	if !strings.HasPrefix(v, "/") {
+		v = "/" + v
+	}
+	fv.Values = append(fv.Values, v)
+	return nil
+}
+
+func (fv *exemptPaths) String() string {
+	return strings.Join(fv.Values, ", ")
+}
+
+// match reports whether urlPath is one of the paths or below one of them.
+// Paths with dot segments match nothing, so that they cannot lead out.
+func (fv *exemptPaths) match(urlPath string) bool {
+	clean := path.Clean(urlPath)
+	if strings.HasSuffix(urlPath, "/") && clean != "/" {
+		clean += "/"
+	}
+	if clean != urlPath {
+		return false
+	}
+	for _, v := range fv.Values {
+		if urlPath == v || strings.HasSuffix(v, "/") && strings.HasPrefix(urlPath, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// validClientCert checks the client certificate flags before anything is
+// bound.
+func validClientCert() error {
+	tlsEnabled := sslCertificate != "" || tlsSelfSignedFlag || letsEncryptFlag
+	switch {
+	case clientCAFlag != "" && !tlsEnabled:
+		return errors.New("-client-ca needs TLS: give -ssl-cert/-ssl-key, -tls-self-signed or -letsencrypt")
+	case len(clientCertCNFlag.Values) > 0 && clientCAFlag == "":
+		return errors.New("-client-cert-cn needs -client-ca")
+	case len(plainAddrFlag.Values) > 0 && len(clientExemptFlag.Values) == 0:
+		return errors.New("-plain-addr serves only the -client-cert-exempt paths: give some")
+	case len(clientExemptFlag.Values) > 0 && len(plainAddrFlag.Values) == 0:
+		return errors.New("-client-cert-exempt paths are served on -plain-addr: give an address")
+	}
+	return nil
+}
+
+// withClientCA makes config require of every client a certificate signed by
+// a CA of the PEM file caFile, rejecting the connections without one in the
+// handshake. The tls-alpn-01 validations of -letsencrypt are let through, as
+// the CA has no such certificate.
+func withClientCA(config *tls.Config, caFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates", caFile)
+	}
+	challenges := config.Clone()
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if isACMEChallenge(hello) {
+			return challenges, nil
+		}
+		return nil, nil
+	}
+	return config, nil
+}
+
+// certSubject returns the name of the verified client certificate of r: its
+// common name, or else its first subject alternative name. It is "" for
+// requests without one.
+func certSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.IPAddresses) > 0:
+		return cert.IPAddresses[0].String()
+	}
+	return ""
+}
+
+// clientCertHandler refuses the requests whose client certificate has none
+// of the -client-cert-cn names, or with writesOnly only those that change
+// something. Requests without TLS come from -plain-addr, which has checked
+// that they are for the exempt paths.
+type clientCertHandler struct {
+	handler    http.Handler
+	names      *certNames
+	writesOnly bool
+}
+
+// ServeHTTP is http.Handler.ServeHTTP
+func (h *clientCertHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil && (!h.writesOnly || !csrfSafeMethods[r.Method]) {
+		if len(r.TLS.VerifiedChains) == 0 || !h.names.match(r.TLS.VerifiedChains[0][0]) {
+			http.Error(w, "client certificate not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// exemptHandler serves the -client-cert-exempt paths on the -plain-addr
+// listeners and refuses any other.
+type exemptHandler struct {
+	handler http.Handler
+	paths   *exemptPaths
+}
+
+// ServeHTTP is http.Handler.ServeHTTP
+func (h *exemptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.paths.match(r.URL.Path) {
+		http.Error(w, "a client certificate is required: connect over HTTPS", http.StatusForbidden)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultCompressTypes   = "text/*,application/json,application/javascript,application/xml,image/svg+xml"
+	defaultCompressMinSize = 1 << 10
+)
+
+// incompressibleTypes are never compressed by -compress whatever
+// -compress-types says, since their content already is.
+var incompressibleTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/vnd.rar",
+	"audio/*",
+	"video/*",
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"font/woff",
+	"font/woff2",
+}
+
+// fileCompression is the -compress setting: files of at least minSize bytes
+// whose Content-Type matches one of types are sent gzipped to clients that
+// accept it. A type ending in /* matches all of its subtypes.
+type fileCompression struct {
+	types   []string
+	minSize int64
+}
+
+func newFileCompression(types string, minSize int64) *fileCompression {
+	c := &fileCompression{minSize: minSize}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			c.types = append(c.types, t)
+		}
+	}
+	return c
+}
+
+// matchesMIMEType reports whether contentType, with or without parameters,
+// is one of types.
+func matchesMIMEType(types []string, contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mediaType, prefix) || t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// compresses reports whether the file at osPath is to be sent compressed to
+// clients that accept it.
+func (f *fileHandler) compresses(osPath string) bool {
+	c := f.compression
+	if c == nil {
+		return false
+	}
+	info, err := f.storage.Stat(f.storageName(osPath))
+	if err != nil || !info.Mode().IsRegular() || info.Size() < c.minSize {
+		return false
+	}
+	contentType, err := f.contentTypeOf(osPath)
+	if err != nil {
+		return false
+	}
+	return !matchesMIMEType(incompressibleTypes, contentType) && matchesMIMEType(c.types, contentType)
+}
+
+// serveCompressed serves the file at osPath gzipped if -compress applies to
+// it and r accepts gzip, and reports whether it did. Range requests get the
+// file as it is, so that resumed downloads of it keep working.
+func (f *fileHandler) serveCompressed(w http.ResponseWriter, r *http.Request, osPath string) bool {
+	if !f.compresses(osPath) {
+		return false
+	}
+	if r.Header.Get("Range") != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		return false
+	}
+	gw, done := gzipWriter(w, r)
+	f.setUserContentHeaders(w, filepath.Base(osPath))
+	http.ServeFileFS(gw, r, f.storage, f.storageName(osPath))
+	_ = done()
+	return true
+}
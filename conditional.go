@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// listingValidators computes a weak ETag and a Last-Modified time for a
+// generated listing of the directory dir with the given (sorted) entries.
+// variant distinguishes representations of the same directory, such as HTML
+// and JSON or different sort orders. The modification time is the latest of
+// the directory's and its entries', since editing a file in place does not
+// touch the directory's own mtime.
+func listingValidators(osPath string, dir os.FileInfo, files []os.FileInfo, variant string) (string, time.Time) {
+	h := sha256.New()
+	modTime := dir.ModTime()
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00", osPath, dir.ModTime().UnixNano(), variant)
+	for _, file := range files {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", file.Name(), file.Size(), file.ModTime().UnixNano())
+		if file.ModTime().After(modTime) {
+			modTime = file.ModTime()
+		}
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, modTime
+}
+
+// checkNotModified sets the ETag and Last-Modified headers and, if the
+// request's If-None-Match or If-Modified-Since precondition shows the client's
+// copy is current, answers 304 and returns true.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notModified = etagMatches(inm, etag)
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.IsZero() {
+		notModified = !modTime.Truncate(time.Second).After(ims)
+	}
+	if notModified {
+		h := w.Header()
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// fileETag is the strong ETag of the file described by info, made of its
+// modification time and size. Files are served with it, and If-Match on a
+// DELETE or overwrite is checked against it.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// preconditionFailed reports whether r's If-Match or, without one, its
+// If-Unmodified-Since precondition fails for the file described by info,
+// nil if there is none, so that a DELETE or overwrite must not happen. Like
+// http.ServeContent, If-Match uses the strong comparison function and fails
+// without a file even for "*".
+func preconditionFailed(r *http.Request, info os.FileInfo) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		return info == nil || !etagMatchesStrong(im, fileETag(info))
+	}
+	ius, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+	if err != nil || info == nil {
+		return false
+	}
+	return info.ModTime().Truncate(time.Second).After(ius)
+}
+
+// etagMatchesStrong reports whether the If-Match header value list matches
+// etag using the strong comparison function: weak tags never match.
+func etagMatchesStrong(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether the If-None-Match header value list matches
+// etag using the weak comparison function.
+func etagMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
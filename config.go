@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// routeConfig holds the settings that may differ between routes.
+type routeConfig struct {
+	// Host is the virtual host the route is served for, "" for any other
+	Host        string
+	Route       string
+	Path        string
+	AllowUpload bool
+	AllowDelete bool
+	ShowHidden  bool
+	Hide        []string
+	NoListing   bool
+	Download    bool
+	Index       bool
+	SPA         bool
+	OnConflict  string
+	// Dropbox takes uploads but lists and serves nothing
+	Dropbox bool
+	// Auth is nil when the route needs no authentication
+	Auth *credentials
+}
+
+// defaultRouteConfig applies the command-line flags to route.
+func defaultRouteConfig(route, path string) routeConfig {
+	rc := routeConfig{
+		Route:       route,
+		Path:        path,
+		AllowUpload: allowUploadsFlag,
+		AllowDelete: allowDeletesFlag,
+		ShowHidden:  showHiddenFlag,
+		Hide:        hideFlag.Values,
+		NoListing:   noListingFlag.enabled(route),
+		Download:    forceDownloadFlag.enabled(route),
+		Index:       indexFlag,
+		SPA:         spaFlag,
+		OnConflict:  onConflictFlag,
+		Dropbox:     dropboxFlag.enabled(route),
+	}
+	if len(authFlag.Values) > 0 {
+		rc.Auth = &authFlag
+	}
+	return rc
+}
+
+// routeConfigs returns the routes to serve: those of the -config file if one
+// is given, else the routes from the command line, then those of the -vhost
+// flags. The current directory is served only when neither gives any.
+func routeConfigs(routes routes, vhosts vhosts) ([]routeConfig, error) {
+	var out []routeConfig
+	if configFlag == "" {
+		if len(routes.Values) == 0 && len(vhosts.Values) == 0 {
+			_ = routes.Set(".")
+		}
+		for _, route := range routes.Values {
+			out = append(out, defaultRouteConfig(route.Route, route.Path))
+		}
+	} else {
+		if len(routes.Values) > 0 {
+			return nil, fmt.Errorf("routes are given both on the command line and in %s", configFlag)
+		}
+		var err error
+		if out, err = loadConfig(configFlag); err != nil {
+			return nil, err
+		}
+	}
+	for _, vhost := range vhosts.Values {
+		for _, rc := range out {
+			if rc.Host == vhost.Host && rc.Route == rootRoute {
+				return nil, fmt.Errorf("host %q is given both by -vhost and in %s", vhost.Host, configFlag)
+			}
+		}
+		rc := defaultRouteConfig(rootRoute, vhost.Path)
+		rc.Host = vhost.Host
+		rc.AllowUpload = rc.AllowUpload || vhost.AllowUpload
+		rc.AllowDelete = rc.AllowDelete || vhost.AllowDelete
+		if info, err := os.Stat(rc.Path); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", rc.Path)
+		}
+		out = append(out, rc)
+	}
+	for i := range out {
+		out[i].applyDropbox()
+	}
+	return out, nil
+}
+
+// applyDropbox makes a drop box route take uploads and nothing else,
+// whatever the other settings say.
+func (rc *routeConfig) applyDropbox() {
+	if rc.Dropbox {
+		rc.AllowUpload = true
+		rc.AllowDelete = false
+		rc.Index = false
+		rc.SPA = false
+		rc.NoListing = false
+	}
+}
+
+// loadConfig reads a YAML file of the form
+//
+//	routes:
+//	  - route: /public/
+//	    path: /srv/public
+//	  - host: downloads.example.com
+//	    path: /srv/downloads
+//	  - route: /inbox/
+//	    path: /srv/inbox
+//	    uploads: true
+//	    deletes: false
+//	    conflict: rename
+//	    hidden: false
+//	    hide: ["*.tmp"]
+//	    listing: true
+//	    download: false
+//	    index: false
+//	    spa: false
+//	    dropbox: false
+//	    auth: ["alice:secret"]
+//
+// Settings left out of an entry default to the command-line flags. An entry
+// with a host, which may be *.domain for its subdomains, is served only for
+// requests to it, at / unless a route is given. Every path must be an
+// existing directory and no two entries may claim the same route of a host.
+func loadConfig(path string) ([]routeConfig, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseYAML(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	top, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a mapping with a routes key", path)
+	}
+	for key := range top {
+		if key != "routes" {
+			return nil, fmt.Errorf("%s: unknown key %q", path, key)
+		}
+	}
+	entries, ok := top["routes"].([]any)
+	if !ok || len(entries) == 0 {
+		return nil, fmt.Errorf("%s: routes must be a non-empty list", path)
+	}
+	var out []routeConfig
+	seen := make(map[string]int)
+	for i, entry := range entries {
+		rc, err := parseRouteConfig(entry, filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: route %d: %v", path, i+1, err)
+		}
+		if rc.Route == "/static/" {
+			return nil, fmt.Errorf("%s: route %d: /static/ is reserved for the listing's assets", path, i+1)
+		}
+		if j, dup := seen[rc.Host+rc.Route]; dup {
+			return nil, fmt.Errorf("%s: routes %d and %d both serve %q", path, j+1, i+1, rc.Host+rc.Route)
+		}
+		seen[rc.Host+rc.Route] = i
+		out = append(out, rc)
+	}
+	return out, nil
+}
+
+func parseRouteConfig(entry any, baseDir string) (routeConfig, error) {
+	m, ok := entry.(map[string]any)
+	if !ok {
+		return routeConfig{}, fmt.Errorf("expected a mapping")
+	}
+	str := func(key string) (string, error) {
+		v, ok := m[key].(string)
+		if !ok {
+			return "", fmt.Errorf("%s must be a string", key)
+		}
+		return v, nil
+	}
+	dir, err := str("path")
+	if err != nil {
+		return routeConfig{}, err
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(baseDir, dir)
+	}
+	var host string
+	if _, ok := m["host"]; ok {
+		s, err := str("host")
+		if err != nil {
+			return routeConfig{}, err
+		}
+		if host, err = vhostPattern(s); err != nil {
+			return routeConfig{}, err
+		}
+	}
+	var r routes
+	spec := dir
+	if host != "" {
+		spec = rootRoute + "=" + dir
+	}
+	if _, ok := m["route"]; ok {
+		route, err := str("route")
+		if err != nil {
+			return routeConfig{}, err
+		}
+		spec = route + "=" + dir
+	}
+	if err := r.Set(spec); err != nil {
+		return routeConfig{}, err
+	}
+	rc := defaultRouteConfig(r.Values[0].Route, r.Values[0].Path)
+	rc.Host = host
+	if info, err := os.Stat(rc.Path); err != nil {
+		return routeConfig{}, err
+	} else if !info.IsDir() {
+		return routeConfig{}, fmt.Errorf("%s is not a directory", rc.Path)
+	}
+	for key, v := range m {
+		switch key {
+		case "host", "route", "path":
+		case "uploads", "deletes", "hidden", "listing", "download", "index", "spa", "dropbox":
+			b, err := yamlBool(key, v)
+			if err != nil {
+				return routeConfig{}, err
+			}
+			switch key {
+			case "uploads":
+				rc.AllowUpload = b
+			case "deletes":
+				rc.AllowDelete = b
+			case "hidden":
+				rc.ShowHidden = b
+			case "listing":
+				rc.NoListing = !b
+			case "download":
+				rc.Download = b
+			case "index":
+				rc.Index = b
+			case "spa":
+				rc.SPA = b
+			case "dropbox":
+				rc.Dropbox = b
+			}
+		case "conflict":
+			s, _ := v.(string)
+			if err := validOnConflict(s); err != nil {
+				return routeConfig{}, fmt.Errorf("conflict: %v", err)
+			}
+			rc.OnConflict = s
+		case "hide":
+			values, err := yamlStrings(key, v)
+			if err != nil {
+				return routeConfig{}, err
+			}
+			var p patterns
+			for _, v := range values {
+				if err := p.Set(v); err != nil {
+					return routeConfig{}, fmt.Errorf("hide: %v", err)
+				}
+			}
+			rc.Hide = p.Values
+		case "auth":
+			values, err := yamlStrings(key, v)
+			if err != nil {
+				return routeConfig{}, err
+			}
+			c := &credentials{}
+			for _, v := range values {
+				if err := c.Set(v); err != nil {
+					return routeConfig{}, fmt.Errorf("auth: %v", err)
+				}
+			}
+			rc.Auth = c
+			if len(c.Values) == 0 {
+				rc.Auth = nil
+			}
+		default:
+			return routeConfig{}, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return rc, nil
+}
+
+func yamlBool(key string, v any) (bool, error) {
+	s, _ := v.(string)
+	switch strings.ToLower(s) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s must be true or false", key)
+}
+
+// yamlStrings accepts a list of strings or a single string.
+func yamlStrings(key string, v any) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		return []string{v}, nil
+	case []any:
+		var out []string
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of strings", key)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a list of strings", key)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What a form upload does when a file of the same name exists.
+const (
+	onConflictReject    = "reject"
+	onConflictRename    = "rename"
+	onConflictOverwrite = "overwrite"
+
+	// conflictKey overrides the route's policy per request, as a query
+	// parameter or as a form field before the files
+	conflictKey = "conflict"
+
+	// maxConflictRenames bounds the search for a free "name (n).ext"
+	maxConflictRenames = 10000
+)
+
+var (
+	errUploadExists = errors.New("file already exists")
+	// errUploadModified refuses to overwrite a file that an If-Match or
+	// If-Unmodified-Since precondition shows has changed
+	errUploadModified = errors.New("file was modified")
+)
+
+func validOnConflict(policy string) error {
+	switch policy {
+	case onConflictReject, onConflictRename, onConflictOverwrite:
+		return nil
+	}
+	return fmt.Errorf("%q is none of %q, %q and %q", policy, onConflictReject, onConflictRename, onConflictOverwrite)
+}
+
+// placeUpload moves the complete temporary file tmp, a name in f.storage, to
+// outPath following policy and returns the path it ended up at. Without
+// overwrite, the file is linked into place, which atomically fails if
+// outPath was taken meanwhile.
+func (f *fileHandler) placeUpload(tmp, outPath, policy string) (string, error) {
+	switch policy {
+	case onConflictOverwrite:
+		return outPath, f.storage.Rename(tmp, f.storageName(outPath))
+	case onConflictRename:
+		for i := 0; i < maxConflictRenames; i++ {
+			candidate := conflictName(outPath, i)
+			err := f.linkNew(tmp, f.storageName(candidate))
+			if !errors.Is(err, errUploadExists) {
+				return candidate, err
+			}
+		}
+		return "", errUploadExists
+	}
+	return outPath, f.linkNew(tmp, f.storageName(outPath))
+}
+
+// linkNew creates dst as a hard link to src, names in f.storage, or returns
+// errUploadExists. Storages and file systems without hard links fall back
+// to a check and a rename.
+func (f *fileHandler) linkNew(src, dst string) error {
+	if linker, ok := f.storage.(storageLinker); ok {
+		err := linker.Link(src, dst)
+		switch {
+		case err == nil:
+			return nil
+		case os.IsExist(err):
+			return errUploadExists
+		}
+	}
+	if _, err := f.storage.Lstat(dst); err == nil {
+		return errUploadExists
+	}
+	return f.storage.Rename(src, dst)
+}
+
+// conflictName returns outPath for i == 0, else outPath with " (i)" inserted
+// before its extension.
+func conflictName(outPath string, i int) string {
+	if i == 0 {
+		return outPath
+	}
+	ext := filepath.Ext(outPath)
+	if strings.HasSuffix(strings.ToLower(outPath), ".tar.gz") {
+		ext = outPath[len(outPath)-len(".tar.gz"):]
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(outPath, ext), i, ext)
+}
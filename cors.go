@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAnyOrigin = "*"
+
+	corsAllowMethods  = "GET, HEAD, POST, PUT, DELETE, MKCOL, OPTIONS"
+	corsAllowHeaders  = "Accept, Authorization, Content-Type, Depth, Destination, If-Match, If-Unmodified-Since, Overwrite, X-Requested-With"
+	corsExposeHeaders = "Content-Disposition, Content-Length, ETag, Last-Modified, Location"
+	corsMaxAge        = "600"
+)
+
+type origins struct {
+	Values []string
+}
+
+func (fv *origins) help() string {
+	return "allow cross-origin requests from ORIGIN, e.g. https://app.example.com, or * for any (repeatable)"
+}
+
+// Set is flag.Value.Set
+func (fv *origins) Set(v string) error {
+	fv.Values = append(fv.Values, strings.TrimSuffix(v, "/"))
+	return nil
+}
+
+func (fv *origins) String() string {
+	return strings.Join(fv.Values, ", ")
+}
+
+// allow reports whether requests from origin are allowed, and whether they
+// may carry credentials, which is only the case for origins listed by name.
+func (fv *origins) allow(origin string) (allowed, credentials bool) {
+	for _, o := range fv.Values {
+		if strings.EqualFold(o, origin) {
+			return true, true
+		}
+		if o == corsAnyOrigin {
+			allowed = true
+		}
+	}
+	return allowed, false
+}
+
+// corsHandler adds CORS headers for the allowed origins and answers their
+// preflight requests itself, before authentication, since browsers send
+// preflights without credentials.
+type corsHandler struct {
+	handler http.Handler
+	origins *origins
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	allowed, credentials := h.origins.allow(origin)
+	if !allowed {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	if credentials {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", corsAnyOrigin)
+	}
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	h.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookieName = "hfs_csrf"
+	csrfFieldName  = "csrf"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// csrfSafeMethods never change anything and need no token.
+var csrfSafeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	methodPropfind:     true,
+}
+
+// csrfToken returns the token of the client's session, issuing a new cookie
+// if it has none yet.
+func (f *fileHandler) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookieName); err == nil && len(c.Value) == 64 {
+		return c.Value
+	}
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	token := hex.EncodeToString(b[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// csrfRequired reports whether r changes state on behalf of a browser and so
+// must carry the session's token. Requests without any of the headers
+// browsers send (curl, scripts) and requests from origins allowed by name
+// with -cors-origin are exempt.
+func (f *fileHandler) csrfRequired(r *http.Request) bool {
+	if !f.csrf || csrfSafeMethods[r.Method] {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" && r.Header.Get("Referer") == "" && r.Header.Get("Sec-Fetch-Site") == "" && r.Header.Get("Cookie") == "" {
+		return false
+	}
+	if origin != "" && f.corsOrigins != nil {
+		if _, trusted := f.corsOrigins.allow(origin); trusted {
+			return false
+		}
+	}
+	return true
+}
+
+// csrfValid reports whether token matches the session cookie of r.
+func csrfValid(r *http.Request, token string) bool {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(token)) == 1
+}
+
+// csrfPrecheck validates the token of a request csrfRequired applies to from
+// its header or, for url-encoded forms, its csrf field. Multipart uploads
+// are let through and checked by serveUploadTo, which reads the field from
+// the stream before storing any file.
+func csrfPrecheck(r *http.Request) bool {
+	if csrfValid(r, r.Header.Get(csrfHeaderName)) {
+		return true
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.Method == http.MethodPost
+	}
+	if hasContentType(r, formContentType) {
+		if err := r.ParseForm(); err != nil {
+			return false
+		}
+		return csrfValid(r, r.PostForm.Get(csrfFieldName))
+	}
+	return false
+}
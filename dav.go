@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	methodPropfind  = "PROPFIND"
+	methodProppatch = "PROPPATCH"
+	methodMove      = "MOVE"
+	methodCopy      = "COPY"
+	methodLock      = "LOCK"
+	methodUnlock    = "UNLOCK"
+
+	davContentType = "application/xml; charset=utf-8"
+	davLockTimeout = "Second-3600"
+)
+
+func isDAVMethod(method string) bool {
+	switch method {
+	case http.MethodOptions, methodPropfind, methodProppatch, methodMove, methodCopy, methodLock, methodUnlock:
+		return true
+	}
+	return false
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName      string           `xml:"D:displayname,omitempty"`
+	ResourceType     *davResourceType `xml:"D:resourcetype,omitempty"`
+	GetContentLength *int64           `xml:"D:getcontentlength,omitempty"`
+	GetContentType   string           `xml:"D:getcontenttype,omitempty"`
+	GetLastModified  string           `xml:"D:getlastmodified,omitempty"`
+	GetETag          string           `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// serveDAV answers the WebDAV methods not already handled by ServeHTTP.
+// Writes are governed by allowUpload and allowDelete like their plain HTTP
+// counterparts.
+func (f *fileHandler) serveDAV(w http.ResponseWriter, r *http.Request, osPath string) error {
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		info, err := os.Stat(osPath)
+		f.setAllow(w, info, err)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case methodPropfind:
+		return f.servePropfind(w, r, osPath)
+	case methodProppatch:
+		if !f.allowUpload {
+			return f.serveStatus(w, r, http.StatusForbidden)
+		}
+		return serveMultistatus(w, []davResponse{{
+			Href:     f.prefix.path(r, r.URL.Path),
+			Propstat: davPropstat{Status: davStatus(http.StatusOK)},
+		}})
+	case methodMove:
+		if !f.allowUpload || !f.allowDelete {
+			return f.serveStatus(w, r, http.StatusForbidden)
+		}
+		return f.serveMoveOrCopy(w, r, osPath, moveTree)
+	case methodCopy:
+		if !f.allowUpload {
+			return f.serveStatus(w, r, http.StatusForbidden)
+		}
+		return f.serveMoveOrCopy(w, r, osPath, copyTree)
+	case methodLock:
+		if !f.allowUpload {
+			return f.serveStatus(w, r, http.StatusForbidden)
+		}
+		return f.serveLock(w, r)
+	case methodUnlock:
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return f.serveStatus(w, r, http.StatusMethodNotAllowed)
+}
+
+// servePropfind reports the live properties of osPath and, unless the Depth
+// header is 0, of its direct children. Depth infinity is treated as 1.
+func (f *fileHandler) servePropfind(w http.ResponseWriter, r *http.Request, osPath string) error {
+	info, err := os.Stat(osPath)
+	switch {
+	case os.IsNotExist(err):
+		return f.serveStatus(w, r, http.StatusNotFound)
+	case os.IsPermission(err):
+		return f.serveStatus(w, r, http.StatusForbidden)
+	case err != nil:
+		return err
+	}
+	responses := []davResponse{davResponseFor(f.prefix.of(r)+r.URL.Path, info)}
+	if info.IsDir() && r.Header.Get("Depth") != "0" {
+		files, err := f.readDir(osPath)
+		if err != nil {
+			return err
+		}
+		sortFiles(files, listingSort{Column: sortByName, Order: sortAscending})
+		for _, file := range files {
+			responses = append(responses, davResponseFor(path.Join(f.prefix.of(r)+r.URL.Path, file.Name()), file))
+		}
+	}
+	return serveMultistatus(w, responses)
+}
+
+func davResponseFor(urlPath string, info os.FileInfo) davResponse {
+	prop := davProp{
+		DisplayName:     info.Name(),
+		ResourceType:    &davResourceType{},
+		GetLastModified: info.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if info.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+		if !strings.HasSuffix(urlPath, "/") {
+			urlPath += "/"
+		}
+	} else {
+		size := info.Size()
+		prop.GetContentLength = &size
+		prop.GetContentType = mime.TypeByExtension(filepath.Ext(info.Name()))
+		prop.GetETag = fileETag(info)
+	}
+	return davResponse{
+		Href:     (&url.URL{Path: urlPath}).EscapedPath(),
+		Propstat: davPropstat{Prop: prop, Status: davStatus(http.StatusOK)},
+	}
+}
+
+func davStatus(status int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", status, http.StatusText(status))
+}
+
+func serveMultistatus(w http.ResponseWriter, responses []davResponse) error {
+	w.Header().Set("Content-Type", davContentType)
+	w.WriteHeader(http.StatusMultiStatus)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(davMultistatus{XMLNS: "DAV:", Responses: responses})
+}
+
+// serveMoveOrCopy applies op to osPath and the path named by the Destination
+// header, honouring the Overwrite header.
+func (f *fileHandler) serveMoveOrCopy(w http.ResponseWriter, r *http.Request, osPath string, op func(src, dst string) error) error {
+	if _, err := os.Stat(osPath); err != nil {
+		return f.serveStatus(w, r, http.StatusNotFound)
+	}
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || destination.Path == "" {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	dst := f.prefix.strip(r, destination.Path)
+	if !f.inRoute(dst) {
+		return f.serveStatus(w, r, http.StatusBadGateway)
+	}
+	return f.serveTransfer(w, r, osPath, dst, r.Header.Get("Overwrite") != "F", op)
+}
+
+// serveTransfer applies op to osPath and the file behind the URL path dst,
+// replacing an existing one only if overwrite is set. It answers 201 Created,
+// or 204 No Content if something was replaced.
+func (f *fileHandler) serveTransfer(w http.ResponseWriter, r *http.Request, osPath, dst string, overwrite bool, op func(src, dst string) error) error {
+	dstPath := f.osPath(dst)
+	if !f.contains(dstPath) || f.hiddenPath(dstPath) || dstPath == osPath || dstPath == f.path || strings.HasPrefix(dstPath, osPath+osPathSeparator) {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	if info, err := os.Stat(filepath.Dir(dstPath)); err != nil || !info.IsDir() {
+		return f.serveStatus(w, r, http.StatusConflict)
+	}
+	dstInfo, err := os.Stat(dstPath)
+	exists := err == nil
+	if policy, _, err := f.accessPolicy(dstPath, dstInfo); err != nil || policy.refusal(r) != 0 {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	if exists {
+		if !overwrite {
+			return f.serveStatus(w, r, http.StatusPreconditionFailed)
+		}
+		if dstInfo.IsDir() && f.refusedBelow(r, dstPath) {
+			return f.serveStatus(w, r, http.StatusForbidden)
+		}
+		if err := os.RemoveAll(dstPath); err != nil {
+			return err
+		}
+	}
+	if err := op(osPath, dstPath); err != nil {
+		return err
+	}
+	if info, err := os.Stat(dstPath); err == nil && info.IsDir() && !strings.HasSuffix(dst, "/") {
+		dst += "/"
+	}
+	action := webhookRename
+	if r.Method == methodCopy {
+		action = webhookCopy
+	}
+	f.notify(r, action, dst, r.URL.Path, dstPath)
+	w.Header().Set("Location", f.prefix.path(r, dst))
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// moveTree renames src to dst, copying and then removing src when they are on
+// different file systems.
+func moveTree(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies the file or directory tree src to dst.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.Mkdir(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// serveLock grants a fake exclusive write lock. Nothing is actually locked;
+// the response only exists so that clients which insist on locking before
+// writing (Finder, the Windows redirector) can proceed.
+func (f *fileHandler) serveLock(w http.ResponseWriter, r *http.Request) error {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	token := fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	if ifHeader := r.Header.Get("If"); ifHeader != "" && r.ContentLength == 0 {
+		// lock refresh: echo the submitted token back
+		if i, j := strings.Index(ifHeader, "<"), strings.Index(ifHeader, ">"); i >= 0 && j > i {
+			token = ifHeader[i+1 : j]
+		}
+	}
+	depth := r.Header.Get("Depth")
+	if depth == "" {
+		depth = "infinity"
+	}
+	w.Header().Set("Content-Type", davContentType)
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.WriteHeader(http.StatusOK)
+	_, err := fmt.Fprintf(w, `%s<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`+
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>%s</D:depth><D:timeout>%s</D:timeout>`+
+		`<D:locktoken><D:href>%s</D:href></D:locktoken>`+
+		`<D:lockroot><D:href>%s</D:href></D:lockroot>`+
+		`</D:activelock></D:lockdiscovery></D:prop>`,
+		xml.Header, xmlEscape(depth), davLockTimeout, xmlEscape(token), xmlEscape(f.prefix.path(r, r.URL.Path)))
+	return err
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
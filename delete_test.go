@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteControlOnlyWithAllowDelete(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	h := newTestHandler(t, "/", dir)
+	body := serveTest(h, http.MethodGet, "/", nil).Body.String()
+	for _, absent := range []string{`class="delete"`, methodOverrideKey, "listing.js", `class="rename"`} {
+		if strings.Contains(body, absent) {
+			t.Errorf("listing without allowDelete contains %q", absent)
+		}
+	}
+	h.allowDelete = true
+	body = serveTest(h, http.MethodGet, "/", nil).Body.String()
+	if got := strings.Count(body, `class="delete"`); got != 2 {
+		t.Errorf("%d delete controls, want one per file and directory", got)
+	}
+	for _, present := range []string{`name="_method" value="DELETE" data-name="a.txt"`, `data-name="sub/"`, "listing.js"} {
+		if !strings.Contains(body, present) {
+			t.Errorf("listing with allowDelete lacks %q", present)
+		}
+	}
+}
+
+func TestDeleteControlWithoutScript(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	h := newTestHandler(t, "/", dir)
+	h.allowDelete = true
+	w := serveTest(h, http.MethodPost, "/a.txt", strings.NewReader(methodOverrideKey+"=DELETE"), "Content-Type", "application/x-www-form-urlencoded")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Errorf("POST _method=DELETE: %d to %q, want a redirect to the listing", w.Code, w.Header().Get("Location"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+)
+
+const (
+	downloadKey   = "download"
+	downloadValue = "1"
+	inlineKey     = "inline"
+	inlineValue   = "1"
+)
+
+// setDisposition sends the file at osPath as an attachment for ?download=1,
+// or by default on a -force-download route unless ?inline=1 asks for it to be
+// shown. The -user-content policy still applies on top, so ?inline=1 never
+// lets active content render.
+func (f *fileHandler) setDisposition(w http.ResponseWriter, r *http.Request, osPath string) {
+	query := r.URL.Query()
+	name := filepath.Base(osPath)
+	switch {
+	case query.Get(downloadKey) == downloadValue:
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	case query.Get(inlineKey) == inlineValue:
+		w.Header().Set("Content-Disposition", contentDisposition("inline", name))
+	case f.forceDownload:
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition, name, want string
+	}{
+		{"attachment", "report.tar.gz", `attachment; filename="report.tar.gz"; filename*=UTF-8''report.tar.gz`},
+		{"attachment", "my file (1).zip", `attachment; filename="my file (1).zip"; filename*=UTF-8''my%20file%20%281%29.zip`},
+		{"attachment", "レポート.zip", `attachment; filename="____.zip"; filename*=UTF-8''%E3%83%AC%E3%83%9D%E3%83%BC%E3%83%88.zip`},
+		{"inline", "café.txt", `inline; filename="caf_.txt"; filename*=UTF-8''caf%C3%A9.txt`},
+		{"attachment", `say "hi" \ bye.txt`, `attachment; filename="say \"hi\" \\ bye.txt"; filename*=UTF-8''say%20%22hi%22%20%5C%20bye.txt`},
+		{"attachment", "tab\there;%.txt", `attachment; filename="tab_here;%.txt"; filename*=UTF-8''tab%09here%3B%25.txt`},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.disposition, tt.name); got != tt.want {
+			t.Errorf("contentDisposition(%q, %q) =\n%s\nwant\n%s", tt.disposition, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveContentDisposition(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"レポート/a.txt": "a", "plain/b.txt": "b"})
+	h := newTestHandler(t, "/", dir)
+	tests := []struct {
+		target, want string
+	}{
+		{"/レポート/?zip=1", `attachment; filename="____.zip"; filename*=UTF-8''%E3%83%AC%E3%83%9D%E3%83%BC%E3%83%88.zip`},
+		{"/レポート/?tar.gz=1", `attachment; filename="____.tar.gz"; filename*=UTF-8''%E3%83%AC%E3%83%9D%E3%83%BC%E3%83%88.tar.gz`},
+		{"/plain/?tar=1", `attachment; filename="plain.tar"; filename*=UTF-8''plain.tar`},
+		{"/plain/b.txt?download=1", `attachment; filename="b.txt"; filename*=UTF-8''b.txt`},
+	}
+	for _, tt := range tests {
+		w := serveTest(h, http.MethodGet, tt.target, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", tt.target, w.Code)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("GET %s: Content-Disposition\n%s\nwant\n%s", tt.target, got, tt.want)
+		}
+	}
+}
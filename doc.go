@@ -0,0 +1,72 @@
+/*
+Command http-file-server serves directory listings and files over HTTP, and
+can download whole directories as .zip, .tar.gz or .tar archives.
+
+# Listing templates
+
+The HTML directory listing can be replaced with -template FILE, an
+html/template executed with a value of the following shape:
+
+	.Title         string   the served path, e.g. "srv/sub"
+	.Breadcrumbs   []{Name string; URL *url.URL}, from the route root down
+	.ParentDir     *url.URL, nil at the route root
+	.Static        string, the path of the bundled assets: /static, preceded
+	               by the -base-url or X-Forwarded-Prefix path if any
+	.ZipURL        *url.URL of the directory as a zip (also the POST target
+	               for downloading a selection of entries)
+	.TarGzURL      *url.URL of the directory as a tar.gz
+	.TarURL        *url.URL of the directory as a tar
+	.AllowUpload   bool, whether uploads are enabled
+	.AllowDelete   bool, whether deletes are enabled
+	.AllowExtract  bool, whether uploaded archives may be unpacked
+	.AllowArchive  bool, whether .ZipURL, .TarGzURL and .TarURL may be
+	               downloaded (not with -no-archive)
+	.AllowShare    bool, whether share links can be made (-share-secret)
+	.OnConflict    string, what uploads do with existing files by default:
+	               "reject", "rename" or "overwrite"; a conflict form field
+	               before the files overrides it
+	.UploadURL     *url.URL to POST multipart uploads to
+	.Dropbox       bool, whether the route is a drop box: files are never listed
+	.Uploaded      int, the number of files a drop box upload just stored
+	.Search        string, the ?q= substring searched for
+	.Searched      bool, whether .Files are search results (?q=, ?glob= or
+	               ?regex=) from the whole tree below the directory
+	.Truncated     bool, whether the search stopped at its result or time limit
+	.Total         *{Size; Entries int; Truncated bool} of everything below the
+	               directory with ?du=true, else nil; .Total.String formats
+	               the size, prefixed with ≥ if the walk ran out of time
+	.CSRFToken     string, to send as the csrf field of every form that POSTs
+	               (before any file input); "" with -no-csrf
+	.Sort          {Column string; Order string} of the current listing
+	.NextSortOrder COLUMN  the O parameter for a header link of COLUMN (N, M or S)
+	.Gallery       bool, whether ?view=gallery asked for a thumbnail grid
+	.Page          {Offset, Limit, Total int; PrevURL, NextURL *url.URL} of the
+	               entries shown, with .Page.First and .Page.Last their 1-based
+	               positions; .Page.Paged reports whether there is more than
+	               one page and the URLs are nil at either end
+	.Readme        template.HTML, the rendered README.md of the directory, if any
+	.Files         []entry
+
+and each entry of .Files has:
+
+	.Name          string, with a trailing separator for directories; the
+	               slash-separated path below the directory for search results
+	.BaseName      string, the bare file name
+	.IsDir         bool
+	.Size          size in bytes; .Size.String formats it as 1.5K, 70M, ...
+	.LastModified  string, "2006-01-02 15:04:05"
+	.ModTime       time.Time
+	.Usage         like .Total, for a directory entry with ?du=true
+	.URL           *url.URL of the entry
+	.Icon          string, the path of the entry's file type icon below .Static
+	.Viewable      bool, whether the entry is a text file small enough to preview
+	.ViewURL       *url.URL of the entry's preview page (?view=1)
+	.ShareURL      *url.URL answering with a share link to the entry
+	.DeleteURL     *url.URL to DELETE the entry (recursively for directories),
+	               or to POST a form with _method=DELETE to
+	.IsImage       bool, whether the entry is a JPEG, PNG or GIF image
+	.ThumbURL      *url.URL of the entry's thumbnail (?thumb=256)
+
+The template is checked at startup by executing it against sample data.
+*/
+package main
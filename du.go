@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	duKey   = "du"
+	duValue = "true"
+
+	// duTimeout bounds all walks of one listing; sizes still missing then
+	// are shown as lower bounds
+	duTimeout = 5 * time.Second
+	// duCacheTTL limits how long a size is reused, since changes deep in a
+	// tree do not touch the directory's own modification time
+	duCacheTTL   = time.Minute
+	duCacheSize  = 4096
+	duLowerBound = "≥"
+)
+
+// dirUsage is the total size of the files below a directory and the number
+// of entries there. Truncated is set if the walk ran out of time, making
+// both lower bounds.
+type dirUsage struct {
+	Size      fileSizeBytes
+	Entries   int
+	Truncated bool
+}
+
+// String formats the size like the listing does, with ≥ if truncated.
+func (u dirUsage) String() string {
+	if u.Truncated {
+		return duLowerBound + u.Size.String()
+	}
+	return u.Size.String()
+}
+
+func (u *dirUsage) add(v dirUsage) {
+	u.Size += v.Size
+	u.Entries += v.Entries
+	u.Truncated = u.Truncated || v.Truncated
+}
+
+// usageCache remembers the usage of recently walked directories, keyed by
+// path and valid while the directory's modification time is unchanged and
+// for at most duCacheTTL.
+type usageCache struct {
+	mu      sync.Mutex
+	entries map[string]usageEntry
+}
+
+type usageEntry struct {
+	modTime time.Time
+	at      time.Time
+	usage   dirUsage
+}
+
+var usages = &usageCache{entries: make(map[string]usageEntry)}
+
+func (c *usageCache) get(osPath string, modTime time.Time) (dirUsage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[osPath]
+	if !ok || !e.modTime.Equal(modTime) || time.Since(e.at) > duCacheTTL {
+		return dirUsage{}, false
+	}
+	return e.usage, true
+}
+
+func (c *usageCache) put(osPath string, modTime time.Time, usage dirUsage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= duCacheSize {
+		for key, e := range c.entries {
+			if time.Since(e.at) > duCacheTTL || len(c.entries) >= duCacheSize {
+				delete(c.entries, key)
+			}
+		}
+	}
+	c.entries[osPath] = usageEntry{modTime: modTime, at: time.Now(), usage: usage}
+}
+
+// usageInfo is a directory entry whose Size is the recursive size of its
+// contents.
+type usageInfo struct {
+	os.FileInfo
+	usage dirUsage
+}
+
+func (u usageInfo) Size() int64 {
+	return int64(u.usage.Size)
+}
+
+// diskUsage replaces the directories among files, the entries of the
+// directory osPath, by usageInfo and returns the total usage of the listing.
+// Symlinks to directories are not followed and count as empty.
+func (f *fileHandler) diskUsage(ctx context.Context, osPath string, files []os.FileInfo) dirUsage {
+	ctx, cancel := context.WithTimeout(ctx, duTimeout)
+	defer cancel()
+	total := dirUsage{Entries: len(files)}
+	for i, file := range files {
+		if !file.IsDir() {
+			total.Size += fileSizeBytes(file.Size())
+			continue
+		}
+		p := filepath.Join(osPath, filepath.FromSlash(file.Name()))
+		var usage dirUsage
+		if info, err := f.storage.Lstat(f.storageName(p)); err == nil && info.IsDir() {
+			usage = f.dirUsage(ctx, p, file.ModTime())
+		}
+		files[i] = usageInfo{FileInfo: file, usage: usage}
+		total.add(usage)
+	}
+	return total
+}
+
+// dirUsage walks the directory osPath of f.storage, following it if it is a
+// symlink, counting the entries listings would show, unless the cache has a
+// complete result for it.
+func (f *fileHandler) dirUsage(ctx context.Context, osPath string, modTime time.Time) dirUsage {
+	if usage, ok := usages.get(osPath, modTime); ok {
+		return usage
+	}
+	var usage dirUsage
+	errStop := errors.New("stop")
+	root := f.storageName(osPath)
+	err := fs.WalkDir(f.storage, root, func(name string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return errStop
+		}
+		if name == root || err != nil {
+			return nil
+		}
+		p := filepath.Join(f.path, filepath.FromSlash(name))
+		if f.hiddenFile(p) || d.IsDir() && f.guarded(p) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		usage.Entries++
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				usage.Size += fileSizeBytes(info.Size())
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStop) {
+		usage.Truncated = true
+		return usage
+	}
+	usages.put(osPath, modTime, usage)
+	return usage
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const errorTemplateText = `
+<html>
+<head>
+	<title>{{ .Status }} {{ .StatusText }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<link rel="stylesheet" href="{{ .Static }}/layout/autoindex.css" type="text/css">
+</head>
+<body>
+<h1>{{ .Status }} {{ .StatusText }}</h1>
+{{- if ne .Message .StatusText }}
+<p>{{ .Message }}</p>
+{{- end }}
+<p><a href="{{ .RouteURL }}">Back to {{ .Route }}</a></p>
+</body>
+</html>
+`
+
+var errorTemplate = template.Must(template.New("").Parse(errorTemplateText))
+
+// errorResult is the body of an error response to a JSON client.
+type errorResult struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+	Path   string `json:"path"`
+}
+
+// loadErrorPages reads the pages of -error-pages: files named after the
+// status they are shown for, such as 404.html.
+func loadErrorPages(dir string) (map[int][]byte, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[int][]byte)
+	for _, name := range names {
+		status, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".html"))
+		if err != nil || status < 400 || status > 599 {
+			continue
+		}
+		if pages[status], err = os.ReadFile(name); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// wantsHTML reports whether r comes from a browser, which asks for HTML
+// rather than text.
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, "text/html") > acceptQuality(accept, textContentType)
+}
+
+// serveError logs err, the cause of a failed request, and answers 500. The
+// response only shows err with -debug, since it may reveal local paths;
+// once the response is under way, the error is logged only.
+func (f *fileHandler) serveError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("[%s] %s %s: %v", f.path, r.Method, loggedURL(r.URL), err)
+	if rec, ok := w.(*statusRecorder); ok && rec.status != 0 {
+		return
+	}
+	message := http.StatusText(http.StatusInternalServerError)
+	if f.debug {
+		message = err.Error()
+	}
+	_ = f.serveStatusMessage(w, r, http.StatusInternalServerError, message)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	eventsKey = "events"
+
+	// maxWatchedDirs caps the directories watched at once for ?events=
+	maxWatchedDirs = 64
+	// eventsKeepAlive is how often an idle event stream gets a comment, so
+	// that proxies do not time it out
+	eventsKeepAlive = 30 * time.Second
+	// pollInterval is how often directories are compared with their last
+	// snapshot where the platform cannot notify us of changes
+	pollInterval = 2 * time.Second
+
+	eventCreate = "create"
+	eventDelete = "delete"
+	eventModify = "modify"
+)
+
+var errTooManyWatches = errors.New("too many directories are being watched, try again later")
+
+// dirEvent is a change to the entry called Name of a watched directory.
+type dirEvent struct {
+	Op   string `json:"op"`
+	Name string `json:"name"`
+}
+
+// watchHub shares one watch per directory between all of its subscribers.
+// The watch starts with the first subscriber and stops when the last one
+// leaves.
+type watchHub struct {
+	mu   sync.Mutex
+	dirs map[string]*dirWatch
+	max  int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type dirWatch struct {
+	subscribers map[chan dirEvent]struct{}
+	stop        func()
+}
+
+var watches = &watchHub{dirs: make(map[string]*dirWatch), max: maxWatchedDirs, done: make(chan struct{})}
+
+// subscribe returns the events of the directory osPath and the function to
+// call once they are no longer wanted.
+func (h *watchHub) subscribe(osPath string) (<-chan dirEvent, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w, ok := h.dirs[osPath]
+	if !ok {
+		if len(h.dirs) >= h.max {
+			return nil, nil, errTooManyWatches
+		}
+		w = &dirWatch{subscribers: make(map[chan dirEvent]struct{})}
+		stop, err := watchDir(osPath, func(ev dirEvent) { h.broadcast(w, ev) })
+		if err != nil {
+			return nil, nil, err
+		}
+		w.stop = stop
+		h.dirs[osPath] = w
+	}
+	events := make(chan dirEvent, 64)
+	w.subscribers[events] = struct{}{}
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(w.subscribers, events)
+		if len(w.subscribers) == 0 && h.dirs[osPath] == w {
+			w.stop()
+			delete(h.dirs, osPath)
+		}
+	}
+	return events, unsubscribe, nil
+}
+
+// broadcast passes ev on to the subscribers of w, dropping it for those
+// that are behind; they refresh the whole listing anyway.
+func (h *watchHub) broadcast(w *dirWatch, ev dirEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for events := range w.subscribers {
+		select {
+		case events <- ev:
+		default:
+		}
+	}
+}
+
+// close ends all event streams, so that they do not hold up a shutdown.
+func (h *watchHub) close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// serveEvents streams the changes to the directory osPath as Server-Sent
+// Events, one JSON dirEvent per message, until the client goes away.
+func (f *fileHandler) serveEvents(w http.ResponseWriter, r *http.Request, osPath string) error {
+	events, unsubscribe, err := watches.subscribe(osPath)
+	if errors.Is(err, errTooManyWatches) {
+		return f.serveStatusMessage(w, r, http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	defer unsubscribe()
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		if err := rc.Flush(); err != nil {
+			return nil
+		}
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-watches.done:
+			return nil
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case ev := <-events:
+			if f.hiddenFile(filepath.Join(osPath, ev.Name)) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return nil
+			}
+		}
+	}
+}
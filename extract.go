@@ -0,0 +1,260 @@
+package main
+
+import (
+	tarball "archive/tar"
+	zipper "archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	extractKey   = "extract"
+	extractValue = "true"
+
+	defaultExtractLimit = 1 << 30
+)
+
+var errExtractLimit = errors.New("extracted size exceeds limit")
+
+type archiveFormat int
+
+const (
+	formatUnknown archiveFormat = iota
+	formatZip
+	formatTar
+	formatTarGz
+)
+
+// detectArchive identifies an uploaded archive by the magic bytes at the start
+// of br, falling back to the file name extension.
+func detectArchive(name string, br *bufio.Reader) archiveFormat {
+	if head, _ := br.Peek(262); len(head) > 0 {
+		switch {
+		case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+			return formatZip
+		case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+			return formatTarGz
+		case len(head) >= 262 && string(head[257:262]) == "ustar":
+			return formatTar
+		}
+	}
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return formatZip
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return formatTarGz
+	case strings.HasSuffix(lower, ".tar"):
+		return formatTar
+	}
+	return formatUnknown
+}
+
+// extract unpacks the archive called name read from in into the directory
+// osPath for r and returns the slash-separated paths of the files it wrote.
+// Entries that would land outside osPath, hidden entries, entries below a
+// directory whose access policy refuses r and anything but regular files and
+// directories are skipped. Files that exist are dealt with as policy says for
+// an upload: the entries rejected, or refused by an If-Match or
+// If-Unmodified-Since precondition, are skipped and extraction ends with
+// errUploadExists or errUploadModified. Every file is written, and goes
+// through the -on-upload hook, as an upload does, so that a failure leaves
+// the previous version in place. Extraction stops with errExtractLimit once
+// f.extractLimit bytes have been written; files written until then are kept.
+func (f *fileHandler) extract(r *http.Request, osPath, name string, in io.Reader, policy string) ([]string, error) {
+	br := bufio.NewReader(in)
+	x := &extractor{handler: f, request: r, root: osPath, policy: policy, remaining: f.extractLimit}
+	var err error
+	switch detectArchive(name, br) {
+	case formatZip:
+		err = x.zip(br)
+	case formatTarGz:
+		gz, gzErr := gzip.NewReader(br)
+		if gzErr != nil {
+			return nil, gzErr
+		}
+		defer gz.Close()
+		err = x.tar(gz)
+	case formatTar:
+		err = x.tar(br)
+	default:
+		return nil, fmt.Errorf("%s: not a zip, tar or tar.gz archive", name)
+	}
+	if err == nil {
+		err = x.conflict
+	}
+	return x.files, err
+}
+
+type extractor struct {
+	handler   *fileHandler
+	request   *http.Request
+	root      string
+	policy    string
+	remaining int64
+	files     []string
+	// conflict is errUploadExists or errUploadModified once an entry is
+	// skipped for a file in its place
+	conflict error
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tarball.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tarball.TypeDir:
+			err = x.mkdir(header.Name)
+		case tarball.TypeReg:
+			err = x.writeFile(header.Name, tr, header.FileInfo().Mode())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// zip spools r to a temporary file since zip archives need random access.
+func (x *extractor) zip(r io.Reader) error {
+	tmp, err := os.CreateTemp(x.root, ".upload-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(&diskGuard{w: tmp, dir: x.root}, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zipper.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range zr.File {
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.mkdir(entry.Name)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			rc, err = entry.Open()
+			if err != nil {
+				return err
+			}
+			err = x.writeFile(entry.Name, rc, mode)
+			rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// target maps an archive entry name to a path below x.root, or returns "" for
+// entries that must be skipped.
+func (x *extractor) target(name string) string {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return ""
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return ""
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if x.handler.hidden(part) {
+			return ""
+		}
+	}
+	target := filepath.Join(x.root, filepath.FromSlash(clean))
+	if !x.handler.contains(target) {
+		return ""
+	}
+	// the upload was only checked against the policy of x.root
+	if policy, _, err := x.handler.accessPolicy(target, nil); err != nil || policy.refusal(x.request) != 0 {
+		return ""
+	}
+	return target
+}
+
+func (x *extractor) mkdir(name string) error {
+	target := x.target(name)
+	if target == "" {
+		return nil
+	}
+	return mkdirAllMode(target, x.handler.uploadDirMode)
+}
+
+func (x *extractor) writeFile(name string, r io.Reader, mode os.FileMode) error {
+	target := x.target(name)
+	if target == "" {
+		return nil
+	}
+	if err := mkdirAllMode(filepath.Dir(target), x.handler.uploadDirMode); err != nil {
+		return err
+	}
+	f := x.handler
+	if !f.contains(filepath.Dir(target)) {
+		return nil
+	}
+	if info, err := f.storage.Stat(f.storageName(target)); err == nil {
+		switch {
+		case info.IsDir(), x.policy == onConflictReject:
+			x.conflict = errUploadExists
+			return nil
+		case x.policy == onConflictOverwrite && preconditionFailed(x.request, info):
+			x.conflict = errUploadModified
+			return nil
+		}
+	}
+	// new files get the upload mode, executable where the archive says so
+	// and the mode lets someone read it
+	perm := f.uploadMode | mode.Perm()&0111&(f.uploadMode>>2)
+	rel, _ := filepath.Rel(x.root, target)
+	check := f.uploadCheck(x.request, path.Join(x.request.URL.Path, filepath.ToSlash(rel)))
+	storedAs, err := f.writeUploadedPart(target, &extractLimiter{x: x, r: r}, x.policy, "", perm, check)
+	if errors.Is(err, errUploadExists) {
+		// created meanwhile
+		x.conflict = err
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rel, _ = filepath.Rel(x.root, storedAs)
+	x.files = append(x.files, filepath.ToSlash(rel))
+	f.afterUpload(x.request, storedAs, path.Join(x.request.URL.Path, filepath.ToSlash(rel)))
+	return nil
+}
+
+// extractLimiter reads an entry of x's archive, failing with errExtractLimit
+// once more than x.remaining bytes have been extracted.
+type extractLimiter struct {
+	x *extractor
+	r io.Reader
+}
+
+func (l *extractLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.x.remaining -= int64(n)
+	if l.x.remaining < 0 {
+		return n, errExtractLimit
+	}
+	return n, err
+}
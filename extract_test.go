@@ -0,0 +1,167 @@
+package main
+
+import (
+	zipper "archive/zip"
+	"bytes"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testZip returns a zip of files, by slash-separated name, written in the
+// order of names.
+func testZip(t *testing.T, names []string, files map[string]string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zipper.NewWriter(&b)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// extractUpload posts archive as name to target with extract=true and the
+// headers given as name, value pairs.
+func extractUpload(t *testing.T, h http.Handler, target, name string, archive []byte, header ...string) int {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(archive)
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w := serveTest(h, http.MethodPost, target+"?"+extractKey+"="+extractValue, &b, append([]string{"Content-Type", mw.FormDataContentType(), "Accept", "application/json"}, header...)...)
+	return w.Code
+}
+
+// readTestFile returns the content of the file name in dir, or "" with ok
+// false if there is none.
+func readTestFile(dir, name string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	return string(data), err == nil
+}
+
+func TestExtractHonorsAccessFiles(t *testing.T) {
+	entries := map[string]string{
+		"top.txt":                     "new",
+		"open/y.txt":                  "new",
+		"readonly/x.txt":              "evil",
+		"readonly/new.txt":            "evil",
+		"readonly/deep/new.txt":       "evil",
+		"secret/z.txt":                "new",
+		accessFileDefault:             "deny",
+		"open/" + accessFileDefault:   "deny",
+		"newdir/" + accessFileDefault: "deny",
+	}
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	archive := testZip(t, names, entries)
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+
+	for _, withAuth := range []bool{false, true} {
+		dir := writeTestTree(t, map[string]string{
+			"open/":                         "",
+			"readonly/" + accessFileDefault: "deny writes",
+			"readonly/x.txt":                "orig",
+			"secret/" + accessFileDefault:   "user alice:secret",
+		})
+		h := newTestHandler(t, "/", dir)
+		h.csrf = false
+		h.allowUpload = true
+		h.access = newAccessFiles(accessFileDefault)
+		var header []string
+		if withAuth {
+			header = []string{"Authorization", auth}
+		}
+		if status := extractUpload(t, h, "/", "upload.zip", archive, header...); status != http.StatusCreated && status != http.StatusOK {
+			t.Fatalf("extract: status %d", status)
+		}
+
+		for _, name := range []string{"top.txt", "open/y.txt"} {
+			if got, _ := readTestFile(dir, name); got != "new" {
+				t.Errorf("%s = %q, want it extracted", name, got)
+			}
+		}
+		if got, _ := readTestFile(dir, "readonly/x.txt"); got != "orig" {
+			t.Errorf("readonly/x.txt = %q, overwritten below deny writes", got)
+		}
+		for _, name := range []string{"readonly/new.txt", "readonly/deep/new.txt", accessFileDefault, "open/" + accessFileDefault, "newdir/" + accessFileDefault} {
+			if _, ok := readTestFile(dir, name); ok {
+				t.Errorf("%s was extracted", name)
+			}
+		}
+		if got, ok := readTestFile(dir, "secret/z.txt"); ok != withAuth || ok && got != "new" {
+			t.Errorf("secret/z.txt with auth %v = %q, %v", withAuth, got, ok)
+		}
+	}
+}
+
+func TestExtractConflictPolicy(t *testing.T) {
+	archive := testZip(t, []string{"a.txt", "new.txt"}, map[string]string{"a.txt": "new", "new.txt": "new"})
+	tests := []struct {
+		policy string
+		header []string
+		want   int
+		files  map[string]string
+	}{
+		{onConflictReject, nil, http.StatusConflict, map[string]string{"a.txt": "orig", "new.txt": "new"}},
+		{onConflictRename, nil, http.StatusOK, map[string]string{"a.txt": "orig", "a (1).txt": "new", "new.txt": "new"}},
+		{onConflictOverwrite, nil, http.StatusOK, map[string]string{"a.txt": "new", "new.txt": "new"}},
+		{onConflictOverwrite, []string{"If-Match", `"stale"`}, http.StatusPreconditionFailed, map[string]string{"a.txt": "orig", "new.txt": "new"}},
+	}
+	for _, tt := range tests {
+		dir := writeTestTree(t, map[string]string{"a.txt": "orig"})
+		h := newTestHandler(t, "/", dir)
+		h.csrf = false
+		h.allowUpload = true
+		h.onConflict = tt.policy
+		if status := extractUpload(t, h, "/", "upload.zip", archive, tt.header...); status != tt.want {
+			t.Errorf("%s %q: status %d, want %d", tt.policy, tt.header, status, tt.want)
+		}
+		for name, want := range tt.files {
+			if got, _ := readTestFile(dir, name); got != want {
+				t.Errorf("%s %q: %s = %q, want %q", tt.policy, tt.header, name, got, want)
+			}
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != len(tt.files) {
+			t.Errorf("%s %q: %d files left, want %d", tt.policy, tt.header, len(entries), len(tt.files))
+		}
+	}
+}
+
+func TestExtractLimitKeepsExistingFile(t *testing.T) {
+	archive := testZip(t, []string{"a.txt"}, map[string]string{"a.txt": "much too long"})
+	dir := writeTestTree(t, map[string]string{"a.txt": "orig"})
+	h := newTestHandler(t, "/", dir)
+	h.csrf = false
+	h.allowUpload = true
+	h.onConflict = onConflictOverwrite
+	h.extractLimit = 4
+	if status := extractUpload(t, h, "/", "upload.zip", archive); status < http.StatusBadRequest {
+		t.Errorf("extract past the limit: status %d", status)
+	}
+	if got, _ := readTestFile(dir, "a.txt"); got != "orig" {
+		t.Errorf("a.txt = %q after extracting past the limit, want it kept", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files left, want 1", len(entries))
+	}
+}
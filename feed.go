@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	feedKey  = "feed"
+	feedAtom = "atom"
+	feedRSS  = "rss"
+
+	defaultFeedEntries = 20
+	defaultFeedDepth   = 1
+	// feedTimeout bounds the walk for the newest files; a feed made when
+	// it runs out holds the newest of those found
+	feedTimeout = 10 * time.Second
+	// feedCacheTTL is how long a feed is reused, since feed readers poll
+	// often and a walk per poll adds up
+	feedCacheTTL  = time.Minute
+	feedCacheSize = 256
+
+	atomContentType = "application/atom+xml; charset=utf-8"
+	rssContentType  = "application/rss+xml; charset=utf-8"
+	atomXMLNS       = "http://www.w3.org/2005/Atom"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title     string       `xml:"title"`
+	Link      string       `xml:"link"`
+	GUID      rssGUID      `xml:"guid"`
+	PubDate   string       `xml:"pubDate"`
+	Enclosure rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// feedItem is a file of a feed with its URL, which is also its id: it stays
+// the same while the file is replaced, which the updated time then shows.
+type feedItem struct {
+	searchHit
+	url         string
+	contentType string
+}
+
+// feedCache holds recently generated feeds by the URL and format asked for.
+type feedCache struct {
+	mu      sync.Mutex
+	entries map[string]feedCacheEntry
+}
+
+type feedCacheEntry struct {
+	at      time.Time
+	body    []byte
+	modTime time.Time
+}
+
+var feeds = &feedCache{entries: make(map[string]feedCacheEntry)}
+
+func (c *feedCache) get(key string) (feedCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Since(e.at) > feedCacheTTL {
+		return feedCacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *feedCache) put(key string, e feedCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= feedCacheSize {
+		for key, e := range c.entries {
+			if time.Since(e.at) > feedCacheTTL || len(c.entries) >= feedCacheSize {
+				delete(c.entries, key)
+			}
+		}
+	}
+	c.entries[key] = e
+}
+
+// serveFeed answers ?feed=atom or ?feed=rss on the directory osPath with a
+// feed of its f.feedEntries most recently modified regular files, looked for
+// f.feedDepth levels down. Entries link to the files and enclose them, with
+// their size and type. Feeds are cached for feedCacheTTL.
+func (f *fileHandler) serveFeed(w http.ResponseWriter, r *http.Request, osPath string) error {
+	format := r.URL.Query().Get(feedKey)
+	contentType := atomContentType
+	switch format {
+	case feedAtom:
+	case feedRSS:
+		contentType = rssContentType
+	default:
+		return f.serveStatusMessage(w, r, http.StatusBadRequest, "feed must be atom or rss")
+	}
+	dirURL := f.prefix.absolute(r, &url.URL{Path: r.URL.Path})
+	key := format + "\x00" + dirURL.String()
+	e, ok := feeds.get(key)
+	if !ok {
+		items, err := f.feedItems(r.Context(), osPath, dirURL)
+		if err != nil {
+			return err
+		}
+		var body bytes.Buffer
+		body.WriteString(xml.Header)
+		relPath, _ := filepath.Rel(f.path, osPath)
+		title := filepath.ToSlash(filepath.Join(filepath.Base(f.path), relPath))
+		if format == feedAtom {
+			err = xml.NewEncoder(&body).Encode(atomFeedOf(r.Host, dirURL, title, items))
+		} else {
+			err = xml.NewEncoder(&body).Encode(rssFeedOf(dirURL, title, items))
+		}
+		if err != nil {
+			return err
+		}
+		e = feedCacheEntry{at: time.Now(), body: body.Bytes()}
+		if len(items) > 0 {
+			e.modTime = items[0].ModTime()
+		}
+		feeds.put(key, e)
+	}
+	sum := sha256.Sum256(e.body)
+	if checkNotModified(w, r, `"`+hex.EncodeToString(sum[:16])+`"`, e.modTime) {
+		return nil
+	}
+	w.Header().Set("Content-Type", contentType)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	_, err := w.Write(e.body)
+	return err
+}
+
+// feedItems returns the newest regular files below osPath, newest first,
+// skipping hidden entries and symlinks out of the served root.
+func (f *fileHandler) feedItems(ctx context.Context, osPath string, dirURL *url.URL) ([]feedItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+	defer cancel()
+	var hits []searchHit
+	newest := func() {
+		sort.Slice(hits, func(i, j int) bool {
+			if a, b := hits[i].ModTime(), hits[j].ModTime(); !a.Equal(b) {
+				return a.After(b)
+			}
+			return hits[i].rel < hits[j].rel
+		})
+		hits = hits[:min(len(hits), f.feedEntries)]
+	}
+	errStop := errors.New("stop")
+	err := filepath.WalkDir(osPath, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return errStop
+		}
+		if p == osPath {
+			return err
+		}
+		if err != nil || f.hiddenFile(p) || !f.contains(p) || d.IsDir() && f.guarded(p) {
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(osPath, p)
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if strings.Count(rel, osPathSeparator)+1 >= f.feedDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		hits = append(hits, searchHit{FileInfo: info, rel: filepath.ToSlash(rel)})
+		if len(hits) >= 2*f.feedEntries {
+			newest()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+	newest()
+	items := make([]feedItem, len(hits))
+	for i, hit := range hits {
+		contentType, err := f.contentTypeOf(filepath.Join(osPath, filepath.FromSlash(hit.rel)))
+		if err != nil {
+			contentType = "application/octet-stream"
+		}
+		items[i] = feedItem{searchHit: hit, url: fileURL(dirURL, hit).String(), contentType: contentType}
+	}
+	return items, nil
+}
+
+func atomFeedOf(host string, dirURL *url.URL, title string, items []feedItem) atomFeed {
+	self := *dirURL
+	self.RawQuery = feedKey + "=" + feedAtom
+	feed := atomFeed{
+		XMLNS:  atomXMLNS,
+		ID:     dirURL.String(),
+		Title:  title,
+		Author: atomAuthor{Name: host},
+		Links: []atomLink{
+			{Rel: "self", Href: self.String(), Type: "application/atom+xml"},
+			{Rel: "alternate", Href: dirURL.String(), Type: "text/html"},
+		},
+		// a feed without entries dates from the epoch rather than changing
+		// at every poll
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+	}
+	if len(items) > 0 {
+		feed.Updated = items[0].ModTime().UTC().Format(time.RFC3339)
+	}
+	for _, item := range items {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      item.url,
+			Title:   item.rel,
+			Updated: item.ModTime().UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Href: item.url},
+				{Rel: "enclosure", Href: item.url, Type: item.contentType, Length: item.Size()},
+			},
+		})
+	}
+	return feed
+}
+
+func rssFeedOf(dirURL *url.URL, title string, items []feedItem) rssFeed {
+	channel := rssChannel{
+		Title:       title,
+		Link:        dirURL.String(),
+		Description: "Recently changed files in " + title,
+	}
+	if len(items) > 0 {
+		channel.LastBuildDate = items[0].ModTime().UTC().Format(time.RFC1123Z)
+	}
+	for _, item := range items {
+		channel.Items = append(channel.Items, rssItem{
+			Title:     item.rel,
+			Link:      item.url,
+			GUID:      rssGUID{IsPermaLink: "true", ID: item.url},
+			PubDate:   item.ModTime().UTC().Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{URL: item.url, Length: item.Size(), Type: item.contentType},
+		})
+	}
+	return rssFeed{Version: "2.0", Channel: channel}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// archiveLinks matches the zip, tar.gz and tar links of a listing.
+var archiveLinks = regexp.MustCompile(`Download as <a href="([^"]*)">zip</a> \| <a href="([^"]*)">tar.gz</a> \| <a href="([^"]*)">tar</a>`)
+
+func TestArchivesHoldWhatIsListed(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{
+		"a.log":       "a",
+		"b.txt":       "b",
+		"x.tmp":       "x",
+		"sub/c.log":   "c",
+		"sub/d.txt":   "d",
+		"sub/e.tmp":   "e",
+		"other/f.txt": "f",
+	})
+	h := newTestHandler(t, "/", dir)
+	h.hide = []string{"*.tmp"}
+	for _, query := range []string{"", "glob=*.log", "q=d", "glob=*.tmp"} {
+		var listing []struct {
+			Name  string `json:"name"`
+			IsDir bool   `json:"isDir"`
+		}
+		w := serveTest(h, http.MethodGet, "/?format=json&"+query, nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+			t.Fatalf("?%s: %v: %s", query, err, w.Body)
+		}
+		var listed []string
+		for _, e := range listing {
+			if !e.IsDir {
+				listed = append(listed, strings.TrimSuffix(e.Name, "/"))
+			}
+		}
+		sort.Strings(listed)
+
+		page := serveTest(h, http.MethodGet, "/?"+query, nil).Body.String()
+		links := archiveLinks.FindStringSubmatch(page)
+		if links == nil {
+			t.Fatalf("?%s: no archive links", query)
+		}
+		for i, key := range []string{zipKey, tarGzKey, tarKey} {
+			w := serveTest(h, http.MethodGet, html.UnescapeString(links[i+1]), nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("?%s: %s: %d", query, links[i+1], w.Code)
+			}
+			var archived []string
+			for name, e := range readArchiveEntries(t, key, w.Body.Bytes()) {
+				if !e.mode.IsDir() {
+					archived = append(archived, name)
+				}
+			}
+			sort.Strings(archived)
+			if query == "" {
+				// the listing shows one level, the archive the whole
+				// tree without the hidden files
+				if want := []string{"a.log", "b.txt", "other/f.txt", "sub/c.log", "sub/d.txt"}; !slices.Equal(archived, want) {
+					t.Errorf("%s holds %q, want %q", key, archived, want)
+				}
+				continue
+			}
+			if !slices.Equal(archived, listed) {
+				t.Errorf("?%s: %s holds %q, the listing shows %q", query, key, archived, listed)
+			}
+		}
+	}
+}
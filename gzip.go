@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipResponseWriter compresses everything written to it. Content-Encoding is
+// only announced once the status is known, so bodiless responses such as 304
+// pass through untouched. Compressed responses do not offer ranges, which
+// would be of the uncompressed bytes.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	compress    bool
+}
+
+// gzipWriter wraps w in a gzipResponseWriter if r accepts gzip. The returned
+// function must be called once the response is complete.
+func gzipWriter(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsEncoding(r, "gzip") {
+		return w, func() error { return nil }
+	}
+	gw := &gzipResponseWriter{ResponseWriter: w}
+	return gw, gw.Close
+}
+
+// acceptsEncoding reports whether r's Accept-Encoding allows coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		if strings.TrimSpace(name) != coding {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	g.compress = status != http.StatusNotModified && status != http.StatusNoContent && g.Header().Get("Content-Encoding") == ""
+	if g.compress {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		g.Header().Del("Accept-Ranges")
+		if etag := g.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// the encoded bytes differ from those the strong tag names
+			g.Header().Set("ETag", "W/"+etag)
+		}
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.compress {
+		return g.ResponseWriter.Write(p)
+	}
+	return g.gz.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, for the
+// write deadline of limitWrite.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Close flushes the compressed stream.
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gunzip(t *testing.T, body []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGeneratedResponsesCompressed(t *testing.T) {
+	tree := map[string]string{"sub/": ""}
+	for i := 0; i < 200; i++ {
+		tree[strings.Repeat("x", i%40)+".txt"] = "x"
+	}
+	h := newTestHandler(t, "/", writeTestTree(t, tree))
+	// the form token would differ between the two listings
+	h.csrf = false
+	for _, target := range []string{"/", "/?format=json", "/missing"} {
+		identity := serveTest(h, http.MethodGet, target, nil)
+		compressed := serveTest(h, http.MethodGet, target, nil, "Accept-Encoding", "br, gzip;q=0.8")
+		if got := identity.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s without Accept-Encoding: Content-Encoding %q", target, got)
+		}
+		if got := compressed.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("%s: Content-Encoding %q, want gzip", target, got)
+		}
+		for _, w := range []*httptest.ResponseRecorder{identity, compressed} {
+			if got := w.Header().Values("Vary"); !strings.Contains(strings.Join(got, ","), "Accept-Encoding") {
+				t.Errorf("%s: Vary %q", target, got)
+			}
+		}
+		if compressed.Code != identity.Code || compressed.Header().Get("Content-Type") != identity.Header().Get("Content-Type") {
+			t.Errorf("%s: %d %q compressed, %d %q not", target, compressed.Code, compressed.Header().Get("Content-Type"), identity.Code, identity.Header().Get("Content-Type"))
+		}
+		if got := gunzip(t, compressed.Body.Bytes()); !bytes.Equal(got, identity.Body.Bytes()) {
+			t.Errorf("%s: decompressed body differs from the identity one", target)
+		}
+		if target == "/" && compressed.Body.Len() >= identity.Body.Len() {
+			t.Errorf("%s: %d bytes compressed, %d not", target, compressed.Body.Len(), identity.Body.Len())
+		}
+	}
+}
+
+func TestGzipRefused(t *testing.T) {
+	h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"a.txt": "a"}))
+	for _, accept := range []string{"", "identity", "gzip;q=0", "gzip; q=0.000", "x-gzip"} {
+		w := serveTest(h, http.MethodGet, "/", nil, "Accept-Encoding", accept)
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q", accept, got)
+		}
+	}
+}
+
+func TestArchivesNotCompressedAgain(t *testing.T) {
+	h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"a.txt": "a"}))
+	for _, target := range []string{"/?zip=1", "/?tar.gz=1", "/?tar=1"} {
+		w := serveTest(h, http.MethodGet, target, nil, "Accept-Encoding", "gzip")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", target, w.Code)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: Content-Encoding %q", target, got)
+		}
+	}
+}
+
+func TestGzipWriterLeavesBodilessResponses(t *testing.T) {
+	for _, status := range []int{http.StatusNotModified, http.StatusNoContent} {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("ETag", `"x"`)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w, done := gzipWriter(rec, r)
+		w.WriteHeader(status)
+		if err := done(); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%d: Content-Encoding %q", status, got)
+		}
+		if got := rec.Header().Get("ETag"); got != `"x"` {
+			t.Errorf("%d: ETag %q", status, got)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("%d: %d bytes of body", status, rec.Body.Len())
+		}
+	}
+}
+
+func TestGzipWriterWeakensETag(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("ETag", `"x"`)
+	rec.Header().Set("Content-Length", "5")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w, done := gzipWriter(rec, r)
+	io.WriteString(w, "hello")
+	if err := done(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get("ETag"); got != `W/"x"` {
+		t.Errorf("ETag %q, want W/\"x\"", got)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "" {
+		t.Errorf("Content-Length %q of the uncompressed body", got)
+	}
+	if got := gunzip(t, rec.Body.Bytes()); string(got) != "hello" {
+		t.Errorf("body %q", got)
+	}
+}
+
+// deadlineRecorder is a ResponseRecorder that notes the write deadline set
+// through http.ResponseController.
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadline time.Time
+}
+
+func (d *deadlineRecorder) SetWriteDeadline(t time.Time) error {
+	d.deadline = t
+	return nil
+}
+
+func TestWriteDeadlineThroughGzip(t *testing.T) {
+	h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"a.txt": "a"}))
+	h.writeTimeout = time.Minute
+	w := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("listing not compressed")
+	}
+	if w.deadline.IsZero() {
+		t.Error("no write deadline set on the compressed listing")
+	}
+}
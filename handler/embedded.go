@@ -1,52 +1,92 @@
 package handler
 
 import (
-	_ "embed"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
 	"net/http"
+	"path"
 	"strings"
 )
 
-var (
-	//go:embed static/layout/autoindex.css
-	autoindex_css []byte
-	//go:embed static/icons/blank.png
-	blank_png []byte
-	//go:embed static/icons/folder.png
-	folder_png []byte
-	//go:embed static/icons/go-previous.png
-	go_previous_png []byte
-	//go:embed static/icons/package-x-generic.png
-	package_x_generic_png []byte
-)
+// static holds every file below static/, served at /static/. Adding an asset
+// only requires dropping it into the directory.
+//
+//go:embed static
+var static embed.FS
+
+// cacheControl lets clients keep assets for a year; they only change with the
+// binary, and the ETag revalidates them after an upgrade.
+const cacheControl = "public, max-age=31536000"
+
+type asset struct {
+	contentType string
+	body        []byte
+	etag        string
+}
+
+// assets maps URL paths such as /static/icons/folder.png to their content,
+// read and hashed once at init.
+var assets = func() map[string]asset {
+	out := make(map[string]asset)
+	err := fs.WalkDir(static, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := static.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		sum := sha256.Sum256(body)
+		out["/"+name] = asset{
+			contentType: contentType,
+			body:        body,
+			etag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return out
+}()
 
 type EmbeddedHandler struct {
 }
 
 func (f *EmbeddedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	urlPath := r.URL.Path
-	if !strings.HasPrefix(urlPath, "/static") {
+	a, ok := assets[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
-	switch urlPath {
-	case "/static/layout/autoindex.css":
-		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "text/css")
-		w.Write(autoindex_css)
-	case "/static/icons/blank.png":
-		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "image/png")
-		w.Write(blank_png)
-	case "/static/icons/folder.png":
-		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "image/png")
-		w.Write(folder_png)
-	case "/static/icons/go-previous.png":
-		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "image/png")
-		w.Write(go_previous_png)
-	case "/static/icons/package-x-generic.png":
-		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "image/png")
-		w.Write(package_x_generic_png)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", a.etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if etagMatches(r.Header.Get("If-None-Match"), a.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(a.body)
+	}
+}
+
+// etagMatches implements the weak comparison If-None-Match calls for.
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
 	}
+	return false
 }
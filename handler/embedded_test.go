@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func serve(method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	(&EmbeddedHandler{}).ServeHTTP(w, r)
+	return w
+}
+
+// TestOriginalAssets checks that the assets served before the directory was
+// embedded as a whole keep their paths, types and bytes.
+func TestOriginalAssets(t *testing.T) {
+	tests := []struct {
+		path, contentType string
+	}{
+		{"/static/layout/autoindex.css", "text/css"},
+		{"/static/icons/blank.png", "image/png"},
+		{"/static/icons/folder.png", "image/png"},
+		{"/static/icons/go-previous.png", "image/png"},
+		{"/static/icons/package-x-generic.png", "image/png"},
+	}
+	for _, tt := range tests {
+		want, err := os.ReadFile(filepath.FromSlash(strings.TrimPrefix(tt.path, "/")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := serve(http.MethodGet, tt.path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", tt.path, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+			t.Errorf("%s: Content-Type %q, want %s", tt.path, got, tt.contentType)
+		}
+		if !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("%s: %d bytes served differ from the %d of the file", tt.path, w.Body.Len(), len(want))
+		}
+	}
+}
+
+func TestEveryFileServed(t *testing.T) {
+	err := filepath.WalkDir("static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		target := "/" + filepath.ToSlash(p)
+		if w := serve(http.MethodGet, target); w.Code != http.StatusOK || w.Header().Get("Content-Type") == "" {
+			t.Errorf("%s: status %d, Content-Type %q", target, w.Code, w.Header().Get("Content-Type"))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnknownAsset(t *testing.T) {
+	for _, target := range []string{"/static/missing.css", "/static/icons", "/static/", "/other"} {
+		if w := serve(http.MethodGet, target); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", target, w.Code)
+		}
+	}
+}
+
+func TestAssetRevalidation(t *testing.T) {
+	const target = "/static/icons/folder.png"
+	w := serve(http.MethodGet, target)
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Cache-Control") != cacheControl {
+		t.Fatalf("ETag %q, Cache-Control %q", etag, w.Header().Get("Cache-Control"))
+	}
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		if w := serve(http.MethodGet, target, "If-None-Match", inm); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: status %d with %d bytes", inm, w.Code, w.Body.Len())
+		}
+	}
+	if w := serve(http.MethodGet, target, "If-None-Match", `"other"`); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match of another tag: status %d", w.Code)
+	}
+	if w := serve(http.MethodHead, target); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("HEAD: status %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
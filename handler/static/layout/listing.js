@@ -0,0 +1,67 @@
+// Asks before deleting and sends a real DELETE request, so that the listing
+// only falls back to the POST form when scripts are disabled. Renaming needs
+// a prompt, so its buttons stay hidden without scripts.
+document.querySelectorAll("button.rename").forEach(function (button) {
+    button.hidden = false;
+});
+
+function csrfToken(button) {
+    var token = button.form.querySelector("input[name=csrf]");
+    return token ? token.value : "";
+}
+
+function reportFailure(what, response) {
+    if (!response.ok) {
+        alert("Could not " + what + ": " + response.status + " " + response.statusText);
+    }
+    location.reload();
+}
+
+function deleteEntry(button) {
+    if (!confirm("Delete " + button.dataset.name + "?")) {
+        return;
+    }
+    var headers = {};
+    if (csrfToken(button)) {
+        headers["X-CSRF-Token"] = csrfToken(button);
+    }
+    fetch(button.formAction, { method: "DELETE", headers: headers, credentials: "same-origin" })
+        .then(function (response) {
+            reportFailure("delete " + button.dataset.name, response);
+        });
+}
+
+function renameEntry(button) {
+    var to = prompt("Rename or move " + button.dataset.name + " to:", button.dataset.name);
+    if (!to || to === button.dataset.name) {
+        return;
+    }
+    var send = function (overwrite) {
+        var body = new URLSearchParams({ action: "rename", to: to, csrf: csrfToken(button) });
+        if (overwrite) {
+            body.set("overwrite", "true");
+        }
+        return fetch(button.dataset.url, { method: "POST", body: body, credentials: "same-origin" });
+    };
+    send(false).then(function (response) {
+        if (response.status === 412 && confirm(to + " already exists. Replace it?")) {
+            return send(true);
+        }
+        return response;
+    }).then(function (response) {
+        reportFailure("rename " + button.dataset.name, response);
+    });
+}
+
+document.addEventListener("click", function (event) {
+    var button = event.target.closest("button.delete, button.rename");
+    if (!button) {
+        return;
+    }
+    event.preventDefault();
+    if (button.classList.contains("delete")) {
+        deleteEntry(button);
+    } else {
+        renameEntry(button);
+    }
+});
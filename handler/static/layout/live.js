@@ -0,0 +1,35 @@
+// Keeps the listing current: the server pushes an event whenever an entry of
+// the directory changes, and the table is then fetched again and swapped in.
+(function () {
+    var table = document.querySelector("table");
+    if (!window.EventSource || !table) {
+        return;
+    }
+    var pending;
+    var refresh = function () {
+        fetch(location.href, { credentials: "same-origin" })
+            .then(function (response) {
+                return response.ok ? response.text() : Promise.reject(response);
+            })
+            .then(function (html) {
+                var current = document.querySelector("table");
+                var fresh = new DOMParser().parseFromString(html, "text/html").querySelector("table");
+                if (!current || !fresh) {
+                    return;
+                }
+                // listing.js un-hides the rename buttons it handles
+                if (current.querySelector("button.rename:not([hidden])")) {
+                    fresh.querySelectorAll("button.rename").forEach(function (button) {
+                        button.hidden = false;
+                    });
+                }
+                current.replaceWith(fresh);
+            })
+            .catch(function () {});
+    };
+    new EventSource(location.pathname + "?events=1").onmessage = function () {
+        // a copy into the directory fires many events; refresh once it settles
+        clearTimeout(pending);
+        pending = setTimeout(refresh, 300);
+    };
+})();
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hashKey = "hash"
+
+	// sha256FieldName and sha256HeaderName carry the expected digest of an
+	// upload: the field applies to the file part after it, the header to a
+	// PUT body or to the files of a multipart upload without the field
+	sha256FieldName  = "sha256"
+	sha256HeaderName = "X-Content-SHA256"
+
+	digestCacheSize = 1024
+)
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// digestCache remembers the digests of recently hashed files. Entries are
+// keyed by path, size and modification time, so changing a file makes its
+// old digests unreachable; they age out of the LRU list.
+type digestCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int
+}
+
+type digestEntry struct {
+	key    string
+	digest string
+}
+
+var digests = &digestCache{entries: make(map[string]*list.Element), lru: list.New(), size: digestCacheSize}
+
+func digestKey(algorithm, osPath string, size int64, modTime time.Time) string {
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%d", algorithm, osPath, size, modTime.UnixNano())
+}
+
+func (c *digestCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*digestEntry).digest, true
+}
+
+func (c *digestCache) put(key, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*digestEntry).digest = digest
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&digestEntry{key: key, digest: digest})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*digestEntry).key)
+	}
+}
+
+// serveHash answers ?hash=ALGORITHM with the hex digest of the file osPath
+// as text/plain.
+func (f *fileHandler) serveHash(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	algorithm := r.URL.Query().Get(hashKey)
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return f.serveStatusMessage(w, r, http.StatusBadRequest, fmt.Sprintf("unknown hash %q, expected md5, sha1 or sha256", algorithm))
+	}
+	key := digestKey(algorithm, osPath, info.Size(), info.ModTime())
+	digest, ok := digests.get(key)
+	if !ok {
+		file, err := f.storage.Open(f.storageName(osPath))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		h := newHash()
+		if _, err := io.Copy(h, file); err != nil {
+			return err
+		}
+		digest = hex.EncodeToString(h.Sum(nil))
+		digests.put(key, digest)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := io.WriteString(w, digest+"\n")
+	return err
+}
+
+// checksumWriter hashes what is written through it so that the digest of an
+// upload can be checked against want once complete.
+type checksumWriter struct {
+	w    io.Writer
+	h    hash.Hash
+	want string
+}
+
+func newChecksumWriter(w io.Writer, want string) *checksumWriter {
+	return &checksumWriter{w: w, h: sha256.New(), want: strings.ToLower(strings.TrimSpace(want))}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumWriter) sum() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+// verify returns errChecksumMismatch unless the data matched want, if given.
+func (c *checksumWriter) verify() error {
+	if c.want != "" && c.sum() != c.want {
+		return fmt.Errorf("%w: got sha256 %s, expected %s", errChecksumMismatch, c.sum(), c.want)
+	}
+	return nil
+}
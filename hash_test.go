@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHash(t *testing.T) {
+	const content = "hash me"
+	h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"a.txt": content, "sub/": ""}))
+	md5Sum, sha1Sum, sha256Sum := md5.Sum([]byte(content)), sha1.Sum([]byte(content)), sha256.Sum256([]byte(content))
+	for algorithm, want := range map[string]string{
+		"md5":    hex.EncodeToString(md5Sum[:]),
+		"sha1":   hex.EncodeToString(sha1Sum[:]),
+		"sha256": hex.EncodeToString(sha256Sum[:]),
+	} {
+		w := serveTest(h, http.MethodGet, "/a.txt?hash="+algorithm, nil)
+		if w.Code != http.StatusOK || w.Body.String() != want+"\n" {
+			t.Errorf("%s: %d %q, want %s", algorithm, w.Code, w.Body.String(), want)
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+			t.Errorf("%s: Content-Type %q", algorithm, got)
+		}
+	}
+	if w := serveTest(h, http.MethodGet, "/a.txt?hash=crc32", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown hash: %d", w.Code)
+	}
+}
+
+func TestHashCacheInvalidation(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"a.txt": "first"})
+	path := filepath.Join(dir, "a.txt")
+	h := newTestHandler(t, "/", dir)
+	hash := func() string {
+		return serveTest(h, http.MethodGet, "/a.txt?hash=sha256", nil).Body.String()
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	write := func(content string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first", mtime)
+	first := hash()
+
+	// same size and time: the file is not read again
+	write("other", mtime)
+	if got := hash(); got != first {
+		t.Errorf("digest %q after a change the cache cannot see, want the cached %q", got, first)
+	}
+
+	write("other", mtime.Add(time.Second))
+	other := sha256.Sum256([]byte("other"))
+	if got, want := hash(), hex.EncodeToString(other[:])+"\n"; got != want {
+		t.Errorf("digest %q after a newer modification time, want %q", got, want)
+	}
+
+	write("longer", mtime.Add(time.Second))
+	longer := sha256.Sum256([]byte("longer"))
+	if got, want := hash(), hex.EncodeToString(longer[:])+"\n"; got != want {
+		t.Errorf("digest %q after a change of size, want %q", got, want)
+	}
+}
+
+func TestDigestCacheEvicts(t *testing.T) {
+	c := &digestCache{entries: make(map[string]*list.Element), lru: list.New(), size: 2}
+	c.put("a", "1")
+	c.put("b", "2")
+	c.get("a")
+	c.put("c", "3")
+	if _, ok := c.get("b"); ok {
+		t.Error("the least recently used entry was kept")
+	}
+	for key, want := range map[string]string{"a": "1", "c": "3"} {
+		if got, ok := c.get(key); !ok || got != want {
+			t.Errorf("get(%q) = %q, %v, want %q", key, got, ok, want)
+		}
+	}
+}
+
+func TestVerifiedUpload(t *testing.T) {
+	dir := t.TempDir()
+	h := newTestHandler(t, "/", dir)
+	h.allowUpload = true
+	sum := sha256.Sum256([]byte("body"))
+	if w := serveTest(h, http.MethodPut, "/bad.txt", strings.NewReader("body"), sha256HeaderName, strings.Repeat("0", 64)); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("PUT with a wrong digest: %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.txt")); !os.IsNotExist(err) {
+		t.Errorf("bad.txt stored: %v", err)
+	}
+	if w := serveTest(h, http.MethodPut, "/good.txt", strings.NewReader("body"), sha256HeaderName, hex.EncodeToString(sum[:])); w.Code != http.StatusCreated {
+		t.Errorf("PUT with the right digest: %d", w.Code)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries, want good.txt alone", len(entries))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+type patterns struct {
+	Values []string
+}
+
+func (fv *patterns) help() string {
+	return "hide files and directories whose name matches the glob PATTERN (repeatable)"
+}
+
+// Set is flag.Value.Set
+func (fv *patterns) Set(v string) error {
+	if _, err := filepath.Match(v, ""); err != nil {
+		return err
+	}
+	fv.Values = append(fv.Values, v)
+	return nil
+}
+
+func (fv *patterns) String() string {
+	return strings.Join(fv.Values, ", ")
+}
+
+// hidden reports whether a file or directory called name must be left out of
+// listings and archives and refused on direct access. The access files of
+// -access-files always are, even with -hidden.
+func (f *fileHandler) hidden(name string) bool {
+	if !f.showHidden && strings.HasPrefix(name, ".") || f.access != nil && name == f.access.name {
+		return true
+	}
+	for _, pattern := range f.hide {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNewName refuses name, which a client picked for a file or directory
+// to create, if it is hidden: such a file could not be fetched, and one
+// called like the access files would decide who gets in.
+func (f *fileHandler) checkNewName(name string) error {
+	if f.hidden(name) {
+		return &badNameError{name, "the name is reserved on this server"}
+	}
+	return nil
+}
+
+// hiddenFile is hidden for the file or directory at osPath, which is also
+// hidden if it holds the trash or, with -hide-precompressed, is the
+// compressed copy of a file next to it. Such copies can still be fetched.
+func (f *fileHandler) hiddenFile(osPath string) bool {
+	return f.hidden(filepath.Base(osPath)) || f.trash.holds(osPath) || f.hidePrecompressed && f.isPrecompressedSibling(osPath)
+}
+
+// hiddenPath reports whether any component of osPath below f.path is hidden
+// or osPath lies in the trash.
+func (f *fileHandler) hiddenPath(osPath string) bool {
+	if f.trash.holds(osPath) {
+		return true
+	}
+	rel, err := filepath.Rel(f.path, osPath)
+	if err != nil || rel == "." {
+		return false
+	}
+	for _, name := range strings.Split(rel, osPathSeparator) {
+		if f.hidden(name) {
+			return true
+		}
+	}
+	return false
+}
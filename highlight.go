@@ -0,0 +1,196 @@
+package main
+
+import (
+	"html/template"
+	"path/filepath"
+	"strings"
+)
+
+// syntax describes just enough of a language to colour comments, strings,
+// numbers and keywords. It is not a parser: anything it does not recognise is
+// emitted as plain text.
+type syntax struct {
+	lineComments []string
+	blockComment [2]string
+	quotes       string
+	keywords     map[string]bool
+}
+
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var (
+	syntaxGo = &syntax{
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		keywords: words(`break case chan const continue default defer else fallthrough for func go goto if
+			import interface map package range return select struct switch type var true false nil iota`),
+	}
+	syntaxC = &syntax{
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		keywords: words(`auto break case catch class const continue default delete do else enum export extends
+			extern false final finally fn for function if impl implements import in interface let match mod
+			namespace new null nullptr package private protected pub public return static struct super switch
+			this throw throws true try type typedef typeof union use var void volatile while yield async await`),
+	}
+	syntaxPython = &syntax{
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+		keywords: words(`and as assert async await break class continue def del elif else except False finally
+			for from global if import in is lambda None nonlocal not or pass raise return True try while with yield`),
+	}
+	syntaxShell = &syntax{
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+		keywords:     words(`if then else elif fi case esac for while until do done in function return local export`),
+	}
+	syntaxConfig = &syntax{
+		lineComments: []string{"#", ";"},
+		quotes:       "\"'",
+		keywords:     words(`true false yes no on off null`),
+	}
+	syntaxJSON = &syntax{
+		quotes:   "\"",
+		keywords: words(`true false null`),
+	}
+	syntaxSQL = &syntax{
+		lineComments: []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "'\"",
+		keywords: words(`select from where and or not insert into values update set delete create table drop
+			alter index join left right inner outer on group by order having limit as null is in like
+			SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP
+			ALTER INDEX JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT AS NULL IS IN LIKE`),
+	}
+)
+
+var syntaxByExtension = map[string]*syntax{
+	".go":    syntaxGo,
+	".c":     syntaxC,
+	".h":     syntaxC,
+	".cc":    syntaxC,
+	".cpp":   syntaxC,
+	".hpp":   syntaxC,
+	".java":  syntaxC,
+	".js":    syntaxC,
+	".ts":    syntaxC,
+	".rs":    syntaxC,
+	".kt":    syntaxC,
+	".swift": syntaxC,
+	".php":   syntaxC,
+	".css":   syntaxC,
+	".py":    syntaxPython,
+	".rb":    syntaxShell,
+	".pl":    syntaxShell,
+	".sh":    syntaxShell,
+	".bash":  syntaxShell,
+	".zsh":   syntaxShell,
+	".yaml":  syntaxConfig,
+	".yml":   syntaxConfig,
+	".toml":  syntaxConfig,
+	".ini":   syntaxConfig,
+	".conf":  syntaxConfig,
+	".cfg":   syntaxConfig,
+	".json":  syntaxJSON,
+	".sql":   syntaxSQL,
+}
+
+// highlight returns src as escaped HTML, with comments, strings, numbers and
+// keywords wrapped in <span class="c|s|n|k"> when the extension of name is
+// known. Other files are only escaped.
+func highlight(name, src string) template.HTML {
+	syn := syntaxByExtension[strings.ToLower(filepath.Ext(name))]
+	if syn == nil {
+		return template.HTML(template.HTMLEscapeString(src))
+	}
+	var b strings.Builder
+	span := func(class, text string) {
+		b.WriteString(`<span class="` + class + `">`)
+		b.WriteString(template.HTMLEscapeString(text))
+		b.WriteString(`</span>`)
+	}
+	plain := 0
+	flush := func(i int) {
+		b.WriteString(template.HTMLEscapeString(src[plain:i]))
+	}
+	for i := 0; i < len(src); {
+		end, class := syn.token(src, i)
+		if end == i {
+			i++
+			continue
+		}
+		flush(i)
+		if class == "" {
+			b.WriteString(template.HTMLEscapeString(src[i:end]))
+		} else {
+			span(class, src[i:end])
+		}
+		i, plain = end, end
+	}
+	flush(len(src))
+	return template.HTML(b.String())
+}
+
+// token returns the end and class of the token starting at src[i], or i if
+// nothing is recognised there. Identifiers that are not keywords come back
+// with an empty class so that digits inside them are not taken for numbers.
+func (syn *syntax) token(src string, i int) (int, string) {
+	rest := src[i:]
+	for _, prefix := range syn.lineComments {
+		if strings.HasPrefix(rest, prefix) {
+			if n := strings.IndexByte(rest, '\n'); n >= 0 {
+				return i + n, "c"
+			}
+			return len(src), "c"
+		}
+	}
+	if open, close := syn.blockComment[0], syn.blockComment[1]; open != "" && strings.HasPrefix(rest, open) {
+		if n := strings.Index(rest[len(open):], close); n >= 0 {
+			return i + len(open) + n + len(close), "c"
+		}
+		return len(src), "c"
+	}
+	c := src[i]
+	switch {
+	case strings.IndexByte(syn.quotes, c) >= 0:
+		for j := i + 1; j < len(src); j++ {
+			switch {
+			case src[j] == '\\' && c != '`':
+				j++
+			case src[j] == c:
+				return j + 1, "s"
+			case src[j] == '\n' && c != '`':
+				return j, "s"
+			}
+		}
+		return len(src), "s"
+	case isDigit(c):
+		j := i
+		for j < len(src) && (isWordByte(src[j]) || src[j] == '.') {
+			j++
+		}
+		return j, "n"
+	case isWordByte(c):
+		j := i
+		for j < len(src) && isWordByte(src[j]) {
+			j++
+		}
+		if syn.keywords[src[i:j]] {
+			return j, "k"
+		}
+		return j, ""
+	}
+	return i, ""
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || isDigit(c) || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHookTimeout     = time.Minute
+	defaultHookConcurrency = 4
+
+	// hookOutputLimit is how much of a hook's output is logged
+	hookOutputLimit = 1 << 10
+)
+
+var errUploadRejected = errors.New("upload rejected by the server's check")
+
+// uploadHook is the -on-upload command, run with the absolute path of each
+// uploaded file as its last argument and the details of the upload in
+// HFS_ACTION, HFS_ROUTE, HFS_PATH and HFS_REMOTE_ADDR. The command is split
+// at spaces and run without a shell. At most cap(slots) hooks run at once.
+// With sync, the hook checks the complete temporary file before it is put in
+// place, and a failing one rejects the upload.
+type uploadHook struct {
+	args    []string
+	timeout time.Duration
+	sync    bool
+	slots   chan struct{}
+}
+
+func newUploadHook(command string, timeout time.Duration, concurrency int, sync bool) *uploadHook {
+	return &uploadHook{args: strings.Fields(command), timeout: timeout, sync: sync, slots: make(chan struct{}, max(concurrency, 1))}
+}
+
+// uploadCheck returns the check writeUploadedPart is to run on the
+// temporary file of the upload r sends to urlPath: in sync mode the hook,
+// whose failure rejects the upload with errUploadRejected, otherwise nil.
+func (f *fileHandler) uploadCheck(r *http.Request, urlPath string) func(osPath string) error {
+	h := f.uploadHook
+	if h == nil || !h.sync {
+		return nil
+	}
+	env := f.hookEnv(r, urlPath)
+	return func(osPath string) error {
+		if err := h.run(osPath, env); err != nil {
+			return errUploadRejected
+		}
+		return nil
+	}
+}
+
+// afterUpload runs the hook in the background for the file r stored at
+// osPath, where its outcome is only logged. In sync mode it has already run
+// as the upload's check.
+func (f *fileHandler) afterUpload(r *http.Request, osPath, urlPath string) {
+	h := f.uploadHook
+	if h == nil || h.sync {
+		return
+	}
+	go h.run(osPath, f.hookEnv(r, urlPath))
+}
+
+func (f *fileHandler) hookEnv(r *http.Request, urlPath string) []string {
+	return []string{
+		"HFS_ACTION=" + webhookUpload,
+		"HFS_ROUTE=" + f.route,
+		"HFS_PATH=" + urlPath,
+		"HFS_REMOTE_ADDR=" + clientIP(r),
+	}
+}
+
+// run runs the hook for osPath and logs how it ended along with the start of
+// its output.
+func (h *uploadHook) run(osPath string, env []string) error {
+	h.slots <- struct{}{}
+	defer func() { <-h.slots }()
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.args[0], append(h.args[1:], osPath)...)
+	cmd.Env = append(os.Environ(), env...)
+	// children that keep the output open do not hold up the upload
+	cmd.WaitDelay = time.Second
+	out := &cappedBuffer{limit: hookOutputLimit}
+	cmd.Stdout, cmd.Stderr = out, out
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	status := "exited 0"
+	if err != nil {
+		status = err.Error()
+	}
+	log.Printf("on-upload %s: %s, output: %q", osPath, status, out)
+	return err
+}
+
+// cappedBuffer keeps the first limit bytes written to it and drops the rest.
+type cappedBuffer struct {
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "…"
+	}
+	return b.buf.String()
+}
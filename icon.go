@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	iconFolder  = "/static/icons/folder.png"
+	iconGeneric = "/static/icons/package-x-generic.png"
+	iconImage   = "/static/icons/image.svg"
+	iconAudio   = "/static/icons/audio.svg"
+	iconVideo   = "/static/icons/video.svg"
+	iconArchive = "/static/icons/archive.svg"
+	iconText    = "/static/icons/text.svg"
+	iconPDF     = "/static/icons/pdf.svg"
+)
+
+var iconsByExtension = func() map[string]string {
+	m := make(map[string]string)
+	add := func(icon string, extensions ...string) {
+		for _, ext := range extensions {
+			m[ext] = icon
+		}
+	}
+	add(iconImage, ".png", ".jpg", ".jpeg", ".gif", ".bmp", ".webp", ".svg", ".ico", ".tif", ".tiff", ".heic", ".avif")
+	add(iconAudio, ".mp3", ".wav", ".flac", ".ogg", ".oga", ".opus", ".m4a", ".aac", ".wma", ".aiff")
+	add(iconVideo, ".mp4", ".m4v", ".mkv", ".webm", ".avi", ".mov", ".wmv", ".flv", ".mpg", ".mpeg", ".ogv")
+	add(iconArchive, ".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar", ".iso", ".dmg", ".deb", ".rpm")
+	add(iconText, ".txt", ".md", ".log", ".csv", ".tsv", ".json", ".xml", ".yaml", ".yml", ".toml", ".ini", ".conf", ".cfg",
+		".html", ".htm", ".css", ".js", ".ts", ".go", ".py", ".rb", ".rs", ".c", ".h", ".cc", ".cpp", ".hpp", ".java",
+		".kt", ".swift", ".sh", ".bash", ".zsh", ".ps1", ".bat", ".sql", ".php", ".pl", ".lua", ".mod", ".sum")
+	add(iconPDF, ".pdf")
+	return m
+}()
+
+// iconFor returns the embedded icon path for a file called name.
+func iconFor(name string, isDir bool) string {
+	if isDir {
+		return iconFolder
+	}
+	if icon, ok := iconsByExtension[strings.ToLower(filepath.Ext(name))]; ok {
+		return icon
+	}
+	return iconGeneric
+}
+
+// Icon is the path of the icon shown next to the entry in the listing.
+func (d directoryListingFileData) Icon() string {
+	return d.prefix + iconFor(d.BaseName, d.IsDir)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIconFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		isDir bool
+		want  string
+	}{
+		{"photos", true, iconFolder},
+		{"photo.jpg", true, iconFolder},
+		{"photo.jpg", false, iconImage},
+		{"PHOTO.JPEG", false, iconImage},
+		{"song.flac", false, iconAudio},
+		{"clip.webm", false, iconVideo},
+		{"backup.tar.gz", false, iconArchive},
+		{"notes.md", false, iconText},
+		{"main.go", false, iconText},
+		{"report.PDF", false, iconPDF},
+		{"binary", false, iconGeneric},
+		{"data.unknown", false, iconGeneric},
+		{".bashrc", false, iconGeneric},
+		{"trailing.", false, iconGeneric},
+	}
+	for _, tt := range tests {
+		if got := iconFor(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("iconFor(%q, %v) = %q, want %q", tt.name, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestIconsAreEmbedded(t *testing.T) {
+	icons := map[string]bool{iconFolder: true, iconGeneric: true}
+	for _, icon := range iconsByExtension {
+		icons[icon] = true
+	}
+	for icon := range icons {
+		if _, err := os.Stat(path.Join("handler", icon)); err != nil {
+			t.Errorf("icon %s: %v", icon, err)
+		}
+	}
+}
+
+func TestIconBelowPrefix(t *testing.T) {
+	d := directoryListingFileData{BaseName: "a.txt", prefix: "/files"}
+	if got, want := d.Icon(), "/files"+iconText; got != want {
+		t.Errorf("Icon() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func indexTree(t *testing.T) string {
+	return writeTestTree(t, map[string]string{
+		"index.html":          "root index",
+		"htm/index.htm":       "htm index",
+		"plain/a.txt":         "a",
+		"site/index.html":     "site index",
+		"site/deep/index.htm": "deep index",
+		"both/index.html":     "html index",
+		"both/index.htm":      "htm index",
+		"fake/index.html/":    "",
+	})
+}
+
+func TestIndex(t *testing.T) {
+	h := newTestHandler(t, "/", indexTree(t))
+	h.index = true
+	tests := []struct {
+		target, want string
+	}{
+		{"/", "root index"},
+		{"/htm/", "htm index"},
+		{"/site/", "site index"},
+		{"/site/deep/", "deep index"},
+		{"/both/", "html index"},
+	}
+	for _, tt := range tests {
+		w := serveTest(h, http.MethodGet, tt.target, nil)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("GET %s: %d %q, want %q", tt.target, w.Code, w.Body.String(), tt.want)
+		}
+	}
+	for _, target := range []string{"/plain/", "/fake/", "/site/?listing=true"} {
+		w := serveTest(h, http.MethodGet, target, nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<table") {
+			t.Errorf("GET %s: %d, want a listing", target, w.Code)
+		}
+	}
+	w := serveTest(h, http.MethodGet, "/site/deep", nil)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/site/deep/" {
+		t.Errorf("GET /site/deep: %d to %q, want a redirect to /site/deep/", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestIndexOff(t *testing.T) {
+	h := newTestHandler(t, "/", indexTree(t))
+	for _, target := range []string{"/", "/site/", "/site/deep/"} {
+		w := serveTest(h, http.MethodGet, target, nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<table") {
+			t.Errorf("GET %s: %d, want a listing", target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MarshalJSON encodes a listing entry with its size in bytes, an RFC 3339
+// modification time, left out if the entry could not be stat'ed, and the URL
+// as a string.
+func (d directoryListingFileData) MarshalJSON() ([]byte, error) {
+	url := ""
+	if d.URL != nil {
+		url = d.URL.String()
+	}
+	lastModified := ""
+	if !d.ModTime.IsZero() {
+		lastModified = d.ModTime.UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(struct {
+		Name         string        `json:"name"`
+		Size         fileSizeBytes `json:"size"`
+		IsDir        bool          `json:"isDir"`
+		LastModified string        `json:"lastModified,omitempty"`
+		URL          string        `json:"url"`
+	}{
+		Name:         d.Name,
+		Size:         d.Size,
+		IsDir:        d.IsDir,
+		LastModified: lastModified,
+		URL:          url,
+	})
+}
+
+// wantsJSON reports whether the client asked for a JSON response, either with
+// ?format=json or an Accept header naming application/json.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get(formatKey) == formatJSON {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		if mediaType == jsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+func serveJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", jsonContentType)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
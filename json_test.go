@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// checkGolden compares got with the file testdata/name, or with -update
+// writes it there.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
+
+// jsonListingTree is a tree with fixed modification times.
+func jsonListingTree(t *testing.T) string {
+	dir := writeTestTree(t, map[string]string{
+		"a.txt":       "hello",
+		"file10.log":  "0123456789",
+		"file2.log":   "01",
+		"b c#%.txt":   "x",
+		"sub/":        "",
+		"sub/d.txt":   "ddd",
+		"Zettel.md":   "# z",
+		"empty/":      "",
+		"ünïcödé.txt": "é",
+	})
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	err := filepath.Walk(dir, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, mtime, mtime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// normalizedListing re-encodes a JSON listing with the sizes of directories,
+// which depend on the file system, set to 0.
+func normalizedListing(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var entries []struct {
+		Name         string `json:"name"`
+		Size         int64  `json:"size"`
+		IsDir        bool   `json:"isDir"`
+		LastModified string `json:"lastModified,omitempty"`
+		URL          string `json:"url"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entries); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	for i := range entries {
+		if entries[i].IsDir {
+			entries[i].Size = 0
+		}
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestJSONListingGolden(t *testing.T) {
+	h := newTestHandler(t, "/", jsonListingTree(t))
+	tests := []struct {
+		target, accept, golden string
+	}{
+		{"/?format=json", "", "listing.json"},
+		{"/", "application/json", "listing-accept.json"},
+		{"/", "text/html;q=0.9, application/json", "listing-accept.json"},
+		{"/sub/?format=json", "", "listing-sub.json"},
+		{"/?format=json&C=S;O=D", "", "listing-size-desc.json"},
+	}
+	for _, tt := range tests {
+		w := serveTest(h, http.MethodGet, tt.target, nil, "Accept", tt.accept)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", tt.target, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != jsonContentType {
+			t.Errorf("GET %s: Content-Type %q", tt.target, ct)
+		}
+		checkGolden(t, tt.golden, normalizedListing(t, w.Body.Bytes()))
+	}
+}
+
+func TestJSONListingIsStable(t *testing.T) {
+	h := newTestHandler(t, "/", jsonListingTree(t))
+	first := serveTest(h, http.MethodGet, "/?format=json", nil).Body.String()
+	for i := 0; i < 5; i++ {
+		if again := serveTest(h, http.MethodGet, "/?format=json", nil).Body.String(); again != first {
+			t.Fatalf("listing changed between requests:\n%s\n%s", first, again)
+		}
+	}
+}
+
+func TestHTMLListingUnchanged(t *testing.T) {
+	h := newTestHandler(t, "/", jsonListingTree(t))
+	for _, accept := range []string{"", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"} {
+		w := serveTest(h, http.MethodGet, "/", nil, "Accept", accept)
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("Accept %q: Content-Type %q", accept, ct)
+		}
+		if !strings.Contains(w.Body.String(), "<table") {
+			t.Errorf("Accept %q: no listing table in\n%s", accept, w.Body)
+		}
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		target, accept string
+		want           bool
+	}{
+		{"/", "", false},
+		{"/?format=json", "", true},
+		{"/?format=html", "application/json", true},
+		{"/", "application/json; charset=utf-8", true},
+		{"/", "text/html, application/json;q=0.5", true},
+		{"/", "application/jsonx", false},
+		{"/", "*/*", false},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, tt.target, nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := wantsJSON(r); got != tt.want {
+			t.Errorf("wantsJSON(%s, Accept %q) = %v, want %v", tt.target, tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+)
+
+const landingTemplateText = `
+<html>
+<head>
+	<title>Shared directories</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<link rel="stylesheet" href="{{ .Static }}/layout/autoindex.css" type="text/css">
+</head>
+<body>
+<h1>Shared directories</h1>
+<table>
+	<tbody>
+	{{- range .Routes }}
+		<tr>
+			<td class="indexcolicon"><a href="{{ .URL.String }}"><img src="{{ $.Static }}/icons/folder.png" alt="[DIR]"></a></td>
+			<td class="indexcolname"><a href="{{ .URL.String }}">{{ .Name }}</a>
+				{{- if .Auth }} <span class="badge">login</span>{{ end }}
+				{{- if .Dropbox }} <span class="badge">drop box</span>{{ else if .Upload }} <span class="badge">upload</span>{{ end }}
+				{{- if .Delete }} <span class="badge">delete</span>{{ end }}</td>
+		</tr>
+	{{- end }}
+	</tbody>
+</table>
+</body>
+</html>
+`
+
+var landingTemplate = template.Must(template.New("").Parse(landingTemplateText))
+
+type landingRoute struct {
+	Name   string
+	URL    *url.URL
+	Upload bool
+	Delete bool
+	Auth   bool
+	// Dropbox only takes uploads
+	Dropbox bool
+}
+
+// landingHandler lists the configured routes at the server root. Local paths
+// are not shown.
+type landingHandler struct {
+	routes []landingRoute
+	csp    string
+	prefix urlPrefix
+}
+
+func newLandingHandler(configs []routeConfig, csp string, prefix urlPrefix) *landingHandler {
+	h := &landingHandler{csp: csp, prefix: prefix}
+	for _, rc := range configs {
+		h.routes = append(h.routes, landingRoute{
+			Name:   filepath.Base(rc.Route),
+			URL:    &url.URL{Path: rc.Route},
+			Upload: rc.AllowUpload,
+			Delete: rc.AllowDelete,
+			Auth:   rc.Auth != nil,
+
+			Dropbox: rc.Dropbox,
+		})
+	}
+	sort.Slice(h.routes, func(i, j int) bool { return h.routes[i].URL.Path < h.routes[j].URL.Path })
+	return h
+}
+
+func (h *landingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != rootRoute {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if h.csp != "" {
+		w.Header().Set("Content-Security-Policy", h.csp)
+	}
+	routes := make([]landingRoute, len(h.routes))
+	for i, route := range h.routes {
+		route.URL = h.prefix.url(r, route.URL)
+		routes[i] = route
+	}
+	gw, done := gzipWriter(w, r)
+	if err := landingTemplate.Execute(gw, struct {
+		Routes []landingRoute
+		Static string
+	}{routes, h.prefix.path(r, "/static")}); err != nil {
+		return
+	}
+	_ = done()
+}
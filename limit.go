@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryAfterSeconds is the Retry-After sent with 503 responses from
+// limitHandler.
+const retryAfterSeconds = 5
+
+// limits is the state shared by the limitHandlers of all routes: requests
+// beyond maxConcurrent in flight overall, or beyond maxPerClient GET and HEAD
+// requests from one client IP, are rejected with 503 instead of queueing.
+// Response bodies go through bandwidth, when set. Requests beyond the
+// request rates, for changing requests overall and per client and for
+// downloads per client, are rejected with 429.
+type limits struct {
+	maxConcurrent   int
+	maxPerClient    int
+	bandwidth       *tokenBucket
+	writeRate       *requestRate
+	writeClientRate *clientRates
+	readClientRate  *clientRates
+
+	mu       sync.Mutex
+	inFlight int
+	clients  map[string]int
+}
+
+// enabled reports whether any limit is configured.
+func (l *limits) enabled() bool {
+	return l.maxConcurrent > 0 || l.maxPerClient > 0 || l.bandwidth != nil ||
+		l.writeRate != nil || l.writeClientRate != nil || l.readClientRate != nil
+}
+
+// admit applies the request rates to a request by client with method, or
+// returns how long the client should wait before trying again. A client
+// over its own rate does not use up the overall one.
+func (l *limits) admit(client, method string, now time.Time) (bool, time.Duration) {
+	if method == http.MethodGet || method == http.MethodHead {
+		if l.readClientRate != nil {
+			return l.readClientRate.take(client, now)
+		}
+		return true, 0
+	}
+	if csrfSafeMethods[method] {
+		return true, 0
+	}
+	if l.writeClientRate != nil {
+		if ok, wait := l.writeClientRate.take(client, now); !ok {
+			return false, wait
+		}
+	}
+	if l.writeRate != nil {
+		return l.writeRate.take(now)
+	}
+	return true, 0
+}
+
+type limitHandler struct {
+	handler http.Handler
+	limits  *limits
+}
+
+func (h *limitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	download := r.Method == http.MethodGet || r.Method == http.MethodHead
+	client := clientIP(r)
+	if ok, wait := h.limits.admit(client, r.Method, time.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	if !h.limits.acquire(client, download) {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.limits.release(client, download)
+	if h.limits.bandwidth != nil {
+		w = &throttledResponseWriter{ResponseWriter: w, bucket: h.limits.bandwidth, ctx: r.Context()}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+func (l *limits) acquire(client string, download bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConcurrent > 0 && l.inFlight >= l.maxConcurrent {
+		return false
+	}
+	if download && l.maxPerClient > 0 {
+		if l.clients[client] >= l.maxPerClient {
+			return false
+		}
+		if l.clients == nil {
+			l.clients = make(map[string]int)
+		}
+		l.clients[client]++
+	}
+	l.inFlight++
+	return true
+}
+
+func (l *limits) release(client string, download bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if download && l.maxPerClient > 0 {
+		if l.clients[client]--; l.clients[client] <= 0 {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// clientIP is the address of the client of r without the port, the one of the
+// client behind a trusted proxy once proxyHandler has seen r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokenBucket limits throughput to rate bytes per second, allowing bursts of
+// up to one second's worth.
+type tokenBucket struct {
+	rate int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// burst is the largest amount a single wait call may take.
+func (b *tokenBucket) burst() int {
+	if b.rate < 1<<10 {
+		return int(max(b.rate, 1))
+	}
+	return int(min(b.rate, 64<<10))
+}
+
+// wait blocks until n bytes may be sent. Tokens are taken up front, so
+// concurrent writers are served in the order they asked.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(float64(b.rate), b.tokens+now.Sub(b.last).Seconds()*float64(b.rate))
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(deficit / float64(b.rate) * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledResponseWriter paces the response body through a shared bucket.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	bucket *tokenBucket
+	ctx    context.Context
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := min(len(p), t.bucket.burst())
+		if err := t.bucket.wait(t.ctx, chunk); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (t *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBandwidthNearCap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes seconds to pace")
+	}
+	const rate = 512 << 10
+	dir := writeTestTree(t, map[string]string{
+		"a.bin": strings.Repeat("a", rate),
+		"b.bin": strings.Repeat("b", rate),
+	})
+	h := &limitHandler{handler: newTestHandler(t, "/", dir), limits: &limits{bandwidth: newTokenBucket(rate)}}
+	// the bucket starts full, so time one second's worth to empty it first
+	serveTest(h, http.MethodGet, "/a.bin", nil)
+	start := time.Now()
+	var wg sync.WaitGroup
+	var total int64
+	var mu sync.Mutex
+	for _, target := range []string{"/a.bin", "/b.bin", "/?tar=1"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serveTest(h, http.MethodGet, target, nil)
+			if w.Code != http.StatusOK {
+				t.Errorf("GET %s: status %d", target, w.Code)
+			}
+			mu.Lock()
+			total += int64(w.Body.Len())
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start).Seconds()
+	throughput := float64(total) / elapsed
+	if throughput > rate*1.1 || throughput < rate*0.8 {
+		t.Errorf("%d bytes in %.2fs, %.0f bytes/s for a cap of %d", total, elapsed, throughput, rate)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+	for _, l := range []*limits{{maxConcurrent: 1}, {maxPerClient: 1}} {
+		h := &limitHandler{handler: blocking, limits: l}
+		var wg sync.WaitGroup
+		start := func(r *http.Request) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.ServeHTTP(httptest.NewRecorder(), r)
+			}()
+			<-entered
+		}
+		start(httptest.NewRequest(http.MethodGet, "/", nil))
+		w := serveTest(h, http.MethodGet, "/", nil)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("%+v: second request %d, Retry-After %q", l, w.Code, w.Header().Get("Retry-After"))
+		}
+		if l.maxPerClient > 0 {
+			// another client is still let in
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.2:1234"
+			start(r)
+			release <- struct{}{}
+		}
+		release <- struct{}{}
+		wg.Wait()
+		if l.inFlight != 0 || len(l.clients) != 0 {
+			t.Errorf("%+v: still counted after the requests", l)
+		}
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	for rate, want := range map[int64]int{1: 1, 100: 100, 1 << 10: 1 << 10, 1 << 20: 64 << 10} {
+		if got := newTokenBucket(rate).burst(); got != want {
+			t.Errorf("burst of %d bytes/s = %d, want %d", rate, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	listingCacheSize = 256
+
+	listingCacheLogInterval = time.Minute
+)
+
+// listingCache keeps the sorted, stat'ed entries of recently listed
+// directories for -listing-cache. An entry is used while it is younger than
+// ttl and the directory's modification time is unchanged; changes the
+// server makes itself drop the affected entries right away. The cache holds
+// at most size directories, evicting the least recently used.
+type listingCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int
+	hits    int
+	misses  int
+}
+
+type listingEntry struct {
+	key     string
+	modTime time.Time
+	at      time.Time
+	// sorted holds the entries in each order asked for so far; they must
+	// not be modified
+	sorted map[listingSort][]os.FileInfo
+}
+
+func newListingCache(ttl time.Duration) *listingCache {
+	return &listingCache{ttl: ttl, entries: make(map[string]*list.Element), lru: list.New(), size: listingCacheSize}
+}
+
+// listingCacheKey tells apart routes serving the same directory, since each
+// may hide different entries.
+func listingCacheKey(route, osPath string) string {
+	return route + "\x00" + filepath.Clean(osPath)
+}
+
+func (c *listingCache) get(key string, modTime time.Time, s listingSort) ([]os.FileInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		entry := e.Value.(*listingEntry)
+		if files, sorted := entry.sorted[s]; sorted && entry.modTime.Equal(modTime) && time.Since(entry.at) < c.ttl {
+			c.lru.MoveToFront(e)
+			c.hits++
+			return files, true
+		}
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *listingCache) put(key string, modTime time.Time, s listingSort, files []os.FileInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*listingEntry)
+		if !entry.modTime.Equal(modTime) || time.Since(entry.at) >= c.ttl {
+			*entry = listingEntry{key: key, modTime: modTime, at: time.Now(), sorted: make(map[listingSort][]os.FileInfo)}
+		}
+		entry.sorted[s] = files
+		c.lru.MoveToFront(e)
+		return
+	}
+	entry := &listingEntry{key: key, modTime: modTime, at: time.Now(), sorted: map[listingSort][]os.FileInfo{s: files}}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*listingEntry).key)
+	}
+}
+
+// invalidate drops the listings of the directory osPath and of its parent,
+// the ones a change to osPath shows up in.
+func (c *listingCache) invalidate(route, osPath string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range []string{osPath, filepath.Dir(osPath)} {
+		if e, ok := c.entries[listingCacheKey(route, p)]; ok {
+			c.lru.Remove(e)
+			delete(c.entries, listingCacheKey(route, p))
+		}
+	}
+}
+
+// logEvery logs the hits and misses of each interval that had any.
+func (c *listingCache) logEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.mu.Lock()
+		hits, misses, cached := c.hits, c.misses, c.lru.Len()
+		c.hits, c.misses = 0, 0
+		c.mu.Unlock()
+		if hits+misses > 0 {
+			log.Printf("listing cache: %d hits, %d misses, %d directories cached", hits, misses, cached)
+		}
+	}
+}
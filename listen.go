@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	unixAddrPrefix    = "unix:"
+	defaultSocketMode = "0660"
+)
+
+// addresses is a repeatable listen address flag. Values are TCP addresses
+// such as 127.0.0.1:8080 and [::1]:8080, or unix:PATH for a Unix socket.
+type addresses struct {
+	Values []string
+	// set tells a value given on the command line apart from the default
+	set bool
+}
+
+func (fv *addresses) help() string {
+	return "address to listen on, HOST:PORT or unix:PATH (repeatable)"
+}
+
+// Set is flag.Value.Set
+func (fv *addresses) Set(v string) error {
+	if !fv.set {
+		fv.Values = nil
+		fv.set = true
+	}
+	if v == "" || v == unixAddrPrefix {
+		return fmt.Errorf("empty address")
+	}
+	fv.Values = append(fv.Values, v)
+	return nil
+}
+
+func (fv *addresses) String() string {
+	return strings.Join(fv.Values, ", ")
+}
+
+// listen opens a listener for each address. If any of them fails, the ones
+// already opened are closed and the error names the address. Unix sockets get
+// the file mode socketMode; a stale socket file left by an earlier run is
+// replaced, and closing the listener removes the file.
+func listen(addrs []string, socketMode string) ([]net.Listener, error) {
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("socket mode %q: %v", socketMode, err)
+	}
+	var listeners []net.Listener
+	fail := func(addr string, err error) ([]net.Listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, fmt.Errorf("listen on %q: %w", addr, err)
+	}
+	for _, addr := range addrs {
+		if path, ok := strings.CutPrefix(addr, unixAddrPrefix); ok {
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+				if c, err := net.Dial("unix", path); err == nil {
+					c.Close()
+					return fail(addr, fmt.Errorf("socket is in use"))
+				}
+				os.Remove(path)
+			}
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				return fail(addr, err)
+			}
+			listeners = append(listeners, l)
+			if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+				return fail(addr, err)
+			}
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fail(addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestUploadFormOnlyWithUploads(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"a.txt": "a", "sub/": ""})
+	for _, allowUpload := range []bool{false, true} {
+		h := newTestHandler(t, "/", dir)
+		h.allowUpload = allowUpload
+		for _, target := range []string{"/", "/sub/"} {
+			body := serveTest(h, http.MethodGet, target, nil).Body.String()
+			form := `<form method="post" action="` + target + `" enctype="multipart/form-data">`
+			if got := strings.Contains(body, form); got != allowUpload {
+				t.Errorf("allowUpload %v, GET %s: upload form shown %v", allowUpload, target, got)
+			}
+			if got := strings.Contains(body, `<input type="file"`); got != allowUpload {
+				t.Errorf("allowUpload %v, GET %s: file input shown %v", allowUpload, target, got)
+			}
+		}
+	}
+}
+
+// multipartBody returns a multipart body with the file parts files, by field
+// file name, and its Content-Type.
+func multipartBody(t *testing.T, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for name, content := range files {
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &b, mw.FormDataContentType()
+}
+
+func TestUploadFormRedirectsToListing(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"sub/": ""})
+	h := newTestHandler(t, "/", dir)
+	h.allowUpload = true
+	body, contentType := multipartBody(t, map[string]string{"new.txt": "uploaded"})
+	w := serveTest(h, http.MethodPost, "/sub/", body, "Content-Type", contentType)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, "/sub/") {
+		t.Errorf("upload redirects to %q, want the listing /sub/", location)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "sub", "new.txt")); err != nil || string(data) != "uploaded" {
+		t.Errorf("uploaded file: %q, %v", data, err)
+	}
+	if listing := serveTest(h, http.MethodGet, "/sub/", nil).Body.String(); !strings.Contains(listing, `href="/sub/new.txt"`) {
+		t.Errorf("listing after the upload lacks the file:\n%s", listing)
+	}
+}
+
+// parentLink returns the href of the Parent Directory row of a listing, or
+// "" if it has none.
+func parentLink(listing string) string {
+	i := strings.Index(listing, `">Parent Directory</a>`)
+	if i < 0 {
+		return ""
+	}
+	return listing[strings.LastIndex(listing[:i], `href="`)+len(`href="`) : i]
+}
+
+func TestParentDirectoryBelowRoute(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"a/b/c/file.txt": "x"})
+	tests := []struct {
+		route string
+		paths map[string]string
+	}{
+		{"/", map[string]string{"/": "", "/a/": "/", "/a/b/": "/a/", "/a/b/c/": "/a/b/"}},
+		{"/files", map[string]string{"/files/": "", "/files/a/": "/files/", "/files/a/b/": "/files/a/", "/files/a/b/c/": "/files/a/b/"}},
+		{"/files/", map[string]string{"/files/": "", "/files/a/": "/files/", "/files/a/b/c/": "/files/a/b/"}},
+	}
+	for _, tt := range tests {
+		var routes routes
+		if err := routes.Set(tt.route + "=" + dir); err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle(routes.Values[0].Route, newTestHandler(t, routes.Values[0].Route, dir))
+		for target, want := range tt.paths {
+			w := serveTest(mux, http.MethodGet, target, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("route %s: GET %s: %d", tt.route, target, w.Code)
+			}
+			body := w.Body.String()
+			if got := parentLink(body); got != want {
+				t.Errorf("route %s: GET %s: parent %q, want %q", tt.route, target, got, want)
+			}
+			if want == "" && strings.Contains(body, "[PARENTDIR]") {
+				t.Errorf("route %s: GET %s: parent icon at the top of the route", tt.route, target)
+			}
+			if tt.route != "/" && strings.Contains(body, `href="/"`) {
+				t.Errorf("route %s: GET %s: link to / outside of the route", tt.route, target)
+			}
+		}
+	}
+}
+
+func TestListingLinksRoundTrip(t *testing.T) {
+	names := []string{"report #3.txt", "100%.txt", "a+b.txt", "space name.txt", "🙂 emoji.txt", "ユニコード.txt", "semi;colon.txt", "amp&er=sand.txt"}
+	if runtime.GOOS != "windows" {
+		names = append(names, "report #3?.txt", "what?.txt")
+	}
+	tree := map[string]string{}
+	for _, name := range names {
+		tree[name] = "content of " + name
+		tree["dir "+name+"/inner.txt"] = "inner of " + name
+	}
+	dir := writeTestTree(t, tree)
+	for _, route := range []string{"/", "/files/"} {
+		h := newTestHandler(t, route, dir)
+		mux := http.NewServeMux()
+		mux.Handle(route, h)
+		listing := serveTest(mux, http.MethodGet, route, nil).Body.String()
+		for _, name := range names {
+			for _, entry := range []struct{ name, content string }{
+				{name, "content of " + name},
+				{"dir " + name + "/inner.txt", "inner of " + name},
+			} {
+				page := listing
+				if strings.Contains(entry.name, "/") {
+					href := listingHref(t, listing, path.Dir(entry.name)+"/")
+					page = serveTest(mux, http.MethodGet, href, nil).Body.String()
+				}
+				href := listingHref(t, page, path.Base(entry.name))
+				w := serveTest(mux, http.MethodGet, href, nil)
+				if w.Code != http.StatusOK || w.Body.String() != entry.content {
+					t.Errorf("route %s: GET %s for %q: %d %q", route, href, entry.name, w.Code, w.Body)
+				}
+			}
+		}
+	}
+}
+
+// listingHref returns the URL the listing links name with, HTML-unescaped.
+func listingHref(t *testing.T, listing, name string) string {
+	t.Helper()
+	for _, m := range listingLink.FindAllStringSubmatch(listing, -1) {
+		if html.UnescapeString(m[2]) == name {
+			href := html.UnescapeString(m[1])
+			if _, err := url.Parse(href); err != nil {
+				t.Fatalf("link for %q: %v", name, err)
+			}
+			return href
+		}
+	}
+	t.Fatalf("no link for %q in\n%s", name, listing)
+	return ""
+}
+
+var listingLink = regexp.MustCompile(`<a href="([^"]*)">([^<]*)</a>`)
+
+// BenchmarkServeDir lists a directory of 50,000 files with os.File.Readdir,
+// which stats every entry as listings once did, with readDir, which stats
+// none, and as served, which stats only the page it shows.
+func BenchmarkServeDir(b *testing.B) {
+	dir := b.TempDir()
+	for i := 0; i < 50000; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%05d.txt", i)), nil, 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Run("Readdir", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			d, err := os.Open(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := d.Readdir(-1); err != nil {
+				b.Fatal(err)
+			}
+			d.Close()
+		}
+	})
+	h := newTestHandler(b, "/", dir)
+	b.Run("readDir", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := h.readDir(dir); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("serveDir", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if w := serveTest(h, http.MethodGet, "/", nil); w.Code != http.StatusOK {
+				b.Fatalf("status %d", w.Code)
+			}
+		}
+	})
+}
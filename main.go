@@ -1,52 +1,264 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/wesleywu/http-file-server/handler"
 )
 
 const (
-	addrEnvVarName           = "ADDR"
-	allowUploadsEnvVarName   = "UPLOADS"
-	allowDeletesEnvVarName   = "DELETES"
-	defaultAddr              = ":8280"
-	portEnvVarName           = "PORT"
-	quietEnvVarName          = "QUIET"
-	rootRoute                = "/"
-	sslCertificateEnvVarName = "SSL_CERTIFICATE"
-	sslKeyEnvVarName         = "SSL_KEY"
+	addrEnvVarName            = "ADDR"
+	allowUploadsEnvVarName    = "UPLOADS"
+	allowDeletesEnvVarName    = "DELETES"
+	authEnvVarName            = "AUTH"
+	davEnvVarName             = "DAV"
+	followSymlinksEnvVarName  = "FOLLOW_SYMLINKS"
+	lexicalSortEnvVarName     = "LEXICAL_SORT"
+	showHiddenEnvVarName      = "HIDDEN"
+	noExtractEnvVarName       = "NO_EXTRACT"
+	extractLimitEnvVarName    = "EXTRACT_LIMIT"
+	noMarkdownEnvVarName      = "NO_MARKDOWN"
+	indexEnvVarName           = "INDEX"
+	spaEnvVarName             = "SPA"
+	noListingEnvVarName       = "NO_LISTING"
+	logFormatEnvVarName       = "LOG_FORMAT"
+	shutdownTimeoutEnvVarName = "SHUTDOWN_TIMEOUT"
+	socketModeEnvVarName      = "SOCKET_MODE"
+	maxConcurrentEnvVarName   = "MAX_CONCURRENT"
+	maxPerClientEnvVarName    = "MAX_PER_CLIENT"
+	rateLimitEnvVarName       = "RATE_LIMIT"
+	writeRateEnvVarName       = "WRITE_RATE"
+	writeClientRateEnvVarName = "WRITE_RATE_PER_CLIENT"
+	readClientRateEnvVarName  = "READ_RATE_PER_CLIENT"
+	requestBurstEnvVarName    = "REQUEST_BURST"
+	headerTimeoutEnvVarName   = "READ_HEADER_TIMEOUT"
+	idleTimeoutEnvVarName     = "IDLE_TIMEOUT"
+	writeTimeoutEnvVarName    = "WRITE_TIMEOUT"
+	maxHeaderBytesEnvVarName  = "MAX_HEADER_BYTES"
+	errorPagesEnvVarName      = "ERROR_PAGES"
+	debugEnvVarName           = "DEBUG"
+	webhookURLEnvVarName      = "WEBHOOK_URL"
+	webhookSecretEnvVarName   = "WEBHOOK_SECRET"
+	webhookEventsEnvVarName   = "WEBHOOK_EVENTS"
+	onUploadEnvVarName        = "ON_UPLOAD"
+	hookTimeoutEnvVarName     = "HOOK_TIMEOUT"
+	hookConcurrencyEnvVarName = "HOOK_CONCURRENCY"
+	hookSyncEnvVarName        = "HOOK_SYNC"
+	auditLogEnvVarName        = "AUDIT_LOG"
+	auditRequiredEnvVarName   = "AUDIT_REQUIRED"
+	statsEnvVarName           = "STATS"
+	statsFileEnvVarName       = "STATS_FILE"
+	precompressedEnvVarName   = "PRECOMPRESSED"
+	hidePrecompEnvVarName     = "HIDE_PRECOMPRESSED"
+	compressEnvVarName        = "COMPRESS"
+	compressTypesEnvVarName   = "COMPRESS_TYPES"
+	compressMinSizeEnvVarName = "COMPRESS_MIN_SIZE"
+	mimeEnvVarName            = "MIME"
+	mimeTypesEnvVarName       = "MIME_TYPES"
+	defaultTypeEnvVarName     = "DEFAULT_TYPE"
+	forceDownloadEnvVarName   = "FORCE_DOWNLOAD"
+	archiveSpoolEnvVarName    = "ARCHIVE_SPOOL"
+	spoolSizeEnvVarName       = "ARCHIVE_SPOOL_SIZE"
+	archiveLevelEnvVarName    = "ARCHIVE_COMPRESSION"
+	archiveWorkersEnvVarName  = "ARCHIVE_WORKERS"
+	noArchiveEnvVarName       = "NO_ARCHIVE"
+	maxArchiveSizeEnvVarName  = "MAX_ARCHIVE_SIZE"
+	treeDepthEnvVarName       = "TREE_DEPTH"
+	s3CompatEnvVarName        = "S3_COMPAT"
+	feedEntriesEnvVarName     = "FEED_ENTRIES"
+	feedDepthEnvVarName       = "FEED_DEPTH"
+	browseZipEnvVarName       = "BROWSE_ZIP"
+	vhostEnvVarName           = "VHOST"
+	letsEncryptEnvVarName     = "LETSENCRYPT"
+	hostnameEnvVarName        = "LETSENCRYPT_HOSTNAME"
+	cacheDirEnvVarName        = "LETSENCRYPT_CACHE_DIR"
+	acmeDirectoryEnvVarName   = "ACME_DIRECTORY"
+	noHTTPRedirectEnvVarName  = "NO_HTTP_REDIRECT"
+	clientCAEnvVarName        = "CLIENT_CA"
+	clientCertCNEnvVarName    = "CLIENT_CERT_CN"
+	clientCNWritesEnvVarName  = "CLIENT_CERT_CN_WRITES"
+	clientExemptEnvVarName    = "CLIENT_CERT_EXEMPT"
+	plainAddrEnvVarName       = "PLAIN_ADDR"
+	tokenEnvVarName           = "TOKEN"
+	tokenFileEnvVarName       = "TOKEN_FILE"
+	accessFilesEnvVarName     = "ACCESS_FILES"
+	accessFileNameEnvVarName  = "ACCESS_FILE_NAME"
+	configEnvVarName          = "CONFIG"
+	landingEnvVarName         = "LANDING"
+	corsOriginEnvVarName      = "CORS_ORIGIN"
+	noNosniffEnvVarName       = "NO_NOSNIFF"
+	cspEnvVarName             = "CSP"
+	userContentEnvVarName     = "USER_CONTENT"
+	noCSRFEnvVarName          = "NO_CSRF"
+	onConflictEnvVarName      = "ON_CONFLICT"
+	maxUploadSizeEnvVarName   = "MAX_UPLOAD_SIZE"
+	strictNamesEnvVarName     = "STRICT_NAMES"
+	uploadModeEnvVarName      = "UPLOAD_MODE"
+	uploadDirModeEnvVarName   = "UPLOAD_DIR_MODE"
+	shareSecretEnvVarName     = "SHARE_SECRET"
+	dropboxEnvVarName         = "DROPBOX"
+	trashDirEnvVarName        = "TRASH_DIR"
+	cliTextEnvVarName         = "CLI_TEXT"
+	pageSizeEnvVarName        = "PAGE_SIZE"
+	listingCacheEnvVarName    = "LISTING_CACHE"
+	baseURLEnvVarName         = "BASE_URL"
+	forwardedPrefixEnvVarName = "TRUST_FORWARDED_PREFIX"
+	trustedProxiesEnvVarName  = "TRUSTED_PROXIES"
+	allowEnvVarName           = "ALLOW"
+	denyEnvVarName            = "DENY"
+	trashRetentionEnvVarName  = "TRASH_RETENTION"
+	templateEnvVarName        = "TEMPLATE"
+	defaultAddr               = ":8280"
+	portEnvVarName            = "PORT"
+	quietEnvVarName           = "QUIET"
+	rootRoute                 = "/"
+	sslCertificateEnvVarName  = "SSL_CERTIFICATE"
+	sslKeyEnvVarName          = "SSL_KEY"
 )
 
 var (
-	addrFlag         = os.Getenv(addrEnvVarName)
-	allowUploadsFlag = os.Getenv(allowUploadsEnvVarName) == "true"
-	allowDeletesFlag = os.Getenv(allowDeletesEnvVarName) == "true"
-	portFlag64, _    = strconv.ParseInt(os.Getenv(portEnvVarName), 10, 64)
-	portFlag         = int(portFlag64)
-	quietFlag        = os.Getenv(quietEnvVarName) == "true"
-	routesFlag       routes
-	sslCertificate   = os.Getenv(sslCertificateEnvVarName)
-	sslKey           = os.Getenv(sslKeyEnvVarName)
-	simpleFlag       bool
+	addrFlag            = addresses{Values: []string{defaultAddr}}
+	allowUploadsFlag    = os.Getenv(allowUploadsEnvVarName) == "true"
+	allowDeletesFlag    = os.Getenv(allowDeletesEnvVarName) == "true"
+	authFlag            credentials
+	davFlag             = os.Getenv(davEnvVarName) == "true"
+	followSymlinksFlag  = os.Getenv(followSymlinksEnvVarName) == "true"
+	lexicalSortFlag     = os.Getenv(lexicalSortEnvVarName) == "true"
+	showHiddenFlag      = os.Getenv(showHiddenEnvVarName) == "true"
+	hideFlag            patterns
+	noExtractFlag       = os.Getenv(noExtractEnvVarName) == "true"
+	extractLimitFlag    = envInt64(extractLimitEnvVarName, defaultExtractLimit)
+	noMarkdownFlag      = os.Getenv(noMarkdownEnvVarName) == "true"
+	indexFlag           = os.Getenv(indexEnvVarName) == "true"
+	spaFlag             = os.Getenv(spaEnvVarName) == "true"
+	noListingFlag       routeSwitch
+	dropboxFlag         routeSwitch
+	forceDownloadFlag   routeSwitch
+	logFormatFlag       = os.Getenv(logFormatEnvVarName)
+	shutdownTimeoutFlag = envDuration(shutdownTimeoutEnvVarName, defaultShutdownTimeout)
+	socketModeFlag      = os.Getenv(socketModeEnvVarName)
+	maxConcurrentFlag   = int(envInt64(maxConcurrentEnvVarName, 0))
+	maxPerClientFlag    = int(envInt64(maxPerClientEnvVarName, 0))
+	rateLimitFlag       = envInt64(rateLimitEnvVarName, 0)
+	writeRateFlag       = envFloat64(writeRateEnvVarName, 0)
+	writeClientRateFlag = envFloat64(writeClientRateEnvVarName, 0)
+	readClientRateFlag  = envFloat64(readClientRateEnvVarName, 0)
+	requestBurstFlag    = int(envInt64(requestBurstEnvVarName, 0))
+	headerTimeoutFlag   = envDuration(headerTimeoutEnvVarName, defaultReadHeaderTimeout)
+	idleTimeoutFlag     = envDuration(idleTimeoutEnvVarName, defaultIdleTimeout)
+	writeTimeoutFlag    = envDuration(writeTimeoutEnvVarName, defaultWriteTimeout)
+	maxHeaderBytesFlag  = int(envInt64(maxHeaderBytesEnvVarName, defaultMaxHeaderBytes))
+	errorPagesFlag      = os.Getenv(errorPagesEnvVarName)
+	debugFlag           = os.Getenv(debugEnvVarName) == "true"
+	webhookURLFlag      = os.Getenv(webhookURLEnvVarName)
+	webhookSecretFlag   = os.Getenv(webhookSecretEnvVarName)
+	webhookEventsFlag   = os.Getenv(webhookEventsEnvVarName)
+	onUploadFlag        = os.Getenv(onUploadEnvVarName)
+	hookTimeoutFlag     = envDuration(hookTimeoutEnvVarName, defaultHookTimeout)
+	hookConcurrencyFlag = int(envInt64(hookConcurrencyEnvVarName, defaultHookConcurrency))
+	hookSyncFlag        = os.Getenv(hookSyncEnvVarName) == "true"
+	auditLogFlag        = os.Getenv(auditLogEnvVarName)
+	auditRequiredFlag   = os.Getenv(auditRequiredEnvVarName) == "true"
+	statsFlag           = os.Getenv(statsEnvVarName) == "true"
+	statsFileFlag       = os.Getenv(statsFileEnvVarName)
+	precompressedFlag   = os.Getenv(precompressedEnvVarName) == "true"
+	hidePrecompFlag     = os.Getenv(hidePrecompEnvVarName) == "true"
+	compressFlag        = os.Getenv(compressEnvVarName) == "true"
+	compressTypesFlag   = os.Getenv(compressTypesEnvVarName)
+	compressMinSizeFlag = envInt64(compressMinSizeEnvVarName, defaultCompressMinSize)
+	mimeFlag            extensionTypes
+	mimeTypesFlag       = os.Getenv(mimeTypesEnvVarName)
+	defaultTypeFlag     = os.Getenv(defaultTypeEnvVarName)
+	archiveSpoolFlag    = os.Getenv(archiveSpoolEnvVarName)
+	spoolSizeFlag       = envInt64(spoolSizeEnvVarName, defaultSpoolSize)
+	archiveLevelFlag    = int(envInt64(archiveLevelEnvVarName, defaultArchiveLevel))
+	archiveWorkersFlag  = int(envInt64(archiveWorkersEnvVarName, 0))
+	noArchiveFlag       = os.Getenv(noArchiveEnvVarName) == "true"
+	maxArchiveSizeFlag  = envInt64(maxArchiveSizeEnvVarName, 0)
+	treeDepthFlag       = int(envInt64(treeDepthEnvVarName, defaultTreeDepth))
+	s3CompatFlag        = os.Getenv(s3CompatEnvVarName) == "true"
+	feedEntriesFlag     = int(envInt64(feedEntriesEnvVarName, defaultFeedEntries))
+	feedDepthFlag       = int(envInt64(feedDepthEnvVarName, defaultFeedDepth))
+	browseZipFlag       = os.Getenv(browseZipEnvVarName) == "true"
+	configFlag          = os.Getenv(configEnvVarName)
+	landingFlag         = os.Getenv(landingEnvVarName) == "true"
+	corsOriginFlag      origins
+	trustedProxiesFlag  networks
+	allowFlag           networks
+	denyFlag            networks
+	noNosniffFlag       = os.Getenv(noNosniffEnvVarName) == "true"
+	cspFlag, cspSet     = os.LookupEnv(cspEnvVarName)
+	userContentFlag     = os.Getenv(userContentEnvVarName)
+	noCSRFFlag          = os.Getenv(noCSRFEnvVarName) == "true"
+	onConflictFlag      = os.Getenv(onConflictEnvVarName)
+	maxUploadSizeFlag   = envInt64(maxUploadSizeEnvVarName, 0)
+	strictNamesFlag     = os.Getenv(strictNamesEnvVarName) == "true"
+	uploadModeFlag      = os.Getenv(uploadModeEnvVarName)
+	uploadDirModeFlag   = os.Getenv(uploadDirModeEnvVarName)
+	shareSecretFlag     = os.Getenv(shareSecretEnvVarName)
+	trashDirFlag        = os.Getenv(trashDirEnvVarName)
+	cliTextFlag         = os.Getenv(cliTextEnvVarName) == "true"
+	pageSizeFlag        = int(envInt64(pageSizeEnvVarName, defaultPageSize))
+	listingCacheFlag    = envDuration(listingCacheEnvVarName, 0)
+	baseURLFlag         = os.Getenv(baseURLEnvVarName)
+	forwardedPrefixFlag = os.Getenv(forwardedPrefixEnvVarName) == "true"
+	trashRetentionFlag  = envDuration(trashRetentionEnvVarName, 0)
+	templateFlag        = os.Getenv(templateEnvVarName)
+	portFlag64, _       = strconv.ParseInt(os.Getenv(portEnvVarName), 10, 64)
+	portFlag            = int(portFlag64)
+	quietFlag           = os.Getenv(quietEnvVarName) == "true"
+	routesFlag          routes
+	vhostsFlag          vhosts
+	letsEncryptFlag     = os.Getenv(letsEncryptEnvVarName) == "true"
+	hostnameFlag        = os.Getenv(hostnameEnvVarName)
+	cacheDirFlag        = os.Getenv(cacheDirEnvVarName)
+	acmeDirectoryFlag   = os.Getenv(acmeDirectoryEnvVarName)
+	noHTTPRedirectFlag  = os.Getenv(noHTTPRedirectEnvVarName) == "true"
+	clientCAFlag        = os.Getenv(clientCAEnvVarName)
+	clientCertCNFlag    certNames
+	clientCNWritesFlag  = os.Getenv(clientCNWritesEnvVarName) == "true"
+	clientExemptFlag    exemptPaths
+	plainAddrFlag       addresses
+	tokenFlag           tokens
+	tokenFileFlag       = os.Getenv(tokenFileEnvVarName)
+	accessFilesFlag     = os.Getenv(accessFilesEnvVarName) == "true"
+	accessFileNameFlag  = os.Getenv(accessFileNameEnvVarName)
+	sslCertificate      = os.Getenv(sslCertificateEnvVarName)
+	sslKey              = os.Getenv(sslKeyEnvVarName)
+	simpleFlag          bool
+	tlsSelfSignedFlag   bool
 )
 
 func init() {
 	log.SetFlags(log.LUTC | log.Ldate | log.Ltime)
 	log.SetOutput(os.Stderr)
-	if addrFlag == "" {
-		addrFlag = defaultAddr
+	if v := os.Getenv(addrEnvVarName); v != "" {
+		for _, a := range strings.Split(v, ",") {
+			if err := addrFlag.Set(strings.TrimSpace(a)); err != nil {
+				log.Fatalf("%s: %v", addrEnvVarName, err)
+			}
+		}
+		// addresses on the command line replace the environment's
+		addrFlag.set = false
+	}
+	flag.Var(&addrFlag, "addr", fmt.Sprintf("%s (environment variable %q, comma-separated)", addrFlag.help(), addrEnvVarName))
+	flag.Var(&addrFlag, "a", "(alias for -addr)")
+	if socketModeFlag == "" {
+		socketModeFlag = defaultSocketMode
 	}
-	flag.StringVar(&addrFlag, "addr", addrFlag, fmt.Sprintf("address to listen on (environment variable %q)", addrEnvVarName))
-	flag.StringVar(&addrFlag, "a", addrFlag, "(alias for -addr)")
+	flag.StringVar(&socketModeFlag, "socket-mode", socketModeFlag, fmt.Sprintf("octal file mode of unix: sockets (environment variable %q)", socketModeEnvVarName))
 	flag.IntVar(&portFlag, "port", portFlag, fmt.Sprintf("port to listen on (overrides -addr port) (environment variable %q)", portEnvVarName))
 	flag.IntVar(&portFlag, "p", portFlag, "(alias for -port)")
 	flag.BoolVar(&quietFlag, "quiet", quietFlag, fmt.Sprintf("disable all log output (environment variable %q)", quietEnvVarName))
@@ -55,15 +267,241 @@ func init() {
 	flag.BoolVar(&allowUploadsFlag, "u", allowUploadsFlag, "(alias for -uploads)")
 	flag.BoolVar(&allowDeletesFlag, "deletes", allowDeletesFlag, fmt.Sprintf("allow deletes (environment variable %q)", allowDeletesEnvVarName))
 	flag.BoolVar(&allowDeletesFlag, "d", allowDeletesFlag, "(alias for -deletes)")
+	if v := os.Getenv(authEnvVarName); v != "" {
+		if err := authFlag.Set(v); err != nil {
+			log.Fatalf("%s: %v", authEnvVarName, err)
+		}
+	}
+	flag.Var(&authFlag, "auth", fmt.Sprintf("%s (environment variable %q)", authFlag.help(), authEnvVarName))
+	flag.BoolVar(&davFlag, "dav", davFlag, fmt.Sprintf("answer WebDAV requests (writes still need -uploads/-deletes) (environment variable %q)", davEnvVarName))
+	flag.BoolVar(&followSymlinksFlag, "follow-symlinks", followSymlinksFlag, fmt.Sprintf("serve symlinks pointing outside of the served paths (environment variable %q)", followSymlinksEnvVarName))
+	flag.BoolVar(&lexicalSortFlag, "lexical-sort", lexicalSortFlag, fmt.Sprintf("sort listings byte-wise instead of in natural order (environment variable %q)", lexicalSortEnvVarName))
+	flag.BoolVar(&showHiddenFlag, "hidden", showHiddenFlag, fmt.Sprintf("show and serve dotfiles (environment variable %q)", showHiddenEnvVarName))
+	flag.Var(&hideFlag, "hide", hideFlag.help())
+	flag.BoolVar(&noExtractFlag, "no-extract", noExtractFlag, fmt.Sprintf("never unpack uploaded archives (environment variable %q)", noExtractEnvVarName))
+	flag.Int64Var(&extractLimitFlag, "extract-limit", extractLimitFlag, fmt.Sprintf("maximum total bytes unpacked from one uploaded archive (environment variable %q)", extractLimitEnvVarName))
+	flag.BoolVar(&noMarkdownFlag, "no-markdown", noMarkdownFlag, fmt.Sprintf("never render READMEs or ?render=md as HTML (environment variable %q)", noMarkdownEnvVarName))
+	flag.BoolVar(&indexFlag, "index", indexFlag, fmt.Sprintf("serve index.html or index.htm instead of listing directories that have one (environment variable %q)", indexEnvVarName))
+	flag.BoolVar(&spaFlag, "spa", spaFlag, fmt.Sprintf("answer GET requests for missing paths without an extension with the route's index.html (environment variable %q)", spaEnvVarName))
+	if v := os.Getenv(noListingEnvVarName); v != "" {
+		for _, route := range strings.Split(v, ",") {
+			_ = noListingFlag.Set(strings.TrimSpace(route))
+		}
+	}
+	flag.Var(&noListingFlag, "no-listing", fmt.Sprintf("answer directory requests with 403; -no-listing=ROUTE (repeatable) limits this to ROUTE (environment variable %q, true or a comma-separated list of routes)", noListingEnvVarName))
+	if v := os.Getenv(dropboxEnvVarName); v != "" {
+		for _, route := range strings.Split(v, ",") {
+			_ = dropboxFlag.Set(strings.TrimSpace(route))
+		}
+	}
+	if v := os.Getenv(forceDownloadEnvVarName); v != "" {
+		for _, route := range strings.Split(v, ",") {
+			_ = forceDownloadFlag.Set(strings.TrimSpace(route))
+		}
+	}
+	flag.Var(&forceDownloadFlag, "force-download", fmt.Sprintf("send files as attachments unless requested with ?inline=1; -force-download=ROUTE (repeatable) limits this to ROUTE (environment variable %q, true or a comma-separated list of routes)", forceDownloadEnvVarName))
+	flag.Var(&dropboxFlag, "dropbox", fmt.Sprintf("take uploads but list only the upload form and refuse downloads, deletes and other writes; -dropbox=ROUTE (repeatable) limits this to ROUTE (environment variable %q, true or a comma-separated list of routes)", dropboxEnvVarName))
+	if logFormatFlag == "" {
+		logFormatFlag = logFormatPlain
+	}
+	flag.StringVar(&logFormatFlag, "log-format", logFormatFlag, fmt.Sprintf("access log format, %q or %q (environment variable %q)", logFormatPlain, logFormatJSON, logFormatEnvVarName))
+	flag.DurationVar(&shutdownTimeoutFlag, "shutdown-timeout", shutdownTimeoutFlag, fmt.Sprintf("how long to wait for in-flight requests on SIGINT/SIGTERM (environment variable %q)", shutdownTimeoutEnvVarName))
+	flag.IntVar(&maxConcurrentFlag, "max-concurrent", maxConcurrentFlag, fmt.Sprintf("maximum requests served at once, 0 for no limit (environment variable %q)", maxConcurrentEnvVarName))
+	flag.IntVar(&maxPerClientFlag, "max-per-client", maxPerClientFlag, fmt.Sprintf("maximum concurrent downloads per client IP, 0 for no limit (environment variable %q)", maxPerClientEnvVarName))
+	flag.Int64Var(&rateLimitFlag, "rate-limit", rateLimitFlag, fmt.Sprintf("total bandwidth cap for responses in bytes per second, 0 for no limit (environment variable %q)", rateLimitEnvVarName))
+	flag.Float64Var(&writeRateFlag, "write-rate", writeRateFlag, fmt.Sprintf("maximum uploads, deletes and other changing requests per second overall, answering 429 beyond it; 0 for no limit (environment variable %q)", writeRateEnvVarName))
+	flag.Float64Var(&writeClientRateFlag, "write-rate-per-client", writeClientRateFlag, fmt.Sprintf("maximum changing requests per second per client IP, 0 for no limit (environment variable %q)", writeClientRateEnvVarName))
+	flag.Float64Var(&readClientRateFlag, "read-rate-per-client", readClientRateFlag, fmt.Sprintf("maximum GET and HEAD requests per second per client IP, 0 for no limit (environment variable %q)", readClientRateEnvVarName))
+	flag.DurationVar(&headerTimeoutFlag, "read-header-timeout", headerTimeoutFlag, fmt.Sprintf("time clients have to send a request's headers, 0 for no limit (environment variable %q)", headerTimeoutEnvVarName))
+	flag.DurationVar(&idleTimeoutFlag, "idle-timeout", idleTimeoutFlag, fmt.Sprintf("how long an idle keep-alive connection is kept open, 0 for the -read-header-timeout (environment variable %q)", idleTimeoutEnvVarName))
+	flag.DurationVar(&writeTimeoutFlag, "write-timeout", writeTimeoutFlag, fmt.Sprintf("time to write a listing or other generated page, 0 for no limit; file, archive and upload transfers have none (environment variable %q)", writeTimeoutEnvVarName))
+	flag.IntVar(&maxHeaderBytesFlag, "max-header-bytes", maxHeaderBytesFlag, fmt.Sprintf("maximum size of a request's headers (environment variable %q)", maxHeaderBytesEnvVarName))
+	flag.IntVar(&requestBurstFlag, "request-burst", requestBurstFlag, fmt.Sprintf("requests allowed in a burst above the -write-rate, -write-rate-per-client and -read-rate-per-client rates, 0 for a second's worth (environment variable %q)", requestBurstEnvVarName))
+	flag.StringVar(&configFlag, "config", configFlag, fmt.Sprintf("path to a YAML file listing the routes to serve with per-route settings (environment variable %q)", configEnvVarName))
+	flag.BoolVar(&landingFlag, "landing", landingFlag, fmt.Sprintf("list the routes at / even when only one is served (environment variable %q)", landingEnvVarName))
+	if v := os.Getenv(corsOriginEnvVarName); v != "" {
+		for _, origin := range strings.Split(v, ",") {
+			_ = corsOriginFlag.Set(strings.TrimSpace(origin))
+		}
+	}
+	flag.Var(&corsOriginFlag, "cors-origin", fmt.Sprintf("%s (environment variable %q, comma-separated)", corsOriginFlag.help(), corsOriginEnvVarName))
+	for _, nf := range []struct {
+		flag       *networks
+		envVarName string
+	}{{&trustedProxiesFlag, trustedProxiesEnvVarName}, {&allowFlag, allowEnvVarName}, {&denyFlag, denyEnvVarName}} {
+		if v := os.Getenv(nf.envVarName); v != "" {
+			if err := nf.flag.Set(v); err != nil {
+				log.Fatalf("%s: %v", nf.envVarName, err)
+			}
+		}
+	}
+	flag.Var(&trustedProxiesFlag, "trusted-proxies", fmt.Sprintf("take client addresses from X-Forwarded-For and X-Real-IP of requests from these reverse proxies, e.g. 127.0.0.1 or 10.0.0.0/8 (repeatable, comma-separated; environment variable %q)", trustedProxiesEnvVarName))
+	flag.Var(&allowFlag, "allow", fmt.Sprintf("only serve clients in these networks, e.g. 192.168.1.0/24, or with -deny exempt them from it (repeatable, comma-separated; environment variable %q)", allowEnvVarName))
+	flag.Var(&denyFlag, "deny", fmt.Sprintf("refuse clients in these networks with 403, unless -allow lists them (repeatable, comma-separated; environment variable %q)", denyEnvVarName))
+	flag.BoolVar(&noNosniffFlag, "no-nosniff", noNosniffFlag, fmt.Sprintf("do not send X-Content-Type-Options: nosniff (environment variable %q)", noNosniffEnvVarName))
+	if !cspSet {
+		cspFlag = defaultCSP
+	}
+	flag.StringVar(&cspFlag, "csp", cspFlag, fmt.Sprintf("Content-Security-Policy of listings and previews, empty for none (environment variable %q)", cspEnvVarName))
+	if userContentFlag == "" {
+		userContentFlag = userContentSandbox
+	}
+	flag.StringVar(&userContentFlag, "user-content", userContentFlag, fmt.Sprintf("how HTML, SVG and XML files are served: %q (CSP sandbox, no scripts), %q (download) or %q (as is, for websites) (environment variable %q)", userContentSandbox, userContentAttachment, userContentInline, userContentEnvVarName))
+	flag.BoolVar(&noCSRFFlag, "no-csrf", noCSRFFlag, fmt.Sprintf("accept uploads and deletes from browsers without a CSRF token (environment variable %q)", noCSRFEnvVarName))
+	if onConflictFlag == "" {
+		onConflictFlag = onConflictReject
+	}
+	flag.StringVar(&onConflictFlag, "on-conflict", onConflictFlag, fmt.Sprintf("what uploads do when the file exists: %q (409 Conflict), %q (store as \"name (1).ext\") or %q; PUT always overwrites unless sent with If-None-Match: * (environment variable %q)", onConflictReject, onConflictRename, onConflictOverwrite, onConflictEnvVarName))
+	flag.Int64Var(&maxUploadSizeFlag, "max-upload-size", maxUploadSizeFlag, fmt.Sprintf("maximum bytes of one upload request, 0 for no limit (environment variable %q)", maxUploadSizeEnvVarName))
+	flag.BoolVar(&strictNamesFlag, "strict-names", strictNamesFlag, fmt.Sprintf("percent-encode everything but ASCII letters, digits and a few punctuation characters in uploaded file names (environment variable %q)", strictNamesEnvVarName))
+	if uploadModeFlag == "" {
+		uploadModeFlag = defaultUploadMode
+	}
+	flag.StringVar(&uploadModeFlag, "upload-mode", uploadModeFlag, fmt.Sprintf("octal file mode of uploaded files, applied regardless of the umask; replaced files keep theirs (environment variable %q)", uploadModeEnvVarName))
+	if uploadDirModeFlag == "" {
+		uploadDirModeFlag = defaultUploadDirMode
+	}
+	flag.StringVar(&uploadDirModeFlag, "upload-dir-mode", uploadDirModeFlag, fmt.Sprintf("octal file mode of directories created by uploads, mkdir and MKCOL, e.g. 2770 to pass on the group, applied regardless of the umask (environment variable %q)", uploadDirModeEnvVarName))
+	flag.StringVar(&shareSecretFlag, "share-secret", shareSecretFlag, fmt.Sprintf("key for signing expiring share links to single files (?share=DURATION), which work without credentials (environment variable %q)", shareSecretEnvVarName))
+	flag.StringVar(&trashDirFlag, "trash-dir", trashDirFlag, fmt.Sprintf("move deleted files and directories to this directory instead of removing them; ROUTE.trash/ lists and restores them (environment variable %q)", trashDirEnvVarName))
+	flag.DurationVar(&trashRetentionFlag, "trash-retention", trashRetentionFlag, fmt.Sprintf("purge trashed items after this long, 0 to keep them (environment variable %q)", trashRetentionEnvVarName))
+	flag.BoolVar(&cliTextFlag, "cli-text", cliTextFlag, fmt.Sprintf("answer curl and wget with plain-text directory listings, as ?format=txt and Accept: text/plain do for everyone (environment variable %q)", cliTextEnvVarName))
+	flag.IntVar(&pageSizeFlag, "page-size", pageSizeFlag, fmt.Sprintf("entries per page of a directory listing, 0 for no paging; ?offset= and ?limit= choose the page (environment variable %q)", pageSizeEnvVarName))
+	flag.DurationVar(&listingCacheFlag, "listing-cache", listingCacheFlag, fmt.Sprintf("reuse directory listings for this long unless the directory changes, e.g. 2s; 0 to always read them (environment variable %q)", listingCacheEnvVarName))
+	flag.StringVar(&baseURLFlag, "base-url", baseURLFlag, fmt.Sprintf("path, or URL of which the path is used, that a reverse proxy serves this server below; links and redirects start with it (environment variable %q)", baseURLEnvVarName))
+	flag.BoolVar(&forwardedPrefixFlag, "trust-forwarded-prefix", forwardedPrefixFlag, fmt.Sprintf("take the prefix of links and redirects from the X-Forwarded-Prefix request header, falling back to -base-url; unless -trusted-proxies restricts it to their requests, only for servers reachable solely through the proxy (environment variable %q)", forwardedPrefixEnvVarName))
+	flag.StringVar(&errorPagesFlag, "error-pages", errorPagesFlag, fmt.Sprintf("directory of HTML pages shown to browsers for error statuses, named like 404.html (environment variable %q)", errorPagesEnvVarName))
+	flag.BoolVar(&debugFlag, "debug", debugFlag, fmt.Sprintf("show the cause of internal server errors in the response, not just in the log (environment variable %q)", debugEnvVarName))
+	flag.StringVar(&webhookURLFlag, "webhook-url", webhookURLFlag, fmt.Sprintf("POST a JSON event to this URL after each upload, delete, mkdir, rename and copy (environment variable %q)", webhookURLEnvVarName))
+	flag.StringVar(&webhookSecretFlag, "webhook-secret", webhookSecretFlag, fmt.Sprintf("sign webhook events with this key, sending the HMAC-SHA256 of the body as X-Signature-256: sha256=HEX (environment variable %q)", webhookSecretEnvVarName))
+	flag.StringVar(&webhookEventsFlag, "webhook-events", webhookEventsFlag, fmt.Sprintf("comma-separated actions to send webhook events for, e.g. upload,delete; all if empty (environment variable %q)", webhookEventsEnvVarName))
+	flag.StringVar(&onUploadFlag, "on-upload", onUploadFlag, fmt.Sprintf("command run after each stored upload, with the file's absolute path as last argument and HFS_ACTION, HFS_ROUTE, HFS_PATH and HFS_REMOTE_ADDR set; split at spaces, no shell (environment variable %q)", onUploadEnvVarName))
+	flag.DurationVar(&hookTimeoutFlag, "hook-timeout", hookTimeoutFlag, fmt.Sprintf("time after which an -on-upload command is killed (environment variable %q)", hookTimeoutEnvVarName))
+	flag.IntVar(&hookConcurrencyFlag, "hook-concurrency", hookConcurrencyFlag, fmt.Sprintf("maximum -on-upload commands running at once (environment variable %q)", hookConcurrencyEnvVarName))
+	flag.BoolVar(&hookSyncFlag, "hook-sync", hookSyncFlag, fmt.Sprintf("make uploads wait for -on-upload, run before they are put in place, and reject them if it fails, e.g. for virus scans (environment variable %q)", hookSyncEnvVarName))
+	flag.StringVar(&auditLogFlag, "audit-log", auditLogFlag, fmt.Sprintf("append a JSON line for each upload, delete, mkdir, rename and copy to this file, with the client, user, paths, sizes and status (environment variable %q)", auditLogEnvVarName))
+	flag.BoolVar(&auditRequiredFlag, "audit-required", auditRequiredFlag, fmt.Sprintf("refuse changes with 503 while the -audit-log cannot be written, rather than only logging the failure (environment variable %q)", auditRequiredEnvVarName))
+	flag.BoolVar(&statsFlag, "stats", statsFlag, fmt.Sprintf("count file downloads and show them at %s, with ?format=json for scripts; the page lists files of every route to anyone (environment variable %q)", statsRoute, statsEnvVarName))
+	flag.StringVar(&statsFileFlag, "stats-file", statsFileFlag, fmt.Sprintf("keep the -stats counters in this JSON file across restarts; defaults to %s next to -config, memory only without (environment variable %q)", statsFileName, statsFileEnvVarName))
+	flag.BoolVar(&precompressedFlag, "precompressed", precompressedFlag, fmt.Sprintf("serve FILE.br or FILE.gz instead of FILE to clients accepting that encoding (environment variable %q)", precompressedEnvVarName))
+	flag.BoolVar(&hidePrecompFlag, "hide-precompressed", hidePrecompFlag, fmt.Sprintf("leave FILE.br and FILE.gz out of listings, archives and searches when FILE exists (environment variable %q)", hidePrecompEnvVarName))
+	flag.BoolVar(&compressFlag, "compress", compressFlag, fmt.Sprintf("gzip downloads of -compress-types files to clients accepting it, except range requests (environment variable %q)", compressEnvVarName))
+	if compressTypesFlag == "" {
+		compressTypesFlag = defaultCompressTypes
+	}
+	flag.StringVar(&compressTypesFlag, "compress-types", compressTypesFlag, fmt.Sprintf("comma-separated MIME types gzipped by -compress, type/* for all subtypes; archives, images, audio and video never are (environment variable %q)", compressTypesEnvVarName))
+	flag.Int64Var(&compressMinSizeFlag, "compress-min-size", compressMinSizeFlag, fmt.Sprintf("size in bytes below which -compress leaves files alone (environment variable %q)", compressMinSizeEnvVarName))
+	if v := os.Getenv(mimeEnvVarName); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			if err := mimeFlag.Set(t); err != nil {
+				log.Fatalf("%s: %v", mimeEnvVarName, err)
+			}
+		}
+	}
+	flag.Var(&mimeFlag, "mime", fmt.Sprintf("%s (environment variable %q, comma-separated)", mimeFlag.help(), mimeEnvVarName))
+	flag.StringVar(&mimeTypesFlag, "mime-types", mimeTypesFlag, fmt.Sprintf("file of MIME types and their extensions in the format of /etc/mime.types, overridden by -mime (environment variable %q)", mimeTypesEnvVarName))
+	flag.StringVar(&defaultTypeFlag, "default-type", defaultTypeFlag, fmt.Sprintf("Content-Type of files with an unknown extension, instead of guessing from their content (environment variable %q)", defaultTypeEnvVarName))
+	flag.StringVar(&archiveSpoolFlag, "archive-spool", archiveSpoolFlag, fmt.Sprintf("generate directory archives into files in this directory before sending them, so that downloads have a length and can resume; reused until the directory changes (environment variable %q)", archiveSpoolEnvVarName))
+	flag.Int64Var(&spoolSizeFlag, "archive-spool-size", spoolSizeFlag, fmt.Sprintf("bytes of spooled archives to keep, removing the least recently used beyond; archives larger than this are removed once sent (environment variable %q)", spoolSizeEnvVarName))
+	flag.IntVar(&archiveLevelFlag, "archive-compression", archiveLevelFlag, fmt.Sprintf("gzip level of tar.gz archives, 0 (none) to 9 (smallest) or -1 for the default; above 1, compressed in parallel (environment variable %q)", archiveLevelEnvVarName))
+	flag.IntVar(&archiveWorkersFlag, "archive-workers", archiveWorkersFlag, fmt.Sprintf("blocks of a tar.gz archive compressed at once, 0 for one per CPU (environment variable %q)", archiveWorkersEnvVarName))
+	flag.BoolVar(&noArchiveFlag, "no-archive", noArchiveFlag, fmt.Sprintf("disable zip, tar.gz and tar downloads of directories and files (environment variable %q)", noArchiveEnvVarName))
+	flag.Int64Var(&maxArchiveSizeFlag, "max-archive-size", maxArchiveSizeFlag, fmt.Sprintf("refuse archives whose files add up to more than this many bytes, or that cannot be sized in time; 0 for no limit (environment variable %q)", maxArchiveSizeEnvVarName))
+	flag.IntVar(&treeDepthFlag, "tree-depth", treeDepthFlag, fmt.Sprintf("most levels of a directory ?tree=1 JSON response, which ?depth= may lower (environment variable %q)", treeDepthEnvVarName))
+	flag.BoolVar(&s3CompatFlag, "s3-compat", s3CompatFlag, fmt.Sprintf("answer S3 ListObjectsV2 requests (?list-type=2) for directories as buckets, create the missing directories of PUT keys and accept deletes of missing keys; requests are not signed (environment variable %q)", s3CompatEnvVarName))
+	flag.IntVar(&feedEntriesFlag, "feed-entries", feedEntriesFlag, fmt.Sprintf("most recently modified files in the ?feed=atom and ?feed=rss feeds of a directory (environment variable %q)", feedEntriesEnvVarName))
+	flag.IntVar(&feedDepthFlag, "feed-depth", feedDepthFlag, fmt.Sprintf("levels of directories a feed looks for files in, 1 for only the directory itself (environment variable %q)", feedDepthEnvVarName))
+	flag.BoolVar(&browseZipFlag, "browse-zip", browseZipFlag, fmt.Sprintf("serve the entries of .zip files as if the files were directories, at paths below them and with ?browse=1 on them (environment variable %q)", browseZipEnvVarName))
+	if v := os.Getenv(vhostEnvVarName); v != "" {
+		for _, vhost := range strings.Fields(v) {
+			_ = vhostsFlag.Set(vhost)
+		}
+	}
+	flag.Var(&vhostsFlag, "vhost", fmt.Sprintf("%s (environment variable %q, space-separated)", vhostsFlag.help(), vhostEnvVarName))
+	flag.StringVar(&templateFlag, "template", templateFlag, fmt.Sprintf("path to an html/template for directory listings (environment variable %q)", templateEnvVarName))
 	flag.Var(&routesFlag, "route", routesFlag.help())
 	flag.Var(&routesFlag, "r", "(alias for -route)")
 	flag.StringVar(&sslCertificate, "ssl-cert", sslCertificate, fmt.Sprintf("path to SSL server certificate (environment variable %q)", sslCertificateEnvVarName))
+	flag.StringVar(&sslCertificate, "cert", sslCertificate, "(alias for -ssl-cert)")
 	flag.StringVar(&sslKey, "ssl-key", sslKey, fmt.Sprintf("path to SSL private key (environment variable %q)", sslKeyEnvVarName))
+	flag.StringVar(&sslKey, "key", sslKey, "(alias for -ssl-key)")
+	flag.BoolVar(&tlsSelfSignedFlag, "tls-self-signed", tlsSelfSignedFlag, "serve HTTPS with a generated self-signed certificate")
+	flag.BoolVar(&letsEncryptFlag, "letsencrypt", letsEncryptFlag, fmt.Sprintf("serve HTTPS on port 443 with certificates for the -hostname hosts obtained and renewed from Let's Encrypt, and redirect HTTP on port 80 to it (environment variable %q)", letsEncryptEnvVarName))
+	flag.StringVar(&hostnameFlag, "hostname", hostnameFlag, fmt.Sprintf("comma-separated DNS names -letsencrypt obtains certificates for; handshakes for other names fail (environment variable %q)", hostnameEnvVarName))
+	flag.StringVar(&cacheDirFlag, "cache-dir", cacheDirFlag, fmt.Sprintf("directory -letsencrypt keeps its account key and certificates in, by default below the user's cache directory (environment variable %q)", cacheDirEnvVarName))
+	if acmeDirectoryFlag == "" {
+		acmeDirectoryFlag = letsEncryptDirectoryURL
+	}
+	flag.StringVar(&acmeDirectoryFlag, "acme-directory", acmeDirectoryFlag, fmt.Sprintf("directory URL of the ACME CA for -letsencrypt, such as Let's Encrypt's staging one (environment variable %q)", acmeDirectoryEnvVarName))
+	flag.StringVar(&clientCAFlag, "client-ca", clientCAFlag, fmt.Sprintf("require of HTTPS clients a certificate signed by a CA in this PEM file, refusing the connections without one (environment variable %q)", clientCAEnvVarName))
+	for _, lf := range []struct {
+		flag       flag.Value
+		envVarName string
+	}{{&clientCertCNFlag, clientCertCNEnvVarName}, {&clientExemptFlag, clientExemptEnvVarName}, {&plainAddrFlag, plainAddrEnvVarName}} {
+		if v := os.Getenv(lf.envVarName); v != "" {
+			for _, s := range strings.Split(v, ",") {
+				if err := lf.flag.Set(strings.TrimSpace(s)); err != nil {
+					log.Fatalf("%s: %v", lf.envVarName, err)
+				}
+			}
+		}
+	}
+	plainAddrFlag.set = false
+	flag.Var(&clientCertCNFlag, "client-cert-cn", fmt.Sprintf("%s (environment variable %q, comma-separated)", clientCertCNFlag.help(), clientCertCNEnvVarName))
+	flag.BoolVar(&clientCNWritesFlag, "client-cert-cn-writes", clientCNWritesFlag, fmt.Sprintf("apply -client-cert-cn only to uploads, deletes and other changes, letting any valid certificate read (environment variable %q)", clientCNWritesEnvVarName))
+	flag.Var(&clientExemptFlag, "client-cert-exempt", fmt.Sprintf("%s (environment variable %q, comma-separated)", clientExemptFlag.help(), clientExemptEnvVarName))
+	flag.Var(&plainAddrFlag, "plain-addr", fmt.Sprintf("address to serve the -client-cert-exempt paths on without TLS, HOST:PORT or unix:PATH (repeatable) (environment variable %q, comma-separated)", plainAddrEnvVarName))
+	if v := os.Getenv(tokenEnvVarName); v != "" {
+		for _, token := range strings.Split(v, ",") {
+			if err := tokenFlag.Set(strings.TrimSpace(token)); err != nil {
+				log.Fatalf("%s: %v", tokenEnvVarName, err)
+			}
+		}
+	}
+	flag.Var(&tokenFlag, "token", fmt.Sprintf("%s (environment variable %q, comma-separated)", tokenFlag.help(), tokenEnvVarName))
+	flag.BoolVar(&accessFilesFlag, "access-files", accessFilesFlag, fmt.Sprintf("apply the access files in the served directories, which require basic auth or deny requests for their directory and everything below it, at the cost of a stat per directory level per request (environment variable %q)", accessFilesEnvVarName))
+	if accessFileNameFlag == "" {
+		accessFileNameFlag = accessFileDefault
+	}
+	flag.StringVar(&accessFileNameFlag, "access-file-name", accessFileNameFlag, fmt.Sprintf("name of the -access-files, never served or listed (environment variable %q)", accessFileNameEnvVarName))
+	flag.StringVar(&tokenFileFlag, "token-file", tokenFileFlag, fmt.Sprintf("read more -token values from this file, one per line, skipping blank lines and those starting with # (environment variable %q)", tokenFileEnvVarName))
+	flag.BoolVar(&noHTTPRedirectFlag, "no-http-redirect", noHTTPRedirectFlag, fmt.Sprintf("with -letsencrypt, leave port 80 alone rather than redirecting it to HTTPS (environment variable %q)", noHTTPRedirectEnvVarName))
 	flag.BoolVar(&simpleFlag, "simple", simpleFlag, "use simple display format")
+}
+
+// parseFlags parses and checks the command line. It is left out of init so
+// that the tests can run.
+func parseFlags() {
 	flag.Parse()
 	if quietFlag {
 		log.SetOutput(ioutil.Discard)
 	}
+	if err := validUserContent(userContentFlag); err != nil {
+		log.Fatalf("-user-content: %v", err)
+	}
+	if err := validOnConflict(onConflictFlag); err != nil {
+		log.Fatalf("-on-conflict: %v", err)
+	}
+	if logFormatFlag != logFormatPlain && logFormatFlag != logFormatJSON {
+		log.Fatalf("-log-format: %q is neither %q nor %q", logFormatFlag, logFormatPlain, logFormatJSON)
+	}
+	if feedEntriesFlag < 1 || feedDepthFlag < 1 {
+		log.Fatalf("-feed-entries and -feed-depth must be at least 1")
+	}
+	if err := validClientCert(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if n := accessFileNameFlag; n == "." || n == ".." || strings.ContainsAny(n, `/\`) {
+		log.Fatalf("-access-file-name: %q is not a file name", n)
+	}
+	if letsEncryptFlag {
+		if err := validLetsEncrypt(); err != nil {
+			log.Fatalf("-letsencrypt: %v", err)
+		}
+		if len(addrFlag.Values) == 1 && addrFlag.Values[0] == defaultAddr {
+			addrFlag.Values = []string{letsEncryptAddr}
+		}
+	}
 	for i := 0; i < flag.NArg(); i++ {
 		arg := flag.Arg(i)
 		err := routesFlag.Set(arg)
@@ -74,37 +512,277 @@ func init() {
 }
 
 func main() {
-	addr, err := addr()
+	parseFlags()
+	addrs, err := addrs()
 	if err != nil {
 		log.Fatalf("address/port: %v", err)
 	}
+	listeners, err := listen(addrs, socketModeFlag)
+	if err != nil {
+		if letsEncryptFlag {
+			err = letsEncryptListenError(err)
+		}
+		log.Fatalf("start server: %v", err)
+	}
 	if simpleFlag {
-		err = http.ListenAndServe(addr, http.FileServer(http.Dir(routesFlag.Values[0].Path)))
+		if len(routesFlag.Values) == 0 {
+			_ = routesFlag.Set(".")
+		}
+		err = serveAll(newServer(http.FileServer(http.Dir(routesFlag.Values[0].Path)), nil), listeners, false)
 	} else {
-		err = server(addr, routesFlag)
+		err = server(listeners, routesFlag)
 	}
 	if err != nil {
 		log.Fatalf("start server: %v", err)
 	}
 }
 
-func server(addr string, routes routes) error {
+func server(listeners []net.Listener, routes routes) error {
+	tlsConfig, err := tlsConfig(listeners)
+	if err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+	if letsEncryptFlag && !noHTTPRedirectFlag {
+		serveHTTPSRedirect(httpRedirectAddr)
+	}
+	listingTemplate := directoryListingTemplate
+	if templateFlag != "" {
+		listingTemplate, err = loadListingTemplate(templateFlag)
+		if err != nil {
+			return fmt.Errorf("template: %v", err)
+		}
+	}
+	configs, err := routeConfigs(routes, vhostsFlag)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if tokenFileFlag != "" {
+		if err := tokenFlag.load(tokenFileFlag); err != nil {
+			return fmt.Errorf("token file: %v", err)
+		}
+	}
+	uploadMode, err := parseFileMode(uploadModeFlag)
+	if err != nil {
+		return fmt.Errorf("upload mode: %v", err)
+	}
+	uploadDirMode, err := parseFileMode(uploadDirModeFlag)
+	if err != nil {
+		return fmt.Errorf("upload dir mode: %v", err)
+	}
 	mux := http.DefaultServeMux
+	vhosts := newVhostHandler(mux)
 	handlers := make(map[string]http.Handler)
 	paths := make(map[string]string)
 
-	if len(routes.Values) == 0 {
-		_ = routes.Set(".")
+	limits := &limits{maxConcurrent: maxConcurrentFlag, maxPerClient: maxPerClientFlag}
+	if rateLimitFlag > 0 {
+		limits.bandwidth = newTokenBucket(rateLimitFlag)
+	}
+	if writeRateFlag > 0 {
+		limits.writeRate = newRequestRate(writeRateFlag, requestBurstFlag)
+	}
+	if writeClientRateFlag > 0 {
+		limits.writeClientRate = newClientRates(writeClientRateFlag, requestBurstFlag)
+	}
+	if readClientRateFlag > 0 {
+		limits.readClientRate = newClientRates(readClientRateFlag, requestBurstFlag)
+	}
+
+	var shares *shareSigner
+	if shareSecretFlag != "" {
+		shares = &shareSigner{secret: []byte(shareSecretFlag)}
+	}
+
+	var listings *listingCache
+	if listingCacheFlag > 0 {
+		listings = newListingCache(listingCacheFlag)
+		go listings.logEvery(listingCacheLogInterval)
+	}
+
+	basePath, err := parseBaseURL(baseURLFlag)
+	if err != nil {
+		return fmt.Errorf("base url: %v", err)
+	}
+	prefix := urlPrefix{base: basePath, trustForwarded: forwardedPrefixFlag}
+
+	var errorPages map[int][]byte
+	if errorPagesFlag != "" {
+		errorPages, err = loadErrorPages(errorPagesFlag)
+		if err != nil {
+			return fmt.Errorf("error pages: %v", err)
+		}
+	}
+
+	var webhook *webhook
+	if webhookURLFlag != "" {
+		actions, err := parseWebhookActions(webhookEventsFlag)
+		if err != nil {
+			return fmt.Errorf("webhook events: %v", err)
+		}
+		webhook = newWebhook(webhookURLFlag, webhookSecretFlag, actions)
+	}
+
+	var uploadHook *uploadHook
+	if strings.TrimSpace(onUploadFlag) != "" {
+		uploadHook = newUploadHook(onUploadFlag, hookTimeoutFlag, hookConcurrencyFlag, hookSyncFlag)
+	}
+
+	var extensionTypes []extensionType
+	if mimeTypesFlag != "" {
+		extensionTypes, err = loadMIMETypes(mimeTypesFlag)
+		if err != nil {
+			return fmt.Errorf("mime types: %v", err)
+		}
+	}
+	if err := registerMIMETypes(append(extensionTypes, mimeFlag.Values...)); err != nil {
+		return fmt.Errorf("mime types: %v", err)
+	}
+	if defaultTypeFlag != "" {
+		if err := validContentType(defaultTypeFlag); err != nil {
+			return fmt.Errorf("default type: %v", err)
+		}
+	}
+
+	var spool *archiveSpool
+	if archiveSpoolFlag != "" {
+		spool, err = newArchiveSpool(archiveSpoolFlag, spoolSizeFlag)
+		if err != nil {
+			return fmt.Errorf("archive spool: %v", err)
+		}
+	}
+
+	archiveCompression, err := newArchiveCompression(archiveLevelFlag, archiveWorkersFlag)
+	if err != nil {
+		return fmt.Errorf("archive compression: %v", err)
+	}
+
+	var compression *fileCompression
+	if compressFlag {
+		compression = newFileCompression(compressTypesFlag, compressMinSizeFlag)
 	}
 
-	for _, route := range routes.Values {
-		handlers[route.Route] = &fileHandler{
-			route:       route.Route,
-			path:        route.Path,
-			allowUpload: allowUploadsFlag,
-			allowDelete: allowDeletesFlag,
+	var audit *auditLog
+	if auditLogFlag != "" {
+		audit, err = newAuditLog(auditLogFlag, auditRequiredFlag)
+		if err != nil {
+			return fmt.Errorf("audit log: %v", err)
+		}
+	}
+
+	var stats *downloadStats
+	if statsFlag {
+		if statsFileFlag == "" && configFlag != "" {
+			statsFileFlag = filepath.Join(filepath.Dir(configFlag), statsFileName)
+		}
+		stats, err = newDownloadStats(statsFileFlag)
+		if err != nil {
+			return fmt.Errorf("stats: %v", err)
+		}
+	}
+
+	var trash *trash
+	if trashDirFlag != "" {
+		trash, err = newTrash(trashDirFlag)
+		if err != nil {
+			return fmt.Errorf("trash: %v", err)
+		}
+		if trashRetentionFlag > 0 {
+			go trash.purgeEvery(trashPurgeInterval, trashRetentionFlag)
 		}
-		paths[route.Route] = route.Path
+	}
+
+	var access *accessFiles
+	if accessFilesFlag {
+		access = newAccessFiles(accessFileNameFlag)
+	}
+
+	for _, rc := range configs {
+		shares := shares.forHost(rc.Host)
+		fh := &fileHandler{
+			route:          rc.Route,
+			vhost:          rc.Host,
+			path:           rc.Path,
+			storage:        osFS{root: rc.Path},
+			allowUpload:    rc.AllowUpload,
+			allowDelete:    rc.AllowDelete,
+			dav:            davFlag && !rc.Dropbox,
+			followSymlinks: followSymlinksFlag,
+			lexicalSort:    lexicalSortFlag,
+			showHidden:     rc.ShowHidden,
+			hide:           rc.Hide,
+			allowExtract:   !noExtractFlag,
+			allowArchive:   !noArchiveFlag,
+			maxArchiveSize: maxArchiveSizeFlag,
+			treeDepth:      treeDepthFlag,
+			s3Compat:       s3CompatFlag,
+			feedEntries:    feedEntriesFlag,
+			feedDepth:      feedDepthFlag,
+			browseZip:      browseZipFlag,
+			extractLimit:   extractLimitFlag,
+			maxUploadSize:  maxUploadSizeFlag,
+			strictNames:    strictNamesFlag,
+			uploadMode:     uploadMode,
+			uploadDirMode:  uploadDirMode,
+			onConflict:     rc.OnConflict,
+			markdown:       !noMarkdownFlag,
+			index:          rc.Index,
+			spa:            rc.SPA,
+			noListing:      rc.NoListing,
+			dropbox:        rc.Dropbox,
+			forceDownload:  rc.Download,
+			spool:          spool,
+			cliText:        cliTextFlag,
+			pageSize:       pageSizeFlag,
+			listings:       listings,
+			logFormat:      logFormatFlag,
+			nosniff:        !noNosniffFlag,
+			csp:            cspFlag,
+			userContent:    userContentFlag,
+			csrf:           !noCSRFFlag,
+			corsOrigins:    &corsOriginFlag,
+			shares:         shares,
+			trash:          trash,
+			access:         access,
+			prefix:         prefix,
+			writeTimeout:   writeTimeoutFlag,
+			errorPages:     errorPages,
+			debug:          debugFlag,
+			webhook:        webhook,
+			uploadHook:     uploadHook,
+			audit:          audit,
+			stats:          stats,
+			precompressed:  precompressedFlag,
+			compression:    compression,
+			defaultType:    defaultTypeFlag,
+
+			listingTemplate:    listingTemplate,
+			archiveCompression: archiveCompression,
+			hidePrecompressed:  hidePrecompFlag,
+		}
+		var h http.Handler = fh
+		if rc.Auth != nil {
+			h = &basicAuthHandler{handler: h, credentials: rc.Auth, realm: rc.Route, shares: shares}
+		}
+		if len(tokenFlag.Values) > 0 {
+			// write tokens get the route as if it had uploads and deletes on
+			writable := *fh
+			writable.allowUpload = true
+			writable.allowDelete = true
+			h = &tokenHandler{handler: h, read: fh, write: &writable, gated: rc.Auth != nil, tokens: &tokenFlag}
+		}
+		if len(corsOriginFlag.Values) > 0 {
+			h = &corsHandler{handler: h, origins: &corsOriginFlag}
+		}
+		if limits.enabled() {
+			h = &limitHandler{handler: h, limits: limits}
+		}
+		if rc.Host != "" {
+			vhosts.handle(rc.Host, rc.Route, h)
+			log.Printf("serving local path %q on %q for host %q", rc.Path, rc.Route, rc.Host)
+			continue
+		}
+		handlers[rc.Route] = h
+		paths[rc.Route] = rc.Path
 	}
 
 	for route, path := range paths {
@@ -112,49 +790,212 @@ func server(addr string, routes routes) error {
 		log.Printf("serving local path %q on %q", path, route)
 	}
 
-	mux.Handle("/static/*", &handler.EmbeddedHandler{})
+	mux.Handle("/static/", &handler.EmbeddedHandler{})
 
-	//_, rootRouteTaken := handlers[rootRoute]
-	//if !rootRouteTaken {
-	//	route := routes.Values[0].Route
-	//	mux.Handle(rootRoute, http.RedirectHandler(route, http.StatusTemporaryRedirect))
-	//	log.Printf("redirecting to %q from %q", route, rootRoute)
-	//}
+	if stats != nil {
+		mux.Handle(statsRoute, &statsHandler{stats: stats, csp: cspFlag, prefix: prefix})
+		log.Printf("download statistics on %q", statsRoute)
+	}
+
+	// the landing page lists the routes of the hosts without a -vhost
+	var anyHost []routeConfig
+	for _, rc := range configs {
+		if rc.Host == "" {
+			anyHost = append(anyHost, rc)
+		}
+	}
+	if _, rootRouteTaken := handlers[rootRoute]; !rootRouteTaken && (len(anyHost) > 1 || landingFlag && len(anyHost) > 0) {
+		mux.Handle(rootRoute, newLandingHandler(anyHost, cspFlag, prefix))
+		log.Printf("listing routes on %q", rootRoute)
+	}
 
 	binaryPath, _ := os.Executable()
 	if binaryPath == "" {
 		binaryPath = "server"
 	}
-	if sslCertificate != "" && sslKey != "" {
-		log.Printf("%s (HTTPS) listening on %q", filepath.Base(binaryPath), addr)
-		return http.ListenAndServeTLS(addr, sslCertificate, sslKey, mux)
+	var hosts http.Handler = mux
+	if len(vhosts.hosts) > 0 {
+		hosts = vhosts
+	}
+	if len(clientCertCNFlag.Values) > 0 {
+		hosts = &clientCertHandler{handler: hosts, names: &clientCertCNFlag, writesOnly: clientCNWritesFlag}
+	}
+	inflight := &inflightHandler{handler: hosts}
+	var root http.Handler = inflight
+	if filter := (addressFilter{allow: &allowFlag, deny: &denyFlag}); filter.enabled() {
+		// the refusal comes before any route, so it links back to the root
+		pages := &fileHandler{route: rootRoute, prefix: prefix, csp: cspFlag, errorPages: errorPages}
+		root = &addressFilterHandler{handler: root, filter: filter, pages: pages}
+	}
+	if len(trustedProxiesFlag.Values) > 0 {
+		root = &proxyHandler{handler: root, proxies: &trustedProxiesFlag}
+	}
+	srv := newServer(root, tlsConfig)
+	srv.RegisterOnShutdown(watches.close)
+	if len(plainAddrFlag.Values) > 0 {
+		plainListeners, err := listen(plainAddrFlag.Values, socketModeFlag)
+		if err != nil {
+			return fmt.Errorf("plain address: %v", err)
+		}
+		plain := newServer(&exemptHandler{handler: root, paths: &clientExemptFlag}, nil)
+		srv.RegisterOnShutdown(func() { _ = plain.Shutdown(context.Background()) })
+		for _, l := range plainListeners {
+			log.Printf("serving %s without TLS on %q", clientExemptFlag.String(), listenerAddr(l))
+		}
+		go func() {
+			if err := serveAll(plain, plainListeners, false); err != nil && err != http.ErrServerClosed {
+				log.Printf("plain address: %v", err)
+			}
+		}()
+	}
+	for _, l := range listeners {
+		addr := listenerAddr(l)
+		if tlsConfig != nil {
+			log.Printf("%s (HTTPS) listening on %q", filepath.Base(binaryPath), addr)
+		} else {
+			log.Printf("%s listening on %q", filepath.Base(binaryPath), addr)
+		}
+		if l.Addr().Network() != "tcp" {
+			continue
+		}
+		for _, host := range reachableHosts(addr) {
+			for _, rc := range anyHost {
+				log.Printf("serving %s", serverURL(host, tlsConfig != nil, rc.Route))
+			}
+		}
 	}
-	log.Printf("%s listening on %q", filepath.Base(binaryPath), addr)
-	return http.ListenAndServe(addr, mux)
+	err = serveUntilSignal(srv, inflight, shutdownTimeoutFlag, func() error {
+		return serveAll(srv, listeners, tlsConfig != nil)
+	})
+	if err := stats.save(); err != nil {
+		log.Printf("stats: %v", err)
+	}
+	return err
 }
 
-func addr() (string, error) {
-	portSet := portFlag != 0
-	addrSet := addrFlag != ""
-	switch {
-	case portSet && addrSet:
-		a, err := net.ResolveTCPAddr("tcp", addrFlag)
-		if err != nil {
-			return "", err
+// serveAll serves srv on every listener until one of them fails.
+func serveAll(srv *http.Server, listeners []net.Listener, tls bool) error {
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if tls {
+				errc <- srv.ServeTLS(l, "", "")
+			} else {
+				errc <- srv.Serve(l)
+			}
+		}(l)
+	}
+	return <-errc
+}
+
+// listenerAddr formats the address of l the way it was given to -addr.
+func listenerAddr(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return unixAddrPrefix + l.Addr().String()
+	}
+	return l.Addr().String()
+}
+
+// serverURL returns the URL of route on a server listening on addr.
+func serverURL(addr string, tls bool, route string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: route}
+	if tls {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
+
+// reachableHosts returns the addresses clients can use to reach a server
+// listening on addr. For a wildcard address these are localhost followed by
+// the addresses of all non-loopback interfaces of the matching IP version;
+// link-local IPv6 addresses are only included when there is nothing else.
+func reachableHosts(addr string) []string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{addr}
+	}
+	ip := net.ParseIP(host)
+	if host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{addr}
+	}
+	out := []string{net.JoinHostPort("localhost", port)}
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return out
+	}
+	onlyIPv4 := ip != nil && ip.To4() != nil
+	var lan, linkLocal []string
+	for _, a := range ifaceAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || (onlyIPv4 && ipNet.IP.To4() == nil) {
+			continue
+		}
+		hostPort := net.JoinHostPort(ipNet.IP.String(), port)
+		if ipNet.IP.IsLinkLocalUnicast() {
+			if ipNet.IP.To4() == nil {
+				linkLocal = append(linkLocal, hostPort)
+			}
+			continue
+		}
+		lan = append(lan, hostPort)
+	}
+	if len(lan) == 0 {
+		lan = linkLocal
+	}
+	return append(out, lan...)
+}
+
+// envInt64 returns the integer value of the environment variable name, or
+// fallback if it is unset or malformed.
+func envInt64(name string, fallback int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// envFloat64 returns the number value of the environment variable name, or
+// fallback if it is unset or malformed.
+func envFloat64(name string, fallback float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// envDuration returns the duration value of the environment variable name,
+// or fallback if it is unset or malformed.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// addrs returns the addresses to listen on. -port replaces the port of every
+// TCP address.
+func addrs() ([]string, error) {
+	var out []string
+	for _, addr := range addrFlag.Values {
+		if strings.HasPrefix(addr, unixAddrPrefix) || portFlag == 0 {
+			out = append(out, addr)
+			continue
 		}
-		a.Port = portFlag
-		return a.String(), nil
-	case !portSet && addrSet:
-		a, err := net.ResolveTCPAddr("tcp", addrFlag)
+		host, _, err := net.SplitHostPort(addr)
 		if err != nil {
-			return "", err
+			return nil, fmt.Errorf("%q: %v", addr, err)
 		}
-		return a.String(), nil
-	case portSet && !addrSet:
-		return fmt.Sprintf(":%d", portFlag), nil
-	case !portSet && !addrSet:
-		fallthrough
-	default:
-		return defaultAddr, nil
+		out = append(out, net.JoinHostPort(host, strconv.Itoa(portFlag)))
 	}
+	return out, nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	// thumbnails are cached below the user's cache directory
+	cacheDir, err := os.MkdirTemp("", "http-file-server-test-cache-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("XDG_CACHE_HOME", cacheDir)
+	code := m.Run()
+	os.RemoveAll(cacheDir)
+	os.Exit(code)
+}
+
+// newTestHandler returns a handler serving dir at route with the defaults of
+// the command line, for the tests to change.
+func newTestHandler(t testing.TB, route, dir string) *fileHandler {
+	t.Helper()
+	archiveCompression, err := newArchiveCompression(defaultArchiveLevel, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadMode, _ := parseFileMode(defaultUploadMode)
+	uploadDirMode, _ := parseFileMode(defaultUploadDirMode)
+	return &fileHandler{
+		route:              route,
+		path:               dir,
+		storage:            osFS{root: dir},
+		allowExtract:       true,
+		extractLimit:       defaultExtractLimit,
+		allowArchive:       true,
+		treeDepth:          defaultTreeDepth,
+		feedEntries:        defaultFeedEntries,
+		feedDepth:          defaultFeedDepth,
+		uploadMode:         uploadMode,
+		uploadDirMode:      uploadDirMode,
+		onConflict:         onConflictReject,
+		markdown:           true,
+		pageSize:           defaultPageSize,
+		logFormat:          logFormatPlain,
+		nosniff:            true,
+		csp:                defaultCSP,
+		userContent:        userContentSandbox,
+		csrf:               true,
+		listingTemplate:    directoryListingTemplate,
+		archiveCompression: archiveCompression,
+	}
+}
+
+// writeTestTree creates the files of tree, by slash-separated name, in a new
+// temporary directory and returns it. Names ending in a slash are
+// directories.
+func writeTestTree(t *testing.T, tree map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range tree {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// serveTest has h answer a request for target with the headers given as
+// name, value pairs.
+func serveTest(h http.Handler, method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
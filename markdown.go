@@ -0,0 +1,275 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderMarkdown converts the common subset of Markdown found in READMEs to
+// HTML: ATX and setext headings, paragraphs, fenced and indented code blocks,
+// block quotes, flat lists, horizontal rules, emphasis, inline code, links and
+// images. Raw HTML in the source is escaped rather than passed through, and
+// link targets with schemes other than http, https and mailto are dropped, so
+// the output is safe to embed in a page.
+func renderMarkdown(src string) template.HTML {
+	var b strings.Builder
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	renderBlocks(&b, lines)
+	return template.HTML(b.String())
+}
+
+var (
+	mdHeading     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRule        = regexp.MustCompile(`^ {0,3}(?:(?:- *){3,}|(?:\* *){3,}|(?:_ *){3,})$`)
+	mdBullet      = regexp.MustCompile(`^ {0,3}[-*+]\s+(.*)$`)
+	mdOrdered     = regexp.MustCompile(`^ {0,3}(\d{1,9})[.)]\s+(.*)$`)
+	mdFence       = regexp.MustCompile("^ {0,3}(```+|~~~+)\\s*([^`\\s]*)")
+	mdSetextOne   = regexp.MustCompile(`^ {0,3}=+\s*$`)
+	mdSetextTwo   = regexp.MustCompile(`^ {0,3}-+\s*$`)
+	mdInlineToken = regexp.MustCompile("(`+)(.+?)`+|!?\\[([^\\]]*)\\]\\(([^)\\s]*)(?:\\s+\"([^\"]*)\")?\\)|\\*\\*(.+?)\\*\\*|__(.+?)__|\\*([^*]+)\\*|\\b_([^_]+)_\\b|<(https?://[^>\\s]+)>")
+)
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func renderBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			j := i + 1
+			for j < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[j]), m[1]) {
+				j++
+			}
+			code := strings.Join(lines[i+1:min(j, len(lines))], "\n")
+			if m[2] != "" {
+				b.WriteString(`<pre><code class="language-` + template.HTMLEscapeString(m[2]) + `">`)
+				b.WriteString(string(highlight("x."+m[2], code)))
+			} else {
+				b.WriteString("<pre><code>")
+				b.WriteString(template.HTMLEscapeString(code))
+			}
+			b.WriteString("</code></pre>\n")
+			i = j + 1
+		case strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t"):
+			var code []string
+			for i < len(lines) && (isBlank(lines[i]) || strings.HasPrefix(lines[i], "    ") || strings.HasPrefix(lines[i], "\t")) {
+				code = append(code, strings.TrimPrefix(strings.TrimPrefix(lines[i], "\t"), "    "))
+				i++
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>" + template.HTMLEscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			level := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+			i++
+		case mdRule.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			var quoted []string
+			for i < len(lines) && strings.HasPrefix(strings.TrimLeft(lines[i], " "), ">") {
+				rest := strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">")
+				quoted = append(quoted, strings.TrimPrefix(rest, " "))
+				i++
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+		case mdBullet.MatchString(line), mdOrdered.MatchString(line):
+			i = renderList(b, lines, i)
+		default:
+			var para []string
+			for i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]) {
+				if len(para) > 0 && (mdSetextOne.MatchString(lines[i]) || mdSetextTwo.MatchString(lines[i])) {
+					break
+				}
+				para = append(para, breakLine(lines[i]))
+				i++
+			}
+			text := renderInline(strings.TrimRight(strings.Join(para, "\n"), " "))
+			switch {
+			case i < len(lines) && mdSetextOne.MatchString(lines[i]):
+				b.WriteString("<h1>" + text + "</h1>\n")
+				i++
+			case i < len(lines) && mdSetextTwo.MatchString(lines[i]):
+				b.WriteString("<h2>" + text + "</h2>\n")
+				i++
+			default:
+				b.WriteString("<p>" + text + "</p>\n")
+			}
+		}
+	}
+}
+
+// startsBlock reports whether line interrupts a paragraph.
+func startsBlock(line string) bool {
+	return mdFence.MatchString(line) || mdHeading.MatchString(line) || mdRule.MatchString(line) ||
+		mdBullet.MatchString(line) || mdOrdered.MatchString(line) || strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+// renderList renders the list starting at lines[i] and returns the index of
+// the first line after it. Indented lines continue the current item.
+func renderList(b *strings.Builder, lines []string, i int) int {
+	ordered := mdOrdered.MatchString(lines[i])
+	if ordered {
+		start := mdOrdered.FindStringSubmatch(lines[i])[1]
+		if n, _ := strconv.Atoi(start); n != 1 {
+			b.WriteString(`<ol start="` + strconv.Itoa(n) + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	item := func(line string) (string, bool) {
+		if ordered {
+			if m := mdOrdered.FindStringSubmatch(line); m != nil {
+				return m[2], true
+			}
+		} else if m := mdBullet.FindStringSubmatch(line); m != nil {
+			return m[1], true
+		}
+		return "", false
+	}
+	for i < len(lines) {
+		text, ok := item(lines[i])
+		if !ok {
+			break
+		}
+		parts := []string{breakLine(text)}
+		i++
+		for i < len(lines) && !isBlank(lines[i]) && (strings.HasPrefix(lines[i], "  ") || !startsBlock(lines[i])) {
+			if _, next := item(lines[i]); next {
+				break
+			}
+			parts = append(parts, breakLine(lines[i]))
+			i++
+		}
+		b.WriteString("<li>" + renderInline(strings.TrimRight(strings.Join(parts, "\n"), " ")) + "</li>\n")
+		if i+1 < len(lines) && isBlank(lines[i]) {
+			if _, next := item(lines[i+1]); next {
+				i++
+			}
+		}
+	}
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// renderInline escapes text and applies inline formatting.
+func renderInline(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range mdInlineToken.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(escapeLine(text[last:m[0]]))
+		last = m[1]
+		group := func(n int) string {
+			if m[2*n] < 0 {
+				return ""
+			}
+			return text[m[2*n]:m[2*n+1]]
+		}
+		token := text[m[0]:m[1]]
+		switch {
+		case m[2] >= 0:
+			b.WriteString("<code>" + template.HTMLEscapeString(group(2)) + "</code>")
+		case m[6] >= 0 && strings.HasPrefix(token, "!"):
+			b.WriteString(`<img src="` + safeURL(group(4)) + `" alt="` + template.HTMLEscapeString(group(3)) + `"`)
+			if title := group(5); title != "" {
+				b.WriteString(` title="` + template.HTMLEscapeString(title) + `"`)
+			}
+			b.WriteString(">")
+		case m[6] >= 0:
+			b.WriteString(`<a href="` + safeURL(group(4)) + `"`)
+			if title := group(5); title != "" {
+				b.WriteString(` title="` + template.HTMLEscapeString(title) + `"`)
+			}
+			b.WriteString(">" + renderInline(group(3)) + "</a>")
+		case m[12] >= 0:
+			b.WriteString("<strong>" + renderInline(group(6)) + "</strong>")
+		case m[14] >= 0:
+			b.WriteString("<strong>" + renderInline(group(7)) + "</strong>")
+		case m[16] >= 0:
+			b.WriteString("<em>" + renderInline(group(8)) + "</em>")
+		case m[18] >= 0:
+			b.WriteString("<em>" + renderInline(group(9)) + "</em>")
+		case m[20] >= 0:
+			b.WriteString(`<a href="` + safeURL(group(10)) + `">` + template.HTMLEscapeString(group(10)) + "</a>")
+		}
+	}
+	b.WriteString(escapeLine(text[last:]))
+	return b.String()
+}
+
+// breakLine trims the spaces around a line of a paragraph, leaving two at
+// the end of one that ends in two or more, which escapeLine turns into a hard
+// break.
+func breakLine(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasSuffix(line, "  ") {
+		trimmed += "  "
+	}
+	return trimmed
+}
+
+// escapeLine escapes text, turning lines ending in two spaces into hard breaks.
+func escapeLine(text string) string {
+	return strings.ReplaceAll(template.HTMLEscapeString(text), "  \n", "<br>\n")
+}
+
+// safeURL returns the escaped link target, or "#" for targets with a scheme
+// other than http, https or mailto (javascript:, data:, ...).
+func safeURL(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "#"
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return template.HTMLEscapeString(target)
+	}
+	return "#"
+}
+
+const (
+	renderKey   = "render"
+	renderValue = "md"
+)
+
+func isMarkdownName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".md" || ext == ".markdown"
+}
+
+// readme renders the README.md among the entries files of the directory
+// osPath, or returns "" if there is none that can be shown.
+func (f *fileHandler) readme(osPath string, files []os.FileInfo) template.HTML {
+	for _, file := range files {
+		if !strings.EqualFold(file.Name(), "README.md") || !file.Mode().IsRegular() || file.Size() > viewLimit {
+			continue
+		}
+		content, ok, err := f.readTextFile(filepath.Join(osPath, file.Name()))
+		if err != nil || !ok {
+			return ""
+		}
+		return renderMarkdown(string(content))
+	}
+	return ""
+}
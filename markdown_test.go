@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdownHardBreaks(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"one  \ntwo", "<p>one<br>\ntwo</p>\n"},
+		{"one   \n  two", "<p>one<br>\ntwo</p>\n"},
+		{"one \ntwo", "<p>one\ntwo</p>\n"},
+		{"one\ntwo  ", "<p>one\ntwo</p>\n"},
+		{"**one**  \ntwo", "<p><strong>one</strong><br>\ntwo</p>\n"},
+		{"a <b>  \nc", "<p>a &lt;b&gt;<br>\nc</p>\n"},
+		{"- one  \n  two\n- three  ", "<ul>\n<li>one<br>\ntwo</li>\n<li>three</li>\n</ul>\n"},
+		{"Title  \nmore\n===", "<h1>Title<br>\nmore</h1>\n"},
+		{"> quoted  \n> line", "<blockquote>\n<p>quoted<br>\nline</p>\n</blockquote>\n"},
+	}
+	for _, tt := range tests {
+		if got := string(renderMarkdown(tt.src)); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"# Title", "<h1>Title</h1>\n"},
+		{"  indented\n   text  ", "<p>indented\ntext</p>\n"},
+		{"[x](javascript:alert(1))", `<p><a href="#">x</a>)</p>` + "\n"},
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"1. one\n2. two", "<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n"},
+	}
+	for _, tt := range tests {
+		if got := string(renderMarkdown(tt.src)); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+	if got := string(renderMarkdown("```\ncode  \n```")); strings.Contains(got, "<br>") {
+		t.Errorf("a code block got a hard break: %q", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// methodSupported reports whether ServeHTTP has a handler for method on a
+// path in the state given by info and statErr: a directory, a file or
+// nothing. Methods it has no handler for are answered with 405; supported
+// ones that the route does not enable stay 403.
+func (f *fileHandler) methodSupported(r *http.Request, info os.FileInfo, statErr error) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if f.dav && isDAVMethod(r.Method) {
+		return true
+	}
+	switch {
+	case statErr != nil:
+		// -s3-compat deletes of missing keys succeed
+		return r.Method == http.MethodPut || r.Method == methodMkcol || f.s3Compat && r.Method == http.MethodDelete
+	case info.IsDir():
+		return r.Method == http.MethodPost || r.Method == http.MethodDelete
+	default:
+		// POSTs to a file only rename it; deletes posted by the listing
+		// arrive as DELETE
+		return r.Method == http.MethodPut || r.Method == http.MethodDelete || r.Method == http.MethodPost && isRename(r)
+	}
+}
+
+// allowedMethods lists the methods the route permits on a path in the state
+// given by info and statErr, for the Allow header.
+func (f *fileHandler) allowedMethods(info os.FileInfo, statErr error) []string {
+	methods := []string{http.MethodOptions, http.MethodGet, http.MethodHead}
+	exists := statErr == nil
+	isDir := exists && info.IsDir()
+	switch {
+	case !exists:
+		if f.allowUpload {
+			methods = append(methods, http.MethodPut, methodMkcol)
+		}
+	case isDir, f.allowDelete:
+		// a directory takes zip downloads of a selection of its entries, a
+		// file renames and the listing's deletes without scripts
+		methods = append(methods, http.MethodPost)
+	}
+	if exists && !isDir && f.allowUpload {
+		methods = append(methods, http.MethodPut)
+	}
+	if exists && f.allowDelete {
+		methods = append(methods, http.MethodDelete)
+	}
+	if f.dav {
+		methods = append(methods, methodPropfind, methodLock, methodUnlock)
+		if f.allowUpload {
+			methods = append(methods, methodProppatch, methodCopy)
+		}
+		if f.allowUpload && f.allowDelete {
+			methods = append(methods, methodMove)
+		}
+	}
+	return methods
+}
+
+// isRead reports whether r is a GET or HEAD request.
+func isRead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// redirectToCanonical sends a client to the form of its URL with a trailing
+// slash for a directory, so relative links in listings and index pages
+// resolve below it, or without one for a file. The query is kept.
+func (f *fileHandler) redirectToCanonical(w http.ResponseWriter, r *http.Request, isDir bool) {
+	// a single leading slash keeps the target from naming another host
+	target := &url.URL{Path: "/" + strings.Trim(r.URL.Path, "/"), RawQuery: r.URL.RawQuery}
+	if isDir {
+		target.Path += "/"
+	}
+	http.Redirect(w, r, f.prefix.url(r, target).String(), http.StatusMovedPermanently)
+}
+
+func (f *fileHandler) setAllow(w http.ResponseWriter, info os.FileInfo, statErr error) {
+	w.Header().Set("Allow", strings.Join(f.allowedMethods(info, statErr), ", "))
+}
+
+// serveOptions answers OPTIONS outside of WebDAV mode with the Allow set.
+func (f *fileHandler) serveOptions(w http.ResponseWriter, info os.FileInfo, statErr error) {
+	f.setAllow(w, info, statErr)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMethods(t *testing.T) {
+	type flags struct{ upload, delete bool }
+	tests := []struct {
+		path  string
+		flags flags
+		allow string
+	}{
+		{"/dir/", flags{}, "OPTIONS, GET, HEAD, POST"},
+		{"/dir/", flags{upload: true}, "OPTIONS, GET, HEAD, POST"},
+		{"/dir/", flags{delete: true}, "OPTIONS, GET, HEAD, POST, DELETE"},
+		{"/dir/", flags{true, true}, "OPTIONS, GET, HEAD, POST, DELETE"},
+		{"/file.txt", flags{}, "OPTIONS, GET, HEAD"},
+		{"/file.txt", flags{upload: true}, "OPTIONS, GET, HEAD, PUT"},
+		{"/file.txt", flags{delete: true}, "OPTIONS, GET, HEAD, POST, DELETE"},
+		{"/file.txt", flags{true, true}, "OPTIONS, GET, HEAD, POST, PUT, DELETE"},
+		{"/missing", flags{}, "OPTIONS, GET, HEAD"},
+		{"/missing", flags{upload: true}, "OPTIONS, GET, HEAD, PUT, MKCOL"},
+		{"/missing", flags{delete: true}, "OPTIONS, GET, HEAD"},
+		{"/missing", flags{true, true}, "OPTIONS, GET, HEAD, PUT, MKCOL"},
+	}
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, methodMkcol, methodPropfind, methodMove, "BREW"}
+	for _, tt := range tests {
+		for _, method := range methods {
+			h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"dir/a.txt": "a", "file.txt": "f"}))
+			h.allowUpload, h.allowDelete = tt.flags.upload, tt.flags.delete
+			// the posts are the forms of the listing: a zip of a selection
+			// from a directory, a delete without scripts of a file
+			target, body, header := tt.path, "", []string{}
+			if method == http.MethodPost {
+				header = []string{"Content-Type", formContentType}
+				if strings.HasSuffix(tt.path, "/") {
+					target, body = tt.path+"?zip=1", "name=a.txt"
+				} else {
+					body = methodOverrideKey + "=DELETE"
+				}
+			}
+			w := serveTest(h, method, target, strings.NewReader(body), header...)
+			name := method + " " + tt.path
+			allowed := slices.Contains(strings.Split(tt.allow, ", "), method)
+			switch {
+			case method == http.MethodOptions:
+				if w.Code != http.StatusNoContent || w.Header().Get("Allow") != tt.allow {
+					t.Errorf("%s with %+v: %d, Allow %q, want 204 and %q", name, tt.flags, w.Code, w.Header().Get("Allow"), tt.allow)
+				}
+			case allowed && (w.Code == http.StatusMethodNotAllowed || w.Code == http.StatusForbidden):
+				t.Errorf("%s with %+v: %d for an allowed method", name, tt.flags, w.Code)
+			case !allowed && w.Code != http.StatusMethodNotAllowed && w.Code != http.StatusForbidden:
+				t.Errorf("%s with %+v: %d, want 405 or 403", name, tt.flags, w.Code)
+			case w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != tt.allow:
+				t.Errorf("%s with %+v: Allow %q, want %q", name, tt.flags, w.Header().Get("Allow"), tt.allow)
+			}
+			if method == http.MethodPatch || method == "BREW" || method == methodPropfind || method == methodMove {
+				if w.Code != http.StatusMethodNotAllowed {
+					t.Errorf("%s with %+v: %d, want 405 without WebDAV", name, tt.flags, w.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestReadsUnchanged(t *testing.T) {
+	h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"file.txt": "content"}))
+	if w := serveTest(h, http.MethodGet, "/file.txt", nil); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("GET: %d %q", w.Code, w.Body.String())
+	}
+	if w := serveTest(h, http.MethodHead, "/file.txt", nil); w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "7" {
+		t.Errorf("HEAD: %d with %d bytes, Content-Length %q", w.Code, w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+}
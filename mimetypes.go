@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extensionType maps a file extension, with its leading dot, to a MIME type.
+type extensionType struct {
+	ext         string
+	contentType string
+}
+
+func newExtensionType(ext, contentType string) (extensionType, error) {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if ext == "" || ext == "." || strings.ContainsAny(ext[1:], `./\`) {
+		return extensionType{}, fmt.Errorf("%q is not a file extension", ext)
+	}
+	contentType = strings.TrimSpace(contentType)
+	if err := validContentType(contentType); err != nil {
+		return extensionType{}, err
+	}
+	return extensionType{ext: ext, contentType: contentType}, nil
+}
+
+func validContentType(contentType string) error {
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return fmt.Errorf("%q: %v", contentType, err)
+	}
+	return nil
+}
+
+type extensionTypes struct {
+	Values []extensionType
+}
+
+func (fv *extensionTypes) help() string {
+	return "serve files ending in EXT as TYPE, e.g. log=text/plain (repeatable, EXT=TYPE)"
+}
+
+// Set is flag.Value.Set
+func (fv *extensionTypes) Set(v string) error {
+	ext, contentType, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("%q: want EXT=TYPE", v)
+	}
+	t, err := newExtensionType(ext, contentType)
+	if err != nil {
+		return err
+	}
+	fv.Values = append(fv.Values, t)
+	return nil
+}
+
+func (fv *extensionTypes) String() string {
+	values := make([]string, len(fv.Values))
+	for i, t := range fv.Values {
+		values[i] = strings.TrimPrefix(t.ext, ".") + "=" + t.contentType
+	}
+	return strings.Join(values, ", ")
+}
+
+// loadMIMETypes reads a file in the format of /etc/mime.types: lines of a
+// MIME type followed by its extensions, without dots, and # comments.
+func loadMIMETypes(path string) ([]extensionType, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var types []extensionType
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			t, err := newExtensionType(ext, fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			types = append(types, t)
+		}
+	}
+	return types, scanner.Err()
+}
+
+// registerMIMETypes makes types override the built-in and system types for
+// every lookup by extension, in the order given.
+func registerMIMETypes(types []extensionType) error {
+	for _, t := range types {
+		if err := mime.AddExtensionType(t.ext, t.contentType); err != nil {
+			return fmt.Errorf("%s: %v", t.ext, err)
+		}
+	}
+	return nil
+}
+
+// contentTypeOf is the Content-Type the file at osPath is served with: that
+// of its extension, else -default-type, else what its first bytes look like.
+func (f *fileHandler) contentTypeOf(osPath string) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(osPath)); contentType != "" {
+		return contentType, nil
+	}
+	if f.defaultType != "" {
+		return f.defaultType, nil
+	}
+	return f.sniffContentType(osPath)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtensionTypesSet(t *testing.T) {
+	var types extensionTypes
+	for _, v := range []string{"log=text/plain", ".M3U8=application/vnd.apple.mpegurl", " wasm = application/wasm "} {
+		if err := types.Set(v); err != nil {
+			t.Errorf("Set(%q): %v", v, err)
+		}
+	}
+	if got, want := types.String(), "log=text/plain, m3u8=application/vnd.apple.mpegurl, wasm=application/wasm"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	for _, v := range []string{"log", "=text/plain", ".=text/plain", "tar.gz=application/gzip", "a/b=text/plain", "log=", "log=text/plain;;"} {
+		if err := types.Set(v); err == nil {
+			t.Errorf("Set(%q) succeeded", v)
+		}
+	}
+}
+
+func TestLoadMIMETypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mime.types")
+	text := "# comment\n\ntext/x-hfs-a\thfsa hfsb # trailing comment\napplication/x-hfs-c hfsc\n"
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	types, err := loadMIMETypes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []extensionType{{".hfsa", "text/x-hfs-a"}, {".hfsb", "text/x-hfs-a"}, {".hfsc", "application/x-hfs-c"}}
+	if len(types) != len(want) {
+		t.Fatalf("loaded %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("type %d = %v, want %v", i, types[i], want[i])
+		}
+	}
+	if err := os.WriteFile(path, []byte("text/plain ok\ntext/plain tar.gz\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMIMETypes(path); err == nil {
+		t.Error("loaded a malformed line")
+	}
+}
+
+func TestContentTypeOverrides(t *testing.T) {
+	// extensions of no registered type, as mime registrations are global
+	if err := registerMIMETypes([]extensionType{{".hfslog", "text/plain; charset=utf-8"}, {".hfswasm", "application/wasm"}}); err != nil {
+		t.Fatal(err)
+	}
+	dir := writeTestTree(t, map[string]string{
+		"app.hfslog":      "log line",
+		"mod.hfswasm":     "\x00asm",
+		"data.hfsunknown": "\x00\x01\x02",
+		"page.hfsunknown": "<html><body>x</body></html>",
+		"big.hfslog":      "log line",
+		"big.hfslog.gz":   "not really gzip",
+	})
+	h := newTestHandler(t, "/", dir)
+	h.precompressed = true
+	tests := []struct {
+		defaultType, target, header, want string
+	}{
+		{"", "/app.hfslog", "", "text/plain; charset=utf-8"},
+		{"", "/mod.hfswasm", "", "application/wasm"},
+		{"", "/data.hfsunknown", "", "application/octet-stream"},
+		{"", "/page.hfsunknown", "", "text/html; charset=utf-8"},
+		{"text/plain", "/data.hfsunknown", "", "text/plain"},
+		{"text/plain", "/page.hfsunknown", "", "text/plain"},
+		{"text/plain", "/app.hfslog", "", "text/plain; charset=utf-8"},
+		{"", "/big.hfslog", "gzip", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		h.defaultType = tt.defaultType
+		w := serveTest(h, http.MethodGet, tt.target, nil, "Accept-Encoding", tt.header)
+		if got := w.Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("-default-type %q: %s: Content-Type %q, want %q", tt.defaultType, tt.target, got, tt.want)
+		}
+		if tt.header != "" && w.Header().Get("Content-Encoding") != tt.header {
+			t.Errorf("%s: the precompressed sibling was not served", tt.target)
+		}
+	}
+}
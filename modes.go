@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	defaultUploadMode    = "0600"
+	defaultUploadDirMode = "0755"
+)
+
+// parseFileMode reads an octal mode such as 0640 or 2770, where the setgid
+// bit lets a directory pass its group on to new files.
+func parseFileMode(s string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if bits&^07777 != 0 {
+		return 0, fmt.Errorf("%q has bits beyond 07777", s)
+	}
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// mkdirAllMode is os.MkdirAll giving every directory it creates exactly
+// mode. The mode is set with chmod after creation, so the umask does not
+// narrow it; existing directories are left alone.
+func mkdirAllMode(dir string, mode os.FileMode) error {
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: fmt.Errorf("not a directory")}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAllMode(parent, mode); err != nil {
+			return err
+		}
+	}
+	err := os.Mkdir(dir, mode)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		s    string
+		want os.FileMode
+	}{
+		{"0600", 0o600},
+		{"640", 0o640},
+		{"0755", 0o755},
+		{"2770", os.ModeSetgid | 0o770},
+		{"4755", os.ModeSetuid | 0o755},
+		{"1777", os.ModeSticky | 0o777},
+		{"7777", os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0o777},
+	}
+	for _, tt := range tests {
+		got, err := parseFileMode(tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("parseFileMode(%q) = %v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"", "0800", "rw-r--r--", "17777", "-1"} {
+		if got, err := parseFileMode(s); err == nil {
+			t.Errorf("parseFileMode(%q) = %v, want an error", s, got)
+		}
+	}
+}
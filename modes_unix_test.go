@@ -0,0 +1,97 @@
+//go:build unix
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// withUmask runs the test with the process umask set to mask.
+func withUmask(t *testing.T, mask int) {
+	old := syscall.Umask(mask)
+	t.Cleanup(func() { syscall.Umask(old) })
+}
+
+func checkMode(t *testing.T, path string, want os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode() & (os.ModePerm | os.ModeSetgid); got != want {
+		t.Errorf("%s: mode %v, want %v", filepath.Base(path), got, want)
+	}
+}
+
+func TestUploadModesIgnoreUmask(t *testing.T) {
+	withUmask(t, 0o077)
+	dir := t.TempDir()
+	h := newTestHandler(t, "/", dir)
+	h.allowUpload = true
+	h.uploadMode = 0o664
+	h.uploadDirMode = os.ModeSetgid | 0o775
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, streamedUpload("/", "upload.bin", 10))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	checkMode(t, filepath.Join(dir, "upload.bin"), 0o664)
+
+	if w := serveTest(h, http.MethodPut, "/put.bin", strings.NewReader("put")); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	checkMode(t, filepath.Join(dir, "put.bin"), 0o664)
+
+	w = serveTest(h, http.MethodPost, "/", strings.NewReader(mkdirKey+"=made"), "Content-Type", "application/x-www-form-urlencoded")
+	if w.Code >= 400 {
+		t.Fatalf("mkdir: %d %s", w.Code, w.Body)
+	}
+	checkMode(t, filepath.Join(dir, "made"), os.ModeSetgid|0o775)
+}
+
+func TestReplacedFileKeepsMode(t *testing.T) {
+	withUmask(t, 0o022)
+	dir := writeTestTree(t, map[string]string{"kept.bin": "old"})
+	if err := os.Chmod(filepath.Join(dir, "kept.bin"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, "/", dir)
+	h.allowUpload = true
+	h.uploadMode = 0o600
+	h.onConflict = onConflictOverwrite
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, streamedUpload("/", "kept.bin", 10))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	checkMode(t, filepath.Join(dir, "kept.bin"), 0o640)
+	if w := serveTest(h, http.MethodPut, "/kept.bin", strings.NewReader("put")); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	checkMode(t, filepath.Join(dir, "kept.bin"), 0o640)
+}
+
+func TestMkdirAllModeIgnoresUmask(t *testing.T) {
+	withUmask(t, 0o077)
+	dir := t.TempDir()
+	if err := mkdirAllMode(filepath.Join(dir, "a", "b"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(t, filepath.Join(dir, "a"), 0o750)
+	checkMode(t, filepath.Join(dir, "a", "b"), 0o750)
+	// existing directories are left alone
+	if err := os.Chmod(filepath.Join(dir, "a"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := mkdirAllMode(filepath.Join(dir, "a", "c"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(t, filepath.Join(dir, "a"), 0o700)
+	checkMode(t, filepath.Join(dir, "a", "c"), 0o755)
+}
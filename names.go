@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameLength is the longest file name most file systems accept, in bytes.
+const maxNameLength = 255
+
+// windowsReservedNames are device names Windows will not create files for,
+// whatever their extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// badNameError is returned for names sanitizeName cannot salvage.
+type badNameError struct {
+	name   string
+	reason string
+}
+
+func (e *badNameError) Error() string {
+	return fmt.Sprintf("bad file name %q: %s", e.name, e.reason)
+}
+
+// sanitizeName turns a client-supplied file name into one that is safe to
+// create on any platform: it keeps the last element of a / or \ separated
+// path, drops control characters and invalid UTF-8, trims leading spaces and
+// trailing dots and spaces, and prefixes Windows device names with "_". With
+// strict, everything but ASCII letters, digits and " ._-()[]+,=@~" is
+// percent-encoded as well.
+func sanitizeName(name string, strict bool) (string, error) {
+	clean := name
+	if i := strings.LastIndexAny(clean, `/\`); i >= 0 {
+		clean = clean[i+1:]
+	}
+	clean = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, clean)
+	clean = strings.TrimLeft(clean, " ")
+	clean = strings.TrimRight(clean, ". ")
+	if strict {
+		clean = percentEncodeUnsafe(clean)
+	}
+	switch {
+	case clean == "":
+		return "", &badNameError{name, "nothing is left after removing unsafe characters"}
+	case len(clean) > maxNameLength:
+		return "", &badNameError{name, fmt.Sprintf("longer than %d bytes", maxNameLength)}
+	}
+	stem, _, _ := strings.Cut(clean, ".")
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		clean = "_" + clean
+	}
+	return clean, nil
+}
+
+func percentEncodeUnsafe(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte(" ._-()[]+,=@~", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// networks is a list of IP networks given as CIDR prefixes or single
+// addresses, for -trusted-proxies, -allow and -deny.
+type networks struct {
+	Values []netip.Prefix
+}
+
+// Set is flag.Value.Set. It takes one network or a comma-separated list.
+func (fv *networks) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap().WithZone("")
+			fv.Values = append(fv.Values, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("%q is neither an IP address nor a CIDR network", s)
+		}
+		fv.Values = append(fv.Values, prefix.Masked())
+	}
+	return nil
+}
+
+func (fv *networks) String() string {
+	values := make([]string, len(fv.Values))
+	for i, prefix := range fv.Values {
+		values[i] = prefix.String()
+	}
+	return strings.Join(values, ", ")
+}
+
+// contains reports whether addr is in one of the networks. IPv4 addresses
+// mapped into IPv6, as the listener reports IPv4 clients of a dual-stack
+// socket, match the IPv4 networks.
+func (fv *networks) contains(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range fv.Values {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
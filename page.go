@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	offsetKey = "offset"
+	limitKey  = "limit"
+
+	defaultPageSize = 2000
+
+	totalCountHeader = "X-Total-Count"
+
+	statWorkers = 16
+)
+
+// page is the window of a listing shown by one response.
+type page struct {
+	Offset int
+	Limit  int
+	// Total is the number of entries of the whole listing
+	Total   int
+	PrevURL *url.URL
+	NextURL *url.URL
+}
+
+// parsePage reads ?offset= and ?limit= for a listing of total entries,
+// falling back to the first page of the handler's page size. A limit of 0
+// shows everything. The links to other pages are variants of base.
+func (f *fileHandler) parsePage(r *http.Request, base *url.URL, total int) page {
+	p := page{Limit: f.pageSize, Total: total}
+	q := r.URL.Query()
+	if n, err := strconv.Atoi(q.Get(offsetKey)); err == nil && n > 0 {
+		p.Offset = n
+	}
+	if n, err := strconv.Atoi(q.Get(limitKey)); err == nil && n > 0 {
+		p.Limit = n
+	}
+	if p.Offset > total {
+		p.Offset = total
+	}
+	if p.Limit <= 0 {
+		return p
+	}
+	if p.Offset > 0 {
+		p.PrevURL = withQueryParam(base, offsetKey, strconv.Itoa(max(p.Offset-p.Limit, 0)))
+	}
+	if p.Offset+p.Limit < total {
+		p.NextURL = withQueryParam(base, offsetKey, strconv.Itoa(p.Offset+p.Limit))
+	}
+	return p
+}
+
+// window returns the entries of files on the page.
+func (p page) window(files []os.FileInfo) []os.FileInfo {
+	if p.Limit <= 0 || p.Offset+p.Limit > len(files) {
+		return files[p.Offset:]
+	}
+	return files[p.Offset : p.Offset+p.Limit]
+}
+
+// First and Last are the 1-based positions of the page's entries.
+func (p page) First() int {
+	return min(p.Offset+1, p.Total)
+}
+
+func (p page) Last() int {
+	if p.Limit <= 0 {
+		return p.Total
+	}
+	return min(p.Offset+p.Limit, p.Total)
+}
+
+// Paged reports whether the listing does not fit on one page.
+func (p page) Paged() bool {
+	return p.PrevURL != nil || p.NextURL != nil
+}
+
+// setHeaders announces the total and the neighbouring pages, for clients of
+// the JSON and text listings.
+func (p page) setHeaders(w http.ResponseWriter) {
+	w.Header().Set(totalCountHeader, strconv.Itoa(p.Total))
+	var links []string
+	if p.PrevURL != nil {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, p.PrevURL))
+	}
+	if p.NextURL != nil {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, p.NextURL))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// withQueryParam returns a copy of u with key set to value. The raw query is
+// edited by hand to keep the ";"-separated sort parameters intact.
+func withQueryParam(u *url.URL, key, value string) *url.URL {
+	out := *u
+	var kept []string
+	for _, kv := range strings.FieldsFunc(u.RawQuery, func(r rune) bool { return r == ';' || r == '&' }) {
+		if k, _, _ := strings.Cut(kv, "="); k != key {
+			kept = append(kept, kv)
+		}
+	}
+	out.RawQuery = strings.Join(append(kept, key+"="+url.QueryEscape(value)), "&")
+	return &out
+}
+
+// lazyInfo is a directory entry that is only stat'ed once its size, mode or
+// modification time is asked for, so that sorting a large directory by name
+// and rendering one page of it stats just that page. An entry whose stat
+// fails, typically because it was just deleted, reports a zero size and
+// modification time.
+type lazyInfo struct {
+	fs.DirEntry
+	info    os.FileInfo
+	statted bool
+}
+
+func (l *lazyInfo) stat() os.FileInfo {
+	if !l.statted {
+		l.info, _ = l.DirEntry.Info()
+		l.statted = true
+	}
+	return l.info
+}
+
+// statFailed reports whether info is an entry that could not be stat'ed.
+func statFailed(info os.FileInfo) bool {
+	l, ok := info.(*lazyInfo)
+	return ok && l.stat() == nil
+}
+
+// statAll stats the lazy entries among files with up to statWorkers calls
+// in flight, which on network file systems is far quicker than one by one.
+func statAll(files []os.FileInfo) {
+	var wg sync.WaitGroup
+	next := make(chan *lazyInfo)
+	for i := 0; i < statWorkers && i < len(files); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range next {
+				l.stat()
+			}
+		}()
+	}
+	for _, file := range files {
+		if l, ok := file.(*lazyInfo); ok && !l.statted {
+			next <- l
+		}
+	}
+	close(next)
+	wg.Wait()
+}
+
+func (l *lazyInfo) Size() int64 {
+	if info := l.stat(); info != nil {
+		return info.Size()
+	}
+	return 0
+}
+
+func (l *lazyInfo) Mode() os.FileMode {
+	if info := l.stat(); info != nil {
+		return info.Mode()
+	}
+	return l.Type()
+}
+
+func (l *lazyInfo) ModTime() time.Time {
+	if info := l.stat(); info != nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+func (l *lazyInfo) Sys() interface{} {
+	if info := l.stat(); info != nil {
+		return info.Sys()
+	}
+	return nil
+}
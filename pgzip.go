@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+)
+
+const (
+	defaultArchiveLevel = gzip.DefaultCompression
+
+	// pgzipBlockSize is the input compressed by one worker at a time
+	pgzipBlockSize = 1 << 20
+	// pgzipDictSize is the window of preceding input a block is compressed
+	// against, so that splitting the stream costs little ratio
+	pgzipDictSize = 32 << 10
+)
+
+// archiveCompression is how tar.gz archives are compressed: at gzip level,
+// by as many workers at once. Levels where compressing is cheaper than
+// splitting the work, and a single worker, use the sequential writer.
+type archiveCompression struct {
+	level   int
+	workers int
+}
+
+// newArchiveCompression checks level and resolves workers 0 to one per CPU.
+func newArchiveCompression(level, workers int) (archiveCompression, error) {
+	if level < gzip.DefaultCompression || level > gzip.BestCompression {
+		return archiveCompression{}, fmt.Errorf("invalid level %d", level)
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return archiveCompression{level: level, workers: workers}, nil
+}
+
+func (c archiveCompression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	if c.workers <= 1 || c.level == gzip.NoCompression || c.level == gzip.BestSpeed {
+		return gzip.NewWriterLevel(w, c.level)
+	}
+	return newParallelGzipWriter(w, c.level, c.workers), nil
+}
+
+// parallelGzipWriter writes a single gzip member whose deflate stream is
+// made of blocks compressed concurrently, each primed with the input before
+// it and ended with a sync flush so that the pieces join up. Standard gzip
+// readers see an ordinary stream.
+type parallelGzipWriter struct {
+	w     io.Writer
+	level int
+
+	buf  []byte
+	dict []byte
+	crc  uint32
+	size uint32
+
+	// blocks go to the output goroutine in stream order; its capacity
+	// bounds the blocks compressed at once
+	blocks chan *pgzipBlock
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+type pgzipBlock struct {
+	out   bytes.Buffer
+	ready chan struct{}
+	err   error
+}
+
+func newParallelGzipWriter(w io.Writer, level, workers int) *parallelGzipWriter {
+	z := &parallelGzipWriter{
+		w:      w,
+		level:  level,
+		buf:    make([]byte, 0, pgzipBlockSize),
+		blocks: make(chan *pgzipBlock, workers),
+		done:   make(chan struct{}),
+	}
+	go z.output()
+	return z
+}
+
+func (z *parallelGzipWriter) Write(p []byte) (int, error) {
+	if err := z.failed(); err != nil {
+		return 0, err
+	}
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	z.size += uint32(len(p))
+	n := len(p)
+	for len(p) > 0 {
+		room := pgzipBlockSize - len(z.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		z.buf = append(z.buf, p[:room]...)
+		p = p[room:]
+		if len(z.buf) == pgzipBlockSize {
+			z.dispatch(false)
+		}
+	}
+	return n, nil
+}
+
+// Close compresses what is left, ends the stream and writes the gzip
+// trailer. It does not close the underlying writer.
+func (z *parallelGzipWriter) Close() error {
+	z.dispatch(true)
+	close(z.blocks)
+	<-z.done
+	if err := z.failed(); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	_, err := z.w.Write(trailer[:])
+	return err
+}
+
+// dispatch hands the buffered input to a worker, the last block of the
+// stream if final.
+func (z *parallelGzipWriter) dispatch(final bool) {
+	input, dict := z.buf, z.dict
+	if len(input) >= pgzipDictSize {
+		z.dict = append([]byte(nil), input[len(input)-pgzipDictSize:]...)
+	} else {
+		z.dict = append(z.dict[max(len(z.dict)+len(input)-pgzipDictSize, 0):], input...)
+	}
+	z.buf = make([]byte, 0, pgzipBlockSize)
+	b := &pgzipBlock{ready: make(chan struct{})}
+	go func() {
+		defer close(b.ready)
+		fw, err := flate.NewWriterDict(&b.out, z.level, dict)
+		if err == nil {
+			_, err = fw.Write(input)
+		}
+		if err == nil && final {
+			err = fw.Close()
+		} else if err == nil {
+			err = fw.Flush()
+		}
+		b.err = err
+	}()
+	z.blocks <- b
+}
+
+// output writes the gzip header and then the blocks in order as they are
+// done. After a failure it only drains them.
+func (z *parallelGzipWriter) output() {
+	defer close(z.done)
+	header := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	_, err := z.w.Write(header)
+	for b := range z.blocks {
+		<-b.ready
+		if err == nil {
+			err = b.err
+		}
+		if err == nil {
+			_, err = z.w.Write(b.out.Bytes())
+		}
+		if err != nil {
+			z.fail(err)
+		}
+	}
+}
+
+func (z *parallelGzipWriter) fail(err error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.err == nil {
+		z.err = err
+	}
+}
+
+func (z *parallelGzipWriter) failed() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// testCorpus returns size bytes of log-like text, compressible about as well
+// as the files archives are usually made of.
+func testCorpus(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"GET", "PUT", "/files/", "report", ".txt", "200", "404", "ok", "upload", "listing", "\n"}
+	var b bytes.Buffer
+	for b.Len() < size {
+		fmt.Fprintf(&b, "%08x %s ", rng.Uint32(), words[rng.Intn(len(words))])
+	}
+	return b.Bytes()[:size]
+}
+
+func TestParallelGzipRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, pgzipDictSize, pgzipBlockSize, 3*pgzipBlockSize + 12345} {
+		data := testCorpus(size)
+		var b bytes.Buffer
+		z := newParallelGzipWriter(&b, gzip.DefaultCompression, 4)
+		// uneven writes, so that blocks fill across them
+		for rest := data; len(rest) > 0; {
+			n := min(len(rest), 100000)
+			if _, err := z.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(&b)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: read back %d bytes (%v)", size, len(got), err)
+		}
+	}
+}
+
+// BenchmarkArchiveCompression compresses a 16 MiB corpus with compress/gzip
+// and with the parallel writer at the default level.
+func BenchmarkArchiveCompression(b *testing.B) {
+	data := testCorpus(16 << 20)
+	// at least two workers, for the parallel writer on a single CPU too
+	for _, workers := range []int{1, max(runtime.GOMAXPROCS(0), 2)} {
+		c, err := newArchiveCompression(defaultArchiveLevel, workers)
+		if err != nil {
+			b.Fatal(err)
+		}
+		name := "gzip"
+		if workers > 1 {
+			name = fmt.Sprintf("pgzip-%d", workers)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			var n int
+			for i := 0; i < b.N; i++ {
+				var out countingWriter
+				z, err := c.newWriter(&out)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := z.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if err := z.Close(); err != nil {
+					b.Fatal(err)
+				}
+				n = int(out)
+			}
+			b.ReportMetric(float64(n)/float64(len(data)), "ratio")
+		})
+	}
+}
+
+// countingWriter counts the bytes written to it and drops them.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
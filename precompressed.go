@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// precompressedEncodings are the siblings looked for by -precompressed, in
+// order of preference, by Content-Encoding and file extension.
+var precompressedEncodings = []struct{ coding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressedSibling returns the compressed copy of the file at osPath that
+// r accepts, if there is one, along with its Content-Encoding.
+func (f *fileHandler) precompressedSibling(r *http.Request, osPath string) (string, string, os.FileInfo) {
+	for _, e := range precompressedEncodings {
+		if !acceptsEncoding(r, e.coding) {
+			continue
+		}
+		if info, err := f.storage.Stat(f.storageName(osPath + e.ext)); err == nil && info.Mode().IsRegular() {
+			return osPath + e.ext, e.coding, info
+		}
+	}
+	return "", "", nil
+}
+
+// isPrecompressedSibling reports whether the file at osPath is the compressed
+// copy of a file next to it.
+func (f *fileHandler) isPrecompressedSibling(osPath string) bool {
+	for _, e := range precompressedEncodings {
+		if original, ok := strings.CutSuffix(osPath, e.ext); ok {
+			if info, err := f.storage.Stat(f.storageName(original)); err == nil && info.Mode().IsRegular() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// servePrecompressed serves a compressed copy of the file at osPath that r
+// accepts, if -precompressed is set and one exists, and reports whether it
+// did. The copy has the original's Content-Type; ETag and Last-Modified
+// are the copy's. Range requests get the whole copy, since ranges of the
+// encoded bytes are not what the client would ask for.
+func (f *fileHandler) servePrecompressed(w http.ResponseWriter, r *http.Request, osPath string) bool {
+	if !f.precompressed || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	siblingPath, coding, info := f.precompressedSibling(r, osPath)
+	if siblingPath == "" {
+		return false
+	}
+	contentType, err := f.contentTypeOf(osPath)
+	if err != nil {
+		return false
+	}
+	file, err := f.storage.Open(f.storageName(siblingPath))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+	f.setUserContentHeaders(w, filepath.Base(osPath))
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Encoding", coding)
+	h.Set("ETag", fileETag(info))
+	r = r.Clone(r.Context())
+	r.Header.Del("Range")
+	r.Header.Del("If-Range")
+	http.ServeContent(&wholeResponseWriter{ResponseWriter: w, size: info.Size()}, r, filepath.Base(osPath), info.ModTime(), content)
+	return true
+}
+
+// sniffContentType detects the Content-Type of the file at osPath from its
+// first bytes, as http.ServeFile does for names without a known extension.
+func (f *fileHandler) sniffContentType(osPath string) (string, error) {
+	file, err := f.storage.Open(f.storageName(osPath))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// wholeResponseWriter passes on a response that is never split into ranges:
+// it takes back http.ServeContent's Accept-Ranges and supplies the
+// Content-Length it leaves out for encoded content.
+type wholeResponseWriter struct {
+	http.ResponseWriter
+	size int64
+}
+
+func (w *wholeResponseWriter) WriteHeader(status int) {
+	w.Header().Del("Accept-Ranges")
+	if status == http.StatusOK {
+		w.Header().Set("Content-Length", strconv.FormatInt(w.size, 10))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
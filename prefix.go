@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const forwardedPrefixHeader = "X-Forwarded-Prefix"
+
+// urlPrefix is the path a reverse proxy serves the server below, which every
+// link, redirect and Location header the server generates must start with:
+// -base-url, or with -trust-forwarded-prefix the X-Forwarded-Prefix header of
+// each request. Requests arrive with the prefix already stripped.
+type urlPrefix struct {
+	base           string
+	trustForwarded bool
+}
+
+// parseBaseURL returns the prefix of -base-url, which may be a path or an
+// absolute URL of which only the path is used.
+func parseBaseURL(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	p, ok := cleanPrefix(u.Path)
+	if !ok {
+		return "", fmt.Errorf("%q has no path", s)
+	}
+	return p, nil
+}
+
+// cleanPrefix returns p with a single leading slash and none at the end, or
+// "" for the root. ok is false unless p is an absolute path.
+func cleanPrefix(p string) (string, bool) {
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#\\") {
+		return "", false
+	}
+	p = path.Clean(p)
+	if p == "/" {
+		return "", true
+	}
+	return p, true
+}
+
+// of returns the prefix for links in the response to r, "" if there is none.
+// A malformed forwarded prefix is ignored.
+func (p urlPrefix) of(r *http.Request) string {
+	if p.trustForwarded {
+		if forwarded, ok := cleanPrefix(r.Header.Get(forwardedPrefixHeader)); ok {
+			return forwarded
+		}
+	}
+	return p.base
+}
+
+// url returns u, a URL of this server, as clients of r address it.
+func (p urlPrefix) url(r *http.Request, u *url.URL) *url.URL {
+	prefix := p.of(r)
+	if prefix == "" {
+		return u
+	}
+	out := *u
+	out.Path = prefix + u.Path
+	if u.RawPath != "" {
+		out.RawPath = (&url.URL{Path: prefix}).EscapedPath() + u.RawPath
+	}
+	return &out
+}
+
+// absolute is url with the scheme and host r was sent to, for links that
+// leave the page, such as share links and feeds.
+func (p urlPrefix) absolute(r *http.Request, u *url.URL) *url.URL {
+	out := *p.url(r, u)
+	out.Host = r.Host
+	out.Scheme = "http"
+	if r.TLS != nil {
+		out.Scheme = "https"
+	}
+	return &out
+}
+
+// path is url for a URL path, returned in its escaped form.
+func (p urlPrefix) path(r *http.Request, urlPath string) string {
+	return p.url(r, &url.URL{Path: urlPath}).String()
+}
+
+// strip turns a URL path a client of r sent in a form field or header back
+// into one of this server.
+func (p urlPrefix) strip(r *http.Request, urlPath string) string {
+	prefix := p.of(r)
+	if rest, ok := strings.CutPrefix(urlPath, prefix); ok && prefix != "" && strings.HasPrefix(rest, "/") {
+		return rest
+	}
+	return urlPath
+}
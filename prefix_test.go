@@ -0,0 +1,81 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// urlAttribute matches the attributes of a page that hold a URL.
+var urlAttribute = regexp.MustCompile(`\b(href|src|action|formaction|data-url)="([^"]*)"`)
+
+func TestListingLinksBelowPrefix(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"sub/a.txt": "a", "sub/b.md": "b", "sub/c.jpg": "c", "sub/d/": ""})
+	tests := []struct {
+		name   string
+		prefix urlPrefix
+		header []string
+	}{
+		{"base URL", urlPrefix{base: "/files"}, nil},
+		{"forwarded prefix", urlPrefix{trustForwarded: true}, []string{forwardedPrefixHeader, "/files/"}},
+		{"forwarded prefix over the base URL", urlPrefix{base: "/other", trustForwarded: true}, []string{forwardedPrefixHeader, "/files"}},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "/", dir)
+		h.prefix = tt.prefix
+		h.allowUpload, h.allowDelete = true, true
+		w := serveTest(h, http.MethodGet, "/sub/", nil, tt.header...)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.name, w.Code)
+		}
+		links := urlAttribute.FindAllStringSubmatch(w.Body.String(), -1)
+		if len(links) < 10 {
+			t.Fatalf("%s: only %d links", tt.name, len(links))
+		}
+		for _, link := range links {
+			// links of just a query stay on the page as the client sees it
+			if u := html.UnescapeString(link[2]); !strings.HasPrefix(u, "/files/") && !strings.HasPrefix(u, "?") {
+				t.Errorf("%s: %s=%q outside /files/", tt.name, link[1], u)
+			}
+		}
+		if !strings.Contains(w.Body.String(), `href="/files/static/layout/autoindex.css"`) {
+			t.Errorf("%s: stylesheet not below the prefix", tt.name)
+		}
+		w = serveTest(h, http.MethodGet, "/sub", nil, tt.header...)
+		if got := w.Header().Get("Location"); got != "/files/sub/" {
+			t.Errorf("%s: redirect to %q, want /files/sub/", tt.name, got)
+		}
+	}
+}
+
+func TestForwardedPrefixUntrusted(t *testing.T) {
+	h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"a.txt": "a"}))
+	body := serveTest(h, http.MethodGet, "/", nil, forwardedPrefixHeader, "/evil").Body.String()
+	if strings.Contains(body, "/evil") {
+		t.Error("listing follows an untrusted X-Forwarded-Prefix")
+	}
+}
+
+func TestCleanPrefix(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"/", "", true},
+		{"/files", "/files", true},
+		{"/files/", "/files", true},
+		{"//files//x/", "/files/x", true},
+		{"files", "", false},
+		{"/a?b", "", false},
+		{"/a#b", "", false},
+		{`/a\b`, "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := cleanPrefix(tt.in); got != tt.want || ok != tt.ok {
+			t.Errorf("cleanPrefix(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// isPrivateDir reports whether info, from Lstat, is that of a directory. The
+// user's cache directory is theirs on these platforms, and permissions are
+// not told by the mode.
+func isPrivateDir(info os.FileInfo) bool {
+	return info.IsDir()
+}
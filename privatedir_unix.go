@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// isPrivateDir reports whether info, from Lstat, is that of a directory the
+// user owns that nobody else may read or write.
+func isPrivateDir(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.IsDir() && int(st.Uid) == os.Getuid() && info.Mode().Perm()&0o077 == 0
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrivateDir(t *testing.T) {
+	base := t.TempDir()
+
+	created := filepath.Join(base, "a", "b")
+	if err := privateDir(created); err != nil {
+		t.Fatalf("privateDir of a new directory: %v", err)
+	}
+	if info, err := os.Stat(created); err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("created %v (%v), want mode 0700", info.Mode(), err)
+	}
+	if err := privateDir(created); err != nil {
+		t.Errorf("privateDir of an existing private directory: %v", err)
+	}
+
+	shared := filepath.Join(base, "shared")
+	if err := os.Mkdir(shared, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(shared, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(shared); err == nil {
+		t.Error("privateDir accepted a directory others may write to")
+	}
+
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(created, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(link); err == nil {
+		t.Error("privateDir accepted a symlink")
+	}
+
+	file := filepath.Join(base, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(file); err == nil {
+		t.Error("privateDir accepted a file")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	forwardedForHeader = "X-Forwarded-For"
+	realIPHeader       = "X-Real-IP"
+)
+
+// clientAddr returns the address of the client behind the trusted proxy that
+// sent r: the rightmost X-Forwarded-For hop that is not a trusted proxy
+// itself, or X-Real-IP if there is no X-Forwarded-For. Hops left of one that
+// does not parse are not believed.
+func clientAddr(proxies *networks, peer netip.Addr, r *http.Request) netip.Addr {
+	forwarded := r.Header.Values(forwardedForHeader)
+	if len(forwarded) == 0 {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get(realIPHeader))); err == nil {
+			return addr.Unmap()
+		}
+		return peer
+	}
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0 && proxies.contains(client); i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+	}
+	return client
+}
+
+// proxyHandler replaces the remote address of requests arriving through a
+// trusted proxy by the client's, so that access logs and per-client limits
+// see the client. Other requests have the forwarding headers removed, since
+// anyone can send them.
+type proxyHandler struct {
+	handler http.Handler
+	proxies *networks
+}
+
+func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	peer, err := netip.ParseAddr(clientIP(r))
+	if err != nil || !h.proxies.contains(peer) {
+		h.handler.ServeHTTP(w, withoutForwardingHeaders(r))
+		return
+	}
+	client := clientAddr(h.proxies, peer.Unmap(), r)
+	r = r.Clone(r.Context())
+	// no port: the client's is not known
+	r.RemoteAddr = client.String()
+	h.handler.ServeHTTP(w, r)
+}
+
+// withoutForwardingHeaders returns r, or a copy of it without the headers a
+// proxy adds if it has any.
+func withoutForwardingHeaders(r *http.Request) *http.Request {
+	headers := []string{forwardedForHeader, realIPHeader, forwardedPrefixHeader}
+	for _, header := range headers {
+		if r.Header.Values(header) != nil {
+			r = r.Clone(r.Context())
+			for _, header := range headers {
+				r.Header.Del(header)
+			}
+			return r
+		}
+	}
+	return r
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateSweepInterval is how often idle clients are dropped from a
+// clientRates.
+const rateSweepInterval = time.Minute
+
+// requestRate admits requests at rate per second on average, with bursts of
+// up to burst requests.
+type requestRate struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRequestRate(rate float64, burst int) *requestRate {
+	if burst <= 0 {
+		// a second's worth, and at least one request
+		burst = max(int(math.Ceil(rate)), 1)
+	}
+	return &requestRate{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take admits one request, or returns how long until the next one would be
+// admitted.
+func (b *requestRate) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// idle reports whether the bucket has refilled completely, so that dropping
+// it changes nothing.
+func (b *requestRate) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// clientRates is a requestRate per client IP. Clients whose bucket is full
+// again are dropped every rateSweepInterval, keeping the map to the clients
+// that are currently busy.
+type clientRates struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*requestRate
+	lastSweep time.Time
+}
+
+func newClientRates(rate float64, burst int) *clientRates {
+	return &clientRates{rate: rate, burst: burst, clients: make(map[string]*requestRate), lastSweep: time.Now()}
+}
+
+func (c *clientRates) take(client string, now time.Time) (bool, time.Duration) {
+	c.mu.Lock()
+	if now.Sub(c.lastSweep) >= rateSweepInterval {
+		for key, b := range c.clients {
+			if b.idle(now) {
+				delete(c.clients, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	b, ok := c.clients[client]
+	if !ok {
+		b = newRequestRate(c.rate, c.burst)
+		c.clients[client] = b
+	}
+	c.mu.Unlock()
+	return b.take(now)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanic, deferred by ServeHTTP, turns a panic of the handler into a
+// 500 response and a log line with the stack, so that the server and the
+// client's connection survive it. If the response was already under way, the
+// connection is aborted instead, since finishing it would make a truncated
+// body look complete.
+func (f *fileHandler) recoverPanic(w *statusRecorder, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	log.Printf("panic serving %s %s for %s: %v\n%s", r.Method, loggedURL(r.URL), r.RemoteAddr, v, debug.Stack())
+	if w.status != 0 {
+		panic(http.ErrAbortHandler)
+	}
+	// headers of the response that was being prepared
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Disposition", "ETag", "Last-Modified"} {
+		w.Header().Del(header)
+	}
+	_ = f.serveStatus(w, r, http.StatusInternalServerError)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// panickingFS is the storage of a directory in which opening boom.txt
+// panics, and reading late.txt panics once its response is under way.
+type panickingFS struct {
+	osFS
+}
+
+func (s panickingFS) Open(name string) (fs.File, error) {
+	if name == "boom.txt" {
+		panic("boom")
+	}
+	f, err := s.osFS.Open(name)
+	if err == nil && name == "late.txt" {
+		return panickingFile{f.(*os.File)}, nil
+	}
+	return f, err
+}
+
+type panickingFile struct {
+	*os.File
+}
+
+func (panickingFile) Read([]byte) (int, error) {
+	panic("late boom")
+}
+
+func TestPanicAnswers500(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"boom.txt": "x", "late.txt": "late", "fine.txt": "fine"})
+	h := newTestHandler(t, "/", dir)
+	h.storage = panickingFS{osFS{root: dir}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	// one connection, so that it is shown to survive the panic too
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	get := func(path string) (*http.Response, string, error) {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+
+	resp, _, err := get("/boom.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("panicking request: %d, want 500", resp.StatusCode)
+	}
+	if resp, body, err := get("/fine.txt"); err != nil || resp.StatusCode != http.StatusOK || body != "fine" {
+		t.Errorf("request after a panic: %v, %v %q", err, resp, body)
+	}
+
+	// the headers are out, so the response is cut short rather than
+	// ended as if complete
+	if _, _, err := get("/late.txt"); err == nil {
+		t.Error("response with a panic during the body completed")
+	}
+	if resp, body, err := get("/fine.txt"); err != nil || resp.StatusCode != http.StatusOK || body != "fine" {
+		t.Errorf("request after an aborted response: %v, %v %q", err, resp, body)
+	}
+}
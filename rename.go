@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	actionKey    = "action"
+	actionRename = "rename"
+
+	renameToKey    = "to"
+	overwriteKey   = "overwrite"
+	overwriteValue = "true"
+)
+
+// isRename reports whether r is a form POST asking to rename or move the file
+// or directory at r.URL.Path.
+func isRename(r *http.Request) bool {
+	return r.Method == http.MethodPost && hasContentType(r, formContentType) && r.PostFormValue(actionKey) == actionRename
+}
+
+// inRoute reports whether the URL path urlPath is served by f.
+func (f *fileHandler) inRoute(urlPath string) bool {
+	return strings.HasPrefix(urlPath, f.route) || strings.HasPrefix("/"+urlPath, f.route)
+}
+
+// serveRename moves osPath to the to form field: a URL path below the route
+// if it starts with "/", else a path relative to the directory containing
+// osPath, so that "new.txt" renames and "sub/new.txt" moves into sub. An
+// existing destination is only replaced with overwrite=true. Like MOVE, it
+// answers 201 Created with the new location, or 204 No Content if something
+// was replaced.
+func (f *fileHandler) serveRename(w http.ResponseWriter, r *http.Request, osPath string) error {
+	if osPath == f.path {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	to := r.PostFormValue(renameToKey)
+	if to == "" || to == "." || to == ".." || strings.Contains(to, `\`) {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	if strings.HasPrefix(to, "/") {
+		to = f.prefix.strip(r, to)
+	} else {
+		to = path.Join(path.Dir(strings.TrimSuffix(r.URL.Path, "/")), to)
+	}
+	if !f.inRoute(to) {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	return f.serveTransfer(w, r, osPath, to, r.PostFormValue(overwriteKey) == overwriteValue, moveTree)
+}
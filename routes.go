@@ -68,3 +68,55 @@ func (fv *routes) Set(v string) error {
 func (fv *routes) String() string {
 	return strings.Join(fv.Texts, ", ")
 }
+
+// routeSwitch is a boolean flag that can also be limited to some routes:
+// -flag turns it on everywhere, -flag=ROUTE (repeatable) only for ROUTE.
+type routeSwitch struct {
+	All    bool
+	Routes []string
+}
+
+func (fv *routeSwitch) IsBoolFlag() bool {
+	return true
+}
+
+// Set is flag.Value.Set
+func (fv *routeSwitch) Set(v string) error {
+	switch v {
+	case "true":
+		fv.All = true
+		return nil
+	case "false":
+		fv.All = false
+		fv.Routes = nil
+		return nil
+	}
+	if !strings.HasPrefix(v, "/") {
+		v = "/" + v
+	}
+	if !strings.HasSuffix(v, "/") {
+		v += "/"
+	}
+	fv.Routes = append(fv.Routes, v)
+	return nil
+}
+
+func (fv *routeSwitch) String() string {
+	if fv.All {
+		return "true"
+	}
+	return strings.Join(fv.Routes, ", ")
+}
+
+// enabled reports whether the switch is on for route.
+func (fv *routeSwitch) enabled(route string) bool {
+	if fv.All {
+		return true
+	}
+	for _, r := range fv.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	s3ListTypeKey     = "list-type"
+	s3ListTypeV2      = "2"
+	s3PrefixKey       = "prefix"
+	s3DelimiterKey    = "delimiter"
+	s3MaxKeysKey      = "max-keys"
+	s3ContinuationKey = "continuation-token"
+	s3StartAfterKey   = "start-after"
+	s3EncodingTypeKey = "encoding-type"
+	s3EncodingTypeURL = "url"
+	s3DefaultMaxKeys  = 1000
+	s3TimeFormat      = "2006-01-02T15:04:05.000Z"
+	s3XMLNS           = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3StorageClass    = "STANDARD"
+	s3ListContentType = "application/xml"
+	s3KeySeparator    = "/"
+	s3TokenPrefix     = "k:"
+)
+
+// isS3List reports whether r is an S3 ListObjectsV2 request, which -s3-compat
+// answers for any directory as if it were a bucket.
+func (f *fileHandler) isS3List(r *http.Request) bool {
+	return f.s3Compat && isRead(r) && r.URL.Query().Get(s3ListTypeKey) == s3ListTypeV2
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	XMLNS                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3Key is a file below a bucket directory by its slash-separated key, or,
+// with a nil info, a subdirectory read without walking it, by its key
+// followed by a slash.
+type s3Key struct {
+	key  string
+	info os.FileInfo
+}
+
+// serveS3List answers a ListObjectsV2 request for the bucket that is the
+// directory osPath: its files are the objects, keyed by their path relative
+// to it, hidden files and symlinks out of the served root left out.
+// Directories only show as the common prefixes of the files below them,
+// except that with the delimiter "/" a subdirectory is a common prefix
+// without checking that it holds any.
+func (f *fileHandler) serveS3List(w http.ResponseWriter, r *http.Request, osPath string) error {
+	q := r.URL.Query()
+	result := s3ListBucketResult{
+		XMLNS:             s3XMLNS,
+		Name:              filepath.Base(osPath),
+		Prefix:            q.Get(s3PrefixKey),
+		Delimiter:         q.Get(s3DelimiterKey),
+		MaxKeys:           s3DefaultMaxKeys,
+		ContinuationToken: q.Get(s3ContinuationKey),
+		StartAfter:        q.Get(s3StartAfterKey),
+	}
+	if v := q.Get(s3MaxKeysKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return f.serveStatusMessage(w, r, http.StatusBadRequest, "max-keys must be a number")
+		}
+		result.MaxKeys = min(n, s3DefaultMaxKeys)
+	}
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil || !strings.HasPrefix(string(token), s3TokenPrefix) {
+			return f.serveStatusMessage(w, r, http.StatusBadRequest, "invalid continuation-token")
+		}
+		after = strings.TrimPrefix(string(token), s3TokenPrefix)
+	}
+	keys, err := f.s3Keys(r.Context(), osPath, result.Prefix, result.Delimiter)
+	if err != nil {
+		return err
+	}
+	last := ""
+	for _, k := range keys {
+		if k.key <= after || result.Delimiter != "" && strings.HasSuffix(after, result.Delimiter) && strings.HasPrefix(k.key, after) {
+			// already listed, or in a common prefix that was
+			continue
+		}
+		commonPrefix := ""
+		if rest := strings.TrimPrefix(k.key, result.Prefix); result.Delimiter != "" {
+			if i := strings.Index(rest, result.Delimiter); i >= 0 {
+				commonPrefix = result.Prefix + rest[:i+len(result.Delimiter)]
+			}
+		}
+		if commonPrefix == "" && k.info == nil || commonPrefix != "" && commonPrefix == last {
+			continue
+		}
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if commonPrefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: commonPrefix})
+			last = commonPrefix
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          k.key,
+				LastModified: k.info.ModTime().UTC().Format(s3TimeFormat),
+				ETag:         fileETag(k.info),
+				Size:         k.info.Size(),
+				StorageClass: s3StorageClass,
+			})
+			last = k.key
+		}
+		result.KeyCount++
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(s3TokenPrefix + last))
+	}
+	if q.Get(s3EncodingTypeKey) == s3EncodingTypeURL {
+		result.encodeURL()
+	}
+	w.Header().Set("Content-Type", s3ListContentType)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(result)
+}
+
+// encodeURL applies encoding-type=url: the keys and prefixes are sent
+// URL-encoded, for clients to decode, so that any character is safe in XML.
+func (result *s3ListBucketResult) encodeURL() {
+	result.EncodingType = s3EncodingTypeURL
+	result.Prefix = url.QueryEscape(result.Prefix)
+	result.Delimiter = url.QueryEscape(result.Delimiter)
+	result.StartAfter = url.QueryEscape(result.StartAfter)
+	for i := range result.Contents {
+		result.Contents[i].Key = url.QueryEscape(result.Contents[i].Key)
+	}
+	for i := range result.CommonPrefixes {
+		result.CommonPrefixes[i].Prefix = url.QueryEscape(result.CommonPrefixes[i].Prefix)
+	}
+}
+
+// s3Keys returns the keys below the bucket directory osPath that start with
+// prefix, in the byte order S3 lists them in. Only the directory the prefix
+// ends in is walked, and with the delimiter "/" only read.
+func (f *fileHandler) s3Keys(ctx context.Context, osPath, prefix, delimiter string) ([]s3Key, error) {
+	dirKey := ""
+	if i := strings.LastIndex(prefix, s3KeySeparator); i >= 0 {
+		dirKey = prefix[:i+1]
+	}
+	dirPath := filepath.Join(osPath, filepath.FromSlash(dirKey))
+	if strings.Contains(dirKey, "..") || f.hiddenPath(dirPath) || !f.contains(dirPath) {
+		return nil, nil
+	}
+	if info, err := os.Stat(dirPath); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	var keys []s3Key
+	if delimiter == s3KeySeparator {
+		entries, err := f.readDir(dirPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			p := filepath.Join(dirPath, entry.Name())
+			key := dirKey + entry.Name()
+			if !strings.HasPrefix(key, prefix) || !f.contains(p) {
+				continue
+			}
+			info, err := os.Stat(p)
+			switch {
+			case err != nil:
+			case info.IsDir():
+				keys = append(keys, s3Key{key: key + s3KeySeparator})
+			case info.Mode().IsRegular():
+				keys = append(keys, s3Key{key: key, info: info})
+			}
+		}
+	} else {
+		err := filepath.WalkDir(dirPath, func(p string, d fs.DirEntry, err error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if p == dirPath {
+				return err
+			}
+			if err != nil || f.hiddenFile(p) || !f.contains(p) || d.IsDir() && f.guarded(p) {
+				if d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(osPath, p)
+			if err != nil {
+				return nil
+			}
+			key := filepath.ToSlash(rel)
+			if d.IsDir() {
+				// nothing below it can match a prefix it does not start
+				if !strings.HasPrefix(key+s3KeySeparator, prefix) && !strings.HasPrefix(prefix, key+s3KeySeparator) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+				keys = append(keys, s3Key{key: key, info: info})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+	return keys, nil
+}
+
+// s3MakeParents creates the missing parent directories of the file a
+// -s3-compat PUT to r.URL.Path stores at osPath, since S3 clients never
+// create them. It stops at the first it cannot create, leaving the PUT to
+// fail.
+func (f *fileHandler) s3MakeParents(r *http.Request, osPath string) {
+	if !f.s3Compat {
+		return
+	}
+	type parent struct{ urlPath, osPath string }
+	var missing []parent
+	urlDir, dir := path.Dir(r.URL.Path), filepath.Dir(osPath)
+	if !f.contains(dir) || f.hiddenPath(dir) {
+		return
+	}
+	for {
+		if _, err := os.Lstat(dir); err == nil || dir == f.path {
+			break
+		}
+		missing = append(missing, parent{urlDir, dir})
+		urlDir, dir = path.Dir(urlDir), filepath.Dir(dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		name := filepath.Base(missing[i].osPath)
+		if clean, err := sanitizeName(name, f.strictNames); err != nil || clean != name {
+			return
+		}
+		if f.createDir(missing[i].osPath, f.uploadDirMode) != http.StatusCreated {
+			return
+		}
+		f.notify(r, webhookMkdir, missing[i].urlPath+"/", "", missing[i].osPath)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	searchKey = "q"
+	globKey   = "glob"
+	regexKey  = "regex"
+
+	// searchLimit caps the number of entries a search returns
+	searchLimit = 1000
+	// searchTimeout bounds the walk of a search, which stops early and
+	// reports what it found so far once it is exceeded
+	searchTimeout = 10 * time.Second
+
+	searchTruncatedHeader = "X-Search-Truncated"
+)
+
+// isSearch reports whether r asks for a search below the directory.
+func isSearch(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Get(searchKey) != "" || q.Get(globKey) != "" || q.Get(regexKey) != ""
+}
+
+// searchMatcher returns the case-insensitive name predicate for the ?q=
+// substring, ?glob= pattern or ?regex= expression of r, in that order of
+// preference.
+func searchMatcher(r *http.Request) (func(name string) bool, error) {
+	q := r.URL.Query()
+	if s := q.Get(searchKey); s != "" {
+		s = strings.ToLower(s)
+		return func(name string) bool { return strings.Contains(strings.ToLower(name), s) }, nil
+	}
+	if glob := q.Get(globKey); glob != "" {
+		glob = strings.ToLower(glob)
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, err
+		}
+		return func(name string) bool {
+			ok, _ := filepath.Match(glob, strings.ToLower(name))
+			return ok
+		}, nil
+	}
+	re, err := regexp.Compile("(?i)" + q.Get(regexKey))
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// searchHit is an entry found by a search, named by its slash-separated path
+// relative to the searched directory.
+type searchHit struct {
+	os.FileInfo
+	rel string
+}
+
+func (h searchHit) Name() string {
+	return h.rel
+}
+
+// search walks the tree below osPath for entries whose name satisfies match,
+// skipping hidden entries, entries outside the served root and directories it
+// cannot read. It stops after searchLimit hits or searchTimeout and reports
+// whether the result is incomplete.
+func (f *fileHandler) search(ctx context.Context, osPath string, match func(name string) bool) ([]os.FileInfo, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, searchTimeout)
+	defer cancel()
+	var hits []os.FileInfo
+	errStop := errors.New("stop")
+	truncated := false
+	err := filepath.WalkDir(osPath, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			truncated = true
+			return errStop
+		}
+		if p == osPath {
+			return err
+		}
+		if err != nil || f.hiddenFile(p) || !f.contains(p) || d.IsDir() && f.guarded(p) {
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !match(d.Name()) {
+			return nil
+		}
+		if len(hits) == searchLimit {
+			truncated = true
+			return errStop
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			if target, err := os.Stat(p); err == nil {
+				info = target
+			}
+		}
+		rel, err := filepath.Rel(osPath, p)
+		if err != nil {
+			return nil
+		}
+		hits = append(hits, searchHit{FileInfo: info, rel: filepath.ToSlash(rel)})
+		return nil
+	})
+	if errors.Is(err, errStop) {
+		err = nil
+	}
+	return hits, truncated, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// defaultCSP is the Content-Security-Policy of the pages the server
+// generates. Scripts may only come from /static/; Markdown may embed remote
+// images.
+const defaultCSP = "default-src 'none'; script-src 'self'; connect-src 'self'; img-src 'self' data: https:; style-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'self'"
+
+// How files whose type a browser would run script in are served.
+const (
+	userContentSandbox    = "sandbox"
+	userContentAttachment = "attachment"
+	userContentInline     = "inline"
+)
+
+// activeContentTypes are the media types that can execute script in the
+// origin they are served from.
+var activeContentTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+}
+
+func validUserContent(mode string) error {
+	switch mode {
+	case userContentSandbox, userContentAttachment, userContentInline:
+		return nil
+	}
+	return fmt.Errorf("%q is none of %q, %q and %q", mode, userContentSandbox, userContentAttachment, userContentInline)
+}
+
+func isActiveContent(name string) bool {
+	contentType, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+	for _, t := range activeContentTypes {
+		if strings.EqualFold(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// setPageHeaders marks a response as a page generated by the server.
+func (f *fileHandler) setPageHeaders(w http.ResponseWriter) {
+	if f.csp != "" {
+		w.Header().Set("Content-Security-Policy", f.csp)
+	}
+}
+
+// setUserContentHeaders applies the -user-content policy to the response for
+// the file called name if it could run script.
+func (f *fileHandler) setUserContentHeaders(w http.ResponseWriter, name string) {
+	if !isActiveContent(name) {
+		return
+	}
+	switch f.userContent {
+	case userContentSandbox:
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	case userContentAttachment:
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	}
+}
+
+// serveFile is http.ServeFile with the -user-content policy and -default-type
+// applied, or a -precompressed copy of the file, or the file gzipped by
+// -compress.
+func (f *fileHandler) serveFile(w http.ResponseWriter, r *http.Request, osPath string) {
+	if f.defaultType != "" && mime.TypeByExtension(filepath.Ext(osPath)) == "" {
+		w.Header().Set("Content-Type", f.defaultType)
+	}
+	name := f.storageName(osPath)
+	if info, err := f.storage.Stat(name); err == nil {
+		// http.ServeFile evaluates If-Match, If-None-Match and If-Range
+		// against it
+		w.Header().Set("ETag", fileETag(info))
+	}
+	if f.servePrecompressed(w, r, osPath) || f.serveCompressed(w, r, osPath) {
+		return
+	}
+	f.setUserContentHeaders(w, filepath.Base(osPath))
+	http.ServeFileFS(w, r, f.storage, name)
+}
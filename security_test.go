@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func securityTree(t *testing.T) string {
+	return writeTestTree(t, map[string]string{
+		"page.html": "<script>alert(1)</script>",
+		"logo.svg":  "<svg/>",
+		"notes.txt": "notes",
+		"sub/a.txt": "a",
+	})
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	h := newTestHandler(t, "/", securityTree(t))
+	tests := []struct {
+		target      string
+		csp         string
+		disposition string
+	}{
+		{"/", defaultCSP, ""},
+		{"/sub/", defaultCSP, ""},
+		{"/notes.txt?view=1", defaultCSP, ""},
+		{"/missing", defaultCSP, ""},
+		{"/notes.txt", "", ""},
+		{"/page.html", "sandbox", ""},
+		{"/logo.svg", "sandbox", ""},
+		{"/?zip=1", "", "attachment"},
+		{"/sub/?tar.gz=1", "", "attachment"},
+	}
+	for _, tt := range tests {
+		w := serveTest(h, http.MethodGet, tt.target, nil, "Accept", "text/html")
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s: X-Content-Type-Options %q", tt.target, got)
+		}
+		if got := w.Header().Get("Content-Security-Policy"); got != tt.csp {
+			t.Errorf("%s: Content-Security-Policy %q, want %q", tt.target, got, tt.csp)
+		}
+		if got := w.Header().Get("Content-Disposition"); !strings.HasPrefix(got, tt.disposition) {
+			t.Errorf("%s: Content-Disposition %q, want %s", tt.target, got, tt.disposition)
+		}
+	}
+}
+
+func TestUserContentModes(t *testing.T) {
+	tests := []struct {
+		mode, csp, disposition string
+	}{
+		{userContentSandbox, "sandbox", ""},
+		{userContentAttachment, "", `attachment; filename="page.html"; filename*=UTF-8''page.html`},
+		{userContentInline, "", ""},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "/", securityTree(t))
+		h.userContent = tt.mode
+		w := serveTest(h, http.MethodGet, "/page.html", nil)
+		if got := w.Header().Get("Content-Security-Policy"); got != tt.csp {
+			t.Errorf("%s: Content-Security-Policy %q, want %q", tt.mode, got, tt.csp)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.disposition {
+			t.Errorf("%s: Content-Disposition %q, want %q", tt.mode, got, tt.disposition)
+		}
+		w = serveTest(h, http.MethodGet, "/notes.txt", nil)
+		if w.Header().Get("Content-Security-Policy") != "" || w.Header().Get("Content-Disposition") != "" {
+			t.Errorf("%s: headers %v on a text file", tt.mode, w.Header())
+		}
+	}
+}
+
+func TestSecurityHeadersRelaxed(t *testing.T) {
+	h := newTestHandler(t, "/", securityTree(t))
+	h.nosniff = false
+	h.csp = ""
+	for _, target := range []string{"/", "/notes.txt", "/?zip=1"} {
+		w := serveTest(h, http.MethodGet, target, nil)
+		if got := w.Header().Get("X-Content-Type-Options"); got != "" {
+			t.Errorf("%s: X-Content-Type-Options %q without -nosniff", target, got)
+		}
+		if got := w.Header().Get("Content-Security-Policy"); got != "" {
+			t.Errorf("%s: Content-Security-Policy %q without -csp", target, got)
+		}
+	}
+}
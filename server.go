@@ -1,18 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
-	"math"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -20,10 +23,32 @@ const (
 	tarGzValue       = "true"
 	tarGzContentType = "application/x-tar+gzip"
 
+	tarKey         = "tar"
+	tarValue       = "true"
+	tarContentType = "application/x-tar"
+
 	zipKey         = "zip"
 	zipValue       = "true"
 	zipContentType = "application/zip"
 
+	mkdirKey        = "mkdir"
+	methodMkcol     = "MKCOL"
+	formContentType = "application/x-www-form-urlencoded"
+
+	listingKey   = "listing"
+	listingValue = "true"
+
+	methodOverrideKey = "_method"
+
+	uploadedKey = "uploaded"
+
+	recursiveKey   = "recursive"
+	recursiveValue = "true"
+
+	formatKey       = "format"
+	formatJSON      = "json"
+	jsonContentType = "application/json"
+
 	osPathSeparator = string(filepath.Separator)
 )
 
@@ -32,103 +57,325 @@ const directoryListingTemplateText = `
 <head>
 	<title>Index of {{ .Title }}</title>
 	<meta name="viewport" content="width=device-width, initial-scale=1">
-	<link rel="stylesheet" href="/static/layout/autoindex.css" type="text/css">
+	<link rel="stylesheet" href="{{ .Static }}/layout/autoindex.css" type="text/css">
+	<link rel="stylesheet" href="{{ .Static }}/layout/view.css" type="text/css">
+	{{- if .AllowDelete }}
+	<script src="{{ .Static }}/layout/listing.js" defer></script>
+	{{- end }}
+	{{- if not .Dropbox }}
+	<script src="{{ .Static }}/layout/live.js" defer></script>
+	{{- end }}
 </head>
 <body>
 <h1>Index of {{ .Title }}</h1>
-{{ if or .Files .AllowUpload }}
+<nav class="breadcrumbs">
+	{{- range $i, $crumb := .Breadcrumbs }}{{ if $i }} / {{ end }}<a href="{{ $crumb.URL.String }}">{{ $crumb.Name }}</a>{{ end -}}
+</nav>
+{{- if not .Dropbox }}
+<form class="search" method="get" action="{{ .UploadURL.String }}">
+	<input type="search" name="q" value="{{ .Search }}" placeholder="Search below here">
+	<input type="submit" value="Search">
+	{{- if .Searched }} <a href="{{ .UploadURL.String }}">clear</a>{{ end }}
+</form>
+{{- if .Truncated }}
+<p class="truncated">Showing the first results only; narrow the search to see the rest.</p>
+{{- end }}
+{{- end }}
+{{- if .Uploaded }}
+<p class="uploaded">Thank you, {{ .Uploaded }} file{{ if ne .Uploaded 1 }}s{{ end }} uploaded.</p>
+{{- end }}
+{{- if not .Dropbox }}
+<p class="archives">{{ if .AllowArchive }}Download as <a href="{{ .ZipURL.String }}">zip</a> | <a href="{{ .TarGzURL.String }}">tar.gz</a> | <a href="{{ .TarURL.String }}">tar</a>
+	| {{ end }}{{ if .Gallery }}<a href="?">Table view</a>{{ else }}<a href="?view=gallery">Gallery view</a>{{ end }}
+	| {{ if .Total }}<a href="?">Hide folder sizes</a>{{ else }}<a href="?du=true">Folder sizes</a>{{ end }}</p>
+{{- if .Gallery }}
+<div class="gallery">
+	{{- range .Files }}{{ if .IsImage }}
+	<a href="{{ .URL.String }}" title="{{ .BaseName }}"><img src="{{ .ThumbURL.String }}" alt="{{ .BaseName }}" loading="lazy"></a>
+	{{- end }}{{ end }}
+</div>
+{{- end }}
+{{- end }}
+{{ if and (not .Dropbox) (or .Files .AllowUpload .ParentDir) }}
+<form method="post" action="{{ .ZipURL.String }}">
+{{- if .CSRFToken }}
+<input type="hidden" name="csrf" value="{{ .CSRFToken }}">
+{{- end }}
 <table>
 	<thead>
 		<th class="indexcolicon">
-			<img src="/static/icons/blank.png" alt="[ICO]">
+			<img src="{{ .Static }}/icons/blank.png" alt="[ICO]">
 		</th>
 		<th class="indexcolname">
-			<a href="?C=N;O=D">Name</a>
+			<a href="?C=N;O={{ .NextSortOrder "N" }}">Name</a>
 		</th>
 		<th class="indexcollastmod">
-			<a href="?C=M;O=A">Last modified</a>
+			<a href="?C=M;O={{ .NextSortOrder "M" }}">Last modified</a>
 		</th>
 		<th class="indexcolsize">
-			<a href="?C=S;O=A">Size</a>
+			<a href="?C=S;O={{ .NextSortOrder "S" }}">Size</a>
 		</th>   
 	</thead>
 	<tbody>
 	{{- if .ParentDir }}
 		<tr class="even">
-			<td class="indexcolicon"><a href="/"><img src="/static/icons/go-previous.png" alt="[PARENTDIR]"></a></td>
+			<td class="indexcolicon"><a href="{{ .ParentDir.String }}"><img src="{{ .Static }}/icons/go-previous.png" alt="[PARENTDIR]"></a></td>
 			<td class="indexcolname"><a href="{{ .ParentDir.String }}">Parent Directory</a></td><td class="indexcollastmod">&nbsp;</td>
 			<td class="indexcolsize">  - </td>
 		</tr>
 	{{- end }}
-	{{- range .Files }}
+	{{- range .Files }}{{ if not (and $.Gallery .IsImage) }}
 		<tr>
 			{{ if (not .IsDir) }}
- 				<td class="indexcolicon"><a href="{{ .URL.String }}"><img src="/static/icons/package-x-generic.png" alt="[ARC]"></a></td>
-				<td class="indexcolname"><a href="{{ .URL.String }}">{{ .Name }}</a></td>
+ 				<td class="indexcolicon"><a href="{{ .URL.String }}"><img src="{{ .Icon }}" alt="[FILE]"></a></td>
+				<td class="indexcolname">{{ if and $.AllowArchive (not $.Searched) }}<input type="checkbox" name="name" value="{{ .BaseName }}"> {{ end }}<a href="{{ .URL.String }}">{{ .Name }}</a>{{ if .Viewable }} <a class="view" href="{{ .ViewURL.String }}">view</a>{{ end }}{{ if $.AllowShare }} <a class="share" href="{{ .ShareURL.String }}">share</a>{{ end }}
+					{{- if $.AllowDelete }}<button class="delete" type="submit" formaction="{{ .DeleteURL.String }}" formmethod="post" name="_method" value="DELETE" data-name="{{ .Name }}">delete</button>{{ end }}
+					{{- if and $.AllowUpload $.AllowDelete }}<button class="rename" type="button" hidden data-url="{{ .URL.EscapedPath }}" data-name="{{ .BaseName }}">rename</button>{{ end }}</td>
 				<td class="indexcollastmod">{{ .LastModified }}</td>
-				<td class="indexcolsize">{{ .Size | printf "%d" }}</td>
+				<td class="indexcolsize" title="{{ .Size | printf "%d" }} bytes">{{ .Size.String }}</td>
 			{{ else }}
-				<td class="indexcolicon"><a href="{{ .URL.String }}"><img src="/static/icons/folder.png" alt="[DIR]"></a></td>
-				<td class="indexcolname"><a href="{{ .URL.String }}">{{ .Name }}</a></td>
+				<td class="indexcolicon"><a href="{{ .URL.String }}"><img src="{{ .Icon }}" alt="[DIR]"></a></td>
+				<td class="indexcolname">{{ if and $.AllowArchive (not $.Searched) }}<input type="checkbox" name="name" value="{{ .BaseName }}"> {{ end }}<a href="{{ .URL.String }}">{{ .Name }}</a>
+					{{- if $.AllowDelete }}<button class="delete" type="submit" formaction="{{ .DeleteURL.String }}" formmethod="post" name="_method" value="DELETE" data-name="{{ .Name }}">delete</button>{{ end }}
+					{{- if and $.AllowUpload $.AllowDelete }}<button class="rename" type="button" hidden data-url="{{ .URL.EscapedPath }}" data-name="{{ .BaseName }}">rename</button>{{ end }}</td>
 				<td class="indexcollastmod">{{ .LastModified }}</td>
+				{{- if .Usage }}
+				<td class="indexcolsize" title="{{ .Usage.Size | printf "%d" }} bytes in {{ .Usage.Entries }} entries">{{ .Usage.String }}</td>
+				{{- else }}
 				<td class="indexcolsize">  - </td>
+				{{- end }}
 			{{ end }}
 		</tr>
-	{{- end }}
+	{{- end }}{{ end }}
 	</tbody>
+	{{- if .Total }}
+	<tfoot>
+		<tr>
+			<td></td>
+			<td class="indexcolname">Total: {{ .Total.Entries }} entr{{ if eq .Total.Entries 1 }}y{{ else }}ies{{ end }}</td>
+			<td></td>
+			<td class="indexcolsize" title="{{ .Total.Size | printf "%d" }} bytes">{{ .Total.String }}</td>
+		</tr>
+	</tfoot>
+	{{- end }}
 </table>
+{{- if .Page.Paged }}
+<nav class="pages">
+	{{- if .Page.PrevURL }}<a rel="prev" href="{{ .Page.PrevURL.String }}">Previous</a> | {{ end -}}
+	{{ .Page.First }}–{{ .Page.Last }} of {{ .Page.Total }}
+	{{- if .Page.NextURL }} | <a rel="next" href="{{ .Page.NextURL.String }}">Next</a>{{ end }}
+</nav>
+{{- end }}
+{{- if and .AllowArchive .Files (not .Searched) }}
+<input type="submit" value="Download selected as zip">
+{{- end }}
+</form>
 {{ end }}
+{{- if .AllowUpload }}
+<form method="post" action="{{ .UploadURL.String }}" enctype="multipart/form-data">
+	{{- if .CSRFToken }}
+	<input type="hidden" name="csrf" value="{{ .CSRFToken }}">
+	{{- end }}
+	{{- if .AllowExtract }}
+	<label><input type="checkbox" name="extract" value="true"> Extract archives</label>
+	{{- end }}
+	<label>If a file exists <select name="conflict">
+		<option value="reject"{{ if eq .OnConflict "reject" }} selected{{ end }}>keep it</option>
+		<option value="rename"{{ if eq .OnConflict "rename" }} selected{{ end }}>keep both</option>
+		<option value="overwrite"{{ if eq .OnConflict "overwrite" }} selected{{ end }}>replace it</option>
+	</select></label>
+	<input type="file" name="file" multiple required>
+	<input type="submit" value="Upload">
+</form>
+{{- if not .Dropbox }}
+<form method="post" action="{{ .UploadURL.String }}">
+	{{- if .CSRFToken }}
+	<input type="hidden" name="csrf" value="{{ .CSRFToken }}">
+	{{- end }}
+	<input type="text" name="mkdir" placeholder="New folder" required>
+	<input type="submit" value="Create folder">
+</form>
+{{- end }}
+{{- end }}
+{{- if .Readme }}
+<article class="markdown readme">
+{{ .Readme }}
+</article>
+{{- end }}
 </body>
 </html>
 `
 
 type fileSizeBytes int64
 
+// String formats f with a K/M/G suffix. Values are truncated rather than
+// rounded so that a size just under a boundary never reads as the next unit,
+// and sizes below 10 units keep one decimal.
 func (f fileSizeBytes) String() string {
 	const (
 		KB = 1024
 		MB = 1024 * KB
 		GB = 1024 * MB
 	)
-	divBy := func(x int64) int {
-		return int(math.Round(float64(f) / float64(x)))
+	format := func(unit int64, suffix string) string {
+		tenths := int64(f) * 10 / unit
+		if tenths < 100 {
+			return fmt.Sprintf("%d.%d%s", tenths/10, tenths%10, suffix)
+		}
+		return fmt.Sprintf("%d%s", tenths/10, suffix)
 	}
 	switch {
 	case f < KB:
 		return fmt.Sprintf("%d", f)
 	case f < MB:
-		return fmt.Sprintf("%dK", divBy(KB))
+		return format(KB, "K")
 	case f < GB:
-		return fmt.Sprintf("%dM", divBy(MB))
+		return format(MB, "M")
 	case f >= GB:
 		fallthrough
 	default:
-		return fmt.Sprintf("%dG", divBy(GB))
+		return format(GB, "G")
 	}
 }
 
 type directoryListingFileData struct {
 	Name         string
+	BaseName     string
 	Size         fileSizeBytes
 	IsDir        bool
 	URL          *url.URL
 	LastModified string
+	ModTime      time.Time
+	// Usage is the recursive size of a directory with ?du=true
+	Usage *dirUsage
+	// prefix is the path the server is served below, see urlPrefix
+	prefix string
 }
 
 type directoryListingData struct {
-	Title       string
-	ZipURL      *url.URL
-	TarGzURL    *url.URL
-	Files       []directoryListingFileData
-	AllowUpload bool
-	ParentDir   *url.URL
+	Title        string
+	ZipURL       *url.URL
+	TarGzURL     *url.URL
+	TarURL       *url.URL
+	Files        []directoryListingFileData
+	AllowUpload  bool
+	AllowDelete  bool
+	AllowExtract bool
+	AllowArchive bool
+	OnConflict   string
+	AllowShare   bool
+	UploadURL    *url.URL
+	ParentDir    *url.URL
+	Breadcrumbs  []breadcrumb
+	Sort         listingSort
+	Readme       template.HTML
+	Gallery      bool
+	CSRFToken    string
+	Dropbox      bool
+	// Search is the ?q= substring, Searched is set for any search and
+	// Truncated when it stopped before walking the whole tree
+	Search    string
+	Searched  bool
+	Truncated bool
+	// Total sums up the listed entries with ?du=true
+	Total *dirUsage
+	Page  page
+	// Uploaded is the number of files a drop box upload just stored
+	Uploaded int
+	// Static is the path the listing's assets are served below, /static
+	// unless the server is behind a prefix
+	Static string
+}
+
+type breadcrumb struct {
+	Name string
+	URL  *url.URL
+}
+
+// ShareURL asks for a share link to the entry valid for a day.
+func (d directoryListingFileData) ShareURL() *url.URL {
+	u := *d.URL
+	u.RawQuery = shareKey + "=" + shareValue
+	return &u
+}
+
+// DeleteURL is the target of the entry's delete button; directories are
+// deleted recursively.
+func (d directoryListingFileData) DeleteURL() *url.URL {
+	u := *d.URL
+	u.RawQuery = ""
+	if d.IsDir {
+		u.RawQuery = recursiveKey + "=" + recursiveValue
+	}
+	return &u
+}
+
+// NextSortOrder is the O parameter value for a column header link.
+func (d directoryListingData) NextSortOrder(column string) string {
+	return d.Sort.nextOrder(column)
 }
 
 type fileHandler struct {
-	route       string
-	path        string
-	allowUpload bool
-	allowDelete bool
+	route          string
+	vhost          string
+	path           string
+	allowUpload    bool
+	allowDelete    bool
+	dav            bool
+	followSymlinks bool
+	storage        storage
+	lexicalSort    bool
+	showHidden     bool
+	hide           []string
+	allowExtract   bool
+	extractLimit   int64
+	allowArchive   bool
+	maxArchiveSize int64
+	treeDepth      int
+	s3Compat       bool
+	feedEntries    int
+	feedDepth      int
+	browseZip      bool
+	uploadMode     os.FileMode
+	uploadDirMode  os.FileMode
+	strictNames    bool
+	maxUploadSize  int64
+	onConflict     string
+	markdown       bool
+	index          bool
+	spa            bool
+	noListing      bool
+	dropbox        bool
+	cliText        bool
+	pageSize       int
+	listings       *listingCache
+	logFormat      string
+	nosniff        bool
+	csp            string
+	userContent    string
+	csrf           bool
+	corsOrigins    *origins
+	shares         *shareSigner
+	trash          *trash
+	access         *accessFiles
+	errorPages     map[int][]byte
+	debug          bool
+	webhook        *webhook
+	uploadHook     *uploadHook
+	audit          *auditLog
+	stats          *downloadStats
+	precompressed  bool
+	compression    *fileCompression
+	defaultType    string
+	forceDownload  bool
+	spool          *archiveSpool
+	prefix         urlPrefix
+	writeTimeout   time.Duration
+
+	listingTemplate    *template.Template
+	archiveCompression archiveCompression
+	// hidePrecompressed leaves the -precompressed copies out of listings
+	hidePrecompressed bool
 }
 
 var (
@@ -136,133 +383,959 @@ var (
 )
 
 func (f *fileHandler) serveStatus(w http.ResponseWriter, r *http.Request, status int) error {
+	return f.serveStatusMessage(w, r, status, http.StatusText(status))
+}
+
+// serveStatusMessage is serveStatus with a more specific message than the
+// status text. JSON clients get it as an errorResult, browsers as an HTML
+// page, the one of -error-pages for status if there is one, and everyone else
+// as text.
+func (f *fileHandler) serveStatusMessage(w http.ResponseWriter, r *http.Request, status int, message string) error {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		w.WriteHeader(status)
+		return serveJSON(w, errorResult{Error: message, Status: status, Path: f.prefix.of(r) + r.URL.Path})
+	}
+	html := wantsHTML(r)
+	page, custom := f.errorPages[status]
+	if html {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if !custom {
+			// the operator's own pages may well use inline styles
+			f.setPageHeaders(w)
+		}
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w, done := gzipWriter(w, r)
 	w.WriteHeader(status)
-	_, err := w.Write([]byte(http.StatusText(status)))
+	var err error
+	switch {
+	case html && custom:
+		_, err = w.Write(page)
+	case html:
+		err = errorTemplate.Execute(w, struct {
+			Status     int
+			StatusText string
+			Message    string
+			Route      string
+			RouteURL   string
+			Static     string
+		}{status, http.StatusText(status), message, f.route, f.prefix.path(r, f.route), f.prefix.path(r, "/static")})
+	default:
+		_, err = w.Write([]byte(message))
+	}
 	if err != nil {
 		return err
 	}
-	return nil
+	return done()
+}
+
+// contentDisposition formats a Content-Disposition header value carrying both
+// an ASCII-only filename fallback and the exact UTF-8 name (RFC 6266, RFC 5987).
+func contentDisposition(disposition, filename string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		case r < 0x20 || r >= 0x7f:
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b may appear unescaped in an RFC 5987 value.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
 }
 
+// serveTarGz, serveTar and serveZip stream the archive of the file or
+// directory at path, holding only the entries a search listed if r
+// carries the listing's ?q=, ?glob= or ?regex=.
 func (f *fileHandler) serveTarGz(w http.ResponseWriter, r *http.Request, path string) error {
+	match, err := archiveMatch(r)
+	if err != nil {
+		return f.serveStatusMessage(w, r, http.StatusBadRequest, err.Error())
+	}
+	if f.refuseLargeArchive(w, r, func(ctx context.Context) dirUsage { return f.archiveRootUsage(ctx, path, match) }) {
+		return nil
+	}
 	w.Header().Set("Content-Type", tarGzContentType)
 	name := filepath.Base(path) + ".tar.gz"
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, name))
-	return tarGz(w, path)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	if served, err := f.serveSpooled(w, r, path, tarGzKey, match, func(ctx context.Context, w io.Writer) error {
+		return f.tarGz(ctx, w, path, match)
+	}); served {
+		return err
+	}
+	if r.Method == http.MethodHead {
+		return f.serveArchiveHead(w, r, path, match, tarEntryOverhead, tarTrailer)
+	}
+	return f.tarGz(r.Context(), w, path, match)
+}
+
+func (f *fileHandler) serveTar(w http.ResponseWriter, r *http.Request, osPath string) error {
+	match, err := archiveMatch(r)
+	if err != nil {
+		return f.serveStatusMessage(w, r, http.StatusBadRequest, err.Error())
+	}
+	if f.refuseLargeArchive(w, r, func(ctx context.Context) dirUsage { return f.archiveRootUsage(ctx, osPath, match) }) {
+		return nil
+	}
+	w.Header().Set("Content-Type", tarContentType)
+	name := filepath.Base(osPath) + ".tar"
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	if served, err := f.serveSpooled(w, r, osPath, tarKey, match, func(ctx context.Context, w io.Writer) error {
+		return f.tar(ctx, w, osPath, match)
+	}); served {
+		return err
+	}
+	if r.Method == http.MethodHead {
+		return f.serveArchiveHead(w, r, osPath, match, tarEntryOverhead, tarTrailer)
+	}
+	return f.tar(r.Context(), w, osPath, match)
 }
 
 func (f *fileHandler) serveZip(w http.ResponseWriter, r *http.Request, osPath string) error {
+	match, err := archiveMatch(r)
+	if err != nil {
+		return f.serveStatusMessage(w, r, http.StatusBadRequest, err.Error())
+	}
+	if f.refuseLargeArchive(w, r, func(ctx context.Context) dirUsage { return f.archiveRootUsage(ctx, osPath, match) }) {
+		return nil
+	}
 	w.Header().Set("Content-Type", zipContentType)
 	name := filepath.Base(osPath) + ".zip"
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, name))
-	return zip(w, osPath)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	if served, err := f.serveSpooled(w, r, osPath, zipKey, match, func(ctx context.Context, w io.Writer) error {
+		return f.zip(ctx, w, osPath, match)
+	}); served {
+		return err
+	}
+	if r.Method == http.MethodHead {
+		return f.serveArchiveHead(w, r, osPath, match, zipEntryOverhead, 0)
+	}
+	return f.zip(r.Context(), w, osPath, match)
 }
 
-func (f *fileHandler) serveDir(w http.ResponseWriter, r *http.Request, osPath string) error {
-	d, err := os.Open(osPath)
+// fileURL returns the link to the directory entry d of the listing at dirURL;
+// search hits are named by their slash-separated path below it.
+// The raw path is built with url.PathEscape so names containing "#", "?" or
+// "%" survive the round trip from the listing back to the server.
+func fileURL(dirURL *url.URL, d os.FileInfo) *url.URL {
+	u := *dirURL
+	u.Path = path.Join(u.Path, d.Name())
+	segments := strings.Split(d.Name(), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	u.RawPath = strings.TrimSuffix(dirURL.EscapedPath(), "/") + "/" + strings.Join(segments, "/")
+	if d.IsDir() {
+		u.Path += "/"
+		u.RawPath += "/"
+	} else {
+		u.RawQuery = ""
+	}
+	return &u
+}
+
+// breadcrumbs returns one entry per directory from the route root down to the
+// directory osPath, linked as clients of r address them.
+func (f *fileHandler) breadcrumbs(r *http.Request, osPath string) []breadcrumb {
+	out := []breadcrumb{{Name: filepath.Base(f.path), URL: f.prefix.url(r, &url.URL{Path: f.route})}}
+	rel, err := filepath.Rel(f.path, osPath)
+	if err != nil || rel == "." {
+		return out
+	}
+	urlPath := f.route
+	for _, name := range strings.Split(rel, osPathSeparator) {
+		urlPath += name + "/"
+		out = append(out, breadcrumb{Name: name, URL: f.prefix.url(r, &url.URL{Path: urlPath})})
+	}
+	return out
+}
+
+// readDir returns the entries of the directory osPath that are not hidden.
+// They are only stat'ed when their size, mode or modification time is used.
+func (f *fileHandler) readDir(osPath string) ([]os.FileInfo, error) {
+	entries, err := f.storage.ReadDir(f.storageName(osPath))
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !f.hiddenFile(filepath.Join(osPath, entry.Name())) {
+			visible = append(visible, &lazyInfo{DirEntry: entry})
+		}
+	}
+	return visible, nil
+}
+
+// indexFiles are the names served in place of a directory listing with -index.
+var indexFiles = []string{"index.html", "index.htm"}
+
+// indexFile returns the path of the index page to serve for the directory
+// osPath, or "" if the listing should be shown: -index is off, ?listing=true
+// forces the listing, or there is no visible index page.
+func (f *fileHandler) indexFile(r *http.Request, osPath string) string {
+	if !f.index || r.URL.Query().Get(listingKey) == listingValue {
+		return ""
+	}
+	for _, name := range indexFiles {
+		indexPath := filepath.Join(osPath, name)
+		if info, err := f.storage.Stat(f.storageName(indexPath)); err == nil && info.Mode().IsRegular() && !f.hidden(name) {
+			return indexPath
+		}
+	}
+	return ""
+}
+
+// serveIndex serves the index page indexPath of the directory at r.URL.Path,
+// first redirecting to the URL with a trailing slash so that relative links
+// in the page resolve inside the directory.
+func (f *fileHandler) serveIndex(w http.ResponseWriter, r *http.Request, indexPath string) {
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		u := *f.prefix.url(r, r.URL)
+		u.Path += "/"
+		if u.RawPath != "" {
+			u.RawPath += "/"
+		}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	f.serveFile(w, r, indexPath)
+}
+
+// spaFallback reports whether a request for a missing path should get the
+// route's index.html so that a single-page app can route it client-side:
+// only GET and HEAD requests for paths without an extension do, so missing
+// assets still 404.
+func (f *fileHandler) spaFallback(r *http.Request) bool {
+	if !f.spa || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	return path.Ext(r.URL.Path) == ""
+}
+
+// serveSPAIndex serves the index.html at the root of the route.
+func (f *fileHandler) serveSPAIndex(w http.ResponseWriter, r *http.Request) error {
+	info, err := f.storage.Stat("index.html")
+	if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+		return f.serveStatus(w, r, http.StatusNotFound)
+	}
 	if err != nil {
 		return err
 	}
-	files, err := d.Readdir(-1)
+	f.setUserContentHeaders(w, "index.html")
+	http.ServeFileFS(w, r, f.storage, "index.html")
+	return nil
+}
+
+// serveZipSelection streams a zip of the entries of the directory osPath named
+// by the posted name values.
+func (f *fileHandler) serveZipSelection(w http.ResponseWriter, r *http.Request, osPath string) error {
+	if err := r.ParseForm(); err != nil {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	names := r.PostForm["name"]
+	if len(names) == 0 {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || f.hiddenFile(filepath.Join(osPath, name)) {
+			return f.serveStatus(w, r, http.StatusBadRequest)
+		}
+		p := filepath.Join(osPath, name)
+		if _, err := f.storage.Lstat(f.storageName(p)); err != nil || !f.contains(p) {
+			return f.serveStatus(w, r, http.StatusNotFound)
+		}
+		paths = append(paths, p)
+	}
+	if f.refuseLargeArchive(w, r, func(ctx context.Context) dirUsage { return f.selectionUsage(ctx, paths) }) {
+		return nil
+	}
+	w.Header().Set("Content-Type", zipContentType)
+	name := filepath.Base(osPath) + ".zip"
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	return f.zipPaths(r.Context(), w, osPath, paths)
+}
+
+// withQuery returns base with key set to value in its query.
+func withQuery(base *url.URL, key, value string) *url.URL {
+	url := *base
+	q := url.Query()
+	q.Set(key, value)
+	url.RawQuery = q.Encode()
+	return &url
+}
+
+// listingFiles returns the listing entries of files, linked relative to base.
+func (f *fileHandler) listingFiles(r *http.Request, base *url.URL, files []os.FileInfo) (out []directoryListingFileData) {
+	for _, d := range files {
+		name := d.Name()
+		if d.IsDir() {
+			name += osPathSeparator
+		}
+		fileData := directoryListingFileData{
+			Name:         name,
+			BaseName:     path.Base(d.Name()),
+			IsDir:        d.IsDir(),
+			Size:         fileSizeBytes(d.Size()),
+			LastModified: d.ModTime().Format("2006-01-02 15:04:05"),
+			ModTime:      d.ModTime(),
+			URL:          fileURL(base, d),
+			prefix:       f.prefix.of(r),
+		}
+		// entries implied by the paths in a zip file have no time
+		if statFailed(d) || d.ModTime().IsZero() {
+			fileData.LastModified = "-"
+		}
+		if u, ok := d.(usageInfo); ok {
+			fileData.Usage = &u.usage
+		}
+		out = append(out, fileData)
+	}
+	return out
+}
+
+// dropboxAllows reports whether a drop box serves r: the upload page of a
+// directory and multipart uploads to it. Everything else, including the
+// urlencoded forms for mkdir, rename, deletes and zip downloads, is refused
+// without revealing whether the path exists.
+func dropboxAllows(r *http.Request, info os.FileInfo, statErr error) bool {
+	if statErr != nil || !info.IsDir() {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		q := r.URL.Query()
+		return !q.Has(zipKey) && !q.Has(tarKey) && !q.Has(tarGzKey) && !q.Has(eventsKey) && !q.Has(treeKey) && !q.Has(s3ListTypeKey) && !q.Has(feedKey)
+	case http.MethodPost:
+		return !hasContentType(r, formContentType)
+	}
+	return false
+}
+
+func (f *fileHandler) serveDir(w http.ResponseWriter, r *http.Request, osPath string) error {
+	f.limitWrite(w)
+	dir, err := f.storage.Stat(f.storageName(osPath))
 	if err != nil {
 		return err
 	}
-	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	return directoryListingTemplate.Execute(w, directoryListingData{
-		AllowUpload: f.allowUpload,
+	searching := isSearch(r) && !f.dropbox
+	du := r.URL.Query().Get(duKey) == duValue && !f.dropbox
+	listingSort := parseListingSort(r.URL.RawQuery)
+	listingSort.Lexical = f.lexicalSort
+	// searches and recursive sizes are not cached
+	cacheable := !searching && !du
+	var files []os.FileInfo
+	var truncated, cached bool
+	if cacheable {
+		files, cached = f.listings.get(listingCacheKey(f.route, osPath), dir.ModTime(), listingSort)
+	}
+	switch {
+	case cached:
+	case searching:
+		match, err := searchMatcher(r)
+		if err != nil {
+			return f.serveStatusMessage(w, r, http.StatusBadRequest, err.Error())
+		}
+		files, truncated, err = f.search(r.Context(), osPath, match)
+		if err != nil {
+			return err
+		}
+		if truncated {
+			w.Header().Set(searchTruncatedHeader, "true")
+		}
+	default:
+		files, err = f.readDir(osPath)
+		if err != nil {
+			return err
+		}
+	}
+	// recursive sizes are only worth the walk when asked for
+	var total *dirUsage
+	if du {
+		usage := f.diskUsage(r.Context(), osPath, files)
+		total = &usage
+	}
+	if !cached {
+		if listingSort.Column != sortByName || cacheable && f.listings != nil {
+			// cached entries are shared and must not be stat'ed later
+			statAll(files)
+		}
+		sortFiles(files, listingSort)
+		if cacheable {
+			f.listings.put(listingCacheKey(f.route, osPath), dir.ModTime(), listingSort, files)
+		}
+	}
+	asJSON := wantsJSON(r)
+	asText := !asJSON && f.wantsText(r)
+	var csrfToken string
+	if f.csrf && !asJSON && !asText {
+		csrfToken = f.csrfToken(w, r)
+	}
+	// a drop box shows nothing of what it holds
+	listed := files
+	if f.dropbox {
+		listed = nil
+	}
+	// links are relative to the URL the client sees, without its token
+	base := withoutToken(f.prefix.url(r, r.URL))
+	page := f.parsePage(r, base, len(listed))
+	listed = page.window(listed)
+	statAll(listed)
+	variant := fmt.Sprintf("json=%t;text=%t;query=%s;upload=%t;delete=%t;csrf=%s;total=%d", asJSON, asText, r.URL.RawQuery, f.allowUpload, f.allowDelete, csrfToken, page.Total)
+	// the representation depends on these as well as on the query
+	w.Header().Add("Vary", "Accept")
+	if f.cliText {
+		w.Header().Add("Vary", "User-Agent")
+	}
+	etag, modTime := listingValidators(osPath, dir, listed, variant)
+	if checkNotModified(w, r, etag, modTime) {
+		return nil
+	}
+	if r.Method == http.MethodHead {
+		// the headers of a GET, without rendering the listing
+		switch {
+		case asJSON:
+			w.Header().Set("Content-Type", jsonContentType)
+		case asText:
+			w.Header().Set("Content-Type", textContentType+"; charset=utf-8")
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			f.setPageHeaders(w)
+		}
+		if asJSON || asText {
+			page.setHeaders(w)
+		}
+		return nil
+	}
+	breadcrumbs := f.breadcrumbs(r, osPath)
+	static := f.prefix.path(r, "/static")
+	data := directoryListingData{
+		Static:      static,
+		Breadcrumbs: breadcrumbs,
+		// the parent of the route root is outside of this handler, so there is none
 		ParentDir: func() *url.URL {
-			urlStr := r.URL.String()
-			if strings.HasSuffix(urlStr, "/") {
-				urlStr = urlStr[0 : len(urlStr)-1]
+			if len(breadcrumbs) < 2 {
+				return nil
 			}
-			lastSlashPos := strings.LastIndex(urlStr, "/")
-			if lastSlashPos > 1 {
-				parentUrlStr := urlStr[0:lastSlashPos]
-				parentUrl, err := url.Parse(parentUrlStr)
-				if err != nil {
-					return nil
-				}
-				return parentUrl
-			}
-			return nil
+			return breadcrumbs[len(breadcrumbs)-2].URL
 		}(),
+		AllowUpload:  f.allowUpload,
+		AllowDelete:  f.allowDelete,
+		AllowExtract: f.allowExtract,
+		AllowArchive: f.allowArchive,
+		OnConflict:   f.onConflict,
+		AllowShare:   f.shares != nil,
+		Gallery:      r.URL.Query().Get(viewKey) == viewGallery,
+		CSRFToken:    csrfToken,
+		Dropbox:      f.dropbox,
+		Search:       r.URL.Query().Get(searchKey),
+		Searched:     searching,
+		Truncated:    truncated,
+		Total:        total,
+		Page:         page,
+		Sort:         listingSort,
 		Title: func() string {
 			relPath, _ := filepath.Rel(f.path, osPath)
 			return filepath.Join(filepath.Base(f.path), relPath)
 		}(),
-		TarGzURL: func() *url.URL {
-			url := *r.URL
-			q := url.Query()
-			q.Set(tarGzKey, tarGzValue)
-			url.RawQuery = q.Encode()
+		TarGzURL: withQuery(base, tarGzKey, tarGzValue),
+		TarURL:   withQuery(base, tarKey, tarValue),
+		UploadURL: func() *url.URL {
+			url := *base
+			url.RawQuery = ""
 			return &url
 		}(),
-		ZipURL: func() *url.URL {
-			url := *r.URL
-			q := url.Query()
-			q.Set(zipKey, zipValue)
-			url.RawQuery = q.Encode()
-			return &url
-		}(),
-		Files: func() (out []directoryListingFileData) {
-			for _, d := range files {
-				name := d.Name()
-				if d.IsDir() {
-					name += osPathSeparator
-				}
-				fileData := directoryListingFileData{
-					Name:         name,
-					IsDir:        d.IsDir(),
-					Size:         fileSizeBytes(d.Size()),
-					LastModified: d.ModTime().Format("2006-01-02 15:04:05"),
-					URL: func() *url.URL {
-						url := *r.URL
-						url.Path = path.Join(url.Path, name)
-						if d.IsDir() {
-							url.Path += "/"
-						}
-						return &url
-					}(),
+		ZipURL: withQuery(base, zipKey, zipValue),
+		Files:  f.listingFiles(r, base, listed),
+	}
+	if asJSON || asText {
+		page.setHeaders(w)
+	}
+	if asJSON {
+		if data.Files == nil {
+			data.Files = []directoryListingFileData{}
+		}
+		return serveJSON(w, data.Files)
+	}
+	if asText {
+		return serveTextListing(w, data.Files)
+	}
+	if f.markdown && !searching {
+		data.Readme = f.readme(osPath, files)
+	}
+	if f.dropbox {
+		data.Uploaded, _ = strconv.Atoi(r.URL.Query().Get(uploadedKey))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	f.setPageHeaders(w)
+	return f.listingTemplate.Execute(w, data)
+}
+
+type uploadResult struct {
+	Name string `json:"name"`
+	// StoredAs is set when the file was stored under another name, because
+	// the name was unsafe or to avoid a conflict
+	StoredAs string `json:"storedAs,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	// Size, LastModified and URL describe the stored file, unless it was
+	// extracted
+	Size         *int64   `json:"size,omitempty"`
+	LastModified string   `json:"lastModified,omitempty"`
+	URL          string   `json:"url,omitempty"`
+	Extracted    []string `json:"extracted,omitempty"`
+}
+
+const (
+	uploadStatusOK       = "ok"
+	uploadStatusFailed   = "failed"
+	uploadStatusConflict = "conflict"
+)
+
+// describeStored fills in the name, size, modification time and URL of the
+// file stored at osPath, in the state info unless it is nil, from an upload
+// to the directory URL dirPath.
+func (u *uploadResult) describeStored(dirPath, osPath string, info os.FileInfo) {
+	base := filepath.Base(osPath)
+	if base != u.Name {
+		u.StoredAs = base
+	}
+	if !strings.HasSuffix(dirPath, "/") {
+		dirPath += "/"
+	}
+	u.URL = (&url.URL{Path: dirPath + base}).String()
+	if info != nil {
+		size := info.Size()
+		u.Size = &size
+		u.LastModified = info.ModTime().UTC().Format(time.RFC3339)
+	}
+}
+
+// serveUploadTo streams every file part of a multipart request body into the
+// directory osPath without buffering it in memory or temp files. Files written
+// before a failure are kept. JSON clients get a per-file report, browsers are
+// redirected back to the listing. With ?extract=true, or an extract=true form
+// field sent before the files, archives are unpacked instead of stored. Files
+// an If-Match or If-Unmodified-Since precondition fails for are not
+// overwritten.
+func (f *fileHandler) serveUploadTo(w http.ResponseWriter, r *http.Request, osPath string) error {
+	if err := f.limitUpload(w, r, osPath); err != nil {
+		return f.refuseUpload(w, r, err)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		// neither an upload nor any of the forms a directory takes
+		return f.serveStatusMessage(w, r, http.StatusUnsupportedMediaType, err.Error())
+	}
+	results := []uploadResult{}
+	extract := r.URL.Query().Get(extractKey) == extractValue
+	policy := f.onConflict
+	if validOnConflict(r.URL.Query().Get(conflictKey)) == nil {
+		policy = r.URL.Query().Get(conflictKey)
+	}
+	// the token field must come before the first file
+	tokenMissing := f.csrfRequired(r) && !csrfValid(r, r.Header.Get(csrfHeaderName))
+	var failed error
+	conflict := false
+	modified := false
+	// fieldSHA256 is the expected digest of the next file part
+	fieldSHA256 := ""
+	// created is set once a file is stored, location is its URL
+	created := false
+	location := ""
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			failed = err
+			break
+		}
+		if part.FileName() == "" {
+			switch part.FormName() {
+			case extractKey:
+				value, _ := io.ReadAll(io.LimitReader(part, int64(len(extractValue))+1))
+				extract = string(value) == extractValue
+			case sha256FieldName:
+				value, _ := io.ReadAll(io.LimitReader(part, 128))
+				fieldSHA256 = string(value)
+			case conflictKey:
+				value, _ := io.ReadAll(io.LimitReader(part, 16))
+				if validOnConflict(string(value)) == nil {
+					policy = string(value)
 				}
-				out = append(out, fileData)
+			case csrfFieldName:
+				value, _ := io.ReadAll(io.LimitReader(part, 128))
+				tokenMissing = tokenMissing && !csrfValid(r, string(value))
 			}
-			return out
-		}(),
-	})
+			part.Close()
+			continue
+		}
+		if tokenMissing {
+			part.Close()
+			return f.serveStatus(w, r, http.StatusForbidden)
+		}
+		wantSHA256 := fieldSHA256
+		if wantSHA256 == "" {
+			wantSHA256 = r.Header.Get(sha256HeaderName)
+		}
+		fieldSHA256 = ""
+		name := part.FileName()
+		clean, err := sanitizeName(name, f.strictNames)
+		if err == nil {
+			err = f.checkNewName(clean)
+		}
+		if err != nil {
+			part.Close()
+			failed = err
+			results = append(results, uploadResult{Name: name, Status: uploadStatusFailed, Error: err.Error()})
+			continue
+		}
+		outPath := filepath.Join(osPath, clean)
+		if _, err := f.storage.Lstat(f.storageName(outPath)); err == nil && policy == onConflictReject && !(extract && f.allowExtract) {
+			// refuse before reading the data
+			part.Close()
+			conflict = true
+			results = append(results, uploadResult{Name: name, Status: uploadStatusConflict, Error: errUploadExists.Error()})
+			continue
+		}
+		if info, err := f.storage.Stat(f.storageName(outPath)); err == nil && policy == onConflictOverwrite && !(extract && f.allowExtract) && preconditionFailed(r, info) {
+			part.Close()
+			modified = true
+			results = append(results, uploadResult{Name: name, Status: uploadStatusConflict, Error: errUploadModified.Error()})
+			continue
+		}
+		var extracted []string
+		storedAs := outPath
+		if extract && f.allowExtract {
+			extracted, err = f.extract(r, osPath, clean, part, policy)
+		} else {
+			check := f.uploadCheck(r, path.Join(r.URL.Path, filepath.Base(outPath)))
+			storedAs, err = f.writeUploadedPart(outPath, part, policy, wantSHA256, f.uploadMode, check)
+			if err == nil {
+				f.afterUpload(r, storedAs, path.Join(r.URL.Path, filepath.Base(storedAs)))
+			}
+		}
+		part.Close()
+		// the files extracted before a conflict or failure are kept
+		for _, name := range extracted {
+			f.notify(r, webhookUpload, path.Join(r.URL.Path, name), "", filepath.Join(osPath, filepath.FromSlash(name)))
+		}
+		if errors.Is(err, errUploadExists) || errors.Is(err, errUploadModified) {
+			conflict = conflict || errors.Is(err, errUploadExists)
+			modified = modified || errors.Is(err, errUploadModified)
+			results = append(results, uploadResult{Name: name, Status: uploadStatusConflict, Error: err.Error(), Extracted: extracted})
+			continue
+		}
+		if err != nil {
+			failed = err
+			results = append(results, uploadResult{Name: name, Status: uploadStatusFailed, Error: uploadError(err), Extracted: extracted})
+			continue
+		}
+		result := uploadResult{Name: name, Status: uploadStatusOK, Extracted: extracted}
+		if !(extract && f.allowExtract) {
+			info, _ := f.storage.Stat(f.storageName(storedAs))
+			result.describeStored(f.prefix.of(r)+r.URL.Path, storedAs, info)
+			f.notify(r, webhookUpload, path.Join(r.URL.Path, filepath.Base(storedAs)), "", storedAs)
+			created = true
+			if f.dropbox {
+				// the file cannot be fetched from here
+				result.URL = ""
+			}
+			if location == "" {
+				location = result.URL
+			}
+		}
+		results = append(results, result)
+	}
+	if wantsJSON(r) {
+		switch {
+		case failed != nil:
+			if uploadErrorStatus(failed) != http.StatusInternalServerError {
+				logRefusedUpload(r, failed)
+			}
+			w.Header().Set("Content-Type", jsonContentType)
+			w.WriteHeader(uploadErrorStatus(failed))
+		case conflict:
+			w.Header().Set("Content-Type", jsonContentType)
+			w.WriteHeader(http.StatusConflict)
+		case modified:
+			w.Header().Set("Content-Type", jsonContentType)
+			w.WriteHeader(http.StatusPreconditionFailed)
+		case created:
+			w.Header().Set("Content-Type", jsonContentType)
+			if location != "" {
+				w.Header().Set("Location", location)
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+		return serveJSON(w, results)
+	}
+	if failed != nil && uploadErrorStatus(failed) != http.StatusInternalServerError {
+		return f.refuseUpload(w, r, failed)
+	}
+	if failed != nil {
+		return failed
+	}
+	if conflict {
+		return f.serveStatus(w, r, http.StatusConflict)
+	}
+	if modified {
+		return f.serveStatus(w, r, http.StatusPreconditionFailed)
+	}
+	// an empty result is http.ErrMissingFile: nothing to store, send the client back to the listing
+	back := *f.prefix.url(r, r.URL)
+	if f.dropbox {
+		stored := 0
+		for _, result := range results {
+			if result.Status == uploadStatusOK {
+				stored++
+			}
+		}
+		back.RawQuery = uploadedKey + "=" + strconv.Itoa(stored)
+	}
+	w.Header().Set("Location", back.String())
+	w.WriteHeader(303)
+	return nil
 }
 
-func (f *fileHandler) serveUploadTo(w http.ResponseWriter, r *http.Request, osPath string) error {
-	if err := r.ParseForm(); err != nil {
-		return err
+// writeUploadedPart stores in at outPath, or next to it as policy demands,
+// and returns the path written. The data goes to a temporary file first,
+// which is only moved into place once complete, so that readers never see a
+// partial upload and an aborted one leaves any previous version in place.
+// New files get mode regardless of the umask; a replaced file keeps its
+// mode. If wantSHA256 is given, data with another digest is discarded with
+// errChecksumMismatch. A check that is not nil is given the absolute path of
+// the complete temporary file, and its error discards the data too.
+func (f *fileHandler) writeUploadedPart(outPath string, in io.Reader, policy, wantSHA256 string, mode os.FileMode, check func(osPath string) error) (string, error) {
+	if info, err := f.storage.Stat(f.storageName(outPath)); err == nil && policy == onConflictOverwrite {
+		mode = info.Mode().Perm()
 	}
-	in, h, err := r.FormFile("file")
-	if err == http.ErrMissingFile {
-		w.Header().Set("Location", r.URL.String())
-		w.WriteHeader(303)
+	tmp, out, err := createTemp(f.storage, f.storageName(filepath.Dir(outPath)), ".upload-", mode)
+	if err != nil {
+		return "", err
+	}
+	defer f.storage.Remove(tmp)
+	var dst io.Writer = &diskGuard{w: out, dir: filepath.Dir(outPath)}
+	var checksum *checksumWriter
+	if wantSHA256 != "" {
+		checksum = newChecksumWriter(dst, wantSHA256)
+		dst = checksum
+	}
+	if _, err := io.Copy(dst, in); err != nil {
+		out.Close()
+		return "", err
+	}
+	if checksum != nil {
+		if err := checksum.verify(); err != nil {
+			out.Close()
+			return "", err
+		}
+	}
+	if syncer, ok := out.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			out.Close()
+			return "", err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if check != nil {
+		if err := check(filepath.Join(f.path, filepath.FromSlash(tmp))); err != nil {
+			return "", err
+		}
+	}
+	storedAs, err := f.placeUpload(tmp, outPath, policy)
+	if err == nil && checksum != nil {
+		if info, err := f.storage.Stat(f.storageName(storedAs)); err == nil {
+			digests.put(digestKey("sha256", storedAs, info.Size(), info.ModTime()), checksum.sum())
+		}
+	}
+	return storedAs, err
+}
+
+// servePut writes the request body to osPath, replacing any existing file
+// once the body is complete unless the request says If-None-Match: *, or an
+// If-Match or If-Unmodified-Since precondition fails. The parent directory
+// must already exist.
+func (f *fileHandler) servePut(w http.ResponseWriter, r *http.Request, osPath string) error {
+	f.s3MakeParents(r, osPath)
+	if info, err := f.storage.Stat(f.storageName(filepath.Dir(osPath))); err != nil || !info.IsDir() {
+		return f.serveStatus(w, r, http.StatusConflict)
+	}
+	info, err := f.storage.Stat(f.storageName(osPath))
+	exists := err == nil
+	if exists && info.IsDir() {
+		return f.serveStatus(w, r, http.StatusConflict)
+	}
+	if !exists {
+		// the client picked the name, so it is refused rather than changed
+		name := filepath.Base(osPath)
+		if clean, err := sanitizeName(name, f.strictNames); err != nil {
+			return f.serveStatusMessage(w, r, http.StatusBadRequest, err.Error())
+		} else if clean != name {
+			return f.serveStatusMessage(w, r, http.StatusBadRequest, (&badNameError{name, fmt.Sprintf("try %q", clean)}).Error())
+		}
+	}
+	if preconditionFailed(r, info) {
+		return f.serveStatus(w, r, http.StatusPreconditionFailed)
+	}
+	policy := onConflictOverwrite
+	if r.Header.Get("If-None-Match") == "*" {
+		if exists {
+			return f.serveStatus(w, r, http.StatusPreconditionFailed)
+		}
+		policy = onConflictReject
+	}
+	if err := f.limitUpload(w, r, filepath.Dir(osPath)); err != nil {
+		return f.refuseUpload(w, r, err)
+	}
+	storedAs, err := f.writeUploadedPart(osPath, r.Body, policy, r.Header.Get(sha256HeaderName), f.uploadMode, f.uploadCheck(r, r.URL.Path))
+	if err == nil {
+		f.afterUpload(r, storedAs, r.URL.Path)
+	}
+	if errors.Is(err, errUploadExists) {
+		return f.serveStatus(w, r, http.StatusPreconditionFailed)
+	}
+	if err != nil && uploadErrorStatus(err) != http.StatusInternalServerError {
+		return f.refuseUpload(w, r, err)
 	}
 	if err != nil {
 		return err
 	}
-	outPath := filepath.Join(osPath, filepath.Base(h.Filename))
-	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY, 0600)
+	f.notify(r, webhookUpload, r.URL.Path, "", osPath)
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// serveMkdir creates the directory named by the mkdir form field inside the
+// directory osPath. JSON clients get 201 Created, browsers are redirected back
+// to the listing.
+func (f *fileHandler) serveMkdir(w http.ResponseWriter, r *http.Request, osPath string) error {
+	name := r.PostFormValue(mkdirKey)
+	if strings.ContainsAny(name, `/\`) {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	name, err := sanitizeName(name, f.strictNames)
+	if err == nil {
+		err = f.checkNewName(name)
+	}
 	if err != nil {
-		return err
+		return f.serveStatusMessage(w, r, http.StatusBadRequest, err.Error())
+	}
+	status := f.createDir(filepath.Join(osPath, name), f.uploadDirMode)
+	if status == http.StatusCreated {
+		f.notify(r, webhookMkdir, path.Join(r.URL.Path, name), "", filepath.Join(osPath, name))
 	}
-	defer out.Close()
+	if status == http.StatusCreated && !wantsJSON(r) {
+		w.Header().Set("Location", f.prefix.url(r, r.URL).String())
+		w.WriteHeader(303)
+		return nil
+	}
+	return f.serveStatus(w, r, status)
+}
+
+func hasContentType(r *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == contentType
+}
 
-	if _, err := io.Copy(out, in); err != nil {
+// createDir creates the directory osPath with mode and returns the matching
+// HTTP status: 201 on success, 409 if it already exists or its parent is
+// missing.
+func (f *fileHandler) createDir(osPath string, mode os.FileMode) int {
+	err := f.storage.Mkdir(f.storageName(osPath), mode)
+	switch {
+	case err == nil:
+		return http.StatusCreated
+	case os.IsExist(err), os.IsNotExist(err):
+		return http.StatusConflict
+	case os.IsPermission(err):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// serveDelete removes the file or directory at osPath, or moves it to the
+// trash with -trash-dir. Non-empty directories are only removed with
+// ?recursive=true or in WebDAV mode; the served root itself never is.
+// Nothing is removed if an If-Match or If-Unmodified-Since precondition
+// fails.
+func (f *fileHandler) serveDelete(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	rel, err := filepath.Rel(f.path, osPath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	if preconditionFailed(r, info) {
+		return f.serveStatus(w, r, http.StatusPreconditionFailed)
+	}
+	if info.IsDir() && f.refusedBelow(r, osPath) {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	if info.IsDir() && !f.dav && r.URL.Query().Get(recursiveKey) != recursiveValue {
+		entries, err := f.storage.ReadDir(f.storageName(osPath))
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return f.serveStatus(w, r, http.StatusConflict)
+		}
+	}
+	switch {
+	case f.trash != nil:
+		err = f.trash.put(f.trashRoute(), strings.TrimSuffix(r.URL.Path, "/"), osPath, info.IsDir())
+	case info.IsDir():
+		err = f.storage.RemoveAll(f.storageName(osPath))
+	default:
+		err = f.storage.Remove(f.storageName(osPath))
+	}
+	if err != nil {
 		return err
 	}
-	w.Header().Set("Location", r.URL.String())
-	w.WriteHeader(303)
+	f.notify(r, webhookDelete, r.URL.Path, "", osPath)
+	if r.PostForm.Get(methodOverrideKey) == http.MethodDelete {
+		// deleted from the listing without scripts: go back to it
+		parent := &url.URL{Path: path.Dir(strings.TrimSuffix(r.URL.Path, "/")) + "/"}
+		if parent.Path == "//" {
+			parent.Path = "/"
+		}
+		http.Redirect(w, r, f.prefix.url(r, parent).String(), http.StatusSeeOther)
+		return nil
+	}
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
-// ServeHTTP is http.Handler.ServeHTTP
-func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[%s] %s %s %s", f.path, r.RemoteAddr, r.Method, r.URL.String())
-	urlPath := r.URL.Path
+// osPath maps a request URL path below f.route to a path below f.path.
+func (f *fileHandler) osPath(urlPath string) string {
 	if !strings.HasPrefix(urlPath, "/") {
 		urlPath = "/" + urlPath
 	}
@@ -270,46 +1343,254 @@ func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	urlPath = strings.TrimPrefix(urlPath, "/"+f.route)
 
 	osPath := strings.ReplaceAll(urlPath, "/", osPathSeparator)
-	osPath = filepath.Clean(osPath)
-	osPath = filepath.Join(f.path, osPath)
-	info, err := os.Stat(osPath)
+	osPath = filepath.Clean(osPathSeparator + osPath)
+	return filepath.Join(f.path, osPath)
+}
+
+// contains reports whether osPath, once symlinks are resolved, lies within
+// f.path. Paths that do not exist yet are checked via their nearest existing
+// ancestor.
+func (f *fileHandler) contains(osPath string) bool {
+	if f.followSymlinks {
+		return true
+	}
+	root, err := filepath.EvalSymlinks(f.path)
+	if err != nil {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(osPath)
+	// below a file, as inside a -browse-zip zip file, nothing exists either
+	for (os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)) && osPath != filepath.Dir(osPath) {
+		osPath = filepath.Dir(osPath)
+		target, err = filepath.EvalSymlinks(osPath)
+	}
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+osPathSeparator)
+}
+
+// ServeHTTP is http.Handler.ServeHTTP
+func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w}
+	defer f.logRequest(r, rec, time.Now())
+	defer func() { f.audit.write(r, f.prefix.of(r)+r.URL.Path, rec) }()
+	defer f.recoverPanic(rec, r)
+	w = rec
+	if f.nosniff {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	if r.Method == http.MethodPost && hasContentType(r, formContentType) && r.PostFormValue(methodOverrideKey) == http.MethodDelete {
+		// the listing's delete buttons post forms when scripts are disabled
+		r = r.Clone(r.Context())
+		r.Method = http.MethodDelete
+	}
+	r = f.audit.withAudit(r)
+	osPath := f.osPath(r.URL.Path)
+	info, err := f.storage.Stat(f.storageName(osPath))
+	inZip := f.zipPath(r, osPath, info, err)
+	policy, realm, policyErr := f.accessPolicy(osPath, info)
 	switch {
-	case os.IsNotExist(err):
+	case !f.contains(osPath):
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case f.isTrashRequest(r):
+		err := f.serveTrash(w, r)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case f.hiddenPath(osPath):
+		_ = f.serveStatus(w, r, http.StatusNotFound)
+	case policyErr != nil:
+		f.serveError(w, r, policyErr)
+	case policy.refusal(r) == http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm))
+		_ = f.serveStatus(w, r, http.StatusUnauthorized)
+	case policy.refusal(r) != 0:
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case isShareRequest(r) && (f.shares.verify(r) != nil || err == nil && !info.Mode().IsRegular()):
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case f.dropbox && !dropboxAllows(r, info, err):
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case !f.methodSupported(r, info, err):
+		f.setAllow(w, info, err)
+		_ = f.serveStatus(w, r, http.StatusMethodNotAllowed)
+	case r.Method == http.MethodOptions && !f.dav:
+		f.serveOptions(w, info, err)
+	case f.csrfRequired(r) && !csrfPrecheck(r):
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case f.audit.refuses(r):
+		_ = f.serveStatus(w, r, http.StatusServiceUnavailable)
+	case !f.allowUpload && r.Method == http.MethodPut:
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case r.Method == http.MethodPut:
+		err := f.servePut(w, r, osPath)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case !f.allowUpload && r.Method == methodMkcol:
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case r.Method == methodMkcol:
+		status := f.createDir(osPath, f.uploadDirMode)
+		if status == http.StatusCreated {
+			f.notify(r, webhookMkdir, r.URL.Path, "", osPath)
+		}
+		_ = f.serveStatus(w, r, status)
+	case f.dav && isDAVMethod(r.Method) && !f.onDisk():
+		_ = f.serveStatus(w, r, http.StatusNotImplemented)
+	case f.dav && isDAVMethod(r.Method):
+		err := f.serveDAV(w, r, osPath)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case inZip != nil:
+		err := f.serveInZip(w, r, inZip)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case os.IsNotExist(err) && f.spaFallback(r):
+		err := f.serveSPAIndex(w, r)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case f.s3Compat && f.allowDelete && r.Method == http.MethodDelete && os.IsNotExist(err):
+		// S3 deletes are idempotent
+		w.WriteHeader(http.StatusNoContent)
+	case os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR):
 		_ = f.serveStatus(w, r, http.StatusNotFound)
 	case os.IsPermission(err):
 		_ = f.serveStatus(w, r, http.StatusForbidden)
 	case err != nil:
-		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		f.serveError(w, r, err)
+	case f.isS3List(r) && !f.onDisk():
+		_ = f.serveStatus(w, r, http.StatusNotImplemented)
+	case f.isS3List(r) && info.IsDir() && !f.noListing:
+		// S3 clients name the bucket without a trailing slash
+		err := f.serveS3List(w, r, osPath)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case isRead(r) && info.IsDir() != strings.HasSuffix(r.URL.Path, "/"):
+		f.redirectToCanonical(w, r, info.IsDir())
+	case !f.onDisk() && readsDisk(r, info):
+		_ = f.serveStatus(w, r, http.StatusNotImplemented)
+	case !info.IsDir() && strings.HasSuffix(r.URL.Path, "/"):
+		_ = f.serveStatus(w, r, http.StatusNotFound)
 	case !f.allowDelete && r.Method == http.MethodDelete:
 		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case !f.allowArchive && isArchive(r):
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case info.IsDir() && r.Method == http.MethodPost && r.URL.Query().Get(zipKey) != "":
+		err := f.serveZipSelection(w, r, osPath)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case isRename(r) && !(f.allowUpload && f.allowDelete):
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case isRename(r):
+		err := f.serveRename(w, r, osPath)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
 	case !f.allowUpload && r.Method == http.MethodPost:
 		_ = f.serveStatus(w, r, http.StatusForbidden)
 	case r.URL.Query().Get(zipKey) != "":
 		err := f.serveZip(w, r, osPath)
 		if err != nil {
-			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			f.serveError(w, r, err)
 		}
 	case r.URL.Query().Get(tarGzKey) != "":
 		err := f.serveTarGz(w, r, osPath)
 		if err != nil {
-			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			f.serveError(w, r, err)
+		}
+	case r.URL.Query().Get(tarKey) != "":
+		err := f.serveTar(w, r, osPath)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case f.allowUpload && info.IsDir() && r.Method == http.MethodPost && hasContentType(r, formContentType):
+		err := f.serveMkdir(w, r, osPath)
+		if err != nil {
+			f.serveError(w, r, err)
 		}
 	case f.allowUpload && info.IsDir() && r.Method == http.MethodPost:
 		err := f.serveUploadTo(w, r, osPath)
 		if err != nil {
-			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			f.serveError(w, r, err)
 		}
-	case f.allowDelete && !info.IsDir() && r.Method == http.MethodDelete:
-		err := os.Remove(osPath)
+	case f.allowDelete && r.Method == http.MethodDelete:
+		err := f.serveDelete(w, r, osPath, info)
 		if err != nil {
-			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			f.serveError(w, r, err)
 		}
+	case f.markdown && !info.IsDir() && r.URL.Query().Get(renderKey) == renderValue && isMarkdownName(info.Name()):
+		err := f.serveMarkdown(w, r, osPath, info)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case !info.IsDir() && r.URL.Query().Get(thumbKey) != "":
+		err := f.serveThumb(w, r, osPath, info)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case f.shares != nil && info.Mode().IsRegular() && r.URL.Query().Has(shareKey) && !isShareRequest(r):
+		err := f.serveShare(w, r)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case !info.IsDir() && r.URL.Query().Get(hashKey) != "":
+		err := f.serveHash(w, r, osPath, info)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case !info.IsDir() && r.URL.Query().Get(viewKey) != "":
+		err := f.serveView(w, r, osPath, info)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case info.IsDir() && !f.noListing && r.URL.Query().Get(feedKey) != "":
+		gw, done := gzipWriter(w, r)
+		err := f.serveFeed(gw, r, osPath)
+		if err == nil {
+			err = done()
+		}
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case info.IsDir() && !f.noListing && r.URL.Query().Get(treeKey) == treeValue:
+		gw, done := gzipWriter(w, r)
+		err := f.serveTree(gw, r, osPath)
+		if err == nil {
+			err = done()
+		}
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case info.IsDir() && !f.noListing && r.URL.Query().Get(eventsKey) != "":
+		err := f.serveEvents(w, r, osPath)
+		if err != nil {
+			f.serveError(w, r, err)
+		}
+	case info.IsDir() && f.indexFile(r, osPath) != "":
+		f.serveIndex(w, r, f.indexFile(r, osPath))
+	case info.IsDir() && f.noListing:
+		_ = f.serveStatus(w, r, http.StatusForbidden)
 	case info.IsDir():
-		err := f.serveDir(w, r, osPath)
+		gw, done := gzipWriter(w, r)
+		err := f.serveDir(gw, r, osPath)
+		if err == nil {
+			err = done()
+		}
 		if err != nil {
-			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			f.serveError(w, r, err)
 		}
 	default:
-		http.ServeFile(w, r, osPath)
+		f.setDisposition(w, r, osPath)
+		f.serveFile(w, r, osPath)
+		f.stats.count(r, rec)
+	}
+	if !csrfSafeMethods[r.Method] && rec.status < http.StatusBadRequest {
+		f.listings.invalidate(f.route, osPath)
 	}
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	shareKey        = "share"
+	shareValue      = "true"
+	shareExpiresKey = "expires"
+	shareSigKey     = "sig"
+
+	defaultShareDuration = 24 * time.Hour
+	maxShareDuration     = 30 * 24 * time.Hour
+)
+
+var (
+	errShareExpired  = errors.New("share link expired")
+	errShareTampered = errors.New("share link signature is invalid")
+)
+
+// shareSigner makes and checks share links: URLs of a single file carrying
+// an expiry time and an HMAC of the method, path and expiry. A valid link
+// grants GET and HEAD on that file without credentials. Links of a -vhost
+// host also sign the host, so that they grant nothing on the others.
+type shareSigner struct {
+	secret []byte
+	host   string
+}
+
+// forHost returns the signer of the links of the -vhost host, "" for the
+// hosts without one.
+func (s *shareSigner) forHost(host string) *shareSigner {
+	if s == nil || host == "" {
+		return s
+	}
+	return &shareSigner{secret: s.secret, host: host}
+}
+
+func (s *shareSigner) sign(method, urlPath string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, urlPath, expires)
+	if s.host != "" {
+		fmt.Fprintf(mac, "\n%s", s.host)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link returns the share link for urlPath, valid until expires.
+func (s *shareSigner) link(urlPath string, expires time.Time) *url.URL {
+	q := url.Values{}
+	q.Set(shareExpiresKey, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(shareSigKey, s.sign(http.MethodGet, urlPath, expires.Unix()))
+	return &url.URL{Path: urlPath, RawQuery: q.Encode()}
+}
+
+// isShareRequest reports whether r presents a share link, valid or not.
+func isShareRequest(r *http.Request) bool {
+	return r.URL.Query().Has(shareSigKey)
+}
+
+// verify checks the share link r presents.
+func (s *shareSigner) verify(r *http.Request) error {
+	if s == nil {
+		return errShareTampered
+	}
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get(shareExpiresKey), 10, 64)
+	if err != nil {
+		return errShareTampered
+	}
+	if !hmac.Equal([]byte(q.Get(shareSigKey)), []byte(s.sign(method, r.URL.Path, expires))) {
+		return errShareTampered
+	}
+	if time.Now().Unix() > expires {
+		return errShareExpired
+	}
+	return nil
+}
+
+type shareResult struct {
+	URL     string `json:"url"`
+	Expires string `json:"expires"`
+}
+
+// serveShare answers ?share=DURATION, or ?share=true for a day, with an
+// absolute share link for the file at r.URL.Path, as JSON or as a line of
+// text.
+func (f *fileHandler) serveShare(w http.ResponseWriter, r *http.Request) error {
+	d := defaultShareDuration
+	if v := r.URL.Query().Get(shareKey); v != shareValue {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d <= 0 || d > maxShareDuration {
+			return f.serveStatusMessage(w, r, http.StatusBadRequest, fmt.Sprintf("share duration %q must be between 0 and %s", v, maxShareDuration))
+		}
+	}
+	expires := time.Now().Add(d)
+	// the signature covers the path as the server sees it
+	link := f.prefix.absolute(r, f.shares.link(r.URL.Path, expires))
+	if wantsJSON(r) {
+		return serveJSON(w, shareResult{URL: link.String(), Expires: expires.UTC().Format(time.RFC3339)})
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := io.WriteString(w, link.String()+"\n")
+	return err
+}
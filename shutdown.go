@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdownProgressInterval is how often the requests still running are logged
+// while shutting down.
+const shutdownProgressInterval = 5 * time.Second
+
+// inflightHandler keeps track of the requests being served so that a
+// shutdown can report what it is waiting for.
+type inflightHandler struct {
+	handler http.Handler
+
+	mu       sync.Mutex
+	next     int
+	requests map[int]string
+}
+
+func (h *inflightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	if h.requests == nil {
+		h.requests = make(map[int]string)
+	}
+	id := h.next
+	h.next++
+	h.requests[id] = r.RemoteAddr + " " + r.Method + " " + loggedURL(r.URL)
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.requests, id)
+		h.mu.Unlock()
+	}()
+	h.handler.ServeHTTP(w, r)
+}
+
+// running returns a description of each request being served, oldest first.
+func (h *inflightHandler) running() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ids := make([]int, 0, len(h.requests))
+	for id := range h.requests {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = h.requests[id]
+	}
+	return out
+}
+
+// serveUntilSignal runs serve until it fails or the process receives SIGINT
+// or SIGTERM. On a signal, srv stops accepting connections and in-flight
+// requests get up to timeout to complete; a second signal exits immediately.
+func serveUntilSignal(srv *http.Server, inflight *inflightHandler, timeout time.Duration, serve func() error) error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-signals:
+		log.Printf("received %v, shutting down (waiting up to %v for in-flight requests, signal again to exit now)", sig, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(shutdownProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case sig := <-signals:
+				log.Printf("received %v again, exiting without waiting", sig)
+				os.Exit(1)
+			case <-ticker.C:
+				running := inflight.running()
+				log.Printf("waiting for %d in-flight requests", len(running))
+				for _, request := range running {
+					log.Printf("  %s", request)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if running := inflight.running(); len(running) > 0 {
+		log.Printf("waiting for %d in-flight requests", len(running))
+		for _, request := range running {
+			log.Printf("  %s", request)
+		}
+	}
+	err := srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("shutdown timed out after %v, closing %d remaining requests", timeout, len(inflight.running()))
+		return srv.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if err := <-errc; err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	log.Printf("shutdown complete")
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	sortColumnKey = "C"
+	sortOrderKey  = "O"
+
+	sortByName     = "N"
+	sortByModified = "M"
+	sortBySize     = "S"
+
+	sortAscending  = "A"
+	sortDescending = "D"
+)
+
+type listingSort struct {
+	Column string
+	Order  string
+	// Lexical compares names byte-wise instead of in natural order
+	Lexical bool
+}
+
+// parseListingSort reads the Apache-style C (column) and O (order) parameters.
+// The template links separate them with ";", which url.ParseQuery rejects, so
+// the raw query is split by hand. Unknown values fall back to name ascending.
+func parseListingSort(rawQuery string) listingSort {
+	s := listingSort{Column: sortByName, Order: sortAscending}
+	for _, kv := range strings.FieldsFunc(rawQuery, func(r rune) bool { return r == ';' || r == '&' }) {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := kv[:i], kv[i+1:]
+		switch {
+		case key == sortColumnKey && (value == sortByName || value == sortByModified || value == sortBySize):
+			s.Column = value
+		case key == sortOrderKey && (value == sortAscending || value == sortDescending):
+			s.Order = value
+		}
+	}
+	return s
+}
+
+// nextOrder returns the order a header link for column should request: the
+// reverse of the current order if column is already the sort key, else ascending.
+func (s listingSort) nextOrder(column string) string {
+	if s.Column == column && s.Order == sortAscending {
+		return sortDescending
+	}
+	return sortAscending
+}
+
+// sortFiles sorts files by the given column and order. Directories are always
+// listed before files, whatever the sort key.
+func sortFiles(files []os.FileInfo, s listingSort) {
+	less := func(a, b os.FileInfo) bool {
+		switch s.Column {
+		case sortByModified:
+			if !a.ModTime().Equal(b.ModTime()) {
+				return a.ModTime().Before(b.ModTime())
+			}
+		case sortBySize:
+			if a.Size() != b.Size() {
+				return a.Size() < b.Size()
+			}
+		}
+		if s.Lexical {
+			return a.Name() < b.Name()
+		}
+		return naturalLess(a.Name(), b.Name())
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.IsDir() != b.IsDir() {
+			return a.IsDir()
+		}
+		if s.Order == sortDescending {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// naturalLess orders names case-insensitively, comparing runs of digits by
+// their numeric value so that "file2" sorts before "file10". Names that only
+// differ in case or leading zeros fall back to byte-wise order.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			ni, nj := digitRun(a, i), digitRun(b, j)
+			x := strings.TrimLeft(a[i:ni], "0")
+			y := strings.TrimLeft(b[j:nj], "0")
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+			if x != y {
+				return x < y
+			}
+			i, j = ni, nj
+			continue
+		}
+		ra, sa := utf8.DecodeRuneInString(a[i:])
+		rb, sb := utf8.DecodeRuneInString(b[j:])
+		if la, lb := unicode.ToLower(ra), unicode.ToLower(rb); la != lb {
+			return la < lb
+		}
+		i += sa
+		j += sb
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func digitRun(s string, i int) int {
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i
+}
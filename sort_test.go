@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"file2.log", "file10.log", true},
+		{"file10.log", "file2.log", false},
+		{"file2", "file2", false},
+		{"a", "B", true},
+		{"B", "a", false},
+		{"README", "notes", false},
+		{"Apple", "apple", true},
+		{"apple", "Apple", false},
+		{"x007", "x7", true},
+		{"x7", "x007", false},
+		{"x9", "x0010", true},
+		{"v1.2.10", "v1.2.9", false},
+		{"v1.2.9", "v1.2.10", true},
+		{"a", "ab", true},
+		{"ab", "a", false},
+		{"", "a", true},
+		{"a", "", false},
+		{"10", "9a", false},
+		{"9", "10", true},
+		{"18446744073709551616", "18446744073709551617", true},
+		{"école", "Étude", true},
+		{"Ärger", "ärger", true},
+		{"λ2", "λ10", true},
+		{"日本1", "日本02", true},
+		{"🙂9", "🙂10", true},
+	}
+	for _, tt := range tests {
+		if got := naturalLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNaturalLessIsStrictOrder(t *testing.T) {
+	names := []string{"file10", "File2", "file2", "file02", "a", "A", "b10", "b9", "é", "E", "", "🙂", "10", "9"}
+	for _, a := range names {
+		if naturalLess(a, a) {
+			t.Errorf("naturalLess(%q, %q) = true", a, a)
+		}
+		for _, b := range names {
+			if a != b && naturalLess(a, b) == naturalLess(b, a) {
+				t.Errorf("naturalLess(%q, %q) and naturalLess(%q, %q) agree", a, b, b, a)
+			}
+		}
+	}
+}
+
+type sortTestInfo struct {
+	os.FileInfo
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i sortTestInfo) Name() string       { return i.name }
+func (i sortTestInfo) Size() int64        { return i.size }
+func (i sortTestInfo) ModTime() time.Time { return i.modTime }
+func (i sortTestInfo) IsDir() bool        { return i.dir }
+
+func TestSortFiles(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := func() []os.FileInfo {
+		return []os.FileInfo{
+			sortTestInfo{name: "file10.log", size: 1, modTime: t0.Add(3 * time.Hour)},
+			sortTestInfo{name: "File2.log", size: 30, modTime: t0.Add(time.Hour)},
+			sortTestInfo{name: "zdir", dir: true, modTime: t0},
+			sortTestInfo{name: "adir", dir: true, modTime: t0.Add(time.Hour)},
+			sortTestInfo{name: "file1.log", size: 20, modTime: t0.Add(2 * time.Hour)},
+		}
+	}
+	tests := []struct {
+		sort listingSort
+		want []string
+	}{
+		{listingSort{Column: sortByName, Order: sortAscending}, []string{"adir", "zdir", "file1.log", "File2.log", "file10.log"}},
+		{listingSort{Column: sortByName, Order: sortDescending}, []string{"zdir", "adir", "file10.log", "File2.log", "file1.log"}},
+		{listingSort{Column: sortByName, Order: sortAscending, Lexical: true}, []string{"adir", "zdir", "File2.log", "file1.log", "file10.log"}},
+		{listingSort{Column: sortBySize, Order: sortAscending}, []string{"adir", "zdir", "file10.log", "file1.log", "File2.log"}},
+		{listingSort{Column: sortByModified, Order: sortDescending}, []string{"adir", "zdir", "file10.log", "file1.log", "File2.log"}},
+	}
+	for _, tt := range tests {
+		fs := files()
+		sortFiles(fs, tt.sort)
+		var got []string
+		for _, f := range fs {
+			got = append(got, f.Name())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("sortFiles(%+v) = %q, want %q", tt.sort, got, tt.want)
+		}
+	}
+}
+
+func TestParseListingSort(t *testing.T) {
+	tests := []struct {
+		rawQuery string
+		want     listingSort
+	}{
+		{"", listingSort{Column: sortByName, Order: sortAscending}},
+		{"C=M;O=D", listingSort{Column: sortByModified, Order: sortDescending}},
+		{"C=S&O=A", listingSort{Column: sortBySize, Order: sortAscending}},
+		{"O=D", listingSort{Column: sortByName, Order: sortDescending}},
+		{"C=X;O=Z", listingSort{Column: sortByName, Order: sortAscending}},
+		{"C;O=D;zip=1", listingSort{Column: sortByName, Order: sortDescending}},
+		{"c=M;o=D", listingSort{Column: sortByName, Order: sortAscending}},
+	}
+	for _, tt := range tests {
+		if got := parseListingSort(tt.rawQuery); got != tt.want {
+			t.Errorf("parseListingSort(%q) = %+v, want %+v", tt.rawQuery, got, tt.want)
+		}
+	}
+}
+
+func TestNextOrder(t *testing.T) {
+	s := listingSort{Column: sortByName, Order: sortAscending}
+	if got := s.nextOrder(sortByName); got != sortDescending {
+		t.Errorf("nextOrder of the ascending sort column = %q, want %q", got, sortDescending)
+	}
+	if got := s.nextOrder(sortBySize); got != sortAscending {
+		t.Errorf("nextOrder of another column = %q, want %q", got, sortAscending)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSPAFallback(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"index.html": "app", "assets/app.js": "js", "about/": ""})
+	for _, route := range []string{"/", "/app"} {
+		var routes routes
+		if err := routes.Set(route + "=" + dir); err != nil {
+			t.Fatal(err)
+		}
+		h := newTestHandler(t, routes.Values[0].Route, dir)
+		h.spa = true
+		mux := http.NewServeMux()
+		mux.Handle(routes.Values[0].Route, h)
+		base := strings.TrimSuffix(routes.Values[0].Route, "/")
+		tests := []struct {
+			method, target string
+			status         int
+			body           string
+		}{
+			{http.MethodGet, "/settings", http.StatusOK, "app"},
+			{http.MethodGet, "/users/42/profile", http.StatusOK, "app"},
+			{http.MethodHead, "/settings", http.StatusOK, ""},
+			{http.MethodGet, "/assets/app.js", http.StatusOK, "js"},
+			{http.MethodGet, "/assets/missing.js", http.StatusNotFound, ""},
+			{http.MethodGet, "/favicon.ico", http.StatusNotFound, ""},
+			{http.MethodPost, "/settings", http.StatusMethodNotAllowed, ""},
+			{http.MethodDelete, "/settings", http.StatusMethodNotAllowed, ""},
+		}
+		for _, tt := range tests {
+			w := serveTest(mux, tt.method, base+tt.target, nil)
+			if w.Code != tt.status || tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("route %s: %s %s: %d %q, want %d %q", route, tt.method, base+tt.target, w.Code, w.Body.String(), tt.status, tt.body)
+			}
+		}
+		if route != "/" {
+			if w := serveTest(mux, http.MethodGet, "/settings", nil); w.Code != http.StatusNotFound {
+				t.Errorf("route %s: GET /settings outside the route: %d", route, w.Code)
+			}
+		}
+	}
+}
+
+func TestSPAFallbackOff(t *testing.T) {
+	h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"index.html": "app"}))
+	if w := serveTest(h, http.MethodGet, "/settings", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /settings: %d, want 404", w.Code)
+	}
+}
+
+func TestSPAWithoutIndex(t *testing.T) {
+	h := newTestHandler(t, "/", writeTestTree(t, map[string]string{"a.txt": "a"}))
+	h.spa = true
+	if w := serveTest(h, http.MethodGet, "/settings", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /settings: %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpoolSize = 10 << 30
+	// spoolPattern names the spool files, which are removed at startup since
+	// the index of them is only kept in memory
+	spoolPattern = "hfs-spool-*"
+)
+
+// archiveSpool holds generated archives in files of dir so that they can be
+// served with a Content-Length, an ETag and ranges, letting interrupted
+// downloads resume. Archives are keyed by what they contain and reused
+// until the tree changes; the least recently used ones are removed once the
+// spool exceeds maxSize, except while they are being served.
+type archiveSpool struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*spoolEntry
+	size    int64
+}
+
+// spoolEntry is an archive being generated until ready is closed; then it is
+// in path, or generating it failed with err.
+type spoolEntry struct {
+	key   string
+	ready chan struct{}
+	path  string
+	size  int64
+	err   error
+
+	// the fields below are guarded by the spool's mutex
+	lastUsed time.Time
+	readers  int
+}
+
+func newArchiveSpool(dir string, maxSize int64) (*archiveSpool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, spoolPattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range stale {
+		os.Remove(name)
+	}
+	return &archiveSpool{dir: dir, maxSize: maxSize, entries: make(map[string]*spoolEntry)}, nil
+}
+
+// acquire returns the archive for key, starting generate in the background
+// unless it is already there or under way, and marks it as in use until
+// release. Without generate, it only returns an archive that is ready.
+func (s *archiveSpool) acquire(key string, generate func(context.Context, io.Writer) error) *spoolEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		if generate == nil {
+			return nil
+		}
+		e = &spoolEntry{key: key, ready: make(chan struct{})}
+		s.entries[key] = e
+		// the archive is made even if the client leaves, for it to resume
+		go s.generate(e, generate)
+	} else if generate == nil {
+		select {
+		case <-e.ready:
+		default:
+			return nil
+		}
+	}
+	e.readers++
+	e.lastUsed = time.Now()
+	return e
+}
+
+func (s *archiveSpool) release(e *spoolEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.readers--
+	s.evict()
+}
+
+func (s *archiveSpool) generate(e *spoolEntry, generate func(context.Context, io.Writer) error) {
+	defer close(e.ready)
+	path, size, err := s.write(generate)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("archive spool: %v", err)
+		e.err = err
+		// a later request tries again
+		delete(s.entries, e.key)
+		return
+	}
+	e.path, e.size = path, size
+	s.size += size
+	s.evict()
+}
+
+func (s *archiveSpool) write(generate func(context.Context, io.Writer) error) (string, int64, error) {
+	file, err := os.CreateTemp(s.dir, spoolPattern)
+	if err != nil {
+		return "", 0, err
+	}
+	err = generate(context.Background(), file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	info, statErr := os.Stat(file.Name())
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, err
+	}
+	return file.Name(), info.Size(), nil
+}
+
+// evict removes the least recently used archives that are ready and not in
+// use until the spool fits maxSize. s.mu must be held.
+func (s *archiveSpool) evict() {
+	for s.size > s.maxSize {
+		var oldest *spoolEntry
+		for _, e := range s.entries {
+			if e.readers > 0 || e.path == "" {
+				continue
+			}
+			if oldest == nil || e.lastUsed.Before(oldest.lastUsed) {
+				oldest = e
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		os.Remove(oldest.path)
+		s.size -= oldest.size
+		delete(s.entries, oldest.key)
+	}
+}
+
+// archiveFingerprint identifies the archive of format of the tree at osPath,
+// filtered by match, by the names, sizes and modification times of the
+// entries it would hold, and returns the latest of those times.
+func (f *fileHandler) archiveFingerprint(ctx context.Context, format, osPath string, match func(name string) bool) (string, time.Time, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", format, osPath)
+	var modTime time.Time
+	err := f.walkArchiveRoot(ctx, osPath, match, func(path, name string, info os.FileInfo) error {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d\x00", name, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil)[:16]), modTime, err
+}
+
+// serveSpooled serves the archive of format of the file or directory osPath,
+// filtered by match, from the -archive-spool, generating it first if needed,
+// and reports whether it did. The response headers other than the validators
+// are already set. HEAD requests are only answered from the spool if the
+// archive is ready, so that they never start a generation.
+func (f *fileHandler) serveSpooled(w http.ResponseWriter, r *http.Request, osPath, format string, match func(name string) bool, generate func(context.Context, io.Writer) error) (bool, error) {
+	if f.spool == nil {
+		return false, nil
+	}
+	key, modTime, err := f.archiveFingerprint(r.Context(), format, osPath, match)
+	if err != nil {
+		return true, err
+	}
+	if r.Method == http.MethodHead {
+		generate = nil
+	}
+	e := f.spool.acquire(key, generate)
+	if e == nil {
+		return false, nil
+	}
+	defer f.spool.release(e)
+	select {
+	case <-e.ready:
+	case <-r.Context().Done():
+		return true, r.Context().Err()
+	}
+	if e.err != nil {
+		return true, e.err
+	}
+	file, err := os.Open(e.path)
+	if err != nil {
+		return true, err
+	}
+	defer file.Close()
+	w.Header().Set("ETag", `"`+key+`"`)
+	http.ServeContent(w, r, "", modTime, file)
+	return true, nil
+}
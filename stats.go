@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	statsRoute = "/stats"
+	// statsFileName is where -stats keeps its counters next to the -config
+	// file when there is no -stats-file
+	statsFileName     = "stats.json"
+	statsSaveInterval = time.Minute
+	// statsTopFiles is how many files each table of the page shows
+	statsTopFiles = 25
+)
+
+const statsTemplateText = `
+<html>
+<head>
+	<title>Download statistics</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<link rel="stylesheet" href="{{ .Static }}/layout/autoindex.css" type="text/css">
+</head>
+<body>
+<h1>Download statistics</h1>
+<p>{{ .SinceStart.Hits }} download{{ if ne .SinceStart.Hits 1 }}s{{ end }}, {{ .SinceStart.Bytes.String }} since the server started at {{ .Started.Format "2006-01-02 15:04:05" }};
+{{ .Total.Hits }} download{{ if ne .Total.Hits 1 }}s{{ end }}, {{ .Total.Bytes.String }} since {{ .Since.Format "2006-01-02 15:04:05" }}.</p>
+{{- range $table := .Tables }}
+<h2>{{ $table.Title }}</h2>
+<table>
+	<thead>
+		<th class="indexcolname">Name</th>
+		<th class="indexcolsize">Downloads</th>
+		<th class="indexcolsize">Served</th>
+	</thead>
+	<tbody>
+	{{- range $table.Files }}
+		<tr>
+			<td class="indexcolname"><a href="{{ .URL.String }}">{{ .Path }}</a></td>
+			<td class="indexcolsize">{{ .Hits }}</td>
+			<td class="indexcolsize" title="{{ .Bytes | printf "%d" }} bytes">{{ .Bytes.String }}</td>
+		</tr>
+	{{- end }}
+	</tbody>
+</table>
+{{- end }}
+</body>
+</html>
+`
+
+var statsTemplate = template.Must(template.New("").Parse(statsTemplateText))
+
+// downloadCount is how often a file, or all of them, was downloaded and how
+// many of its bytes were sent.
+type downloadCount struct {
+	Hits  int64         `json:"hits"`
+	Bytes fileSizeBytes `json:"bytes"`
+}
+
+func (c *downloadCount) add(bytes int64) {
+	c.Hits++
+	c.Bytes += fileSizeBytes(bytes)
+}
+
+// statsFile is the persisted form of the counters.
+type statsFile struct {
+	Since time.Time                 `json:"since"`
+	Files map[string]*downloadCount `json:"files"`
+}
+
+// downloadStats counts the successful downloads of each file by URL path.
+// It is loaded from and saved every statsSaveInterval to path, if not "".
+type downloadStats struct {
+	path    string
+	started time.Time
+
+	mu         sync.Mutex
+	since      time.Time
+	files      map[string]*downloadCount
+	sinceStart downloadCount
+	dirty      bool
+}
+
+func newDownloadStats(path string) (*downloadStats, error) {
+	now := time.Now()
+	s := &downloadStats{path: path, started: now, since: now, files: make(map[string]*downloadCount)}
+	if path == "" {
+		return s, nil
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.saveEvery(statsSaveInterval)
+	return s, nil
+}
+
+// load reads the counters saved in s.path, if it exists.
+func (s *downloadStats) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved statsFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if !saved.Since.IsZero() {
+		s.since = saved.Since
+	}
+	for name, count := range saved.Files {
+		if count != nil {
+			s.files[name] = count
+		}
+	}
+	return nil
+}
+
+// count records the response rec to r, a request for a file. Only GETs
+// answered with 200 or 206 count, with the bytes actually sent, so that a
+// range request adds the part it fetched. It is a no-op on nil stats.
+func (s *downloadStats) count(r *http.Request, rec *statusRecorder) {
+	if s == nil || r.Method != http.MethodGet || rec.status != 0 && rec.status != http.StatusOK && rec.status != http.StatusPartialContent {
+		return
+	}
+	bytes := rec.bytes
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.files[r.URL.Path]
+	if !ok {
+		c = &downloadCount{}
+		s.files[r.URL.Path] = c
+	}
+	c.add(bytes)
+	s.sinceStart.add(bytes)
+	s.dirty = true
+}
+
+func (s *downloadStats) saveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.save(); err != nil {
+			log.Printf("stats: %v", err)
+		}
+	}
+}
+
+// save writes the counters to s.path if they changed since the last save,
+// replacing the file only once the new one is complete. It is a no-op on nil
+// stats.
+func (s *downloadStats) save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if s.path == "" || !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(statsFile{Since: s.since, Files: s.files})
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// statsEntry is a file in the statistics.
+type statsEntry struct {
+	Path string   `json:"path"`
+	URL  *url.URL `json:"-"`
+	downloadCount
+}
+
+// statsResult is the statistics as shown by the page and its ?format=json
+// variant. Files lists every file counted, the most downloaded first.
+type statsResult struct {
+	Started    time.Time     `json:"started"`
+	Since      time.Time     `json:"since"`
+	SinceStart downloadCount `json:"sinceStart"`
+	Total      downloadCount `json:"total"`
+	Files      []statsEntry  `json:"files"`
+}
+
+// snapshot copies the counters, sorted by hits and then by path.
+func (s *downloadStats) snapshot() statsResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := statsResult{Started: s.started, Since: s.since, SinceStart: s.sinceStart, Files: make([]statsEntry, 0, len(s.files))}
+	for name, count := range s.files {
+		result.Total.Hits += count.Hits
+		result.Total.Bytes += count.Bytes
+		result.Files = append(result.Files, statsEntry{Path: name, URL: &url.URL{Path: name}, downloadCount: *count})
+	}
+	sort.Slice(result.Files, func(i, j int) bool {
+		a, b := result.Files[i], result.Files[j]
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return a.Path < b.Path
+	})
+	return result
+}
+
+type statsTable struct {
+	Title string
+	Files []statsEntry
+}
+
+// statsHandler serves the -stats page at statsRoute. It lists the paths of
+// downloaded files of every route, including those behind a login.
+type statsHandler struct {
+	stats  *downloadStats
+	csp    string
+	prefix urlPrefix
+}
+
+func (h *statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	result := h.stats.snapshot()
+	w.Header().Set("Cache-Control", "no-cache")
+	if wantsJSON(r) {
+		_ = serveJSON(w, result)
+		return
+	}
+	for i := range result.Files {
+		result.Files[i].URL = h.prefix.url(r, result.Files[i].URL)
+	}
+	byHits := result.Files[:min(len(result.Files), statsTopFiles)]
+	byBytes := append([]statsEntry(nil), result.Files...)
+	sort.SliceStable(byBytes, func(i, j int) bool { return byBytes[i].Bytes > byBytes[j].Bytes })
+	byBytes = byBytes[:min(len(byBytes), statsTopFiles)]
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if h.csp != "" {
+		w.Header().Set("Content-Security-Policy", h.csp)
+	}
+	gw, done := gzipWriter(w, r)
+	if err := statsTemplate.Execute(gw, struct {
+		statsResult
+		Tables []statsTable
+		Static string
+	}{result, []statsTable{{"Most downloaded", byHits}, {"Most data served", byBytes}}, h.prefix.path(r, "/static")}); err != nil {
+		return
+	}
+	_ = done()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// storage is the tree a fileHandler serves. Names are slash-separated and
+// relative to its root, as with fs.FS, which it extends by what uploads,
+// deletes and new directories need. Files opened from it are seekable.
+type storage interface {
+	fs.StatFS
+	fs.ReadDirFS
+	// Lstat is Stat of name itself rather than of what a symlink there
+	// points to, and ReadLink the target of such a symlink.
+	Lstat(name string) (fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+	// Create opens the new file name for writing, failing with
+	// fs.ErrExist if there is one already. It and Mkdir apply perm as
+	// given, regardless of the umask.
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+	Mkdir(name string, perm fs.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+}
+
+// storageLinker is implemented by storages with hard links, which uploads
+// use to put a file in place only if the name is still free.
+type storageLinker interface {
+	Link(oldName, newName string) error
+}
+
+// osFS is the storage of the directory root on disk.
+type osFS struct {
+	root string
+}
+
+var _ storageLinker = osFS{}
+
+func (s osFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(s.root, filepath.FromSlash(name)), nil
+}
+
+func (s osFS) Open(name string) (fs.File, error) {
+	p, err := s.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s osFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := s.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (s osFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := s.path("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (s osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := s.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (s osFS) ReadLink(name string) (string, error) {
+	p, err := s.path("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+func (s osFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	p, err := s.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	// chmod, unlike open, is not subject to the umask
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		os.Remove(p)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s osFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := s.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(p, perm); err != nil {
+		return err
+	}
+	return os.Chmod(p, perm)
+}
+
+func (s osFS) Remove(name string) error {
+	p, err := s.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (s osFS) RemoveAll(name string) error {
+	p, err := s.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (s osFS) Rename(oldName, newName string) error {
+	oldPath, err := s.path("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.path("rename", newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (s osFS) Link(oldName, newName string) error {
+	oldPath, err := s.path("link", oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.path("link", newName)
+	if err != nil {
+		return err
+	}
+	return os.Link(oldPath, newPath)
+}
+
+// readOnlyFS is the storage of any fs.FS, which has no symlinks and refuses
+// every change.
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+func (s readOnlyFS) Open(name string) (fs.File, error) {
+	return s.fsys.Open(name)
+}
+
+func (s readOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, name)
+}
+
+func (s readOnlyFS) Lstat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, name)
+}
+
+func (s readOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(s.fsys, name)
+}
+
+func (s readOnlyFS) ReadLink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (s readOnlyFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrPermission}
+}
+
+func (s readOnlyFS) Mkdir(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (s readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (s readOnlyFS) RemoveAll(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (s readOnlyFS) Rename(oldName, newName string) error {
+	return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrPermission}
+}
+
+// createTemp creates a new file in the directory dir of s named prefix and a
+// random suffix, like os.CreateTemp, and returns its name.
+func createTemp(s storage, dir, prefix string, perm fs.FileMode) (string, io.WriteCloser, error) {
+	for try := 0; ; try++ {
+		var suffix [8]byte
+		if _, err := rand.Read(suffix[:]); err != nil {
+			return "", nil, err
+		}
+		name := path.Join(dir, prefix+hex.EncodeToString(suffix[:]))
+		w, err := s.Create(name, perm)
+		if errors.Is(err, fs.ErrExist) && try < 100 {
+			continue
+		}
+		return name, w, err
+	}
+}
+
+// storageName returns the name in f.storage of osPath, which lies below
+// f.path, or an invalid name that the storage refuses if it does not.
+func (f *fileHandler) storageName(osPath string) string {
+	rel, err := filepath.Rel(f.path, osPath)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// newFSHandler returns a handler serving fsys, such as an embed.FS, at route
+// read-only, with the listings, trees and archives of the directories main
+// serves from disk. The features readsDisk lists answer 501, as do WebDAV and
+// S3 listings should they be enabled; zip files are not browsed.
+func newFSHandler(route string, fsys fs.FS, listingTemplate *template.Template) (*fileHandler, error) {
+	archiveCompression, err := newArchiveCompression(defaultArchiveLevel, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &fileHandler{
+		route:   route,
+		path:    string(filepath.Separator),
+		storage: readOnlyFS{fsys: fsys},
+		// names in an fs.FS cannot lead out of it
+		followSymlinks:     true,
+		allowArchive:       true,
+		treeDepth:          defaultTreeDepth,
+		feedEntries:        defaultFeedEntries,
+		feedDepth:          defaultFeedDepth,
+		nosniff:            true,
+		listingTemplate:    listingTemplate,
+		archiveCompression: archiveCompression,
+	}, nil
+}
+
+// onDisk reports whether f.storage is the directory f.path on disk, which
+// the features that read the tree without going through it need.
+func (f *fileHandler) onDisk() bool {
+	_, ok := f.storage.(osFS)
+	return ok
+}
+
+// readsDisk reports whether r asks for one of those features on the file or
+// directory in the state info: searches, feeds and events of directories,
+// and thumbnails of files.
+func readsDisk(r *http.Request, info os.FileInfo) bool {
+	q := r.URL.Query()
+	if info.IsDir() {
+		return isSearch(r) || q.Has(feedKey) || q.Has(eventsKey)
+	}
+	return q.Has(thumbKey)
+}
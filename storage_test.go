@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func testMapFS() fstest.MapFS {
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	return fstest.MapFS{
+		"README.md":       {Data: []byte("# In memory\n"), ModTime: mtime},
+		"a.txt":           {Data: []byte("alpha"), ModTime: mtime},
+		"docs/guide.md":   {Data: []byte("guide"), ModTime: mtime},
+		"docs/deep/b.txt": {Data: []byte("bravo"), ModTime: mtime},
+		"empty":           {Mode: fs.ModeDir | 0o755, ModTime: mtime},
+	}
+}
+
+func newTestFSHandler(t *testing.T) *fileHandler {
+	t.Helper()
+	h, err := newFSHandler("/", testMapFS(), directoryListingTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestFSHandlerListing(t *testing.T) {
+	h := newTestFSHandler(t)
+	h.markdown = true
+	w := serveTest(h, http.MethodGet, "/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing: %d %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, want := range []string{`href="/a.txt"`, `href="/docs/"`, `href="/empty/"`, "<h1>In memory</h1>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing lacks %s", want)
+		}
+	}
+	w = serveTest(h, http.MethodGet, "/docs/?format=json", nil)
+	if !strings.Contains(w.Body.String(), `"name": "deep/"`) || !strings.Contains(w.Body.String(), `"name": "guide.md"`) {
+		t.Errorf("JSON listing of docs/: %s", w.Body)
+	}
+	if w := serveTest(h, http.MethodGet, "/?du=true", nil); w.Code != http.StatusOK {
+		t.Errorf("listing with sizes: %d", w.Code)
+	}
+}
+
+func TestFSHandlerFiles(t *testing.T) {
+	h := newTestFSHandler(t)
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"/a.txt", http.StatusOK, "alpha"},
+		{"/docs/deep/b.txt", http.StatusOK, "bravo"},
+		{"/a.txt?hash=md5", http.StatusOK, "2c1743a391305fbf367df8e4f069f9f9\n"},
+		{"/missing.txt", http.StatusNotFound, ""},
+		{"/a.txt?thumb=1", http.StatusNotImplemented, ""},
+		{"/?q=b", http.StatusNotImplemented, ""},
+		{"/?feed=atom", http.StatusNotImplemented, ""},
+	}
+	for _, tt := range tests {
+		w := serveTest(h, http.MethodGet, tt.target, nil)
+		if w.Code != tt.status || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("GET %s: %d %q, want %d %q", tt.target, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+	if w := serveTest(h, http.MethodGet, "/a.txt?view=1", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "alpha") {
+		t.Errorf("view: %d", w.Code)
+	}
+	if w := serveTest(h, http.MethodGet, "/a.txt", nil, "Range", "bytes=1-2"); w.Code != http.StatusPartialContent || w.Body.String() != "lp" {
+		t.Errorf("range: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestFSHandlerArchives(t *testing.T) {
+	h := newTestFSHandler(t)
+	want := []string{"README.md", "a.txt", "docs/deep/b.txt", "docs/guide.md"}
+	for _, key := range []string{zipKey, tarGzKey, tarKey} {
+		w := serveTest(h, http.MethodGet, "/?"+key+"=1", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("?%s: %d %s", key, w.Code, w.Body)
+		}
+		entries := readArchiveEntries(t, key, w.Body.Bytes())
+		var files []string
+		for name, e := range entries {
+			if !e.mode.IsDir() {
+				files = append(files, name)
+			}
+		}
+		sort.Strings(files)
+		if !slices.Equal(files, want) {
+			t.Errorf("?%s holds %q, want %q", key, files, want)
+		}
+		if e := entries["docs/deep/b.txt"]; e.content != "bravo" {
+			t.Errorf("?%s: docs/deep/b.txt holds %q", key, e.content)
+		}
+		found := false
+		for name, e := range entries {
+			found = found || strings.TrimSuffix(name, "/") == "empty" && e.mode.IsDir()
+		}
+		if !found {
+			t.Errorf("?%s lacks the empty directory", key)
+		}
+		if w := serveTest(h, http.MethodHead, "/docs/?"+key+"=1", nil); w.Code != http.StatusOK || w.Header().Get(estimatedSizeHeader) == "" {
+			t.Errorf("HEAD ?%s: %d, estimate %q", key, w.Code, w.Header().Get(estimatedSizeHeader))
+		}
+	}
+}
+
+func TestFSHandlerRefusesChanges(t *testing.T) {
+	h := newTestFSHandler(t)
+	for _, method := range []string{http.MethodPut, http.MethodDelete, methodMkcol} {
+		if w := serveTest(h, method, "/a.txt", strings.NewReader("x")); w.Code < 400 {
+			t.Errorf("%s: %d", method, w.Code)
+		}
+	}
+	// the handler is read-only even with the flags that would allow changes
+	h.allowUpload, h.allowDelete = true, true
+	if w := serveTest(h, http.MethodPut, "/new.txt", strings.NewReader("x")); w.Code < 400 {
+		t.Errorf("PUT with uploads allowed: %d", w.Code)
+	}
+	if w := serveTest(h, http.MethodDelete, "/a.txt", nil); w.Code < 400 {
+		t.Errorf("DELETE with deletes allowed: %d", w.Code)
+	}
+	if w := serveTest(h, http.MethodGet, "/a.txt", nil); w.Body.String() != "alpha" {
+		t.Errorf("a.txt after the refused changes: %q", w.Body.String())
+	}
+	h.dav = true
+	if w := serveTest(h, methodPropfind, "/", nil); w.Code != http.StatusNotImplemented {
+		t.Errorf("PROPFIND: %d, want 501", w.Code)
+	}
+}
+
+func TestFSHandlerSPA(t *testing.T) {
+	fsys := testMapFS()
+	fsys["index.html"] = &fstest.MapFile{Data: []byte("app")}
+	h, err := newFSHandler("/", fsys, directoryListingTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.spa = true
+	if w := serveTest(h, http.MethodGet, "/settings", nil); w.Code != http.StatusOK || w.Body.String() != "app" {
+		t.Errorf("deep link: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestOSFSRefusesNamesOutside(t *testing.T) {
+	s := osFS{root: t.TempDir()}
+	for _, name := range []string{"../x", "/etc/passwd", "a/../../x", ""} {
+		if _, err := s.Stat(name); err == nil {
+			t.Errorf("Stat(%q) succeeded", name)
+		}
+	}
+	h := newTestHandler(t, "/", s.root)
+	if got := h.storageName(filepath.Join(s.root, "a", "b")); got != "a/b" {
+		t.Errorf("storageName = %q, want a/b", got)
+	}
+}
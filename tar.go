@@ -0,0 +1,72 @@
+package main
+
+import (
+	tarball "archive/tar"
+	"context"
+	"io"
+	"log"
+	"os"
+)
+
+// tar writes an uncompressed tar archive of the file or directory at path,
+// see walkArchiveRoot for match.
+func (f *fileHandler) tar(ctx context.Context, w io.Writer, path string, match func(name string) bool) error {
+	return f.writeTar(ctx, w, func(add archiveAdder) error {
+		return f.walkArchiveRoot(ctx, path, match, add)
+	})
+}
+
+// tarPaths writes an uncompressed tar archive of the trees rooted at paths,
+// naming entries relative to basePath.
+func (f *fileHandler) tarPaths(ctx context.Context, w io.Writer, basePath string, paths []string) error {
+	return f.writeTar(ctx, w, func(add archiveAdder) error {
+		return f.walkArchive(ctx, basePath, paths, add)
+	})
+}
+
+// writeTar writes an uncompressed tar archive of the entries walk passes to
+// add, reading them from f.storage.
+func (f *fileHandler) writeTar(ctx context.Context, w io.Writer, walk func(add archiveAdder) error) error {
+	wTar := tarball.NewWriter(w)
+	defer func() {
+		if err := wTar.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	return walk(func(path, name string, stat os.FileInfo) error {
+		if name == "." && stat.IsDir() {
+			return nil
+		}
+		link := ""
+		if stat.Mode()&os.ModeSymlink != 0 {
+			// store the link itself rather than following it
+			var err error
+			if link, err = f.storage.ReadLink(f.storageName(path)); err != nil {
+				return err
+			}
+		}
+		header, err := tarball.FileInfoHeader(stat, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if stat.IsDir() {
+			header.Name += "/"
+		}
+		if err := wTar.WriteHeader(header); err != nil {
+			return err
+		}
+		if !stat.Mode().IsRegular() {
+			return nil
+		}
+		file, err := f.storage.Open(f.storageName(path))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := copyContext(ctx, wTar, file); err != nil {
+			return err
+		}
+		return wTar.Flush()
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"net/url"
+	"os"
+	"time"
+)
+
+// loadListingTemplate parses the directory listing template at path and
+// executes it once against sample data, so that syntax errors and references
+// to fields that do not exist are reported at startup instead of on the first
+// request.
+func loadListingTemplate(path string) (*template.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(path).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(io.Discard, sampleListingData()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// sampleListingData fills every field of directoryListingData so that a dry
+// run of a template takes as many branches as possible.
+func sampleListingData() directoryListingData {
+	u := func(s string) *url.URL {
+		return &url.URL{Path: s}
+	}
+	return directoryListingData{
+		Title:        "sample",
+		ZipURL:       u("/sample/"),
+		TarGzURL:     u("/sample/"),
+		TarURL:       u("/sample/"),
+		AllowUpload:  true,
+		AllowDelete:  true,
+		AllowExtract: true,
+		AllowArchive: true,
+		OnConflict:   onConflictReject,
+		AllowShare:   true,
+		UploadURL:    u("/sample/"),
+		ParentDir:    u("/"),
+		Static:       "/static",
+		Breadcrumbs:  []breadcrumb{{Name: "sample", URL: u("/sample/")}},
+		Sort:         listingSort{Column: sortByName, Order: sortAscending},
+		Readme:       "<p>sample</p>",
+		Gallery:      true,
+		CSRFToken:    "sample",
+		Uploaded:     1,
+		Search:       "sample",
+		Searched:     true,
+		Truncated:    true,
+		Total:        &dirUsage{Size: 2048, Entries: 3, Truncated: true},
+		Page:         page{Offset: 3, Limit: 3, Total: 9, PrevURL: u("/sample/"), NextURL: u("/sample/")},
+		Files: []directoryListingFileData{
+			{Name: "dir/", BaseName: "dir", IsDir: true, URL: u("/sample/dir/"), ModTime: time.Now(), Usage: &dirUsage{Size: 1024, Entries: 1}},
+			{Name: "file.txt", BaseName: "file.txt", Size: 1024, URL: u("/sample/file.txt"), ModTime: time.Now()},
+			{Name: "image.jpg", BaseName: "image.jpg", Size: 1024, URL: u("/sample/image.jpg"), ModTime: time.Now()},
+		},
+	}
+}
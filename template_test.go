@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTemplate(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "listing.html")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCustomListingTemplate(t *testing.T) {
+	tmpl, err := loadListingTemplate(writeTemplate(t, `<h1>{{.Title}}</h1>{{range .Files}}<a href="{{.URL}}">{{.Name}}</a>;{{end}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := writeTestTree(t, map[string]string{"a.txt": "a", "sub/": ""})
+	h := newTestHandler(t, "/", dir)
+	h.listingTemplate = tmpl
+	w := serveTest(h, http.MethodGet, "/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	want := "<h1>" + filepath.Base(dir) + "</h1>" + `<a href="/sub/">sub/</a>;<a href="/a.txt">a.txt</a>;`
+	if got := w.Body.String(); got != want {
+		t.Errorf("listing %q, want %q", got, want)
+	}
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type %q", got)
+	}
+}
+
+func TestLoadListingTemplateErrors(t *testing.T) {
+	tests := map[string]string{
+		"syntax":             `{{range .Files}}`,
+		"unknown field":      `{{.NoSuchField}}`,
+		"unknown file field": `{{range .Files}}{{.NoSuchField}}{{end}}`,
+	}
+	for name, text := range tests {
+		if _, err := loadListingTemplate(writeTemplate(t, text)); err == nil {
+			t.Errorf("%s: loaded %q", name, text)
+		}
+	}
+	if _, err := loadListingTemplate(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestEmbeddedTemplateRunsOnSampleData(t *testing.T) {
+	if err := directoryListingTemplate.Execute(new(strings.Builder), sampleListingData()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	formatText      = "txt"
+	textContentType = "text/plain"
+)
+
+// cliAgents are the User-Agent prefixes answered with a plain-text listing
+// under -cli-text.
+var cliAgents = []string{"curl/", "Wget/"}
+
+// wantsText reports whether the client asked for a plain-text listing, with
+// ?format=txt or an Accept header ranking text/plain above text/html, or is
+// curl or wget and -cli-text is set.
+func (f *fileHandler) wantsText(r *http.Request) bool {
+	if format := r.URL.Query().Get(formatKey); format != "" {
+		return format == formatText
+	}
+	if accept := r.Header.Get("Accept"); accept != "" {
+		text, html := acceptQuality(accept, textContentType), acceptQuality(accept, "text/html")
+		if text != html {
+			return text > html
+		}
+	}
+	if f.cliText {
+		agent := r.Header.Get("User-Agent")
+		for _, prefix := range cliAgents {
+			if strings.HasPrefix(agent, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptQuality returns the q value the Accept header value accept gives
+// mediaType, from the most specific matching entry, or 0 if none matches.
+func acceptQuality(accept, mediaType string) float64 {
+	quality, specificity := 0.0, -1
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		var s int
+		switch {
+		case name == mediaType:
+			s = 2
+		case name == strings.SplitN(mediaType, "/", 2)[0]+"/*":
+			s = 1
+		case name == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
+
+// serveTextListing writes one line per entry: the size in bytes right-aligned
+// in a fixed-width column, the UTC modification time and the name, with "/"
+// appended to directories; search hits are named by their path. Only the name may contain spaces, so the other
+// columns can be split on whitespace; names with control characters are
+// quoted to keep every entry on its own line.
+func serveTextListing(w http.ResponseWriter, files []directoryListingFileData) error {
+	w.Header().Set("Content-Type", textContentType+"; charset=utf-8")
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name, osPathSeparator)
+		if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			name = strconv.Quote(name)
+		}
+		if file.IsDir {
+			name += "/"
+		}
+		if _, err := fmt.Fprintf(w, "%15d  %s  %s\n", int64(file.Size), file.ModTime.UTC().Format(time.RFC3339), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	thumbKey         = "thumb"
+	thumbDefaultSize = 256
+	thumbMaxSize     = 1024
+	thumbContentType = "image/jpeg"
+
+	viewGallery = "gallery"
+
+	// thumbMaxPixels caps the decoded size of a source image at roughly
+	// 160 MB of RGBA, so a single crafted file cannot exhaust memory.
+	thumbMaxPixels = 40 << 20
+)
+
+var errThumbTooLarge = errors.New("image too large to thumbnail")
+
+// thumbSlots bounds the number of thumbnails generated at once; each holds a
+// fully decoded source image.
+var thumbSlots = make(chan struct{}, 2)
+
+// thumbCacheDir returns the directory generated thumbnails are kept in,
+// keyed by source path, size and modification time, so they are regenerated
+// when the source changes. It is below the user's cache directory if that is
+// private to them, as what is there is served, or else a temporary directory
+// of this process.
+var thumbCacheDir = sync.OnceValues(func() (string, error) {
+	if dir, err := os.UserCacheDir(); err == nil {
+		dir = filepath.Join(dir, "http-file-server", "thumbs")
+		err := privateDir(dir)
+		if err == nil {
+			return dir, nil
+		}
+		log.Printf("thumbnails: %v", err)
+	}
+	return os.MkdirTemp("", "http-file-server-thumbs-")
+})
+
+// privateDir creates the directory path with its parents unless it exists,
+// and checks that it is a directory of the user's, not a symlink, that
+// nobody else has access to.
+func privateDir(path string) error {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !isPrivateDir(info) {
+		return fmt.Errorf("%s is not a directory private to the user", path)
+	}
+	return nil
+}
+
+func isImageName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// IsImage reports whether the entry is an image the gallery can thumbnail.
+func (d directoryListingFileData) IsImage() bool {
+	return !d.IsDir && isImageName(d.BaseName)
+}
+
+// ThumbURL is the link to the gallery thumbnail of an image.
+func (d directoryListingFileData) ThumbURL() *url.URL {
+	u := *d.URL
+	u.RawQuery = thumbKey + "=" + strconv.Itoa(thumbDefaultSize)
+	return &u
+}
+
+// serveThumb serves a JPEG no larger than ?thumb=SIZE pixels on either side
+// of the image osPath, generating and caching it on first use.
+func (f *fileHandler) serveThumb(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	size, err := strconv.Atoi(r.URL.Query().Get(thumbKey))
+	if err != nil || size < 1 || size > thumbMaxSize {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	if !isImageName(info.Name()) {
+		return f.serveStatus(w, r, http.StatusUnsupportedMediaType)
+	}
+	cacheDir, err := thumbCacheDir()
+	if err != nil {
+		return err
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d", osPath, info.ModTime().UnixNano(), info.Size(), size)))
+	cached := filepath.Join(cacheDir, hex.EncodeToString(key[:])+".jpg")
+	if _, err := os.Stat(cached); err != nil {
+		err := generateThumb(osPath, cached, size)
+		switch {
+		case err == errThumbTooLarge || errors.Is(err, image.ErrFormat):
+			return f.serveStatus(w, r, http.StatusUnsupportedMediaType)
+		case err != nil:
+			return err
+		}
+	}
+	file, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", thumbContentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+	return nil
+}
+
+// generateThumb writes the thumbnail of the image src to dst.
+func generateThumb(src, dst string, size int) error {
+	thumbSlots <- struct{}{}
+	defer func() { <-thumbSlots }()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// the size is read from the whole file, as a JPEG's may follow more
+	// metadata than a peek would hold, before anything is decoded; an image
+	// whose size cannot be read is not thumbnailed
+	config, _, err := image.DecodeConfig(bufio.NewReader(in))
+	if err != nil {
+		return fmt.Errorf("%w: %v", image.ErrFormat, err)
+	}
+	if int64(config.Width)*int64(config.Height) > thumbMaxPixels {
+		return errThumbTooLarge
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(in)
+	head, _ := br.Peek(64 << 10)
+	orientation := exifOrientation(head)
+	img, _, err := image.Decode(br)
+	if err != nil {
+		return err
+	}
+	if b := img.Bounds(); int64(b.Dx())*int64(b.Dy()) > thumbMaxPixels {
+		return errThumbTooLarge
+	}
+	thumb := orient(resize(img, size), orientation)
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := jpeg.Encode(tmp, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// resize scales img down so that neither side exceeds size, averaging the
+// source pixels covered by each output pixel. Transparent areas are composed
+// onto white, since the result is encoded as JPEG. Images already small enough
+// keep their size.
+func resize(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, max(1, sh*size/sw)
+		} else {
+			dw, dh = max(1, sw*size/sh), size
+		}
+	}
+	at := func(x, y int) (r, g, b, a uint32) {
+		return img.At(x, y).RGBA()
+	}
+	if fast, ok := img.(image.RGBA64Image); ok {
+		at = func(x, y int) (r, g, b, a uint32) {
+			c := fast.RGBA64At(x, y)
+			return uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := b.Min.Y+dy*sh/dh, b.Min.Y+(dy+1)*sh/dh
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := b.Min.X+dx*sw/dw, b.Min.X+(dx+1)*sw/dw
+			var sr, sg, sb, sa, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					r, g, b, a := at(x, y)
+					sr, sg, sb, sa = sr+uint64(r), sg+uint64(g), sb+uint64(b), sa+uint64(a)
+					n++
+				}
+			}
+			// colors are premultiplied, so adding the missing coverage as
+			// white composes the pixel over a white background
+			white := n*0xffff - sa
+			dst.SetRGBA(dx, dy, color.RGBA{
+				R: uint8((sr + white) / n >> 8),
+				G: uint8((sg + white) / n >> 8),
+				B: uint8((sb + white) / n >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+// orient applies the EXIF orientation (1 to 8) to img.
+func orient(img *image.RGBA, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var nx, ny int
+			switch orientation {
+			case 2: // mirrored horizontally
+				nx, ny = w-1-x, y
+			case 3: // rotated 180°
+				nx, ny = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				nx, ny = x, h-1-y
+			case 5: // transposed
+				nx, ny = y, x
+			case 6: // rotated 90° clockwise
+				nx, ny = w-1-y, x
+			case 7: // transversed
+				nx, ny = w-1-y, h-1-x
+			case 8: // rotated 90° counter-clockwise
+				nx, ny = y, h-1-x
+			}
+			dst.SetRGBA(nx, ny, img.RGBAAt(x, y))
+		}
+	}
+	return dst
+}
+
+// exifOrientation returns the orientation tag from the EXIF segment at the
+// start of a JPEG file, or 1 (upright) if there is none.
+func exifOrientation(head []byte) int {
+	if len(head) < 4 || head[0] != 0xff || head[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(head) && head[i] == 0xff; {
+		marker := head[i+1]
+		length := int(binary.BigEndian.Uint16(head[i+2:]))
+		if marker == 0xda || length < 2 || i+2+length > len(head) {
+			break
+		}
+		segment := head[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := order.Uint32(tiff[4:])
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return 1
+	}
+	ifd := int(offset)
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tiffWithOrientation returns a TIFF header in order whose first IFD, at
+// offset, holds the orientation tag.
+func tiffWithOrientation(order binary.ByteOrder, offset uint32, orientation uint16) []byte {
+	b := make([]byte, 8+2+12)
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], offset)
+	order.PutUint16(b[8:], 1)
+	order.PutUint16(b[10:], 0x0112)
+	order.PutUint16(b[12:], 3)
+	order.PutUint32(b[14:], 1)
+	order.PutUint16(b[18:], orientation)
+	return b
+}
+
+func TestTiffOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"little-endian", tiffWithOrientation(binary.LittleEndian, 8, 6), 6},
+		{"big-endian", tiffWithOrientation(binary.BigEndian, 8, 3), 3},
+		{"short", []byte("II*\x00"), 1},
+		{"unknown byte order", append([]byte("XX"), tiffWithOrientation(binary.BigEndian, 8, 6)[2:]...), 1},
+		{"IFD past the end", tiffWithOrientation(binary.LittleEndian, 21, 6), 1},
+		{"IFD offset overflowing int32", tiffWithOrientation(binary.LittleEndian, 0xfffffff0, 6), 1},
+		{"largest IFD offset", tiffWithOrientation(binary.BigEndian, 0xffffffff, 6), 1},
+		{"entries past the end", tiffWithOrientation(binary.LittleEndian, 8, 6)[:20], 1},
+	}
+	for _, tt := range tests {
+		if got := tiffOrientation(tt.tiff); got != tt.want {
+			t.Errorf("%s: tiffOrientation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xff})
+		}
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// withPNGSize returns data, a PNG, claiming to be width by height pixels.
+func withPNGSize(data []byte, width, height uint32) []byte {
+	data = bytes.Clone(data)
+	// the IHDR chunk follows the signature: length, type, data and CRC
+	ihdr := data[8:]
+	binary.BigEndian.PutUint32(ihdr[8:], width)
+	binary.BigEndian.PutUint32(ihdr[12:], height)
+	binary.BigEndian.PutUint32(ihdr[8+13:], crc32.ChecksumIEEE(ihdr[4:8+13]))
+	return data
+}
+
+// testJPEG returns a JPEG of width by height pixels with padding bytes of
+// metadata before the frame header, in segments of its own.
+func testJPEG(t *testing.T, width, height, padding int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	out := append([]byte{}, data[:2]...)
+	for padding > 0 {
+		n := min(padding, 0xfff0)
+		out = append(out, 0xff, 0xe2, byte((n+2)>>8), byte(n+2))
+		out = append(out, make([]byte, n)...)
+		padding -= n
+	}
+	return append(out, data[2:]...)
+}
+
+// withJPEGSize returns data, a JPEG, claiming to be width by height pixels.
+func withJPEGSize(t *testing.T, data []byte, width, height uint16) []byte {
+	t.Helper()
+	data = bytes.Clone(data)
+	i := bytes.Index(data, []byte{0xff, 0xc0})
+	if i < 0 {
+		t.Fatal("no baseline frame header")
+	}
+	binary.BigEndian.PutUint16(data[i+5:], height)
+	binary.BigEndian.PutUint16(data[i+7:], width)
+	return data
+}
+
+func TestGenerateThumb(t *testing.T) {
+	small := testPNG(t, 100, 50)
+	bigJPEG := testJPEG(t, 64, 48, 100<<10)
+	overflowErr := errThumbTooLarge
+	if strconv.IntSize == 32 {
+		// the decoder refuses a size overflowing int itself
+		overflowErr = image.ErrFormat
+	}
+	tests := []struct {
+		name       string
+		data       []byte
+		wantErr    error
+		wantWidth  int
+		wantHeight int
+	}{
+		{"png", small, nil, 32, 16},
+		{"jpeg with metadata past the peek", bigJPEG, nil, 32, 24},
+		{"png too large", withPNGSize(small, 7000, 7000), errThumbTooLarge, 0, 0},
+		{"png with a pixel count overflowing int32", withPNGSize(small, 70000, 70000), overflowErr, 0, 0},
+		{"jpeg too large past the peek", withJPEGSize(t, bigJPEG, 8000, 8000), errThumbTooLarge, 0, 0},
+		{"not an image", []byte("hello"), image.ErrFormat, 0, 0},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		src := filepath.Join(dir, "src")
+		dst := filepath.Join(dir, "dst.jpg")
+		os.Remove(dst)
+		if err := os.WriteFile(src, tt.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := generateThumb(src, dst, 32)
+		if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+			t.Errorf("%s: generateThumb = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			if _, err := os.Stat(dst); err == nil {
+				t.Errorf("%s: a thumbnail was written", tt.name)
+			}
+			continue
+		}
+		file, err := os.Open(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := jpeg.DecodeConfig(file)
+		file.Close()
+		if err != nil || config.Width != tt.wantWidth || config.Height != tt.wantHeight {
+			t.Errorf("%s: thumbnail %dx%d (%v), want %dx%d", tt.name, config.Width, config.Height, err, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestServeThumb(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{
+		"a.png":      string(testPNG(t, 100, 50)),
+		"large.png":  string(withPNGSize(testPNG(t, 4, 4), 70000, 70000)),
+		"broken.png": "not a png",
+		"a.txt":      "text",
+	})
+	h := newTestHandler(t, "/", dir)
+	w := serveTest(h, http.MethodGet, "/a.png?thumb=64", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != thumbContentType {
+		t.Fatalf("thumbnail: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if config, err := jpeg.DecodeConfig(w.Body); err != nil || config.Width != 64 || config.Height != 32 {
+		t.Errorf("thumbnail %dx%d (%v), want 64x32", config.Width, config.Height, err)
+	}
+
+	cacheDir, err := thumbCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cacheDir, os.Getenv("XDG_CACHE_HOME")) {
+		t.Errorf("thumbnails cached in %s, outside the user's cache directory", cacheDir)
+	}
+	if info, err := os.Lstat(cacheDir); err != nil || !isPrivateDir(info) {
+		t.Errorf("the thumbnail cache %s is not private (%v)", cacheDir, err)
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) == 0 {
+		t.Errorf("no thumbnail cached in %s", cacheDir)
+	}
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/a.png?thumb=64", http.StatusOK},
+		{"/a.png?thumb=0", http.StatusBadRequest},
+		{"/a.png?thumb=4096", http.StatusBadRequest},
+		{"/a.png?thumb=x", http.StatusBadRequest},
+		{"/a.txt?thumb=64", http.StatusUnsupportedMediaType},
+		{"/large.png?thumb=64", http.StatusUnsupportedMediaType},
+		{"/broken.png?thumb=64", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		if w := serveTest(h, http.MethodGet, tt.target, nil); w.Code != tt.want {
+			t.Errorf("GET %s: status %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+}
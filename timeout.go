@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultWriteTimeout      = time.Minute
+	defaultMaxHeaderBytes    = 64 << 10
+)
+
+// newServer returns a server for handler whose clients must send their
+// request headers within -read-header-timeout and may keep idle connections
+// for -idle-timeout. It has no overall read or write timeout, which would
+// cut off long uploads and downloads; generated pages set their own write
+// deadline instead, see limitWrite.
+func newServer(handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: headerTimeoutFlag,
+		IdleTimeout:       idleTimeoutFlag,
+		MaxHeaderBytes:    maxHeaderBytesFlag,
+	}
+}
+
+// limitWrite gives the response w -write-timeout from now to be written.
+// Listings and other pages the server generates are small, so a client
+// taking longer is stalling; files and archives are streamed without a
+// deadline, since a download may rightly take hours.
+func (f *fileHandler) limitWrite(w http.ResponseWriter) {
+	if f.writeTimeout > 0 {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(f.writeTimeout))
+	}
+}
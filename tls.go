@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// tlsConfig returns the TLS configuration for the server, or nil if TLS is
+// disabled, with the -client-ca requirement if one is given.
+func tlsConfig(listeners []net.Listener) (*tls.Config, error) {
+	config, err := serverCertificate(listeners)
+	if err != nil || config == nil || clientCAFlag == "" {
+		return config, err
+	}
+	return withClientCA(config, clientCAFlag)
+}
+
+// serverCertificate returns the TLS configuration with the server's
+// certificate, or nil if TLS is disabled. The certificate is loaded eagerly
+// so a bad key pair fails at startup rather than on the first handshake.
+func serverCertificate(listeners []net.Listener) (*tls.Config, error) {
+	switch {
+	case letsEncryptFlag:
+		return letsEncryptConfig(listeners)
+	case tlsSelfSignedFlag && (sslCertificate != "" || sslKey != ""):
+		return nil, errors.New("-tls-self-signed cannot be combined with -ssl-cert/-ssl-key")
+	case tlsSelfSignedFlag:
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case sslCertificate != "" && sslKey == "":
+		return nil, errors.New("-ssl-cert requires -ssl-key")
+	case sslCertificate == "" && sslKey != "":
+		return nil, errors.New("-ssl-key requires -ssl-cert")
+	case sslCertificate != "" && sslKey != "":
+		cert, err := tls.LoadX509KeyPair(sslCertificate, sslKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// selfSignedCertificate generates an in-memory certificate for the local host
+// name and all interface addresses.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
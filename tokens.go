@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	tokenKey      = "token"
+	tokenRead     = "read"
+	tokenWrite    = "write"
+	bearerScheme  = "Bearer"
+	tokenScrubbed = "***"
+)
+
+// tokens holds the -token flags and the lines of the -token-file: bearer
+// tokens by their SHA-256, each either read-only or also allowed to upload
+// and delete, with a label naming it in the logs.
+type tokens struct {
+	Values []struct {
+		Token [sha256.Size]byte
+		Write bool
+		Label string
+	}
+	Texts []string
+}
+
+func (fv *tokens) help() string {
+	return fmt.Sprintf("accept the bearer token TOKEN, sent as Authorization: Bearer TOKEN or ?token=TOKEN, given as TOKEN[:%s|%s[:LABEL]]; %s tokens pass the routes' basic auth, %s tokens may also upload and delete on any route (repeatable)", tokenRead, tokenWrite, tokenRead, tokenWrite)
+}
+
+// Set is flag.Value.Set
+func (fv *tokens) Set(v string) error {
+	parts := strings.SplitN(v, ":", 3)
+	if parts[0] == "" {
+		return errors.New("expected TOKEN[:PERMISSION[:LABEL]]")
+	}
+	value := struct {
+		Token [sha256.Size]byte
+		Write bool
+		Label string
+	}{Token: sha256.Sum256([]byte(parts[0]))}
+	permission := tokenRead
+	if len(parts) > 1 {
+		permission = parts[1]
+	}
+	switch permission {
+	case tokenRead:
+	case tokenWrite:
+		value.Write = true
+	default:
+		return fmt.Errorf("permission %q is neither %q nor %q", permission, tokenRead, tokenWrite)
+	}
+	if len(parts) > 2 {
+		value.Label = parts[2]
+	}
+	fv.Texts = append(fv.Texts, strings.Join(append([]string{tokenScrubbed}, parts[1:]...), ":"))
+	fv.Values = append(fv.Values, value)
+	return nil
+}
+
+func (fv *tokens) String() string {
+	return strings.Join(fv.Texts, ", ")
+}
+
+// load adds the tokens of the file path, one per line as -token takes them.
+// Blank lines and those starting with # are skipped.
+func (fv *tokens) load(path string) error {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fv.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+	}
+	return nil
+}
+
+// lookup finds token, comparing it against every one in constant time.
+func (fv *tokens) lookup(token string) (found, write bool, label string) {
+	sum := sha256.Sum256([]byte(token))
+	match := -1
+	for i, t := range fv.Values {
+		if subtle.ConstantTimeCompare(sum[:], t.Token[:]) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return false, false, ""
+	}
+	t := fv.Values[match]
+	return true, t.Write, t.Label
+}
+
+// bearerToken returns the token r presents in an Authorization header or,
+// without one, in the token query parameter.
+func bearerToken(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if !ok || !strings.EqualFold(scheme, bearerScheme) {
+			return "", false
+		}
+		return strings.TrimSpace(token), true
+	}
+	if q := r.URL.Query(); q.Has(tokenKey) {
+		return q.Get(tokenKey), true
+	}
+	return "", false
+}
+
+// scrubToken returns rawQuery with the value of the token parameter
+// replaced, for logs.
+func scrubToken(rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if key, err := url.QueryUnescape(key); err == nil && key == tokenKey {
+			params[i] = tokenKey + "=" + tokenScrubbed
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// loggedURL is u as logs show it, without a token.
+func loggedURL(u *url.URL) string {
+	scrubbed := *u
+	scrubbed.RawQuery = scrubToken(u.RawQuery)
+	return scrubbed.String()
+}
+
+// withoutToken returns u with the token parameter dropped from its query,
+// for the links of a page so that they do not pass the token on.
+func withoutToken(u *url.URL) *url.URL {
+	out := *u
+	if u.RawQuery == "" {
+		return &out
+	}
+	var kept []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if key, err := url.QueryUnescape(key); err != nil || key != tokenKey {
+			kept = append(kept, param)
+		}
+	}
+	out.RawQuery = strings.Join(kept, "&")
+	return &out
+}
+
+// tokenHandler lets the requests with a token to a route past its basic
+// auth: read tokens to read, write tokens to the route with uploads and
+// deletes allowed. A token that is not known answers 401, and a read token
+// asking for a change on a route that needs auth 403. Requests without a
+// token go to handler, the route as it is.
+type tokenHandler struct {
+	handler http.Handler
+	read    *fileHandler
+	write   *fileHandler
+	gated   bool
+	tokens  *tokens
+}
+
+// ServeHTTP is http.Handler.ServeHTTP
+func (h *tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if !ok {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	found, write, label := h.tokens.lookup(token)
+	if !found {
+		w.Header().Set("WWW-Authenticate", bearerScheme+` error="invalid_token"`)
+		_ = h.read.serveStatusMessage(w, r, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	if label == "" {
+		label = tokenKey
+	}
+	r = r.WithContext(context.WithValue(r.Context(), authUserKey{}, label))
+	switch {
+	case write:
+		h.write.ServeHTTP(w, r)
+	case h.gated && !csrfSafeMethods[r.Method]:
+		w.Header().Set("WWW-Authenticate", bearerScheme+` error="insufficient_scope"`)
+		_ = h.read.serveStatusMessage(w, r, http.StatusForbidden, "the token is read-only")
+	default:
+		h.read.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestTokenHandler returns the token handler main builds for a route
+// serving dir, with a read token "reader" and a write token "writer", behind
+// basic auth if gated.
+func newTestTokenHandler(t *testing.T, dir string, gated bool) *tokenHandler {
+	t.Helper()
+	var ts tokens
+	for _, v := range []string{"reader", "writer:" + tokenWrite} {
+		if err := ts.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fh := newTestHandler(t, "/", dir)
+	fh.csrf = false
+	writable := *fh
+	writable.allowUpload = true
+	writable.allowDelete = true
+	refused := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+	return &tokenHandler{handler: refused, read: fh, write: &writable, gated: gated, tokens: &ts}
+}
+
+func TestTokenHandler(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"a.txt": "alpha", "sub/c.txt": "gamma"})
+	h := newTestTokenHandler(t, dir, true)
+
+	if w := serveTest(h, http.MethodGet, "/a.txt", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET without a token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serveTest(h, http.MethodGet, "/a.txt", nil, "Authorization", "Bearer reader"); w.Code != http.StatusOK || w.Body.String() != "alpha" {
+		t.Errorf("GET with the read token: status %d, body %q", w.Code, w.Body)
+	}
+	if w := serveTest(h, http.MethodGet, "/a.txt?token=reader", nil); w.Code != http.StatusOK {
+		t.Errorf("GET with the read token in the query: status %d, want %d", w.Code, http.StatusOK)
+	}
+	// the links of a listing would hand the token on to whoever gets them
+	if w := serveTest(h, http.MethodGet, "/?C=M;O=D&token=reader", nil, "Accept", "text/html"); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "reader") {
+		t.Errorf("listing with the read token in the query: status %d, body %q", w.Code, w.Body)
+	}
+	if w := serveTest(h, http.MethodPut, "/b.txt", strings.NewReader("beta"), "Authorization", "Bearer writer"); w.Code != http.StatusCreated {
+		t.Errorf("PUT with the write token: status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "b.txt")); err != nil || string(got) != "beta" {
+		t.Errorf("b.txt after PUT = %q, %v", got, err)
+	}
+}
+
+func TestTokenHandlerRefusals(t *testing.T) {
+	dir := writeTestTree(t, map[string]string{"a.txt": "alpha"})
+	tests := []struct {
+		name      string
+		method    string
+		token     string
+		want      int
+		challenge string
+	}{
+		{"unknown token", http.MethodGet, "nobody", http.StatusUnauthorized, `error="invalid_token"`},
+		{"read token asking for a change", http.MethodPut, "reader", http.StatusForbidden, `error="insufficient_scope"`},
+	}
+	for _, tt := range tests {
+		h := newTestTokenHandler(t, dir, true)
+		w := serveTest(h, tt.method, "/a.txt", strings.NewReader("changed"), "Authorization", "Bearer "+tt.token, "Accept", "application/json")
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+		if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, tt.challenge) {
+			t.Errorf("%s: WWW-Authenticate %q, want %s", tt.name, got, tt.challenge)
+		}
+		if got := w.Header().Get("Content-Type"); got != jsonContentType {
+			t.Errorf("%s: Content-Type %q, want %q", tt.name, got, jsonContentType)
+		}
+		var result errorResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Status != tt.want || result.Error == "" {
+			t.Errorf("%s: body %q (%v)", tt.name, w.Body, err)
+		}
+
+		w = serveTest(h, tt.method, "/a.txt", strings.NewReader("changed"), "Authorization", "Bearer "+tt.token, "Accept", "text/html")
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+			t.Errorf("%s: Content-Type for a browser %q, want text/html", tt.name, got)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(got) != "alpha" {
+		t.Errorf("a.txt after the refused PUT = %q", got)
+	}
+
+	// without basic auth a read token is refused only what the route refuses
+	h := newTestTokenHandler(t, dir, false)
+	if w := serveTest(h, http.MethodPut, "/a.txt", strings.NewReader("changed"), "Authorization", "Bearer reader"); w.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("PUT with the read token on an open route: WWW-Authenticate %q", w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestLoggedURLScrubsToken(t *testing.T) {
+	tests := []struct {
+		target, want string
+	}{
+		{"/a.txt", "/a.txt"},
+		{"/a.txt?token=secret", "/a.txt?token=" + tokenScrubbed},
+		{"/dir/?format=json&token=secret&q=x", "/dir/?format=json&token=" + tokenScrubbed + "&q=x"},
+		{"/a.txt?%74oken=secret", "/a.txt?token=" + tokenScrubbed},
+		{"/a.txt?tokens=kept", "/a.txt?tokens=kept"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := loggedURL(u); got != tt.want {
+			t.Errorf("loggedURL(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestLogsLeaveOutTokens(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(io.Discard)
+
+	filter := addressFilter{allow: &networks{}, deny: &networks{}}
+	if err := filter.allow.Set("198.51.100.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	refusing := &addressFilterHandler{handler: http.NotFoundHandler(), filter: filter, pages: newTestHandler(t, "/", t.TempDir())}
+	if w := serveTest(refusing, http.MethodGet, "/a.txt?token=secret", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	inflight := &inflightHandler{}
+	var running []string
+	inflight.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		running = inflight.running()
+	})
+	serveTest(inflight, http.MethodGet, "/a.txt?token=secret", nil)
+
+	for _, text := range append(running, logged.String()) {
+		if strings.Contains(text, "secret") || !strings.Contains(text, "token="+tokenScrubbed) {
+			t.Errorf("logged %q", text)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// trashSegment is the URL path below a route at which its trash is shown
+	// when -trash-dir is set
+	trashSegment = ".trash"
+
+	trashIDKey       = "id"
+	trashRestoreKey  = "restore"
+	trashMetadataExt = ".json"
+
+	trashPurgeInterval = time.Hour
+)
+
+var errTrashItemExists = errors.New("the original path is taken")
+
+// trash holds deleted files and directories so that they can be restored.
+// Every item is moved to dir under a timestamped, random ID, next to an
+// ID.json sidecar recording where it came from.
+type trash struct {
+	dir string
+}
+
+type trashItem struct {
+	ID        string    `json:"id"`
+	Route     string    `json:"route"`
+	URLPath   string    `json:"path"`
+	Name      string    `json:"name"`
+	IsDir     bool      `json:"isDir"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+func newTrash(dir string) (*trash, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0700); err != nil {
+		return nil, err
+	}
+	return &trash{dir: abs}, nil
+}
+
+// holds reports whether osPath is the trash directory or lies below it.
+func (t *trash) holds(osPath string) bool {
+	if t == nil {
+		return false
+	}
+	abs, err := filepath.Abs(osPath)
+	return err == nil && (abs == t.dir || strings.HasPrefix(abs, t.dir+osPathSeparator))
+}
+
+func (t *trash) itemPath(id string) string {
+	return filepath.Join(t.dir, id)
+}
+
+// put moves osPath, served by route at urlPath, into the trash.
+func (t *trash) put(route, urlPath, osPath string, isDir bool) error {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	item := trashItem{
+		ID:        now.Format("20060102T150405Z") + "-" + hex.EncodeToString(b[:]),
+		Route:     route,
+		URLPath:   urlPath,
+		Name:      filepath.Base(osPath),
+		IsDir:     isDir,
+		DeletedAt: now,
+	}
+	metadata, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if err := moveTree(osPath, t.itemPath(item.ID)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(t.itemPath(item.ID)+trashMetadataExt, metadata, 0600); err != nil {
+		// without the sidecar nobody could find it again
+		_ = moveTree(t.itemPath(item.ID), osPath)
+		return err
+	}
+	return nil
+}
+
+// items lists what route deleted, most recent first.
+func (t *trash) items(route string) ([]trashItem, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []trashItem
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), trashMetadataExt) {
+			continue
+		}
+		item, err := t.item(strings.TrimSuffix(entry.Name(), trashMetadataExt))
+		if err == nil && (route == "" || item.Route == route) {
+			out = append(out, item)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeletedAt.After(out[j].DeletedAt) })
+	return out, nil
+}
+
+func (t *trash) item(id string) (trashItem, error) {
+	var item trashItem
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return item, os.ErrNotExist
+	}
+	metadata, err := os.ReadFile(t.itemPath(id) + trashMetadataExt)
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(metadata, &item)
+	if err == nil && item.ID != id {
+		err = os.ErrNotExist
+	}
+	return item, err
+}
+
+// remove drops an item for good.
+func (t *trash) remove(item trashItem) error {
+	if err := os.RemoveAll(t.itemPath(item.ID)); err != nil {
+		return err
+	}
+	return os.Remove(t.itemPath(item.ID) + trashMetadataExt)
+}
+
+// purgeEvery removes items deleted longer than retention ago, now and then
+// every interval until the process exits.
+func (t *trash) purgeEvery(interval, retention time.Duration) {
+	t.purge(retention)
+	for range time.Tick(interval) {
+		t.purge(retention)
+	}
+}
+
+func (t *trash) purge(retention time.Duration) {
+	items, err := t.items("")
+	if err != nil {
+		log.Printf("trash: %v", err)
+		return
+	}
+	for _, item := range items {
+		if time.Since(item.DeletedAt) < retention {
+			continue
+		}
+		if err := t.remove(item); err != nil {
+			log.Printf("trash: purge %s: %v", item.URLPath, err)
+		}
+	}
+}
+
+// trashRoute is the route the trash files the items f deletes under: the
+// routes of -vhost hosts are told apart by the host in front.
+func (f *fileHandler) trashRoute() string {
+	return f.vhost + f.route
+}
+
+// isTrashRequest reports whether r is for the trash page of the route.
+func (f *fileHandler) isTrashRequest(r *http.Request) bool {
+	if f.trash == nil || !f.allowDelete {
+		return false
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, f.route), "/")
+	return rel == trashSegment || rel == trashSegment+"/"
+}
+
+// serveTrash lists the route's deleted items on GET, restores the one named
+// by the id field on a POST with restore=true and deletes it for good on
+// DELETE ?id=ID. Items are under the access policy of the path they were
+// deleted from: the list leaves out those r may not read there, and
+// restoring or deleting one needs r to be allowed to write there.
+func (f *fileHandler) serveTrash(w http.ResponseWriter, r *http.Request) error {
+	if f.csrfRequired(r) && !csrfPrecheck(r) {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return f.serveTrashList(w, r)
+	case http.MethodPost, http.MethodDelete:
+		id := r.URL.Query().Get(trashIDKey)
+		if r.Method == http.MethodPost {
+			id = r.PostFormValue(trashIDKey)
+		}
+		item, err := f.trash.item(id)
+		if err != nil || item.Route != f.trashRoute() || f.hiddenPath(f.osPath(item.URLPath)) {
+			return f.serveStatus(w, r, http.StatusNotFound)
+		}
+		policy, realm, err := f.trashPolicy(item)
+		if err != nil {
+			return err
+		}
+		switch policy.refusal(r) {
+		case 0:
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm))
+			return f.serveStatus(w, r, http.StatusUnauthorized)
+		default:
+			return f.serveStatus(w, r, http.StatusForbidden)
+		}
+		if r.Method == http.MethodDelete {
+			if err := f.trash.remove(item); err != nil {
+				return err
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		if r.PostFormValue(trashRestoreKey) != "true" {
+			return f.serveStatus(w, r, http.StatusBadRequest)
+		}
+		err = f.restore(item)
+		if errors.Is(err, errTrashItemExists) {
+			return f.serveStatusMessage(w, r, http.StatusConflict, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		if wantsJSON(r) {
+			w.Header().Set("Location", f.prefix.path(r, item.URLPath))
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		http.Redirect(w, r, f.prefix.path(r, r.URL.Path), http.StatusSeeOther)
+		return nil
+	}
+	return f.serveStatus(w, r, http.StatusMethodNotAllowed)
+}
+
+// trashPolicy returns the access policy of the path item was deleted from,
+// with the URL path of its directory: that of the access file a deleted
+// directory took with it, else that of the nearest one above, as for the
+// files there now.
+func (f *fileHandler) trashPolicy(item trashItem) (*accessPolicy, string, error) {
+	if f.access == nil {
+		return nil, "", nil
+	}
+	if item.IsDir {
+		data, err := os.ReadFile(filepath.Join(f.trash.itemPath(item.ID), f.access.name))
+		if err == nil {
+			policy, err := parseAccessPolicy(string(data))
+			return policy, item.URLPath + "/", err
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, "", err
+		}
+	}
+	return f.accessPolicy(f.osPath(item.URLPath), nil)
+}
+
+// trashReadable returns the items r may read the paths they were deleted
+// from, and so see in the trash.
+func (f *fileHandler) trashReadable(r *http.Request, items []trashItem) []trashItem {
+	var out []trashItem
+	for _, item := range items {
+		if f.hiddenPath(f.osPath(item.URLPath)) {
+			continue
+		}
+		policy, _, err := f.trashPolicy(item)
+		if err == nil && policy.refusal(r) == 0 {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// restore moves item back to where it was deleted from, recreating missing
+// parent directories, unless something else is there now.
+func (f *fileHandler) restore(item trashItem) error {
+	osPath := f.osPath(item.URLPath)
+	if !f.contains(osPath) || f.hiddenPath(osPath) {
+		return errTrashItemExists
+	}
+	if _, err := os.Lstat(osPath); err == nil {
+		return errTrashItemExists
+	}
+	if err := mkdirAllMode(filepath.Dir(osPath), f.uploadDirMode); err != nil {
+		return err
+	}
+	if err := moveTree(f.trash.itemPath(item.ID), osPath); err != nil {
+		return err
+	}
+	return os.Remove(f.trash.itemPath(item.ID) + trashMetadataExt)
+}
+
+const trashTemplateText = `
+<html>
+<head>
+	<title>Trash of {{ .Route }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<link rel="stylesheet" href="{{ .Static }}/layout/autoindex.css" type="text/css">
+</head>
+<body>
+<h1>Trash of <a href="{{ .RouteURL }}">{{ .Route }}</a></h1>
+{{- if .Items }}
+<table>
+	<thead>
+		<th class="indexcolname">Name</th>
+		<th class="indexcollastmod">Deleted</th>
+		<th></th>
+	</thead>
+	<tbody>
+	{{- range .Items }}
+		<tr>
+			<td class="indexcolname">{{ .URLPath }}{{ if .IsDir }}/{{ end }}</td>
+			<td class="indexcollastmod">{{ .DeletedAt.Local.Format "2006-01-02 15:04:05" }}</td>
+			<td><form method="post">
+				{{- if $.CSRFToken }}
+				<input type="hidden" name="csrf" value="{{ $.CSRFToken }}">
+				{{- end }}
+				<input type="hidden" name="id" value="{{ .ID }}">
+				<button type="submit" name="restore" value="true">restore</button>
+			</form></td>
+		</tr>
+	{{- end }}
+	</tbody>
+</table>
+{{- else }}
+<p>The trash is empty.</p>
+{{- end }}
+</body>
+</html>
+`
+
+var trashTemplate = template.Must(template.New("").Parse(trashTemplateText))
+
+func (f *fileHandler) serveTrashList(w http.ResponseWriter, r *http.Request) error {
+	f.limitWrite(w)
+	items, err := f.trash.items(f.trashRoute())
+	if err != nil {
+		return err
+	}
+	items = f.trashReadable(r, items)
+	if wantsJSON(r) {
+		if items == nil {
+			items = []trashItem{}
+		}
+		return serveJSON(w, items)
+	}
+	var csrfToken string
+	if f.csrf {
+		csrfToken = f.csrfToken(w, r)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	f.setPageHeaders(w)
+	return trashTemplate.Execute(w, struct {
+		Route     string
+		RouteURL  string
+		Items     []trashItem
+		CSRFToken string
+		Static    string
+	}{f.route, f.prefix.path(r, f.route), items, csrfToken, f.prefix.path(r, "/static")})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestTrashHandler returns a handler serving tree at / with deletes into
+// a trash and access files, and the trash with the items named by trashed,
+// URL paths deleted before the handler serves them.
+func newTestTrashHandler(t *testing.T, tree map[string]string, trashed ...string) *fileHandler {
+	t.Helper()
+	dir := writeTestTree(t, tree)
+	h := newTestHandler(t, "/", dir)
+	h.csrf = false
+	h.allowDelete = true
+	h.access = newAccessFiles(accessFileDefault)
+	var err error
+	if h.trash, err = newTrash(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	for _, urlPath := range trashed {
+		osPath := h.osPath(urlPath)
+		info, err := os.Stat(osPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.trash.put(h.trashRoute(), urlPath, osPath, info.IsDir()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+// trashListed returns the URL paths of the items h lists in its trash.
+func trashListed(t *testing.T, h *fileHandler, header ...string) []string {
+	t.Helper()
+	w := serveTest(h, http.MethodGet, "/"+trashSegment+"/", nil, append([]string{"Accept", "application/json"}, header...)...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("trash list: status %d", w.Code)
+	}
+	var items []trashItem
+	if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, item := range items {
+		paths = append(paths, item.URLPath)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// trashID returns the ID of the item deleted from urlPath.
+func trashID(t *testing.T, h *fileHandler, urlPath string) string {
+	t.Helper()
+	items, err := h.trash.items(h.trashRoute())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if item.URLPath == urlPath {
+			return item.ID
+		}
+	}
+	t.Fatalf("%s is not in the trash", urlPath)
+	return ""
+}
+
+var trashPolicyTree = map[string]string{
+	"public/a.txt":                        "a",
+	"secret/" + accessFileDefault:         "user alice:secret",
+	"secret/b.txt":                        "b",
+	"secret/deep/c.txt":                   "c",
+	"readonly/" + accessFileDefault:       "deny writes",
+	"readonly/d.txt":                      "d",
+	"denied/" + accessFileDefault:         "deny",
+	"denied/e.txt":                        "e",
+	"gone/" + accessFileDefault:           "user alice:secret",
+	"gone/f.txt":                          "f",
+	".hidden/g.txt":                       "g",
+	"public/goneToo/" + accessFileDefault: "deny",
+}
+
+func TestTrashListsReadableItems(t *testing.T) {
+	h := newTestTrashHandler(t, trashPolicyTree,
+		"/public/a.txt", "/secret/b.txt", "/secret/deep/c.txt", "/readonly/d.txt", "/denied/e.txt", "/gone", "/.hidden/g.txt", "/public/goneToo")
+
+	if got, want := trashListed(t, h), []string{"/public/a.txt", "/readonly/d.txt"}; !slices.Equal(got, want) {
+		t.Errorf("trash listed without auth %q, want %q", got, want)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	if got, want := trashListed(t, h, "Authorization", auth), []string{"/gone", "/public/a.txt", "/readonly/d.txt", "/secret/b.txt", "/secret/deep/c.txt"}; !slices.Equal(got, want) {
+		t.Errorf("trash listed with auth %q, want %q", got, want)
+	}
+
+	w := serveTest(h, http.MethodGet, "/"+trashSegment+"/", nil, "Accept", "text/html")
+	for _, name := range []string{"b.txt", "c.txt", "e.txt", "/gone", "g.txt", "goneToo"} {
+		if strings.Contains(w.Body.String(), name) {
+			t.Errorf("trash page shows %s", name)
+		}
+	}
+}
+
+func TestTrashRestoreAndRemoveNeedWriteAccess(t *testing.T) {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	tests := []struct {
+		name    string
+		urlPath string
+		header  []string
+		want    int
+	}{
+		{"public", "/public/a.txt", nil, 0},
+		{"behind basic auth", "/secret/b.txt", nil, http.StatusUnauthorized},
+		{"below basic auth", "/secret/deep/c.txt", nil, http.StatusUnauthorized},
+		{"behind basic auth with credentials", "/secret/b.txt", []string{"Authorization", auth}, 0},
+		{"read-only", "/readonly/d.txt", nil, http.StatusForbidden},
+		{"read-only with credentials", "/readonly/d.txt", []string{"Authorization", auth}, http.StatusForbidden},
+		{"denied", "/denied/e.txt", nil, http.StatusForbidden},
+		{"directory taking its access file", "/gone", nil, http.StatusUnauthorized},
+		{"directory taking its access file with credentials", "/gone", []string{"Authorization", auth}, 0},
+		{"hidden", "/.hidden/g.txt", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			h := newTestTrashHandler(t, trashPolicyTree, tt.urlPath)
+			id := trashID(t, h, tt.urlPath)
+			var w *httptest.ResponseRecorder
+			if method == http.MethodPost {
+				form := url.Values{trashIDKey: {id}, trashRestoreKey: {"true"}}
+				w = serveTest(h, method, "/"+trashSegment+"/", strings.NewReader(form.Encode()), append([]string{"Content-Type", formContentType}, tt.header...)...)
+			} else {
+				w = serveTest(h, method, "/"+trashSegment+"/?"+trashIDKey+"="+id, nil, tt.header...)
+			}
+			_, stillTrashed := h.trash.item(id)
+			_, restoredErr := os.Lstat(h.osPath(tt.urlPath))
+			switch {
+			case tt.want == 0 && w.Code >= http.StatusBadRequest:
+				t.Errorf("%s %s: status %d", method, tt.name, w.Code)
+			case tt.want != 0 && w.Code != tt.want:
+				t.Errorf("%s %s: status %d, want %d", method, tt.name, w.Code, tt.want)
+			case tt.want != 0 && stillTrashed != nil:
+				t.Errorf("%s %s: refused, but the item left the trash", method, tt.name)
+			case tt.want == 0 && stillTrashed == nil:
+				t.Errorf("%s %s: the item is still in the trash", method, tt.name)
+			case method == http.MethodPost && (tt.want == 0) != (restoredErr == nil):
+				t.Errorf("%s %s: restored %v, want %v", method, tt.name, restoredErr == nil, tt.want == 0)
+			}
+			if tt.want == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+				t.Errorf("%s %s: WWW-Authenticate %q", method, tt.name, w.Header().Get("WWW-Authenticate"))
+			}
+		}
+	}
+}
+
+func TestTrashWithoutAccessFiles(t *testing.T) {
+	h := newTestTrashHandler(t, trashPolicyTree, "/secret/b.txt", "/denied/e.txt")
+	h.access = nil
+	if got, want := trashListed(t, h), []string{"/denied/e.txt", "/secret/b.txt"}; !slices.Equal(got, want) {
+		t.Errorf("trash listed %q, want %q", got, want)
+	}
+	id := trashID(t, h, "/secret/b.txt")
+	if w := serveTest(h, http.MethodDelete, "/"+trashSegment+"/?"+trashIDKey+"="+id, nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if _, err := os.Stat(filepath.Join(h.trash.dir, id)); err == nil {
+		t.Errorf("the item is still in the trash")
+	}
+}
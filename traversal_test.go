@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// traversalTree returns a served directory and, next to it, a directory
+// outside of it with a secret, linked to from inside.
+func traversalTree(t *testing.T) (served, outside string) {
+	t.Helper()
+	base := writeTestTree(t, map[string]string{
+		"served/a.txt":         "a",
+		"served/sub/b.txt":     "b",
+		"outside/secret.txt":   "secret",
+		"outside/dir/deep.txt": "deep",
+	})
+	served = filepath.Join(base, "served")
+	outside = filepath.Join(base, "outside")
+	if err := os.Symlink(outside, filepath.Join(served, "link")); err != nil {
+		t.Skipf("symlinks: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(served, "sub", "secret-link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(served, "inside-link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	return served, outside
+}
+
+func TestPathTraversal(t *testing.T) {
+	served, outside := traversalTree(t)
+	for _, route := range []string{"/", "/files/"} {
+		h := newTestHandler(t, route, served)
+		h.allowUpload = true
+		h.allowDelete = true
+		p := strings.TrimSuffix(route, "/")
+		tests := []struct {
+			method, path string
+			want         int
+		}{
+			{http.MethodGet, p + "/a.txt", http.StatusOK},
+			{http.MethodGet, p + "/inside-link.txt", http.StatusOK},
+			{http.MethodGet, p + "/../outside/secret.txt", http.StatusNotFound},
+			{http.MethodGet, p + "/sub/../../outside/secret.txt", http.StatusNotFound},
+			{http.MethodGet, p + "/%2e%2e/outside/secret.txt", http.StatusNotFound},
+			{http.MethodGet, p + "/%2e%2e%2foutside%2fsecret.txt", http.StatusNotFound},
+			{http.MethodGet, p + "/sub/%2E%2E/%2E%2E/outside/secret.txt", http.StatusNotFound},
+			{http.MethodGet, p + "/link/secret.txt", http.StatusForbidden},
+			{http.MethodGet, p + "/link/", http.StatusForbidden},
+			{http.MethodGet, p + "/link/dir/deep.txt", http.StatusForbidden},
+			{http.MethodGet, p + "/sub/secret-link.txt", http.StatusForbidden},
+			{http.MethodGet, p + "/link/missing.txt", http.StatusForbidden},
+			{http.MethodDelete, p + "/link/secret.txt", http.StatusForbidden},
+			{http.MethodDelete, p + "/sub/secret-link.txt", http.StatusForbidden},
+			// the path stays below the root, where nothing by that name exists
+			{http.MethodDelete, p + "/%2e%2e/outside/secret.txt", http.StatusMethodNotAllowed},
+			{http.MethodPost, p + "/link/", http.StatusForbidden},
+			{http.MethodPut, p + "/link/new.txt", http.StatusForbidden},
+		}
+		if runtime.GOOS == "windows" {
+			tests = append(tests, []struct {
+				method, path string
+				want         int
+			}{
+				{http.MethodGet, p + `/..\outside\secret.txt`, http.StatusNotFound},
+				{http.MethodGet, p + "/%5c..%5coutside%5csecret.txt", http.StatusNotFound},
+				{http.MethodDelete, p + `/sub\..\..\outside\secret.txt`, http.StatusMethodNotAllowed},
+			}...)
+		}
+		for _, tt := range tests {
+			w := serveTest(h, tt.method, tt.path, nil)
+			if w.Code != tt.want {
+				t.Errorf("route %s: %s %s: %d, want %d", route, tt.method, tt.path, w.Code, tt.want)
+			}
+			if strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "deep") {
+				t.Errorf("route %s: %s %s: leaked %q", route, tt.method, tt.path, w.Body)
+			}
+		}
+	}
+	for _, name := range []string{"secret.txt", filepath.Join("dir", "deep.txt")} {
+		if _, err := os.Stat(filepath.Join(outside, name)); err != nil {
+			t.Errorf("outside file %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); err == nil {
+		t.Error("PUT through a symlink wrote outside")
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	served, _ := traversalTree(t)
+	h := newTestHandler(t, "/", served)
+	h.followSymlinks = true
+	for _, path := range []string{"/link/secret.txt", "/sub/secret-link.txt"} {
+		if w := serveTest(h, http.MethodGet, path, nil); w.Code != http.StatusOK || w.Body.String() != "secret" {
+			t.Errorf("-follow-symlinks: GET %s: %d %q", path, w.Code, w.Body)
+		}
+	}
+	if w := serveTest(h, http.MethodGet, "/%2e%2e/outside/secret.txt", nil); w.Code == http.StatusOK {
+		t.Errorf("-follow-symlinks: .. segments served %q", w.Body)
+	}
+}
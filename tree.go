@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	treeKey   = "tree"
+	treeValue = "1"
+	depthKey  = "depth"
+
+	defaultTreeDepth = 5
+	// treeLimit caps the entries of one tree; directories still open when
+	// it is reached are marked truncated
+	treeLimit = 10000
+)
+
+var errTreeLimit = errors.New("tree limit reached")
+
+// treeEntry is an entry of a ?tree=1 response. Directories within the depth
+// have children, and truncated if the tree stopped before listing them all.
+type treeEntry struct {
+	Name  string `json:"name"`
+	IsDir bool   `json:"isDir"`
+	Size  int64  `json:"size"`
+	Mtime string `json:"mtime,omitempty"`
+}
+
+func newTreeEntry(info os.FileInfo) treeEntry {
+	e := treeEntry{Name: info.Name(), IsDir: info.IsDir(), Size: info.Size()}
+	if !info.ModTime().IsZero() {
+		e.Mtime = info.ModTime().UTC().Format(time.RFC3339)
+	}
+	return e
+}
+
+// serveTree streams the tree below the directory osPath as nested JSON, down
+// to ?depth= levels of children but no more than f.treeDepth, skipping the
+// entries listings hide and symlinks leading out of the served root. It
+// stops at treeLimit entries and when the client goes away.
+func (f *fileHandler) serveTree(w http.ResponseWriter, r *http.Request, osPath string) error {
+	depth := f.treeDepth
+	if v := r.URL.Query().Get(depthKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return f.serveStatusMessage(w, r, http.StatusBadRequest, "depth must be a number of levels")
+		}
+		depth = min(n, f.treeDepth)
+	}
+	info, err := f.storage.Stat(f.storageName(osPath))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	t := &treeWriter{f: f, ctx: r.Context(), w: w, enc: json.NewEncoder(w)}
+	err = t.dir(osPath, info, depth)
+	if errors.Is(err, errTreeLimit) {
+		err = nil
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "\n")
+	}
+	return err
+}
+
+// treeWriter writes a tree as it walks it, so that the response never has
+// to fit in memory.
+type treeWriter struct {
+	f       *fileHandler
+	ctx     context.Context
+	w       io.Writer
+	enc     *json.Encoder
+	entries int
+}
+
+// dir writes the directory at osPath with depth levels of children. Once
+// treeLimit is reached, the directories being written are closed with
+// "truncated": true and errTreeLimit is returned.
+func (t *treeWriter) dir(osPath string, info os.FileInfo, depth int) error {
+	head, err := json.Marshal(newTreeEntry(info))
+	if err != nil {
+		return err
+	}
+	if depth == 0 {
+		_, err := t.w.Write(head)
+		return err
+	}
+	// the object stays open for the children
+	if _, err := t.w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(t.w, `,"children":[`); err != nil {
+		return err
+	}
+	err = t.children(osPath, depth)
+	end := "]}"
+	if errors.Is(err, errTreeLimit) {
+		end = `],"truncated":true}`
+	} else if err != nil {
+		return err
+	}
+	if _, writeErr := io.WriteString(t.w, end); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+func (t *treeWriter) children(osPath string, depth int) error {
+	entries, err := t.f.readDir(osPath)
+	if err != nil {
+		// an unreadable directory is shown empty, as searches skip it
+		return nil
+	}
+	first := true
+	for _, entry := range entries {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		if t.entries == treeLimit {
+			return errTreeLimit
+		}
+		p := filepath.Join(osPath, entry.Name())
+		if !t.f.contains(p) {
+			continue
+		}
+		info, err := t.f.storage.Stat(t.f.storageName(p))
+		if err != nil {
+			// a dangling symlink is listed as itself
+			info = entry
+		}
+		t.entries++
+		if !first {
+			if _, err := io.WriteString(t.w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		if info.IsDir() && !t.f.guarded(p) {
+			err = t.dir(p, info, depth-1)
+		} else {
+			err = t.enc.Encode(newTreeEntry(info))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
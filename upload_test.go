@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// patternReader yields size bytes of a repeating pattern without holding
+// them.
+type patternReader struct {
+	size, off int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if rest := r.size - r.off; n > rest {
+		n = rest
+	}
+	for i := range p[:n] {
+		p[i] = byte((r.off + int64(i)) % 251)
+	}
+	r.off += n
+	return int(n), nil
+}
+
+// streamedUpload returns a request posting a file part of size bytes to
+// target, generated while it is read.
+func streamedUpload(target, name string, size int64) *http.Request {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, &patternReader{size: size})
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	r := httptest.NewRequest(http.MethodPost, target, pr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUploadLargerThanMultipartMemoryStreams(t *testing.T) {
+	const size = 48 << 20 // above the 32 MB ParseMultipartForm keeps in memory
+	dir := t.TempDir()
+	h := newTestHandler(t, "/", dir)
+	h.allowUpload = true
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, streamedUpload("/", "big.bin", size))
+	runtime.ReadMemStats(&after)
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("the upload of %d bytes allocated %d bytes", size, allocated)
+	}
+	f, err := os.Open(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() != size {
+		t.Fatalf("uploaded file: %v, %v", info, err)
+	}
+	want := &patternReader{size: size}
+	got := make([]byte, 1<<16)
+	wantBuf := make([]byte, 1<<16)
+	for {
+		n, err := io.ReadFull(f, got)
+		if _, werr := io.ReadFull(want, wantBuf[:n]); werr != nil && n > 0 {
+			t.Fatal(werr)
+		}
+		if string(got[:n]) != string(wantBuf[:n]) {
+			t.Fatal("uploaded content differs")
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+func TestUploadWithoutFile(t *testing.T) {
+	dir := t.TempDir()
+	h := newTestHandler(t, "/", dir)
+	h.allowUpload = true
+	body, contentType := multipartBody(t, nil)
+	w := serveTest(h, http.MethodPost, "/", body, "Content-Type", contentType)
+	// http.ErrMissingFile: nothing stored, back to the listing
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("upload without a file part: %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("upload without a file part stored %v", entries)
+	}
+}
+
+var errAborted = errors.New("client went away")
+
+// abortedUpload returns a request posting, or with put putting, half of a
+// file of size bytes to target before its body fails.
+func abortedUpload(method, target, name string, size int64) *http.Request {
+	pr, pw := io.Pipe()
+	r := httptest.NewRequest(method, target, pr)
+	if method == http.MethodPut {
+		go func() {
+			io.Copy(pw, &patternReader{size: size / 2})
+			pw.CloseWithError(errAborted)
+		}()
+		return r
+	}
+	mw := multipart.NewWriter(pw)
+	go func() {
+		if part, err := mw.CreateFormFile("file", name); err == nil {
+			io.Copy(part, &patternReader{size: size / 2})
+		}
+		pw.CloseWithError(errAborted)
+	}()
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestAbortedUploadLeavesNoFile(t *testing.T) {
+	const size = 1 << 20
+	for _, tt := range []struct{ method, target string }{{http.MethodPost, "/"}, {http.MethodPut, "/new.bin"}} {
+		dir := writeTestTree(t, map[string]string{"old.bin": "previous"})
+		h := newTestHandler(t, "/", dir)
+		h.allowUpload = true
+		h.onConflict = onConflictOverwrite
+		for _, name := range []string{"new.bin", "old.bin"} {
+			target := tt.target
+			if tt.method == http.MethodPut {
+				target = "/" + name
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, abortedUpload(tt.method, target, name, size))
+			if w.Code < 400 {
+				t.Errorf("%s %s of %s: status %d", tt.method, target, name, w.Code)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "new.bin")); !os.IsNotExist(err) {
+			t.Errorf("%s: new.bin after an aborted upload: %v", tt.method, err)
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, "old.bin")); err != nil || string(b) != "previous" {
+			t.Errorf("%s: old.bin after an aborted upload: %q, %v", tt.method, b, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("%s: left %d entries, temporary files among them", tt.method, len(entries))
+		}
+	}
+}
+
+func TestUploadRefusesHiddenNames(t *testing.T) {
+	for _, name := range []string{accessFileDefault, ".secret", "notes.tmp"} {
+		for _, dropbox := range []bool{false, true} {
+			dir := writeTestTree(t, map[string]string{"a.txt": "alpha"})
+			h := newTestHandler(t, "/", dir)
+			h.csrf = false
+			h.allowUpload = true
+			h.dropbox = dropbox
+			h.access = newAccessFiles(accessFileDefault)
+			h.hide = []string{"*.tmp"}
+
+			body, contentType := multipartBody(t, map[string]string{name: "deny"})
+			if w := serveTest(h, http.MethodPost, "/", body, "Content-Type", contentType); w.Code != http.StatusBadRequest {
+				t.Errorf("upload of %s (dropbox %v): status %d, want %d", name, dropbox, w.Code, http.StatusBadRequest)
+			}
+			if !dropbox {
+				form := url.Values{mkdirKey: {name}}
+				if w := serveTest(h, http.MethodPost, "/", strings.NewReader(form.Encode()), "Content-Type", formContentType); w.Code != http.StatusBadRequest {
+					t.Errorf("mkdir %s: status %d, want %d", name, w.Code, http.StatusBadRequest)
+				}
+			}
+			if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+				t.Errorf("%s was created (dropbox %v)", name, dropbox)
+			}
+			if w := serveTest(h, http.MethodGet, "/a.txt", nil); !dropbox && w.Code != http.StatusOK {
+				t.Errorf("GET /a.txt after the upload of %s: status %d", name, w.Code)
+			}
+		}
+	}
+}
+
+func TestSyncHookChecksBeforePlacing(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook is a shell script")
+	}
+	scripts := t.TempDir()
+	hook := filepath.Join(scripts, "scan")
+	// the hook logs what it is given and refuses files saying "virus"
+	script := "#!/bin/sh\necho \"$1\" >>" + filepath.Join(scripts, "log") + "\n! grep -q virus \"$1\"\n"
+	if err := os.WriteFile(hook, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dir := writeTestTree(t, map[string]string{"a.txt": "orig"})
+	h := newTestHandler(t, "/", dir)
+	h.csrf = false
+	h.allowUpload = true
+	h.onConflict = onConflictOverwrite
+	h.uploadHook = newUploadHook(hook, time.Minute, 1, true)
+
+	if w := serveTest(h, http.MethodPut, "/a.txt", strings.NewReader("virus")); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("PUT of a refused file: status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	body, contentType := multipartBody(t, map[string]string{"a.txt": "virus"})
+	if w := serveTest(h, http.MethodPost, "/", body, "Content-Type", contentType, "Accept", "application/json"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("upload of a refused file: status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	archive := testZip(t, []string{"b.txt", "a.txt"}, map[string]string{"b.txt": "clean", "a.txt": "virus"})
+	if status := extractUpload(t, h, "/", "upload.zip", archive); status != http.StatusUnprocessableEntity {
+		t.Errorf("extract of a refused file: status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	if got, _ := readTestFile(dir, "a.txt"); got != "orig" {
+		t.Errorf("a.txt = %q after refused uploads, want the previous version", got)
+	}
+	if got, _ := readTestFile(dir, "b.txt"); got != "clean" {
+		t.Errorf("b.txt = %q, want it extracted", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("%d files left, want 2", len(entries))
+	}
+	log, _ := os.ReadFile(filepath.Join(scripts, "log"))
+	if n := strings.Count(string(log), "\n"); n != 4 || strings.Contains(string(log), filepath.Join(dir, "a.txt")) {
+		t.Errorf("hook ran for\n%s, want the 4 temporary files", log)
+	}
+
+	if w := serveTest(h, http.MethodPut, "/a.txt", strings.NewReader("clean")); w.Code != http.StatusNoContent {
+		t.Errorf("PUT of a clean file: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got, _ := readTestFile(dir, "a.txt"); got != "clean" {
+		t.Errorf("a.txt = %q, want the clean upload", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"syscall"
+)
+
+const (
+	// diskReserve is the free space uploads leave on the target file system
+	diskReserve = 16 << 20
+	// diskCheckInterval is how many bytes an upload may write between checks
+	diskCheckInterval = 8 << 20
+)
+
+var errInsufficientStorage = errors.New("not enough free disk space")
+
+// checkFreeSpace returns errInsufficientStorage if writing n more bytes below
+// dir would eat into diskReserve; n < 0 checks the reserve alone. It passes
+// where the free space is unknown.
+func checkFreeSpace(dir string, n int64) error {
+	if n < 0 {
+		n = 0
+	}
+	free, ok := freeSpace(dir)
+	if ok && uint64(n)+diskReserve > free {
+		return errInsufficientStorage
+	}
+	return nil
+}
+
+// diskGuard is an io.Writer writing to a file below dir that fails with
+// errInsufficientStorage before the disk fills up, rather than with whatever
+// the file system reports once it is full.
+type diskGuard struct {
+	w         io.Writer
+	dir       string
+	unchecked int64
+}
+
+func (g *diskGuard) Write(p []byte) (int, error) {
+	if g.unchecked+int64(len(p)) > diskCheckInterval {
+		if err := checkFreeSpace(g.dir, int64(len(p))); err != nil {
+			return 0, err
+		}
+		g.unchecked = 0
+	}
+	n, err := g.w.Write(p)
+	g.unchecked += int64(n)
+	if errors.Is(err, syscall.ENOSPC) {
+		err = errInsufficientStorage
+	}
+	return n, err
+}
+
+// uploadErrorStatus maps the errors that mean an upload was refused to their
+// HTTP status: 400 for a bad name, 413 for -max-upload-size, 422 for a
+// wrong checksum, 507 for a full disk, else 500.
+func uploadErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	var badName *badNameError
+	switch {
+	case errors.As(err, &badName):
+		return http.StatusBadRequest
+	case errors.Is(err, errChecksumMismatch), errors.Is(err, errUploadRejected):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errInsufficientStorage):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadError describes err for clients, naming the limit that was hit.
+func uploadError(err error) string {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Sprintf("upload exceeds the limit of %d bytes", tooLarge.Limit)
+	}
+	return err.Error()
+}
+
+// limitUpload applies -max-upload-size to the body of r and checks that the
+// file system holding dir has room for it, as far as its length is known.
+func (f *fileHandler) limitUpload(w http.ResponseWriter, r *http.Request, dir string) error {
+	if f.maxUploadSize > 0 {
+		if r.ContentLength > f.maxUploadSize {
+			return &http.MaxBytesError{Limit: f.maxUploadSize}
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, f.maxUploadSize)
+	}
+	return checkFreeSpace(dir, r.ContentLength)
+}
+
+func logRefusedUpload(r *http.Request, err error) {
+	log.Printf("%s %s refused: %s", r.Method, r.URL.Path, uploadError(err))
+}
+
+// refuseUpload logs and answers an upload that failed for err.
+func (f *fileHandler) refuseUpload(w http.ResponseWriter, r *http.Request, err error) error {
+	logRefusedUpload(r, err)
+	return f.serveStatusMessage(w, r, uploadErrorStatus(err), uploadError(err))
+}
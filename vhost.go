@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wesleywu/http-file-server/handler"
+)
+
+const (
+	vhostUpload   = "upload"
+	vhostDelete   = "delete"
+	vhostWildcard = "*."
+)
+
+// vhosts holds the -vhost flags, each serving a directory at / of the
+// requests for one host, or with *.domain for any subdomain of domain.
+type vhosts struct {
+	Values []struct {
+		Host        string
+		Path        string
+		AllowUpload bool
+		AllowDelete bool
+	}
+	Texts []string
+}
+
+func (fv *vhosts) help() string {
+	return fmt.Sprintf("serve PATH to requests for HOST, or for any subdomain with *.DOMAIN, as HOST=PATH[,%s][,%s] (repeatable); other hosts get the -route routes, or none if only -vhost is given", vhostUpload, vhostDelete)
+}
+
+// Set is flag.Value.Set
+func (fv *vhosts) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("%q is not HOST=PATH", v)
+	}
+	host, err := vhostPattern(v[:i])
+	if err != nil {
+		return err
+	}
+	value := struct {
+		Host        string
+		Path        string
+		AllowUpload bool
+		AllowDelete bool
+	}{Host: host}
+	// options only come last, so that a path may hold commas
+	path := v[i+1:]
+	for {
+		j := strings.LastIndex(path, ",")
+		if j < 0 {
+			break
+		}
+		switch path[j+1:] {
+		case vhostUpload:
+			value.AllowUpload = true
+		case vhostDelete:
+			value.AllowDelete = true
+		default:
+			j = -1
+		}
+		if j < 0 {
+			break
+		}
+		path = path[:j]
+	}
+	if path == "" {
+		return fmt.Errorf("%q has no path", v)
+	}
+	if value.Path, err = filepath.Abs(path); err != nil {
+		return err
+	}
+	for _, other := range fv.Values {
+		if other.Host == value.Host {
+			return fmt.Errorf("host %q is given twice", value.Host)
+		}
+	}
+	fv.Texts = append(fv.Texts, v)
+	fv.Values = append(fv.Values, value)
+	return nil
+}
+
+func (fv *vhosts) String() string {
+	return strings.Join(fv.Texts, ", ")
+}
+
+// vhostPattern checks a -vhost host, or a config file's, and returns it the
+// way requests are matched against it.
+func vhostPattern(host string) (string, error) {
+	pattern := requestHost(host)
+	name := strings.TrimPrefix(pattern, vhostWildcard)
+	if name == "" || strings.ContainsAny(name, "*/ ") {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+	return pattern, nil
+}
+
+// requestHost returns the host name of a Host header, as the patterns are
+// written: without the port, the brackets of an IPv6 literal and a trailing
+// dot, in lower case.
+func requestHost(hostport string) string {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// vhostHandler passes requests on to the mux of the host they name, or to
+// fallback. A host matches its exact pattern before any wildcard, and the
+// wildcard of the longest domain first.
+type vhostHandler struct {
+	hosts     map[string]*http.ServeMux
+	wildcards []string
+	fallback  http.Handler
+}
+
+func newVhostHandler(fallback http.Handler) *vhostHandler {
+	return &vhostHandler{hosts: make(map[string]*http.ServeMux), fallback: fallback}
+}
+
+// handle serves route of the host pattern with h. Each host has its own
+// listing assets, as they are linked from /static/ whatever the host.
+func (v *vhostHandler) handle(pattern, route string, h http.Handler) {
+	mux, ok := v.hosts[pattern]
+	if !ok {
+		mux = http.NewServeMux()
+		mux.Handle("/static/", &handler.EmbeddedHandler{})
+		v.hosts[pattern] = mux
+		if strings.HasPrefix(pattern, vhostWildcard) {
+			v.wildcards = append(v.wildcards, pattern)
+			sort.Slice(v.wildcards, func(i, j int) bool { return len(v.wildcards[i]) > len(v.wildcards[j]) })
+		}
+	}
+	mux.Handle(route, h)
+}
+
+func (v *vhostHandler) match(host string) http.Handler {
+	if mux, ok := v.hosts[host]; ok && !strings.HasPrefix(host, vhostWildcard) {
+		return mux
+	}
+	for _, pattern := range v.wildcards {
+		// *.example.com is any subdomain, not example.com itself
+		if domain := pattern[len(vhostWildcard)-1:]; strings.HasSuffix(host, domain) && len(host) > len(domain) {
+			return v.hosts[pattern]
+		}
+	}
+	return v.fallback
+}
+
+func (v *vhostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.match(requestHost(r.Host)).ServeHTTP(w, r)
+}
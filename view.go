@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	viewKey   = "view"
+	viewValue = "1"
+
+	// viewLimit is the largest file rendered as a preview; bigger files are
+	// downloaded as usual.
+	viewLimit = 1 << 20
+)
+
+const viewTemplateText = `
+<html>
+<head>
+	<title>{{ .Name }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<link rel="stylesheet" href="{{ .Static }}/layout/autoindex.css" type="text/css">
+	<link rel="stylesheet" href="{{ .Static }}/layout/view.css" type="text/css">
+</head>
+<body>
+<h1>{{ .Name }}</h1>
+<p class="archives"><a href="{{ .DirURL.String }}">Back to listing</a> | <a href="{{ .URL.String }}">Download</a></p>
+{{ if .Markdown }}<article class="markdown">
+{{ .Content }}
+</article>{{ else }}<pre class="view">{{ .Content }}</pre>{{ end }}
+</body>
+</html>
+`
+
+var viewTemplate = template.Must(template.New("").Parse(viewTemplateText))
+
+type viewData struct {
+	Name    string
+	URL     *url.URL
+	DirURL  *url.URL
+	Content template.HTML
+	// Markdown is set when Content is rendered Markdown rather than text
+	Markdown bool
+	Static   string
+}
+
+// isTextName reports whether the file name suggests text content, which is
+// when the listing offers a preview link.
+func isTextName(name string) bool {
+	return iconFor(name, false) == iconText || strings.HasPrefix(mime.TypeByExtension(filepath.Ext(name)), "text/")
+}
+
+// isText reports whether b looks like text: valid UTF-8 without NUL bytes.
+func isText(b []byte) bool {
+	return bytes.IndexByte(b, 0) < 0 && utf8.Valid(b)
+}
+
+// ViewURL is the link to the preview page of a text file.
+func (d directoryListingFileData) ViewURL() *url.URL {
+	u := *d.URL
+	u.RawQuery = viewKey + "=" + viewValue
+	return &u
+}
+
+// Viewable reports whether the listing should offer a preview link for d.
+func (d directoryListingFileData) Viewable() bool {
+	return !d.IsDir && d.Size <= viewLimit && isTextName(d.BaseName)
+}
+
+// readTextFile returns the content of the file osPath, or ok false when it is
+// larger than viewLimit or not text.
+func (f *fileHandler) readTextFile(osPath string) (content []byte, ok bool, err error) {
+	file, err := f.storage.Open(f.storageName(osPath))
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	content, err = io.ReadAll(io.LimitReader(file, viewLimit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	return content, len(content) <= viewLimit && isText(content), nil
+}
+
+// serveView renders the regular file osPath as an HTML page. Files that are
+// too large or do not look like text are served as is.
+func (f *fileHandler) serveView(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	if info.Size() > viewLimit {
+		f.serveFile(w, r, osPath)
+		return nil
+	}
+	content, ok, err := f.readTextFile(osPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		f.serveFile(w, r, osPath)
+		return nil
+	}
+	return f.servePage(w, r, viewData{
+		Name:    info.Name(),
+		Content: highlight(info.Name(), string(content)),
+	})
+}
+
+// serveMarkdown renders the Markdown file osPath as an HTML page. Like
+// serveView, it serves the file as is when it is too large or not text.
+func (f *fileHandler) serveMarkdown(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	if info.Size() > viewLimit {
+		f.serveFile(w, r, osPath)
+		return nil
+	}
+	content, ok, err := f.readTextFile(osPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		f.serveFile(w, r, osPath)
+		return nil
+	}
+	return f.servePage(w, r, viewData{
+		Name:     info.Name(),
+		Content:  renderMarkdown(string(content)),
+		Markdown: true,
+	})
+}
+
+// servePage fills in the links of data from the request URL and renders it.
+func (f *fileHandler) servePage(w http.ResponseWriter, r *http.Request, data viewData) error {
+	f.limitWrite(w)
+	data.URL = &url.URL{Path: r.URL.Path}
+	data.DirURL = &url.URL{Path: path.Dir(r.URL.Path) + "/"}
+	if data.DirURL.Path == "//" {
+		data.DirURL.Path = "/"
+	}
+	data.URL = f.prefix.url(r, data.URL)
+	data.DirURL = f.prefix.url(r, data.DirURL)
+	data.Static = f.prefix.path(r, "/static")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	f.setPageHeaders(w)
+	gw, done := gzipWriter(w, r)
+	if err := viewTemplate.Execute(gw, data); err != nil {
+		return err
+	}
+	return done()
+}
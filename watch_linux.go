@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB
+
+// watchDir reports changes to the entries of the directory osPath with
+// inotify, falling back to polling if no watch can be set up, e.g. because
+// the per-user limit is reached.
+func watchDir(osPath string, emit func(dirEvent)) (func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return pollDir(osPath, emit)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, osPath, inotifyMask); err != nil {
+		syscall.Close(fd)
+		return pollDir(osPath, emit)
+	}
+	// a non-blocking descriptor makes the file pollable, so Close ends a
+	// pending Read
+	file := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				mask := binary.NativeEndian.Uint32(buf[off+4:])
+				length := int(binary.NativeEndian.Uint32(buf[off+12:]))
+				start := off + syscall.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[start:min(start+length, n)]), "\x00")
+				off = start + length
+				switch {
+				case name == "":
+				case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+					emit(dirEvent{Op: eventCreate, Name: name})
+				case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+					emit(dirEvent{Op: eventDelete, Name: name})
+				case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_ATTRIB) != 0:
+					emit(dirEvent{Op: eventModify, Name: name})
+				}
+			}
+		}
+	}()
+	return func() { file.Close() }, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// watchDir reports changes to the entries of the directory osPath. Only
+// Linux has a notification backend; elsewhere the directory is polled.
+func watchDir(osPath string, emit func(dirEvent)) (func(), error) {
+	return pollDir(osPath, emit)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+type pollState struct {
+	size    int64
+	modTime time.Time
+}
+
+// pollDir reports changes to the entries of the directory osPath by
+// comparing it with a snapshot every pollInterval.
+func pollDir(osPath string, emit func(dirEvent)) (func(), error) {
+	last, err := pollSnapshot(osPath)
+	if err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			current, err := pollSnapshot(osPath)
+			if err != nil {
+				continue
+			}
+			for name, state := range current {
+				previous, ok := last[name]
+				switch {
+				case !ok:
+					emit(dirEvent{Op: eventCreate, Name: name})
+				case previous != state:
+					emit(dirEvent{Op: eventModify, Name: name})
+				}
+			}
+			for name := range last {
+				if _, ok := current[name]; !ok {
+					emit(dirEvent{Op: eventDelete, Name: name})
+				}
+			}
+			last = current
+		}
+	}()
+	return func() { close(stop) }, nil
+}
+
+func pollSnapshot(osPath string) (map[string]pollState, error) {
+	entries, err := os.ReadDir(osPath)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]pollState, len(entries))
+	for _, entry := range entries {
+		var state pollState
+		if info, err := entry.Info(); err == nil {
+			state = pollState{size: info.Size(), modTime: info.ModTime()}
+		}
+		out[entry.Name()] = state
+	}
+	return out, nil
+}
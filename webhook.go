@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	webhookUpload = "upload"
+	webhookDelete = "delete"
+	webhookMkdir  = "mkdir"
+	webhookRename = "rename"
+	webhookCopy   = "copy"
+
+	webhookSignatureHeader = "X-Signature-256"
+
+	// webhookQueueSize bounds the events waiting for delivery; further
+	// events are dropped while the endpoint is unreachable or slow
+	webhookQueueSize = 256
+	webhookAttempts  = 4
+	webhookTimeout   = 10 * time.Second
+	webhookBackoff   = time.Second
+)
+
+var webhookActions = []string{webhookUpload, webhookDelete, webhookMkdir, webhookRename, webhookCopy}
+
+// webhookEvent is the JSON body POSTed for a change. Path is the URL path of
+// the affected file or directory as clients see it; From is the path it was
+// renamed or copied from.
+type webhookEvent struct {
+	Action     string `json:"action"`
+	Path       string `json:"path"`
+	From       string `json:"from,omitempty"`
+	Size       *int64 `json:"size,omitempty"`
+	RemoteAddr string `json:"remoteAddr"`
+	Timestamp  string `json:"timestamp"`
+}
+
+// webhook delivers events to -webhook-url from a background worker, so that
+// a slow endpoint never holds up the request that caused the event. Each
+// delivery is retried with growing delays. With a secret, the body's
+// HMAC-SHA256 is sent in X-Signature-256 as "sha256=HEX".
+type webhook struct {
+	url     string
+	secret  []byte
+	actions map[string]bool
+	queue   chan []byte
+	client  *http.Client
+}
+
+// parseWebhookActions parses the comma-separated -webhook-events list.
+func parseWebhookActions(list string) (map[string]bool, error) {
+	actions := make(map[string]bool)
+	for _, action := range strings.Split(list, ",") {
+		action = strings.TrimSpace(action)
+		if action == "" {
+			continue
+		}
+		known := false
+		for _, a := range webhookActions {
+			known = known || a == action
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event %q, want one of %s", action, strings.Join(webhookActions, ", "))
+		}
+		actions[action] = true
+	}
+	return actions, nil
+}
+
+func newWebhook(url, secret string, actions map[string]bool) *webhook {
+	h := &webhook{
+		url:     url,
+		secret:  []byte(secret),
+		actions: actions,
+		queue:   make(chan []byte, webhookQueueSize),
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+	go h.run()
+	return h
+}
+
+// notify queues the event for the change r made to urlPath, unless its
+// action is filtered out or the queue is full. It is a no-op on a nil
+// webhook.
+func (h *webhook) notify(r *http.Request, action, urlPath, from string, size *int64) {
+	if h == nil || len(h.actions) > 0 && !h.actions[action] {
+		return
+	}
+	body, err := json.Marshal(webhookEvent{
+		Action:     action,
+		Path:       urlPath,
+		From:       from,
+		Size:       size,
+		RemoteAddr: clientIP(r),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return
+	}
+	select {
+	case h.queue <- body:
+	default:
+		log.Printf("webhook: queue full, dropping %s event for %s", action, urlPath)
+	}
+}
+
+func (h *webhook) run() {
+	for body := range h.queue {
+		delay := webhookBackoff
+		for attempt := 1; ; attempt++ {
+			err := h.deliver(body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Printf("webhook: giving up after %d attempts: %v", attempt, err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (h *webhook) deliver(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", h.url, resp.Status)
+	}
+	return nil
+}
+
+// notify reports the change r made to the file or directory osPath at
+// urlPath, moved or copied from fromPath if not "", to the webhook and the
+// audit log.
+func (f *fileHandler) notify(r *http.Request, action, urlPath, fromPath, osPath string) {
+	if f.webhook == nil && f.audit == nil {
+		return
+	}
+	var size *int64
+	if info, err := f.storage.Stat(f.storageName(osPath)); err == nil && info.Mode().IsRegular() {
+		n := info.Size()
+		size = &n
+	}
+	if fromPath != "" {
+		fromPath = f.prefix.of(r) + fromPath
+	}
+	urlPath = f.prefix.of(r) + urlPath
+	audit(r, auditChange{Action: action, Path: urlPath, From: fromPath, Size: size})
+	f.webhook.notify(r, action, urlPath, fromPath, size)
+}
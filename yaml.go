@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the block-style subset of YAML used by config files:
+// mappings, sequences ("- item", including mappings as items), flow
+// sequences of scalars ("[a, b]"), plain, single- and double-quoted scalars
+// and comments. Mappings come back as map[string]any, sequences as []any and
+// scalars as string; an empty value is "".
+func parseYAML(text string) (any, error) {
+	var lines []yamlLine
+	for n, raw := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		content := strings.TrimRight(stripYAMLComment(raw), " ")
+		trimmed := strings.TrimLeft(content, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", n+1)
+		}
+		lines = append(lines, yamlLine{number: n + 1, indent: len(content) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.node(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	line := p.lines[min(p.i, len(p.lines)-1)]
+	return fmt.Errorf("line %d: %s", line.number, fmt.Sprintf(format, args...))
+}
+
+// node parses the mapping or sequence whose lines start at column indent.
+func (p *yamlParser) node(indent int) (any, error) {
+	if isYAMLItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	out := []any{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].text) {
+		line := p.lines[p.i]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		switch {
+		case rest == "":
+			p.i++
+			v, err := p.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		case isYAMLItem(rest) || yamlKey(rest) != "":
+			// the item's first line continues in place of the dash
+			p.lines[p.i] = yamlLine{number: line.number, indent: line.indent + len(line.text) - len(rest), text: rest}
+			v, err := p.node(p.lines[p.i].indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		default:
+			v, err := yamlScalar(rest)
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			out = append(out, v)
+			p.i++
+		}
+	}
+	return out, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	out := map[string]any{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent {
+		text := p.lines[p.i].text
+		key := yamlKey(text)
+		if key == "" {
+			return nil, p.errorf("expected \"key: value\", got %q", text)
+		}
+		name := strings.TrimSpace(key[:len(key)-1])
+		if unquoted, err := yamlScalar(name); err == nil {
+			name = unquoted.(string)
+		}
+		if _, dup := out[name]; dup {
+			return nil, p.errorf("duplicate key %q", name)
+		}
+		rest := strings.TrimSpace(text[len(key):])
+		p.i++
+		if rest != "" {
+			v, err := yamlScalar(rest)
+			if err != nil {
+				p.i--
+				return nil, p.errorf("%v", err)
+			}
+			out[name] = v
+			continue
+		}
+		// sequences may sit at the same indentation as their key
+		if p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].text) {
+			v, err := p.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			out[name] = v
+			continue
+		}
+		v, err := p.nested(indent)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = v
+	}
+	return out, nil
+}
+
+// nested parses the block indented deeper than indent, or returns "" if
+// there is none.
+func (p *yamlParser) nested(indent int) (any, error) {
+	if p.i >= len(p.lines) || p.lines[p.i].indent <= indent {
+		return "", nil
+	}
+	return p.node(p.lines[p.i].indent)
+}
+
+// yamlKey returns the "key:" prefix of a mapping line, or "" if text is not
+// one.
+func yamlKey(text string) string {
+	if text[0] == '"' || text[0] == '\'' {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return ""
+		}
+		after := text[end+2:]
+		if strings.HasPrefix(after, ":") && (len(after) == 1 || after[1] == ' ') {
+			return text[:end+3]
+		}
+		return ""
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return text[:i+1]
+		}
+	}
+	return ""
+}
+
+// stripYAMLComment removes a trailing "# comment" outside of quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlScalar parses a scalar or a flow sequence of scalars.
+func yamlScalar(s string) (any, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated %q", s)
+		}
+		out := []any{}
+		for _, item := range splitYAMLFlow(s[1 : len(s)-1]) {
+			v, err := yamlScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad double-quoted string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("bad single-quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "{") || strings.HasPrefix(s, "&") || strings.HasPrefix(s, "*") || strings.HasPrefix(s, "|") || strings.HasPrefix(s, ">"):
+		return nil, fmt.Errorf("unsupported YAML syntax %q", s)
+	}
+	return s, nil
+}
+
+// splitYAMLFlow splits the inside of a flow sequence at commas outside quotes.
+func splitYAMLFlow(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var out []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
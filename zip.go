@@ -2,46 +2,126 @@ package main
 
 import (
 	zipper "archive/zip"
+	"context"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"math"
 	"os"
-	"path/filepath"
 )
 
-func zip(w io.Writer, path string) error {
-	basePath := path
-	addFile := func(w *zipper.Writer, path string, stat os.FileInfo) error {
-		if stat.IsDir() {
+// zip64Threshold is the file size from which entries need zip64 headers.
+const zip64Threshold = math.MaxUint32
+
+// zip writes a zip archive of the file or directory at path, see
+// walkArchiveRoot for match.
+func (f *fileHandler) zip(ctx context.Context, w io.Writer, path string, match func(name string) bool) error {
+	return f.writeZip(ctx, w, func(add archiveAdder) error {
+		return f.walkArchiveRoot(ctx, path, match, add)
+	})
+}
+
+// zipPaths writes a zip archive of the trees rooted at paths, naming entries
+// relative to basePath.
+func (f *fileHandler) zipPaths(ctx context.Context, w io.Writer, basePath string, paths []string) error {
+	return f.writeZip(ctx, w, func(add archiveAdder) error {
+		return f.walkArchive(ctx, basePath, paths, add)
+	})
+}
+
+// writeZip writes a zip archive of the entries walk passes to add, reading
+// them from f.storage.
+func (f *fileHandler) writeZip(ctx context.Context, w io.Writer, walk func(add archiveAdder) error) error {
+	wZip := zipper.NewWriter(w)
+	defer func() {
+		if err := wZip.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	return walk(func(path, name string, stat os.FileInfo) error {
+		if name == "." && stat.IsDir() {
 			return nil
 		}
-		file, err := os.Open(path)
+		isSymlink := stat.Mode()&os.ModeSymlink != 0
+		if !stat.Mode().IsRegular() && !isSymlink && !stat.IsDir() {
+			return nil
+		}
+		header, err := zipper.FileInfoHeader(stat)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		path, err = filepath.Rel(basePath, path)
-		if err != nil {
+		header.Name = name
+		if stat.IsDir() {
+			// explicit entries keep empty directories in the archive
+			header.Name += "/"
+			_, err := wZip.CreateHeader(header)
 			return err
 		}
-		zw, err := w.Create(path)
+		if stat.Mode().IsRegular() && stat.Size() >= zip64Threshold {
+			return f.zipLargeFile(ctx, wZip, header, path)
+		}
+		header.Method = zipper.Deflate
+		zw, err := wZip.CreateHeader(header)
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(zw, file); err != nil {
+		if isSymlink {
+			// a zip symlink entry stores the link target as its content
+			link, err := f.storage.ReadLink(f.storageName(path))
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(zw, link)
 			return err
 		}
-		return w.Flush()
-	}
-	wZip := zipper.NewWriter(w)
-	defer func() {
-		if err := wZip.Close(); err != nil {
-			log.Println(err)
-		}
-	}()
-	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		file, err := f.storage.Open(f.storageName(path))
 		if err != nil {
 			return err
 		}
-		return addFile(wZip, path, info)
+		defer file.Close()
+		if _, err := copyContext(ctx, zw, file); err != nil {
+			return err
+		}
+		return wZip.Flush()
 	})
 }
+
+// zipLargeFile stores a file too big for 32-bit zip headers. Its CRC is
+// computed in a first pass so the entry can be written raw, with known sizes
+// in a zip64 extra field of the local header rather than only in a trailing
+// data descriptor, which some extractors do not accept for zip64 entries.
+func (f *fileHandler) zipLargeFile(ctx context.Context, wZip *zipper.Writer, header *zipper.FileHeader, path string) error {
+	file, err := f.storage.Open(f.storageName(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	crc := crc32.NewIEEE()
+	n, err := copyContext(ctx, crc, file)
+	if err != nil {
+		return err
+	}
+	seeker, ok := file.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("%s: not seekable", path)
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header.Method = zipper.Store
+	// CreateRaw leaves the version alone; 4.5 is the first with zip64
+	header.CreatorVersion = header.CreatorVersion&0xff00 | 45
+	header.ReaderVersion = 45
+	header.CRC32 = crc.Sum32()
+	header.CompressedSize64 = uint64(n)
+	header.UncompressedSize64 = uint64(n)
+	zw, err := wZip.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+	if _, err := copyContext(ctx, zw, io.LimitReader(file, n)); err != nil {
+		return err
+	}
+	return wZip.Flush()
+}